@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+)
+
+var usg = `Usage of %s:
+
+%s converts a variable bitrate TS into a constant bitrate TS at the given mux
+rate. Packets are sent at their times interpolated between the PCRs, with null
+packets (PID 0x1FFF) in between, and the PCRs are restamped according to the
+packet position. Null packets of the input are dropped. It is an error if the
+input rate between two PCRs exceeds the mux rate.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{Indent: true}
+	flag.Int64Var(&opts.MuxRate, "muxrate", 0, "output bitrate in bits per second (required)")
+	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
+	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func cbr(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
+	}
+	err = internal.RestampCBR(ctx, textOutput, tsOutput, f, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, cbr)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+)
+
+var usg = `Usage of %s:
+
+%s joins several TS files into one with a single program.
+The PAT and PMT of the first file are used for the output, and the streams of
+the other files are mapped to the output PIDs by codec in PMT order. Streams
+without a match are dropped.
+
+PTS/DTS/PCR of each file after the first are shifted so that its first video
+frame follows the last video frame of the previous file. With -discontinuity,
+the timestamps are kept and the discontinuity_indicator is set on the first PCR
+of each file instead. Continuity counters are renumbered.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{ShowStreamInfo: true, Indent: true}
+	flag.BoolVar(&opts.Discontinuity, "discontinuity", false, "set discontinuity_indicator instead of rebasing timestamps")
+	flag.IntVar(&opts.Program, "program", 0, "program number to concatenate (0 = first program)")
+	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
+	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file1.ts file2.ts ... (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func concat(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	inputs := []io.Reader{f}
+	for _, inFile := range flag.Args()[1:] {
+		fh, err := os.Open(inFile)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = fh.Close() }()
+		inputs = append(inputs, fh)
+	}
+
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
+	}
+	err = internal.ConcatTS(ctx, textOutput, tsOutput, inputs, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, concat)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+)
+
+var usg = `Usage of %s:
+
+%s copies a section of a TS between a start and an end point.
+The points are given as a number followed by an optional unit:
+s (seconds after the first video PTS, the default), pts (90kHz PTS) or
+f (number of video frames), e.g. 10.5, 900000pts or 250f.
+
+The output starts with PAT and PMT followed by the first IDR picture at or
+after the start point with its parameter sets. Audio is cut at the first
+frame at or after the start of the video. Continuity counters are renumbered.
+`
+
+func cutPointFlag(cp *tsanalyzer.CutPoint) func(string) error {
+	return func(s string) error {
+		var err error
+		*cp, err = tsanalyzer.ParseCutPoint(s)
+		return err
+	}
+}
+
+func parseOptions() internal.Options {
+	opts := internal.Options{ShowStreamInfo: true, Indent: true}
+	flag.Func("start", "start of the cut (default first IDR picture)", cutPointFlag(&opts.CutStart))
+	flag.Func("end", "end of the cut (default end of stream)", cutPointFlag(&opts.CutEnd))
+	flag.IntVar(&opts.Program, "program", 0, "program number to cut (0 = first program)")
+	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
+	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func cut(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
+	}
+	err = internal.CutTS(ctx, textOutput, tsOutput, f, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, cut)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
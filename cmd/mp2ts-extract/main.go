@@ -21,6 +21,8 @@ By default, it waits for parameter sets (VPS/SPS/PPS) before starting extraction
 func parseOptions() internal.Options {
 	opts := internal.Options{ShowStreamInfo: true, Indent: false, WaitForPS: true}
 	flag.IntVar(&opts.ExtractPID, "pid", 0, "PID to extract (if 0, extract first video PID found)")
+	flag.IntVar(&opts.Program, "program", 0, "program number to analyze (0 = all programs)")
+	flag.StringVar(&opts.ServiceName, "servicename", "", "service name (from SDT) of the program to analyze")
 	flag.StringVar(&opts.OutPutTo, "output", "", "output file path (- for stdout, required)")
 	flag.BoolVar(&opts.WaitForPS, "waitps", true, "wait for parameter sets (VPS/SPS/PPS) before extraction")
 	flag.BoolVar(&opts.Version, "version", false, "print version")
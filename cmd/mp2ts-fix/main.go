@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+)
+
+var usg = `Usage of %s:
+
+%s repairs a damaged TS. Bytes are skipped until sync is found again,
+packets that are cut short are dropped, duplicate packets are dropped and the
+continuity counters are rewritten to be continuous per PID. Optionally, null
+packets are stripped and the last PAT and PMT are repeated if they are missing
+for longer than an interval. Every change is reported as JSON.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{Indent: true}
+	flag.BoolVar(&opts.StripNulls, "stripnulls", false, "drop null packets (PID 0x1FFF)")
+	flag.DurationVar(&opts.PSIInterval, "psiinterval", 0, "insert PAT/PMT if missing for longer than this, e.g. 500ms (0 = no insertion)")
+	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
+	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func fix(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
+	}
+	err = internal.FixTS(ctx, textOutput, tsOutput, f, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, fix)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
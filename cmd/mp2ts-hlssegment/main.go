@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+)
+
+var usg = `Usage of %s:
+
+%s splits a TS into HLS segments segment_<nr>.ts and writes the media playlist
+index.m3u8 to the output directory. Segments start on IDR pictures (or pictures
+with random_access_indicator) and begin with PAT and PMT. Segments also start at
+the splice points of SCTE-35 cues in the program, and with -cuetags the cues are
+written as EXT-X-CUE-OUT/IN (cue) or EXT-X-DATERANGE (daterange) tags.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{ShowStreamInfo: true, Indent: false}
+	flag.StringVar(&opts.OutPutTo, "output", "", "output directory for segments and playlist (required)")
+	flag.Float64Var(&opts.SegDuration, "duration", tsanalyzer.DefaultSegmentDuration, "target segment duration in seconds")
+	flag.IntVar(&opts.Program, "program", 0, "program number to segment (0 = first program)")
+	flag.StringVar(&opts.CueTags, "cuetags", "", "playlist tags for SCTE-35 cues: cue or daterange (default none)")
+	flag.StringVar(&opts.StartTime, "starttime", "", "program date time of the first segment in RFC 3339 format (default now)")
+	flag.BoolVar(&opts.Indent, "indent", false, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func segment(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	if o.OutPutTo == "" {
+		return fmt.Errorf("output directory is required (use -output)")
+	}
+	if o.SegDuration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	switch o.CueTags {
+	case tsanalyzer.CueTagsNone, tsanalyzer.CueTagsCue, tsanalyzer.CueTagsDateRange:
+	default:
+		return fmt.Errorf("unknown cue tags %q", o.CueTags)
+	}
+	if err := os.MkdirAll(o.OutPutTo, 0755); err != nil {
+		return err
+	}
+	return internal.SegmentHLS(ctx, w, f, o)
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, segment)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
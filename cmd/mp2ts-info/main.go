@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
 )
 
 var usg = `Usage of %s:
@@ -21,6 +22,11 @@ func parseOptions() internal.Options {
 	opts := internal.Options{ShowStreamInfo: true, Indent: true}
 	flag.BoolVar(&opts.ShowService, "service", false, "show service information")
 	flag.BoolVar(&opts.ShowSCTE35, "scte35", true, "show SCTE35 information")
+	flag.BoolVar(&opts.SCTE35Align, "align", false, "show the video frame at the splice time of each SCTE35 cue")
+	flag.BoolVar(&opts.ShowBitrate, "bitrate", false, "show packet counts and PCR-based bitrates per PID")
+	flag.DurationVar(&opts.BitrateWindow, "window", tsanalyzer.DefaultBitrateWindow, "window for min/max bitrates")
+	flag.BoolVar(&opts.ShowTiming, "timing", false, "show PTS-PCR delays, DTS errors and T-STD violations per PID")
+	flag.DurationVar(&opts.DelayWindow, "delaywindow", tsanalyzer.DefaultDelayWindow, "window for the delay timeline")
 	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
 	flag.BoolVar(&opts.Version, "version", false, "print version")
 
@@ -37,8 +43,23 @@ func parseOptions() internal.Options {
 }
 
 func parse(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
-	// Parse either general information, or scte35 (by default)
-	if o.ShowService {
+	// Parse either bitrates, timing, general information, scte35 alignment, or scte35 (by default)
+	if o.ShowBitrate {
+		err := internal.ParseBitrates(ctx, w, f, o)
+		if err != nil {
+			return err
+		}
+	} else if o.ShowTiming {
+		err := internal.ParseTiming(ctx, w, f, o)
+		if err != nil {
+			return err
+		}
+	} else if o.SCTE35Align {
+		err := internal.ParseAll(ctx, w, f, o)
+		if err != nil {
+			return err
+		}
+	} else if o.ShowService {
 		err := internal.ParseInfo(ctx, w, f, o)
 		if err != nil {
 			return err
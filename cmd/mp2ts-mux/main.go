@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+)
+
+var usg = `Usage of %s:
+
+%s packetizes an Annex B AVC or HEVC video file, such as the output of
+mp2ts-extract, and optionally an ADTS AAC audio file into a TS with one program.
+The codec is detected from the first NAL unit. Timestamps are generated from the
+frame rate, given with -framerate or taken from the VUI of the SPS, and the
+picture order count. PCR is sent on the video PID, PAT and PMT are repeated,
+and random_access_indicator is set on IDR pictures.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{ShowStreamInfo: true, Indent: true}
+	flag.StringVar(&opts.AudioFile, "audio", "", "ADTS AAC file to mux with the video")
+	flag.IntVar(&opts.VideoPID, "videopid", tsanalyzer.DefaultVideoPID, "video PID")
+	flag.IntVar(&opts.AudioPID, "audiopid", tsanalyzer.DefaultAudioPID, "audio PID")
+	flag.IntVar(&opts.PMTPID, "pmtpid", tsanalyzer.DefaultPMTPID, "PMT PID")
+	flag.Float64Var(&opts.FrameRate, "framerate", 0, "video frame rate (0 = from VUI)")
+	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
+	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] video.264 (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func mux(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
+	}
+	err = internal.MuxES(ctx, textOutput, tsOutput, f, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, mux)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -23,6 +23,9 @@ func parseOptions() internal.Options {
 	flag.IntVar(&opts.MaxNrPictures, "max", 0, "max nr pictures to parse")
 	flag.BoolVar(&opts.ShowSEIDetails, "sei", false, "print detailed sei message information")
 	flag.BoolVar(&opts.ShowSMPTE2038, "smpte2038", false, "print details about SMPTE-2038 data")
+	flag.BoolVar(&opts.ShowAudio, "audio", false, "print AAC and AC-3/E-AC-3 frames and audio statistics")
+	flag.IntVar(&opts.Program, "program", 0, "program number to analyze (0 = all programs)")
+	flag.StringVar(&opts.ServiceName, "servicename", "", "service name (from SDT) of the program to analyze")
 	flag.BoolVar(&opts.Indent, "indent", false, "indent JSON output")
 	flag.BoolVar(&opts.WaitForPS, "waitps", false, "wait for parameter sets (SPS/PPS) before printing NAL units")
 	flag.BoolVar(&opts.Version, "version", false, "print version")
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/Eyevinn/mp2ts-tools/internal"
@@ -17,11 +18,56 @@ var usg = `Usage of %s:
 %s filters out some chosen pids from the ts packet.
 Drop nothing and list all PIDs if empty pids list is specified (by default).
 However, PAT(0) and PMT must not be dropped.
+Streams can also be selected by kind (video, audio, scte35, smpte2038, subtitles,
+teletext, data) or codec (e.g. AVC, AAC, AC-3), optionally followed by a
+language, e.g. "audio:eng" or "*:swe". With -keep, all elementary streams that
+are not selected are dropped.
+PIDs, including PMT PIDs, and program numbers can be changed with -remap and
+-renumber. PAT, PMT and SDT are rewritten accordingly, and PCRs on a dropped PCR
+PID are kept in packets with only an adaptation field. Two PIDs must not be
+output on the same PID.
 `
 
+func dropFlag(opts *internal.Options) func(string) error {
+	return func(s string) error {
+		var pids []string
+		var selectors []string
+		for _, word := range strings.Fields(s) {
+			if _, err := strconv.Atoi(word); err == nil {
+				pids = append(pids, word)
+			} else {
+				selectors = append(selectors, word)
+			}
+		}
+		opts.PidsToDrop = strings.Join(pids, " ")
+		var err error
+		opts.DropStreams, err = internal.ParseStreamSelectors(strings.Join(selectors, " "))
+		return err
+	}
+}
+
+func keepFlag(opts *internal.Options) func(string) error {
+	return func(s string) error {
+		var err error
+		opts.KeepStreams, err = internal.ParseStreamSelectors(s)
+		return err
+	}
+}
+
+func numberMapFlag(m *map[int]int) func(string) error {
+	return func(s string) error {
+		var err error
+		*m, err = internal.ParseNumberMap(s)
+		return err
+	}
+}
+
 func parseOptions() internal.Options {
 	opts := internal.Options{ShowStreamInfo: true, Indent: true, FilterPids: true}
-	flag.StringVar(&opts.PidsToDrop, "drop", "", "pids to drop in the PMT (split by space), e.g. \"256 257\"")
+	flag.Func("drop", "pids or streams to drop (split by space), e.g. \"256 257\" or \"audio:swe scte35\"", dropFlag(&opts))
+	flag.Func("keep", "pids or streams to keep (split by space), e.g. \"video audio:eng\"", keepFlag(&opts))
+	flag.Func("remap", "pids to change (split by space), e.g. \"256:4096 257:4097\"", numberMapFlag(&opts.PIDMap))
+	flag.Func("renumber", "program numbers to change (split by space), e.g. \"1:10\"", numberMapFlag(&opts.ProgramNumbers))
 	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
 	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
 	flag.BoolVar(&opts.Version, "version", false, "print version")
@@ -39,28 +85,15 @@ func parseOptions() internal.Options {
 }
 
 func filter(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
-	outPutToFile := o.OutPutTo != "-"
-	var textOutput io.Writer
-	var tsOutput io.Writer
-	// If we output to ts files, print analysis to stdout
-	if outPutToFile {
-		// Remove existing output file
-		if err := internal.RemoveFileIfExists(o.OutPutTo); err != nil {
-			return err
-		}
-		file, err := internal.OpenFileAndAppend(o.OutPutTo)
-		if err != nil {
-			return err
-		}
-		tsOutput = file
-		textOutput = w
-		defer func() { _ = file.Close() }()
-	} else { // If we output to stdout, print analysis to stderr
-		tsOutput = w
-		textOutput = os.Stderr
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
 	}
-
-	return internal.FilterPids(ctx, textOutput, tsOutput, f, o)
+	err = internal.FilterPids(ctx, textOutput, tsOutput, f, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func main() {
@@ -20,6 +20,8 @@ var usg = `Usage of %s:
 func parseOptions() internal.Options {
 	opts := internal.Options{ShowStreamInfo: true, ShowService: false, ShowPS: true, VerbosePSInfo: true, Indent: true, ShowNALU: false, ShowSEIDetails: false, ShowStatistics: false}
 	flag.IntVar(&opts.MaxNrPictures, "max", 0, "max nr pictures to parse")
+	flag.IntVar(&opts.Program, "program", 0, "program number to analyze (0 = all programs)")
+	flag.StringVar(&opts.ServiceName, "servicename", "", "service name (from SDT) of the program to analyze")
 	flag.BoolVar(&opts.Version, "version", false, "print version")
 
 	flag.Usage = func() {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+)
+
+var usg = `Usage of %s:
+
+%s inserts SCTE-35 cues (splice_insert or time_signal with segmentation
+descriptors) into a TS. The events are read from a JSON or YAML file with a
+list of events, where the time is given in seconds after the first video PTS:
+
+  - time: 10.0
+    preroll: 4
+    spliceCommand: {type: SpliceInsert, eventId: 1, outOfNetwork: true, duration: 2700000, autoReturn: true}
+  - time: 40.0
+    spliceCommand: {type: TimeSignal}
+    segmentationDes:
+      - {eventId: 2, typeId: 52, segmentNumber: 1, segmentsExpected: 1, duration: 2700000,
+         upid: {type: 9, value: "SIGNAL:abc"}}
+
+The cue PID is added to the PMT with stream_type 0x86 and a CUEI registration descriptor.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{ShowStreamInfo: true, ShowSCTE35: true, Indent: true}
+	flag.StringVar(&opts.SCTE35Events, "events", "", "JSON or YAML file with the SCTE-35 events to insert")
+	flag.IntVar(&opts.SCTE35PID, "pid", tsanalyzer.DefaultSCTE35PID, "PID for the SCTE-35 cues")
+	flag.IntVar(&opts.Program, "program", 0, "program number to insert the cues in (0 = first program)")
+	flag.StringVar(&opts.OutPutTo, "output", "", "save the TS packets into the given file (filepath) or stdout (-)")
+	flag.BoolVar(&opts.Indent, "indent", true, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func inject(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	if o.SCTE35Events == "" {
+		return fmt.Errorf("no events file given with -events")
+	}
+	textOutput, tsOutput, closeOutput, err := internal.OpenOutput(w, o.OutPutTo)
+	if err != nil {
+		return err
+	}
+	err = internal.InjectSCTE35(ctx, textOutput, tsOutput, f, o)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, inject)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
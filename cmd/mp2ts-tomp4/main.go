@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+)
+
+var usg = `Usage of %s:
+
+%s remuxes the AVC, HEVC and AAC streams of a TS to fragmented MP4 following CMAF.
+Each stream is written to its own track file in the output directory, video_<pid>.cmfv
+or audio_<pid>.cmfa, with an init segment followed by fragments.
+Video fragments start on IDR pictures.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{ShowStreamInfo: true, Indent: false}
+	flag.StringVar(&opts.OutPutTo, "output", "", "output directory for the track files (required)")
+	flag.Float64Var(&opts.SegDuration, "duration", tsanalyzer.DefaultSegmentDuration, "target fragment duration in seconds")
+	flag.IntVar(&opts.Program, "program", 0, "program number to remux (0 = all programs)")
+	flag.StringVar(&opts.ServiceName, "servicename", "", "service name (from SDT) of the program to remux")
+	flag.BoolVar(&opts.Indent, "indent", false, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func remux(ctx context.Context, w io.Writer, f io.Reader, o internal.Options) error {
+	if o.OutPutTo == "" {
+		return fmt.Errorf("output directory is required (use -output)")
+	}
+	if o.SegDuration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if err := os.MkdirAll(o.OutPutTo, 0755); err != nil {
+		return err
+	}
+	return internal.RemuxMP4(ctx, w, f, o)
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, remux)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Eyevinn/mp2ts-tools/internal"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+)
+
+var usg = `Usage of %s:
+
+%s checks a TS file against the ETSI TR 101 290 priority 1 and 2 indicators.
+Priority 1: TS_sync_loss, Sync_byte_error, PAT_error, Continuity_count_error, PMT_error and PID_error.
+Priority 2: Transport_error, CRC_error, PCR_repetition_error, PCR_discontinuity_indicator_error,
+PCR_accuracy_error and PTS_error.
+Each error is printed with packet number, byte offset and time (in seconds from the first PCR),
+followed by a summary.
+`
+
+func parseOptions() internal.Options {
+	opts := internal.Options{Indent: false}
+	flag.DurationVar(&opts.PIDTimeout, "pidtimeout", tsanalyzer.DefaultPIDTimeout, "max interval between packets on PIDs referenced in the PMT")
+	flag.BoolVar(&opts.Indent, "indent", false, "indent JSON output")
+	flag.BoolVar(&opts.Version, "version", false, "print version")
+
+	flag.Usage = func() {
+		parts := strings.Split(os.Args[0], "/")
+		name := parts[len(parts)-1]
+		fmt.Fprintf(os.Stderr, usg, name, name)
+		fmt.Fprintf(os.Stderr, "\nRun as: %s [options] file.ts (- for stdin) with options:\n\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	return opts
+}
+
+func main() {
+	o, inFile := internal.ParseParams(parseOptions)
+	err := internal.Execute(os.Stdout, o, inFile, internal.Validate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
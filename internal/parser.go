@@ -5,349 +5,223 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/Comcast/gots/v2/packet"
-	"github.com/Comcast/gots/v2/psi"
-	"github.com/Comcast/gots/v2/scte35"
-	"github.com/asticode/go-astits"
-	slices "golang.org/x/exp/slices"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
 )
 
+// ParseAll prints stream information, parameter sets, NAL units and statistics as JSON.
 func ParseAll(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
-	rd := bufio.NewReaderSize(f, 1000*PacketSize)
-	dmx := astits.NewDemuxer(ctx, rd)
-	pmtPID := -1
-	nrPics := 0
-	sdtPrinted := false
-	esKinds := make(map[uint16]string)
-	avcPSs := make(map[uint16]*AvcPS)
-	hevcPSs := make(map[uint16]*HevcPS)
 	jp := &JsonPrinter{W: w, Indent: o.Indent}
-	statistics := make(map[uint16]*StreamStatistics)
-dataLoop:
-	for {
-		// Check if context was cancelled
-		select {
-		case <-ctx.Done():
-			break dataLoop
-		default:
-		}
-
-		d, err := dmx.NextData()
-		if err != nil {
-			if err.Error() == "astits: no more packets" {
-				break dataLoop
-			}
-			return fmt.Errorf("reading next data %w", err)
-		}
+	return tsanalyzer.ParseAll(ctx, f, jp.Handler(o), o.AnalyzerOptions())
+}
 
-		// Print service information
-		if d.SDT != nil && !sdtPrinted {
-			jp.PrintSdtInfo(d.SDT, o.ShowService)
-			sdtPrinted = true
-		}
+// ParseInfo prints stream information and optionally service information as JSON.
+func ParseInfo(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	return tsanalyzer.ParseInfo(ctx, f, jp.Handler(o), o.AnalyzerOptions())
+}
 
-		// Print PID information
-		if pmtPID < 0 && d.PMT != nil {
-			// Loop through elementary streams
-			for _, es := range d.PMT.ElementaryStreams {
-				streamInfo := ParseAstitsElementaryStreamInfo(es)
-				if streamInfo != nil {
-					esKinds[es.ElementaryPID] = streamInfo.Codec
-					jp.Print(streamInfo, o.ShowStreamInfo)
-				}
-			}
-			pmtPID = int(d.PID)
-		}
-		if pmtPID == -1 {
-			continue
-		}
-		pes := d.PES
-		if pes == nil {
-			continue
-		}
+// ParseSCTE35 prints stream information and SCTE-35 messages as JSON.
+func ParseSCTE35(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	return tsanalyzer.ParseSCTE35(ctx, f, jp.Handler(o), o.AnalyzerOptions())
+}
 
-		switch esKinds[d.PID] {
-		case "AVC":
-			avcPS := avcPSs[d.PID]
-			avcPS, err = ParseAVCPES(jp, d, avcPS, o)
-			if err != nil {
-				return err
-			}
-			if avcPS == nil {
-				continue
-			}
-			if avcPSs[d.PID] == nil {
-				avcPSs[d.PID] = avcPS
-			}
-			nrPics++
-			statistics[d.PID] = &avcPS.Statistics
-		case "HEVC":
-			hevcPS := hevcPSs[d.PID]
-			hevcPS, err = ParseHEVCPES(jp, d, hevcPS, o)
-			if err != nil {
-				return err
-			}
-			if hevcPS == nil {
-				continue
-			}
-			if hevcPSs[d.PID] == nil {
-				hevcPSs[d.PID] = hevcPS
-			}
-			nrPics++
-			statistics[d.PID] = &hevcPS.Statistics
-		case "SMPTE-2038":
-			if o.ShowSMPTE2038 {
-				ParseSMPTE2038(jp, d, o)
-			}
-		default:
-			// Skip unknown elementary streams
-			continue
-		}
+// FilterPids writes the filtered TS to tsWriter and prints information to textWriter.
+func FilterPids(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.FilterPids(ctx, f, tsWriter, jp.Handler(o), o.AnalyzerOptions())
+}
 
-		// Keep looping if MaxNrPictures equals 0
-		if o.MaxNrPictures > 0 && nrPics >= o.MaxNrPictures {
-			break dataLoop
-		}
+// InjectSCTE35 writes the TS with the SCTE-35 events in o.SCTE35Events to tsWriter
+// and prints the stream information and the inserted cues to textWriter.
+func InjectSCTE35(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
+	events, err := ReadSCTE35Events(o.SCTE35Events)
+	if err != nil {
+		return err
 	}
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.InjectSCTE35(ctx, f, tsWriter, events, jp.Handler(o), o.AnalyzerOptions())
+}
 
-	for _, s := range statistics {
-		jp.PrintStatistics(*s, o.ShowStatistics)
-	}
+// ExtractES writes the elementary stream to esWriter and prints information to textWriter.
+func ExtractES(ctx context.Context, textWriter io.Writer, esWriter io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.ExtractES(ctx, f, esWriter, jp.Handler(o), o.AnalyzerOptions())
+}
 
-	return jp.Error()
+// CutTS writes the cut TS to tsWriter and prints information to textWriter.
+func CutTS(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.CutTS(ctx, f, tsWriter, jp.Handler(o), o.AnalyzerOptions())
 }
 
-func ParseInfo(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
-	rd := bufio.NewReaderSize(f, 1000*PacketSize)
-	dmx := astits.NewDemuxer(ctx, rd)
-	pmtPID := -1
-	jp := &JsonPrinter{W: w, Indent: o.Indent}
-dataLoop:
-	for {
-		// Check if context was cancelled
-		select {
-		case <-ctx.Done():
-			break dataLoop
-		default:
-		}
+// ConcatTS writes the inputs as one TS to tsWriter and prints information to textWriter.
+func ConcatTS(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, inputs []io.Reader, o Options) error {
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.ConcatTS(ctx, inputs, tsWriter, jp.Handler(o), o.AnalyzerOptions())
+}
 
-		d, err := dmx.NextData()
+// MuxES writes a TS with the Annex B video and the ADTS audio in o.AudioFile, if any,
+// to tsWriter and prints information to textWriter.
+func MuxES(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, video io.Reader, o Options) error {
+	var audio io.Reader
+	if o.AudioFile != "" {
+		fh, err := os.Open(o.AudioFile)
 		if err != nil {
-			if err.Error() == "astits: no more packets" {
-				break dataLoop
-			}
-			return fmt.Errorf("reading next data %w", err)
-		}
-
-		// Print PID information
-		if pmtPID < 0 && d.PMT != nil {
-			// Loop through elementary streams
-			for _, es := range d.PMT.ElementaryStreams {
-				streamInfo := ParseAstitsElementaryStreamInfo(es)
-				if streamInfo != nil {
-					jp.Print(streamInfo, o.ShowStreamInfo)
-				}
-			}
-			pmtPID = int(d.PID)
-		}
-		if pmtPID == -1 {
-			continue
-		}
-
-		// Exit imediately if we don't want service information
-		if !o.ShowService {
-			break dataLoop
-		}
-
-		// Print service information
-		if d.SDT != nil {
-			jp.PrintSdtInfo(d.SDT, o.ShowService)
-			break dataLoop
+			return err
 		}
-
-		// Loop until we have printed service information
+		defer func() { _ = fh.Close() }()
+		audio = fh
 	}
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.MuxES(ctx, video, audio, tsWriter, jp.Handler(o), o.AnalyzerOptions())
+}
 
-	return jp.Error()
+// RestampCBR writes the TS at the constant bitrate o.MuxRate to tsWriter and
+// prints a summary to textWriter.
+func RestampCBR(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.RestampCBR(ctx, f, tsWriter, jp.Handler(o), o.AnalyzerOptions())
 }
 
-func ParseSCTE35(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
-	reader := bufio.NewReader(f)
-	_, err := packet.Sync(reader)
-	if err != nil {
-		return fmt.Errorf("syncing with reader %w", err)
-	}
-	pat, err := psi.ReadPAT(reader)
-	if err != nil {
-		return fmt.Errorf("reading PAT %w", err)
-	}
+// FixTS writes a repaired copy of the TS to tsWriter and prints every change
+// and a summary to textWriter.
+func FixTS(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.FixTS(ctx, f, tsWriter, jp.Handler(o), o.AnalyzerOptions())
+}
 
-	var pmts []psi.PMT
-	pm := pat.ProgramMap()
-	for _, pid := range pm {
-		pmt, err := psi.ReadPMT(reader, pid)
+// TimeshiftTS writes the TS with shifted timestamps to tsWriter and prints
+// the applied time jumps of o.Schedule and the first and last values per PID
+// to textWriter.
+func TimeshiftTS(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
+	ao := o.AnalyzerOptions()
+	if o.Schedule != "" {
+		jumps, err := ReadTimeJumps(o.Schedule)
 		if err != nil {
-			return fmt.Errorf("reading PMT %w", err)
+			return err
 		}
-		pmts = append(pmts, pmt)
+		ao.TimeJumps = jumps
 	}
+	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
+	return tsanalyzer.TimeshiftTS(ctx, f, tsWriter, jp.Handler(o), ao)
+}
 
-	jp := &JsonPrinter{W: w, Indent: o.Indent}
-	scte35PIDs := make(map[int]bool)
-	for _, pmt := range pmts {
-		for _, es := range pmt.ElementaryStreams() {
-			streamInfo := ParseElementaryStreamInfo(es)
-			if streamInfo != nil {
-				if streamInfo.Codec == "SCTE35" {
-					scte35PIDs[es.ElementaryPid()] = true
-				}
-
-				jp.Print(streamInfo, o.ShowStreamInfo)
-			}
+// RemuxMP4 writes the CMAF tracks to the directory o.OutPutTo and prints
+// stream and track information to w. Video tracks are written to
+// video_<pid>.cmfv and audio tracks to audio_<pid>.cmfa.
+func RemuxMP4(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	var files []*os.File
+	var writers []*bufio.Writer
+	newWriter := func(pid uint16, codec string) (io.Writer, error) {
+		name := fmt.Sprintf("video_%d.cmfv", pid)
+		if codec == "AAC" {
+			name = fmt.Sprintf("audio_%d.cmfa", pid)
+		}
+		file, err := os.Create(filepath.Join(o.OutPutTo, name))
+		if err != nil {
+			return nil, fmt.Errorf("creating output file %w", err)
 		}
+		bw := bufio.NewWriter(file)
+		files = append(files, file)
+		writers = append(writers, bw)
+		return bw, nil
 	}
-
-	// Print SCTE35
-	for {
-		var pkt packet.Packet
-		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				break
-			}
-			return fmt.Errorf("reading Packet %w", err)
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	err := tsanalyzer.RemuxMP4(ctx, f, newWriter, jp.Handler(o), o.AnalyzerOptions())
+	for i, file := range files {
+		if flushErr := writers[i].Flush(); err == nil {
+			err = flushErr
 		}
-
-		currPID := packet.Pid(&pkt)
-		if scte35PIDs[currPID] {
-			pay, err := packet.Payload(&pkt)
-			if err != nil {
-				return fmt.Errorf("cannot get payload for packet on PID %d Error=%s", currPID, err)
-			}
-			msg, err := scte35.NewSCTE35(pay)
-			if err != nil {
-				return fmt.Errorf("cannot parse SCTE35 Error=%v", err)
-			}
-			scte35 := toSCTE35(uint16(currPID), msg)
-			jp.Print(scte35, o.ShowSCTE35)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
 		}
 	}
-
-	return jp.Error()
+	return err
 }
 
-func FilterPids(ctx context.Context, textWriter io.Writer, tsWriter io.Writer, f io.Reader, o Options) error {
-	pidsToDrop := ParsePidsFromString(o.PidsToDrop)
-	if slices.Contains(pidsToDrop, 0) {
-		return fmt.Errorf("filtering out PAT is not allowed")
+// SegmentHLS writes TS segments segment_<nr>.ts and the media playlist
+// index.m3u8 to the directory o.OutPutTo and prints stream and segment
+// information to w.
+func SegmentHLS(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	playlist := tsanalyzer.MediaPlaylist{CueTags: o.CueTags, ProgramDateTime: time.Now()}
+	if o.StartTime != "" {
+		t, err := time.Parse(time.RFC3339, o.StartTime)
+		if err != nil {
+			return fmt.Errorf("parsing start time %w", err)
+		}
+		playlist.ProgramDateTime = t
 	}
-
-	reader := bufio.NewReader(f)
-	_, err := packet.Sync(reader)
-	if err != nil {
-		return fmt.Errorf("syncing with reader %w", err)
+	var file *os.File
+	var bw *bufio.Writer
+	closeSegment := func() error {
+		if file == nil {
+			return nil
+		}
+		err := bw.Flush()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		file = nil
+		return err
 	}
-
-	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
-	statistics := PidFilterStatistics{PidsToDrop: pidsToDrop, TotalPackets: 0, FilteredPackets: 0, PacketsBeforePAT: 0}
-
-	var pkt packet.Packet
-	var pat psi.PAT
-	foundPAT := false
-	hasShownStreamInfo := false
-	// Skip packets until PAT
-	for {
-		// Read packet
-		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				break
-			}
-			return fmt.Errorf("reading Packet %w", err)
-		}
-		if packet.IsPat(&pkt) {
-			// Found first PAT packet
-			foundPAT = true
+	newSegment := func(nr int) (io.Writer, string, error) {
+		if err := closeSegment(); err != nil {
+			return nil, "", err
 		}
-
-		// Count PAT packet and non-PMT packets
-		statistics.TotalPackets = statistics.TotalPackets + 1
-		if !foundPAT {
-			// packets before PAT
-			statistics.PacketsBeforePAT = statistics.PacketsBeforePAT + 1
-			continue
+		uri := fmt.Sprintf("segment_%d.ts", nr)
+		var err error
+		file, err = os.Create(filepath.Join(o.OutPutTo, uri))
+		if err != nil {
+			return nil, "", fmt.Errorf("creating output file %w", err)
 		}
+		bw = bufio.NewWriter(file)
+		return bw, uri, nil
+	}
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	print := jp.Handler(o)
+	h := tsanalyzer.HandlerFunc(func(ev tsanalyzer.Event) error {
+		if seg, ok := ev.(tsanalyzer.HLSSegment); ok {
+			playlist.Segments = append(playlist.Segments, seg)
+		}
+		return print.HandleEvent(ev)
+	})
+	err := tsanalyzer.SegmentHLS(ctx, f, newSegment, h, o.AnalyzerOptions())
+	if closeErr := closeSegment(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	pf, err := os.Create(filepath.Join(o.OutPutTo, "index.m3u8"))
+	if err != nil {
+		return fmt.Errorf("creating playlist %w", err)
+	}
+	err = playlist.Write(pf)
+	if closeErr := pf.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-		if packet.IsPat(&pkt) {
-			// Parse PAT packet
-			pat, err = ParsePacketToPAT(&pkt)
-			if err != nil {
-				return err
-			}
-
-			// Save PAT packet
-			if err = WritePacket(&pkt, tsWriter); err != nil {
-				return err
-			}
-
-			// Handle PMT packet(s)
-			pm := pat.ProgramMap()
-			for _, pid := range pm {
-				if slices.Contains(pidsToDrop, pid) {
-					return fmt.Errorf("filtering out PMT is not allowed")
-				}
-
-				packets, pmt, err := ReadPMTPackets(reader, pid)
-				if err != nil {
-					return err
-				}
-				// Count PMT packets
-				statistics.TotalPackets = statistics.TotalPackets + uint32(len(packets))
-
-				// 1. Print stream info only once
-				if o.ShowStreamInfo && !hasShownStreamInfo {
-					for _, es := range pmt.ElementaryStreams() {
-						streamInfo := ParseElementaryStreamInfo(es)
-						if streamInfo != nil {
-							jp.Print(streamInfo, true)
-						}
-					}
-					hasShownStreamInfo = true
-				}
-
-				// 2. Drop pids if exist
-				isFilteringOutPids := IsTwoSlicesOverlapping(pmt.Pids(), pidsToDrop)
-				pkts := []*packet.Packet{}
-				for i := range packets {
-					pkts = append(pkts, &packets[i])
-				}
-				if isFilteringOutPids {
-					pidsToKeep := GetDifferenceOfTwoSlices(pmt.Pids(), pidsToDrop)
-					pkts, err = psi.FilterPMTPacketsToPids(pkts, pidsToKeep)
-					if err != nil {
-						return fmt.Errorf("filtering pids %w", err)
-					}
-
-					statistics.FilteredPackets = statistics.FilteredPackets + uint32(len(pkts))
-				}
-
-				// 3. Save PMT packets
-				for _, p := range pkts {
-					if err = WritePacket(p, tsWriter); err != nil {
-						return err
-					}
-				}
-			}
-
-			// Move on to next packet
-			continue
-		}
+// Validate prints the ETSI TR 101 290 errors found in the TS as JSON.
+func Validate(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	return tsanalyzer.Validate(ctx, f, jp.Handler(o), o.AnalyzerOptions())
+}
 
-		// Save non-PAT/PMT packets
-		if err = WritePacket(&pkt, tsWriter); err != nil {
-			return err
-		}
-	}
+// ParseBitrates prints stream information and the packet counts and bitrates of all PIDs as JSON.
+func ParseBitrates(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	return tsanalyzer.ParseBitrates(ctx, f, jp.Handler(o), o.AnalyzerOptions())
+}
 
-	jp.PrintFilter(statistics, true)
-	return nil
+// ParseTiming prints the PTS - PCR delays, DTS errors and T-STD violations of all PES PIDs as JSON.
+func ParseTiming(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+	jp := &JsonPrinter{W: w, Indent: o.Indent}
+	return tsanalyzer.ParseTiming(ctx, f, jp.Handler(o), o.AnalyzerOptions())
 }
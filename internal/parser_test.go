@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -26,6 +27,14 @@ func TestParseFile(t *testing.T) {
 	parseInfoFunc := ParseInfo
 	parseSCTE35Func := ParseSCTE35
 	parseAllFunc := ParseAll
+	// Inject cues and parse them from the output TS
+	injectSCTE35Func := func(ctx context.Context, w io.Writer, f io.Reader, o Options) error {
+		var ts bytes.Buffer
+		if err := InjectSCTE35(ctx, w, &ts, f, o); err != nil {
+			return err
+		}
+		return ParseSCTE35(ctx, w, &ts, o)
+	}
 
 	cases := []struct {
 		name                 string
@@ -38,9 +47,12 @@ func TestParseFile(t *testing.T) {
 		{"avc_without_ps", "testdata/avc_with_time.ts", Options{MaxNrPictures: 10, ShowStreamInfo: true}, "testdata/golden_avc_without_ps.txt", parseInfoFunc},
 		{"avc_with_service", "testdata/80s_with_ad.ts", Options{MaxNrPictures: 0, ShowStreamInfo: true, ShowService: true}, "testdata/golden_avc_with_service.txt", parseInfoFunc},
 		{"avc_with_scte35", "testdata/80s_with_ad.ts", Options{MaxNrPictures: 0, ShowStreamInfo: true, ShowSCTE35: true}, "testdata/golden_avc_with_scte35.txt", parseSCTE35Func},
+		{"avc_with_scte35_align", "testdata/80s_with_ad.ts", Options{MaxNrPictures: 0, ShowStreamInfo: true, SCTE35Align: true}, "testdata/golden_avc_with_scte35_align.txt", parseAllFunc},
+		{"bbb_1s_scte35_inject", "testdata/bbb_1s.ts", Options{ShowStreamInfo: true, ShowSCTE35: true, SCTE35Events: "testdata/scte35_events.yaml", SCTE35PID: 500}, "testdata/golden_bbb_1s_scte35_inject.txt", injectSCTE35Func},
 		{"bbb_1s", "testdata/bbb_1s.ts", fullOptionsWith35Pic, "testdata/golden_bbb_1s.txt", parseAllFunc},
 		{"bbb_1s_indented", "testdata/bbb_1s.ts", fullOptionsWith2Pic, "testdata/golden_bbb_1s_indented.txt", parseAllFunc},
 		{"bbb_1s_no_nalu_no_sei", "testdata/bbb_1s.ts", fullOptionsWith35PicWithoutNALUSEI, "testdata/golden_bbb_1s_no_nalu(no_sei).txt", parseAllFunc},
+		{"bbb_1s_audio", "testdata/bbb_1s.ts", Options{MaxNrPictures: 10, ShowStreamInfo: true, ShowNALU: true, ShowAudio: true, ShowStatistics: true}, "testdata/golden_bbb_1s_audio.txt", parseAllFunc},
 		{"obs_hevc_aac", "testdata/obs_hevc_aac.ts", fullOptionsWith35Pic, "testdata/golden_obs_hevc_aac.txt", parseAllFunc},
 		{"obs_hevc_aac_indented", "testdata/obs_hevc_aac.ts", fullOptionsWith2Pic, "testdata/golden_obs_hevc_aac_indented.txt", parseAllFunc},
 		{"obs_hevc_aac_no_nalu_no_sei", "testdata/obs_hevc_aac.ts", fullOptionsWith35PicWithoutNALUSEI, "testdata/golden_obs_hevc_aac_no_nalu(no_sei).txt", parseAllFunc},
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
 )
 
 type JsonPrinter struct {
@@ -36,3 +38,26 @@ func (p *JsonPrinter) Print(data any, show bool) {
 func (p *JsonPrinter) Error() error {
 	return p.AccError
 }
+
+// Handler returns a tsanalyzer.Handler that prints the events selected by o.
+func (p *JsonPrinter) Handler(o Options) tsanalyzer.Handler {
+	return tsanalyzer.HandlerFunc(func(ev tsanalyzer.Event) error {
+		switch ev.(type) {
+		case tsanalyzer.ElementaryStreamInfo:
+			p.Print(ev, o.ShowStreamInfo)
+		case tsanalyzer.SdtInfo:
+			p.Print(ev, o.ShowService)
+		case tsanalyzer.PsInfo:
+			p.Print(ev, o.ShowPS)
+		case tsanalyzer.NaluFrameData, tsanalyzer.AacFrameData, tsanalyzer.Ac3FrameData:
+			p.Print(ev, o.ShowNALU)
+		case tsanalyzer.SCTE35Info:
+			p.Print(ev, o.ShowSCTE35)
+		case tsanalyzer.StreamStatistics:
+			p.Print(ev, o.ShowStatistics)
+		default:
+			p.Print(ev, true)
+		}
+		return p.Error()
+	})
+}
@@ -1,8 +1,9 @@
 package internal
 
 import (
+	"bufio"
 	"context"
-	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,12 +14,10 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	"github.com/Comcast/gots/v2"
-	"github.com/Comcast/gots/v2/packet"
-	"github.com/Comcast/gots/v2/psi"
-	"github.com/asticode/go-astits"
-	slices "golang.org/x/exp/slices"
+	"github.com/Eyevinn/mp2ts-tools/pkg/tsanalyzer"
+	"gopkg.in/yaml.v3"
 )
 
 type Options struct {
@@ -32,74 +31,101 @@ type Options struct {
 	ShowNALU       bool
 	ShowSEIDetails bool
 	ShowSMPTE2038  bool
+	ShowAudio      bool
 	ShowSCTE35     bool
+	SCTE35Align    bool // Correlate SCTE-35 cues with video frames
 	ShowStatistics bool
+	ShowBitrate    bool
+	ShowTiming     bool
 	FilterPids     bool
 	PidsToDrop     string
 	OutPutTo       string
-	WaitForPS      bool // Wait for parameter sets (SPS/PPS) before printing NAL units
-	ExtractPID     int  // PID to extract for elementary stream extraction (0 = first video PID)
+	WaitForPS      bool                        // Wait for parameter sets (SPS/PPS) before printing NAL units
+	ExtractPID     int                         // PID to extract for elementary stream extraction (0 = first video PID)
+	Program        int                         // Program number to analyze (0 = all programs)
+	ServiceName    string                      // Service name (from SDT) of the program to analyze
+	PIDTimeout     time.Duration               // Max interval between packets on referenced PIDs (PID_error)
+	BitrateWindow  time.Duration               // Window for min/max bitrates
+	DelayWindow    time.Duration               // Window of the PTS - PCR delay timeline
+	SCTE35Events   string                      // JSON or YAML file with SCTE-35 events to inject
+	SCTE35PID      int                         // PID for injected SCTE-35 cues
+	SegDuration    float64                     // Target segment duration in seconds
+	CueTags        string                      // HLS cue tag style for SCTE-35 cues (cue or daterange)
+	StartTime      string                      // Program date time of the first HLS segment (RFC 3339)
+	CutStart       tsanalyzer.CutPoint         // Start of the cut (zero value = first IDR picture)
+	CutEnd         tsanalyzer.CutPoint         // End of the cut (zero value = end of stream)
+	Discontinuity  bool                        // Set discontinuity_indicator instead of rebasing timestamps when concatenating
+	AudioFile      string                      // ADTS AAC file to mux with the video
+	VideoPID       int                         // Video PID when muxing (0 = default)
+	AudioPID       int                         // Audio PID when muxing (0 = default)
+	PMTPID         int                         // PMT PID when muxing (0 = default)
+	FrameRate      float64                     // Video frame rate when muxing (0 = from VUI)
+	MuxRate        int64                       // Constant output bitrate in bits per second
+	PIDMap         map[int]int                 // PIDs to change when filtering, from input to output PID
+	DropStreams    []tsanalyzer.StreamSelector // Elementary streams to drop when filtering
+	KeepStreams    []tsanalyzer.StreamSelector // Elementary streams to keep when filtering (empty = all)
+	ProgramNumbers map[int]int                 // Program numbers to change when filtering
+	StripNulls     bool                        // Drop null packets when fixing
+	PSIInterval    time.Duration               // Max interval between PAT/PMT when fixing (0 = no insertion)
+	TimeOffset     int64                       // Timestamp offset in 90kHz units
+	PIDOffsets     map[int]int64               // Extra PTS/DTS offset per PID in 90kHz units
+	Rebase         bool                        // Shift so that the first PCR or PTS becomes RebaseTo
+	RebaseTo       int64                       // Target of the first timestamp with Rebase in 90kHz units
+	PCROnly        bool                        // Only shift PCRs
+	PESOnly        bool                        // Only shift PTS/DTS
+	Schedule       string                      // JSON or YAML file with time jumps to apply when shifting
+}
+
+// AnalyzerOptions returns the options for the tsanalyzer parsers.
+func (o Options) AnalyzerOptions() tsanalyzer.Options {
+	return tsanalyzer.Options{
+		MaxNrPictures:   o.MaxNrPictures,
+		WaitForPS:       o.WaitForPS,
+		SEIDetails:      o.ShowSEIDetails,
+		PSDetails:       o.VerbosePSInfo,
+		SMPTE2038:       o.ShowSMPTE2038,
+		Audio:           o.ShowAudio,
+		Service:         o.ShowService,
+		ExtractPID:      o.ExtractPID,
+		Program:         o.Program,
+		ServiceName:     o.ServiceName,
+		PidsToDrop:      ParsePidsFromString(o.PidsToDrop),
+		PIDTimeout:      o.PIDTimeout,
+		BitrateWindow:   o.BitrateWindow,
+		DelayWindow:     o.DelayWindow,
+		SCTE35Align:     o.SCTE35Align,
+		SCTE35PID:       o.SCTE35PID,
+		SegmentDuration: o.SegDuration,
+		CutStart:        o.CutStart,
+		CutEnd:          o.CutEnd,
+		Discontinuity:   o.Discontinuity,
+		VideoPID:        o.VideoPID,
+		AudioPID:        o.AudioPID,
+		PMTPID:          o.PMTPID,
+		FrameRate:       o.FrameRate,
+		MuxRate:         o.MuxRate,
+		PIDMap:          o.PIDMap,
+		DropStreams:     o.DropStreams,
+		KeepStreams:     o.KeepStreams,
+		ProgramNumbers:  o.ProgramNumbers,
+		StripNulls:      o.StripNulls,
+		PSIInterval:     o.PSIInterval,
+		TimeOffset:      o.TimeOffset,
+		PIDOffsets:      o.PIDOffsets,
+		Rebase:          o.Rebase,
+		RebaseTo:        o.RebaseTo,
+		PCROnly:         o.PCROnly,
+		PESOnly:         o.PESOnly,
+	}
 }
 
 func CreateFullOptions(max int) Options {
 	return Options{MaxNrPictures: max, ShowStreamInfo: true, ShowService: true, ShowPS: true, ShowNALU: true, ShowSEIDetails: true, ShowSMPTE2038: true, ShowStatistics: true}
 }
 
-const (
-	ANC_REGISTERED_IDENTIFIER = 0x56414E43
-	ANC_DESCRIPTOR_TAG        = 0xC4
-)
-
 type OptionParseFunc func() Options
 type RunableFunc func(ctx context.Context, w io.Writer, f io.Reader, o Options) error
 
-func ReadPMTPackets(r io.Reader, pid int) ([]packet.Packet, psi.PMT, error) {
-	packets := []packet.Packet{}
-	var pkt = &packet.Packet{}
-	var err error
-	var pmt psi.PMT
-
-	pmtAcc := packet.NewAccumulator(psi.PmtAccumulatorDoneFunc)
-	done := false
-
-	for !done {
-		if _, err := io.ReadFull(r, pkt[:]); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return nil, nil, gots.ErrPMTNotFound
-			}
-			return nil, nil, err
-		}
-		currPid := pkt.PID()
-		if currPid != pid {
-			continue
-		}
-		packets = append(packets, *pkt)
-
-		_, err = pmtAcc.WritePacket(pkt)
-		if err == gots.ErrAccumulatorDone {
-			pmt, err = psi.NewPMT(pmtAcc.Bytes())
-			if err != nil {
-				return nil, nil, err
-			}
-			if len(pmt.Pids()) == 0 {
-				done = false
-				pmtAcc = packet.NewAccumulator(psi.PmtAccumulatorDoneFunc)
-				continue
-			}
-			done = true
-		} else if err != nil {
-			return nil, nil, err
-		}
-	}
-
-	return packets, pmt, nil
-}
-
-func WritePacket(pkt *packet.Packet, w io.Writer) error {
-	_, err := w.Write(pkt[:])
-	return err
-}
-
 func RemoveFileIfExists(file string) error {
 	// Remove the file if it exists
 	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
@@ -125,128 +151,125 @@ func OpenFileAndAppend(file string) (*os.File, error) {
 	return fo, nil
 }
 
-func ParseAstitsElementaryStreamInfo(es *astits.PMTElementaryStream) *ElementaryStreamInfo {
-	var streamInfo *ElementaryStreamInfo
-	switch es.StreamType {
-	case astits.StreamTypeH264Video:
-		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "AVC", Type: "video"}
-	case astits.StreamTypeAACAudio:
-		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "AAC", Type: "audio"}
-	case astits.StreamTypeH265Video:
-		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "HEVC", Type: "video"}
-	case astits.StreamTypeSCTE35:
-		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "SCTE35", Type: "cue"}
-	case astits.StreamTypePrivateData:
-		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "PrivateData", Type: "data"}
-	default:
-		return nil
+// OpenOutput returns the writers for the text and the TS output of a tool.
+// With output "-", the TS is written to w and the text to stderr. Otherwise
+// the TS is written to the output file, which is replaced if it exists, and
+// the text to w. The TS output is buffered, so closeOutput must be called when done.
+func OpenOutput(w io.Writer, output string) (textOut, tsOut io.Writer, closeOutput func() error, err error) {
+	if output == "" {
+		return nil, nil, nil, fmt.Errorf("no output given with -output")
+	}
+	if output == "-" {
+		bw := bufio.NewWriter(w)
+		return os.Stderr, bw, bw.Flush, nil
 	}
-	for _, d := range es.ElementaryStreamDescriptors {
-		switch d.Tag {
-		case astits.DescriptorTagISO639LanguageAndAudioType:
-			l := d.ISO639LanguageAndAudioType
-			fmt.Printf("Language: %s\n", l.Language)
-		case astits.DescriptorTagDataStreamAlignment:
-			a := d.DataStreamAlignment
-			log.Printf("PID %d: Descriptor Data stream alignment: %d\n", es.ElementaryPID, a.Type)
-		case astits.DescriptorTagRegistration:
-			r := d.Registration
-			switch r.FormatIdentifier {
-			case ANC_REGISTERED_IDENTIFIER:
-				streamInfo.Codec = "SMPTE-2038"
-				streamInfo.Type = "ANC"
-			}
-		case ANC_DESCRIPTOR_TAG:
-			if streamInfo.Type != "ANC" {
-				log.Printf("PID %d: bad combination of descriptor 0xc4 and no preceding ANC", es.ElementaryPID)
-				continue
-			}
-			u := d.UserDefined
-			log.Printf("PID %d: Got ancillary descriptor with data: %q\n", es.ElementaryPID, hex.EncodeToString(u))
-		default:
-			// Nothing
+	if err := RemoveFileIfExists(output); err != nil {
+		return nil, nil, nil, err
+	}
+	file, err := OpenFileAndAppend(output)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bw := bufio.NewWriter(file)
+	closeOutput = func() error {
+		err := bw.Flush()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
 		}
+		return err
 	}
-
-	return streamInfo
+	return w, bw, closeOutput, nil
 }
 
-func ParseElementaryStreamInfo(es psi.PmtElementaryStream) *ElementaryStreamInfo {
-	pid := uint16(es.ElementaryPid())
-	var streamInfo *ElementaryStreamInfo
-	switch es.StreamType() {
-	case psi.PmtStreamTypeMpeg4VideoH264:
-		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "AVC", Type: "video"}
-	case psi.PmtStreamTypeAac:
-		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "AAC", Type: "audio"}
-	case psi.PmtStreamTypeMpeg4VideoH265:
-		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "HEVC", Type: "video"}
-	case psi.PmtStreamTypeScte35:
-		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "SCTE35", Type: "cue"}
+func ParsePidsFromString(input string) []int {
+	words := strings.Fields(input)
+	var pids []int
+	for _, word := range words {
+		number, err := strconv.Atoi(word)
+		if err != nil {
+			continue
+		}
+		pids = append(pids, number)
 	}
-
-	return streamInfo
+	return pids
 }
 
-func ParsePacketToPAT(pkt *packet.Packet) (pat psi.PAT, e error) {
-	if packet.IsPat(pkt) {
-		pay, err := packet.Payload(pkt)
+// ParseStreamSelectors parses space-separated stream selectors such as "video audio:eng 500".
+func ParseStreamSelectors(input string) ([]tsanalyzer.StreamSelector, error) {
+	var selectors []tsanalyzer.StreamSelector
+	for _, word := range strings.Fields(input) {
+		sel, err := tsanalyzer.ParseStreamSelector(word)
 		if err != nil {
 			return nil, err
 		}
+		selectors = append(selectors, sel)
+	}
+	return selectors, nil
+}
 
-		pat, err = psi.NewPAT(pay)
+// ParseNumberMap parses space-separated pairs of numbers such as "256:4096 257:4097".
+func ParseNumberMap(input string) (map[int]int, error) {
+	m := make(map[int]int)
+	for _, word := range strings.Fields(input) {
+		from, to, ok := strings.Cut(word, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not on the form from:to", word)
+		}
+		f, err := strconv.Atoi(from)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%q is not on the form from:to", word)
 		}
-
-		return pat, nil
+		t, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not on the form from:to", word)
+		}
+		if _, ok := m[f]; ok {
+			return nil, fmt.Errorf("%d is mapped twice", f)
+		}
+		m[f] = t
 	}
-
-	return nil, fmt.Errorf("unable to parse packet to PAT")
-}
-
-// Check if two sets contain same elements
-func IsTwoSlicesOverlapping(s1 []int, s2 []int) bool {
-	intersection := GetIntersectionOfTwoSlices(s1, s2)
-	return len(intersection) != 0
+	return m, nil
 }
 
-// Return a set that contains those elements of s1 that are also in s2
-func GetIntersectionOfTwoSlices(s1 []int, s2 []int) []int {
-	intersection := []int{}
-	for _, e := range s1 {
-		if slices.Contains(s2, e) {
-			intersection = append(intersection, e)
-		}
+// ReadSCTE35Events reads a list of SCTE-35 events from a JSON or YAML file.
+// The field names are the same as in the JSON output of SCTE35Info.
+func ReadSCTE35Events(file string) ([]tsanalyzer.SCTE35Event, error) {
+	var events []tsanalyzer.SCTE35Event
+	if err := readYAML(file, &events); err != nil {
+		return nil, err
 	}
-
-	return intersection
+	return events, nil
 }
 
-// Return a set that contains those elements of s1 that are NOT in s2
-func GetDifferenceOfTwoSlices(s1 []int, s2 []int) []int {
-	difference := []int{}
-	for _, e := range s1 {
-		if !slices.Contains(s2, e) {
-			difference = append(difference, e)
-		}
+// ReadTimeJumps reads a timeshift schedule, a list of time jumps, from a JSON
+// or YAML file. The field names are the JSON names of TimeJump.
+func ReadTimeJumps(file string) ([]tsanalyzer.TimeJump, error) {
+	var jumps []tsanalyzer.TimeJump
+	if err := readYAML(file, &jumps); err != nil {
+		return nil, err
 	}
-
-	return difference
+	return jumps, nil
 }
 
-func ParsePidsFromString(input string) []int {
-	words := strings.Fields(input)
-	var pids []int
-	for _, word := range words {
-		number, err := strconv.Atoi(word)
-		if err != nil {
-			continue
-		}
-		pids = append(pids, number)
+// readYAML reads a JSON or YAML file into v using the json field names.
+func readYAML(file string, v any) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
 	}
-	return pids
+	// JSON is valid YAML, and going via JSON gives the json field names
+	var y any
+	if err := yaml.Unmarshal(data, &y); err != nil {
+		return fmt.Errorf("parsing %s: %w", file, err)
+	}
+	jsonData, err := json.Marshal(y)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if err := json.Unmarshal(jsonData, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return nil
 }
 
 func ParseParams(function OptionParseFunc) (o Options, inFile string) {
@@ -0,0 +1,94 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/aac"
+	"github.com/asticode/go-astits"
+)
+
+// aacSamplesPerFrame is the number of samples in an AAC frame (raw data block)
+const aacSamplesPerFrame = 1024
+
+// AacFrameData is the ADTS frames of an AAC PES packet.
+// Profile, sample rate and channel configuration are taken from the first frame.
+type AacFrameData struct {
+	PID           uint16 `json:"pid"`
+	PTS           int64  `json:"pts"`
+	NrFrames      int    `json:"nrFrames"`
+	Profile       string `json:"profile"`
+	SampleRate    int    `json:"sampleRate"`
+	ChannelConfig int    `json:"channelConfig"`
+	FrameLengths  []int  `json:"frameLengths"`
+}
+
+// AacStream is the state of an AAC stream between PES packets.
+type AacStream struct {
+	sampleRate int
+	Statistics StreamStatistics
+}
+
+// adtsProfiles is the names of the 2-bit ADTS profiles (audio object type - 1).
+var adtsProfiles = []string{"Main", "LC", "SSR", "LTP"}
+
+// ParseAACPES parses the ADTS frames of an AAC PES packet and reports them to h.
+// The returned AacStream should be passed to the next call for the same PID.
+func ParseAACPES(d *astits.DemuxerData, as *AacStream, h Handler, o Options) (*AacStream, error) {
+	pid := d.PID
+	pes := d.PES
+	if pes.Header.OptionalHeader == nil || pes.Header.OptionalHeader.PTS == nil {
+		return nil, fmt.Errorf("no PTS in PES")
+	}
+	if as == nil {
+		as = &AacStream{}
+	}
+	pts := pes.Header.OptionalHeader.PTS.Base
+	as.Statistics.Type = "AAC"
+	as.Statistics.Pid = pid
+	afd := AacFrameData{PID: pid, PTS: pts}
+
+	data := pes.Data
+	pos := 0
+	for pos < len(data) {
+		hdr, offset, err := aac.DecodeADTSHeader(bytes.NewReader(data[pos:]))
+		if err != nil {
+			if afd.NrFrames == 0 {
+				return nil, fmt.Errorf("PID %d: no ADTS frame in PES: %w", pid, err)
+			}
+			as.Statistics.Errors = appendOnce(as.Statistics.Errors, "bad ADTS data after frames")
+			break
+		}
+		if afd.NrFrames == 0 {
+			if int(hdr.ObjectType) <= len(adtsProfiles) {
+				afd.Profile = adtsProfiles[hdr.ObjectType-1]
+			}
+			afd.SampleRate = int(hdr.Frequency())
+			afd.ChannelConfig = int(hdr.ChannelConfig)
+			if afd.SampleRate > 0 {
+				as.sampleRate = afd.SampleRate
+			}
+		}
+		frameLength := int(hdr.HeaderLength) + int(hdr.PayloadLength)
+		afd.FrameLengths = append(afd.FrameLengths, frameLength)
+		if as.sampleRate > 0 {
+			// Timestamp of each frame, since the PES PTS applies to the first
+			frameTS := AddPTS(pts, int64(afd.NrFrames)*aacSamplesPerFrame*TimeScale/int64(as.sampleRate))
+			as.Statistics.AddTimestamp(frameTS)
+		}
+		afd.NrFrames++
+		pos += offset + frameLength
+	}
+
+	return as, emit(h, afd)
+}
+
+// appendOnce appends msg to msgs unless it is already there.
+func appendOnce(msgs []string, msg string) []string {
+	for _, m := range msgs {
+		if m == msg {
+			return msgs
+		}
+	}
+	return append(msgs, msg)
+}
@@ -0,0 +1,46 @@
+package tsanalyzer
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAAC(t *testing.T) {
+	f, err := os.Open("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	var frames []AacFrameData
+	var stats []StreamStatistics
+	h := HandlerFunc(func(ev Event) error {
+		switch e := ev.(type) {
+		case AacFrameData:
+			frames = append(frames, e)
+		case StreamStatistics:
+			stats = append(stats, e)
+		}
+		return nil
+	})
+	err = ParseAll(context.TODO(), f, h, Options{Audio: true})
+	require.NoError(t, err)
+	require.Len(t, frames, 5)
+	require.Equal(t, AacFrameData{PID: 257, PTS: 129320, NrFrames: 8, Profile: "LC", SampleRate: 44100, ChannelConfig: 2,
+		FrameLengths: []int{285, 286, 285, 286, 286, 436, 422, 410}}, frames[0])
+	require.Len(t, stats, 2)
+	require.Equal(t, "AAC", stats[1].Type)
+	require.InDelta(t, 44100.0/1024, stats[1].FrameRate, 0.01)
+	require.Empty(t, stats[1].Errors)
+}
+
+func TestAudioGaps(t *testing.T) {
+	s := StreamStatistics{Type: "AAC"}
+	for _, ts := range []int64{0, 1920, 3840, 7680, 9600} {
+		s.AddTimestamp(ts)
+	}
+	s.Calculate(TimeScale)
+	require.Equal(t, 1, s.Gaps)
+	require.Equal(t, []string{"irregular PTS/DTS steps", "1 gaps in timestamps"}, s.Errors)
+}
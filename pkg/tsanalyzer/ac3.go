@@ -0,0 +1,180 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/bits"
+	"github.com/asticode/go-astits"
+)
+
+// ac3SyncWord starts every AC-3 and E-AC-3 syncframe
+const ac3SyncWord = 0x0b77
+
+// ac3Bitrates is the nominal bitrates in kbit/s indexed by frmsizecod/2.
+var ac3Bitrates = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+
+var ac3SampleRates = []int{48000, 44100, 32000}
+
+// eac3ReducedSampleRates is the sample rates for fscod2 when fscod is 3.
+var eac3ReducedSampleRates = []int{24000, 22050, 16000}
+
+// Ac3Frame is the header information of an AC-3 or E-AC-3 syncframe.
+// Dialnorm is the dialogue level in -dB (1-31, 0 means -31 dB).
+// PTS is calculated from the PES PTS and the samples of the preceding frames.
+type Ac3Frame struct {
+	PTS        int64 `json:"pts"`
+	Bsid       int   `json:"bsid"`
+	Acmod      int   `json:"acmod"`
+	LFE        bool  `json:"lfe"`
+	SampleRate int   `json:"sampleRate"`
+	Bitrate    int   `json:"bitrate"`
+	Dialnorm   int   `json:"dialnorm"`
+	Length     int   `json:"length"`
+	Samples    int   `json:"-"`
+	dependent  bool  // E-AC-3 dependent substream of the preceding frame
+}
+
+// Ac3FrameData is the syncframes of an AC-3 or E-AC-3 PES packet.
+type Ac3FrameData struct {
+	PID    uint16     `json:"pid"`
+	Codec  string     `json:"codec"`
+	PTS    int64      `json:"pts"`
+	Frames []Ac3Frame `json:"frames"`
+}
+
+// Ac3Stream is the state of an AC-3 or E-AC-3 stream between PES packets.
+type Ac3Stream struct {
+	Statistics StreamStatistics
+}
+
+// ParseAC3Frame parses the syncframe header at the start of data.
+// The bitstream is E-AC-3 if bsid is larger than 10.
+func ParseAC3Frame(data []byte) (Ac3Frame, error) {
+	var f Ac3Frame
+	if len(data) < 8 {
+		return f, fmt.Errorf("too short for syncframe header")
+	}
+	if int(data[0])<<8|int(data[1]) != ac3SyncWord {
+		return f, fmt.Errorf("no syncword")
+	}
+	f.Bsid = int(data[5] >> 3)
+	switch {
+	case f.Bsid <= 8:
+		return parseAC3Header(data, f)
+	case f.Bsid > 10 && f.Bsid <= 16:
+		return parseEAC3Header(data, f)
+	default:
+		return f, fmt.Errorf("unsupported bsid %d", f.Bsid)
+	}
+}
+
+func parseAC3Header(data []byte, f Ac3Frame) (Ac3Frame, error) {
+	fscod := int(data[4] >> 6)
+	frmsizecod := int(data[4] & 0x3f)
+	if fscod == 3 || frmsizecod/2 >= len(ac3Bitrates) {
+		return f, fmt.Errorf("bad fscod %d or frmsizecod %d", fscod, frmsizecod)
+	}
+	f.SampleRate = ac3SampleRates[fscod]
+	kbps := ac3Bitrates[frmsizecod/2]
+	f.Bitrate = kbps * 1000
+	f.Samples = 1536
+	// The frame size is 1536 samples at the nominal bitrate, rounded down to
+	// 16-bit words at 44.1 kHz where odd frmsizecod adds a word
+	words := kbps * 1000 * f.Samples / (16 * f.SampleRate)
+	if fscod == 1 {
+		words += frmsizecod & 1
+	}
+	f.Length = 2 * words
+
+	br := bits.NewReader(bytes.NewReader(data[5:]))
+	_ = br.Read(5) // bsid
+	_ = br.Read(3) // bsmod
+	f.Acmod = int(br.Read(3))
+	if f.Acmod&1 != 0 && f.Acmod != 1 {
+		_ = br.Read(2) // cmixlev
+	}
+	if f.Acmod&4 != 0 {
+		_ = br.Read(2) // surmixlev
+	}
+	if f.Acmod == 2 {
+		_ = br.Read(2) // dsurmod
+	}
+	f.LFE = br.ReadFlag()
+	f.Dialnorm = int(br.Read(5))
+	return f, br.AccError()
+}
+
+func parseEAC3Header(data []byte, f Ac3Frame) (Ac3Frame, error) {
+	br := bits.NewReader(bytes.NewReader(data[2:]))
+	f.dependent = br.Read(2) == 1 // strmtyp
+	_ = br.Read(3)                // substreamid
+	f.Length = 2 * (int(br.Read(11)) + 1)
+	fscod := br.Read(2)
+	blocks := 6
+	if fscod == 3 {
+		fscod2 := br.Read(2)
+		if fscod2 == 3 {
+			return f, fmt.Errorf("bad fscod2")
+		}
+		f.SampleRate = eac3ReducedSampleRates[fscod2]
+	} else {
+		blocks = []int{1, 2, 3, 6}[br.Read(2)]
+		f.SampleRate = ac3SampleRates[fscod]
+	}
+	f.Samples = 256 * blocks
+	f.Acmod = int(br.Read(3))
+	f.LFE = br.ReadFlag()
+	_ = br.Read(5) // bsid
+	f.Dialnorm = int(br.Read(5))
+	f.Bitrate = f.Length * 8 * f.SampleRate / f.Samples
+	return f, br.AccError()
+}
+
+// ParseAC3PES parses the syncframes of an AC-3 or E-AC-3 PES packet and reports them to h.
+// The returned Ac3Stream should be passed to the next call for the same PID.
+func ParseAC3PES(d *astits.DemuxerData, codec string, as *Ac3Stream, h Handler, o Options) (*Ac3Stream, error) {
+	pid := d.PID
+	pes := d.PES
+	if pes.Header.OptionalHeader == nil || pes.Header.OptionalHeader.PTS == nil {
+		return nil, fmt.Errorf("no PTS in PES")
+	}
+	if as == nil {
+		as = &Ac3Stream{}
+	}
+	pts := pes.Header.OptionalHeader.PTS.Base
+	as.Statistics.Type = codec
+	as.Statistics.Pid = pid
+	afd := Ac3FrameData{PID: pid, Codec: codec, PTS: pts}
+
+	data := pes.Data
+	pos := 0
+	samples := 0
+	for pos+1 < len(data) {
+		if int(data[pos])<<8|int(data[pos+1]) != ac3SyncWord {
+			pos++
+			continue
+		}
+		frame, err := ParseAC3Frame(data[pos:])
+		if err != nil || frame.Length == 0 {
+			as.Statistics.Errors = appendOnce(as.Statistics.Errors, "bad syncframe header")
+			pos++
+			continue
+		}
+		if frame.dependent && len(afd.Frames) > 0 {
+			// Same time as the independent frame it extends
+			frame.PTS = afd.Frames[len(afd.Frames)-1].PTS
+		} else {
+			frame.PTS = AddPTS(pts, int64(samples)*TimeScale/int64(frame.SampleRate))
+			as.Statistics.AddTimestamp(frame.PTS)
+			samples += frame.Samples
+		}
+		afd.Frames = append(afd.Frames, frame)
+		pos += frame.Length
+	}
+	if len(afd.Frames) == 0 {
+		return nil, fmt.Errorf("PID %d: no syncframe in PES", pid)
+	}
+
+	return as, emit(h, afd)
+}
@@ -0,0 +1,84 @@
+package tsanalyzer
+
+import (
+	"testing"
+
+	"github.com/asticode/go-astits"
+	"github.com/stretchr/testify/require"
+)
+
+// syncframe returns a frame of length bytes starting with header.
+func syncframe(header []byte, length int) []byte {
+	frame := make([]byte, length)
+	copy(frame, header)
+	return frame
+}
+
+func TestParseAC3Frame(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   []byte
+		expected Ac3Frame
+	}{
+		{"ac3 stereo", []byte{0x0b, 0x77, 0x00, 0x00, 0x14, 0x40, 0x43, 0x60},
+			Ac3Frame{Bsid: 8, Acmod: 2, SampleRate: 48000, Bitrate: 192000, Dialnorm: 27, Length: 768, Samples: 1536}},
+		{"ac3 5.1", []byte{0x0b, 0x77, 0x00, 0x00, 0x14, 0x40, 0xe1, 0xf8},
+			Ac3Frame{Bsid: 8, Acmod: 7, LFE: true, SampleRate: 48000, Bitrate: 192000, Dialnorm: 31, Length: 768, Samples: 1536}},
+		{"ac3 44.1kHz odd frmsizecod", []byte{0x0b, 0x77, 0x00, 0x00, 0x41, 0x40, 0x43, 0x60},
+			Ac3Frame{Bsid: 8, Acmod: 2, SampleRate: 44100, Bitrate: 32000, Dialnorm: 27, Length: 140, Samples: 1536}},
+		{"eac3 5.1", []byte{0x0b, 0x77, 0x01, 0x7f, 0x3f, 0x86, 0x00, 0x00},
+			Ac3Frame{Bsid: 16, Acmod: 7, LFE: true, SampleRate: 48000, Bitrate: 192000, Dialnorm: 24, Length: 768, Samples: 1536}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := ParseAC3Frame(c.header)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, f)
+		})
+	}
+
+	_, err := ParseAC3Frame([]byte{0x0b, 0x78, 0x00, 0x00, 0x14, 0x40, 0x43, 0x60})
+	require.Error(t, err)
+}
+
+func TestParseAC3PES(t *testing.T) {
+	header := []byte{0x0b, 0x77, 0x00, 0x00, 0x14, 0x40, 0x43, 0x60}
+	data := append(syncframe(header, 768), syncframe(header, 768)...)
+	d := &astits.DemuxerData{
+		PID: 258,
+		PES: &astits.PESData{
+			Data:   data,
+			Header: &astits.PESHeader{OptionalHeader: &astits.PESOptionalHeader{PTS: &astits.ClockReference{Base: 90000}}},
+		},
+	}
+	var frameData []Ac3FrameData
+	h := HandlerFunc(func(ev Event) error {
+		if e, ok := ev.(Ac3FrameData); ok {
+			frameData = append(frameData, e)
+		}
+		return nil
+	})
+	as, err := ParseAC3PES(d, "AC-3", nil, h, Options{})
+	require.NoError(t, err)
+	require.Len(t, frameData, 1)
+	require.Len(t, frameData[0].Frames, 2)
+	require.Equal(t, int64(90000+2880), frameData[0].Frames[1].PTS)
+
+	d.PES.Header.OptionalHeader.PTS.Base = 90000 + 2*2880
+	as, err = ParseAC3PES(d, "AC-3", as, h, Options{})
+	require.NoError(t, err)
+	as.Statistics.Calculate(TimeScale)
+	require.Equal(t, 31.25, as.Statistics.FrameRate)
+	require.Empty(t, as.Statistics.Errors)
+}
+
+func TestAC3StreamInfo(t *testing.T) {
+	es := &astits.PMTElementaryStream{
+		ElementaryPID:               258,
+		StreamType:                  astits.StreamTypePrivateData,
+		ElementaryStreamDescriptors: []*astits.Descriptor{{Tag: astits.DescriptorTagEnhancedAC3}},
+	}
+	require.Equal(t, &ElementaryStreamInfo{PID: 258, Codec: "E-AC-3", Type: "audio"}, ParseAstitsElementaryStreamInfo(es))
+	es = &astits.PMTElementaryStream{ElementaryPID: 259, StreamType: astits.StreamTypeAC3Audio}
+	require.Equal(t, &ElementaryStreamInfo{PID: 259, Codec: "AC-3", Type: "audio"}, ParseAstitsElementaryStreamInfo(es))
+}
@@ -1,4 +1,4 @@
-package internal
+package tsanalyzer
 
 import (
 	"encoding/hex"
@@ -63,7 +63,9 @@ func (a *AvcPS) setPPS(nalu []byte) error {
 	return nil
 }
 
-func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (*AvcPS, error) {
+// ParseAVCPES parses an AVC PES packet and reports parameter sets and NAL units to h.
+// The returned AvcPS should be passed to the next call for the same PID.
+func ParseAVCPES(d *astits.DemuxerData, ps *AvcPS, h Handler, o Options) (*AvcPS, error) {
 	pid := d.PID
 	pes := d.PES
 	fp := d.FirstPacket
@@ -85,7 +87,7 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 	if fp != nil && fp.AdaptationField != nil {
 		nfd.RAI = fp.AdaptationField.RandomAccessIndicator
 		if nfd.RAI {
-			ps.Statistics.RAIPTS = append(ps.Statistics.IDRPTS, pts.Base)
+			ps.Statistics.AddRAI(pts.Base)
 		}
 	}
 
@@ -96,7 +98,7 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 		// Use PTS as DTS in statistics if DTS is not present
 		nfd.DTS = pts.Base
 	}
-	ps.Statistics.TimeStamps = append(ps.Statistics.TimeStamps, nfd.DTS)
+	ps.Statistics.AddTimestamp(nfd.DTS)
 
 	data := pes.Data
 	nalus := avc.ExtractNalusFromByteStream(data)
@@ -131,7 +133,7 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 				t := sei.SEIType(msg.Type())
 				if t == sei.SEIPicTimingType {
 					pt := msg.(*sei.PicTimingAvcSEI)
-					if o.ShowSEIDetails && sps != nil {
+					if o.SEIDetails && sps != nil {
 						parts = append(parts, SeiOut{
 							Msg:     t.String(),
 							Payload: picTimingAvcToOut(pt),
@@ -140,7 +142,7 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 						parts = append(parts, SeiOut{Msg: t.String()})
 					}
 				} else {
-					if o.ShowSEIDetails {
+					if o.SEIDetails {
 						parts = append(parts, SeiOut{Msg: t.String(), Payload: msg})
 					} else {
 						parts = append(parts, SeiOut{Msg: t.String()})
@@ -150,7 +152,7 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 			data = parts
 		case avc.NALU_IDR, avc.NALU_NON_IDR:
 			if naluType == avc.NALU_IDR {
-				ps.Statistics.IDRPTS = append(ps.Statistics.IDRPTS, pts.Base)
+				ps.Statistics.AddIDR(pts.Base)
 			}
 			sliceType, err := avc.GetSliceTypeFromNALU(nalu)
 			if err == nil {
@@ -164,7 +166,7 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 		})
 	}
 
-	if jp == nil {
+	if h == nil {
 		return ps, nil
 	}
 	if firstPS {
@@ -172,25 +174,28 @@ func ParseAVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *AvcPS, o Options) (
 		if spsHex != ps.lastSPSHex {
 			ps.lastSPSHex = spsHex
 			for nr := range ps.spss {
-				jp.PrintPS(pid, "SPS", nr, ps.spsnalu, ps.spss[nr], o.VerbosePSInfo, o.ShowPS)
+				if err := emit(h, NewPsInfo(pid, "SPS", nr, ps.spsnalu, ps.spss[nr], o.PSDetails)); err != nil {
+					return nil, err
+				}
 			}
 		}
 		for nr := range ps.ppss {
 			ppsHex := hex.EncodeToString(ps.ppsnalus[nr])
 			if ppsHex != ps.lastPPSHex[nr] {
 				ps.lastPPSHex[nr] = ppsHex
-				jp.PrintPS(pid, "PPS", nr, ps.ppsnalus[nr], ps.ppss[nr], o.VerbosePSInfo, o.ShowPS)
+				if err := emit(h, NewPsInfo(pid, "PPS", nr, ps.ppsnalus[nr], ps.ppss[nr], o.PSDetails)); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 
-	// Skip printing if WaitForPS is enabled and we don't have parameter sets yet
+	// Skip reporting if WaitForPS is enabled and we don't have parameter sets yet
 	if o.WaitForPS && !ps.hasPS() {
 		return ps, nil
 	}
 
-	jp.Print(nfd, o.ShowNALU)
-	return ps, jp.Error()
+	return ps, emit(h, nfd)
 }
 
 // picTimingAvcToOut converts a PicTimingAvcSEI to a richer output struct
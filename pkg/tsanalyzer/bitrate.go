@@ -0,0 +1,241 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+	"github.com/Comcast/gots/v2/psi"
+)
+
+// DefaultBitrateWindow is the default duration of the windows for min/max bitrates
+const DefaultBitrateWindow = time.Second
+
+// PidBitrate is the packet count and bitrates of one PID.
+// Bitrates are in bits per second.
+type PidBitrate struct {
+	PID        uint16 `json:"pid"`
+	Type       string `json:"type,omitempty"`
+	Packets    int64  `json:"packets"`
+	MinBitrate int64  `json:"minBitrate"`
+	AvgBitrate int64  `json:"avgBitrate"`
+	MaxBitrate int64  `json:"maxBitrate"`
+}
+
+// BitrateInfo is the packet counts and PCR-based bitrates of a TS.
+// Min and max bitrates are calculated over sliding windows of WindowMs
+// milliseconds that end at each PCR, and the average bitrates over the time
+// between the first and last PCR.
+type BitrateInfo struct {
+	Packets     int64        `json:"packets"`
+	Duration    float64      `json:"duration"`
+	WindowMs    int64        `json:"windowMs"`
+	MuxRate     int64        `json:"muxRate"`
+	NullPackets int64        `json:"nullPackets"`
+	NullShare   float64      `json:"nullShare"`
+	PIDs        []PidBitrate `json:"pids"`
+}
+
+func (BitrateInfo) isEvent() {}
+
+// pidCounter counts the packets of a PID.
+type pidCounter struct {
+	total    int64 // all packets
+	pending  int64 // packets since latest PCR
+	timed    int64 // packets between first and latest PCR
+	min, max int64 // bitrates of windows
+	windows  int   // number of windows
+}
+
+// pcr moves the packets since the previous PCR to the timed packets.
+func (c *pidCounter) pcr() {
+	c.timed += c.pending
+	c.pending = 0
+}
+
+// addWindow adds the bitrate of a window with packets in ticks to min and max.
+func (c *pidCounter) addWindow(packets, ticks int64) {
+	rate := bitrate(packets, ticks)
+	if c.windows == 0 || rate < c.min {
+		c.min = rate
+	}
+	if c.windows == 0 || rate > c.max {
+		c.max = rate
+	}
+	c.windows++
+}
+
+// windowStart is the number of timed packets per PID at a PCR.
+type windowStart struct {
+	ticks int64
+	timed map[int]int64
+}
+
+// bitrate returns the bitrate in bits per second of packets sent in ticks.
+// It is calculated with floats, since the number of bits times PcrTimeScale
+// overflows int64 after a few hours.
+func bitrate(packets, ticks int64) int64 {
+	return int64(float64(packets) * PacketSize * 8 * PcrTimeScale / float64(ticks))
+}
+
+// ParseBitrates counts the packets of all PIDs in the TS and calculates
+// bitrates based on the PCRs of the first PCR PID. Stream information from the
+// first PMT of every program is reported when found, and a BitrateInfo at the end.
+func ParseBitrates(ctx context.Context, f io.Reader, h Handler, o Options) error {
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	_, err := packet.Sync(rd)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+
+	window := o.BitrateWindow
+	if window == 0 {
+		window = DefaultBitrateWindow
+	}
+	windowTicks := durationToTicks(window)
+	clock := newPCRClock()
+	counters := make(map[int]*pidCounter)
+	types := map[int]string{0: "PAT", sdtPID: "SDT", NullPID: "null"}
+	sections := make(map[int]*sectionAssembler)
+	pmtPIDs := make(map[int]bool)
+	programsFound := make(map[int]bool)
+	var starts []windowStart // PCRs that can start the next windows
+	nr := int64(0)
+	var pkt packet.Packet
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		if _, err := io.ReadFull(rd, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break dataLoop
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		pid := packet.Pid(&pkt)
+
+		if packet.ContainsAdaptationField(&pkt) && adaptationfield.Length(&pkt) > 0 && adaptationfield.HasPCR(&pkt) {
+			if pcrBytes, err := adaptationfield.PCR(&pkt); err == nil {
+				if clock.update(pid, int64(gots.ExtractPCR(pcrBytes)), nr) {
+					start := windowStart{ticks: clock.ticks(nr), timed: make(map[int]int64, len(counters))}
+					for pid, c := range counters {
+						c.pcr()
+						start.timed[pid] = c.timed
+					}
+					starts = append(starts, start)
+					// The window ends at this PCR and starts at the latest PCR
+					// that is at least a window earlier
+					for len(starts) > 1 && start.ticks-starts[1].ticks >= windowTicks {
+						starts = starts[1:]
+					}
+					if ticks := start.ticks - starts[0].ticks; ticks >= windowTicks {
+						for pid, c := range counters {
+							c.addWindow(c.timed-starts[0].timed[pid], ticks)
+						}
+					}
+				}
+			}
+		}
+
+		c := counters[pid]
+		if c == nil {
+			c = &pidCounter{}
+			counters[pid] = c
+		}
+		c.total++
+		if clock.valid() {
+			c.pending++
+		}
+
+		if pid == 0 || pmtPIDs[pid] {
+			payload, err := packet.Payload(&pkt)
+			if err != nil {
+				nr++
+				continue
+			}
+			a := sections[pid]
+			if a == nil {
+				a = &sectionAssembler{}
+				sections[pid] = a
+			}
+			for _, section := range a.write(packet.PayloadUnitStartIndicator(&pkt), payload) {
+				switch {
+				case pid == 0 && section[0] == 0x00:
+					for _, pmtPID := range patPrograms(section) {
+						pmtPIDs[pmtPID] = true
+						types[pmtPID] = "PMT"
+					}
+				case pid != 0 && section[0] == 0x02:
+					p, ok := parsePMTSection(section)
+					if !ok || programsFound[p.programNr] {
+						continue
+					}
+					pmt, err := psi.NewPMT(append([]byte{0}, section...))
+					if err != nil {
+						continue
+					}
+					for _, es := range pmt.ElementaryStreams() {
+						streamInfo := ParseElementaryStreamInfo(es)
+						if streamInfo == nil {
+							continue
+						}
+						streamInfo.ProgramNumber = uint16(p.programNr)
+						types[es.ElementaryPid()] = streamInfo.Codec
+						if err := emit(h, *streamInfo); err != nil {
+							return err
+						}
+					}
+					programsFound[p.programNr] = true
+				}
+			}
+		}
+		nr++
+	}
+
+	info := BitrateInfo{
+		Packets:  nr,
+		Duration: float64(clock.lastTicks) / PcrTimeScale,
+		WindowMs: window.Milliseconds(),
+		PIDs:     make([]PidBitrate, 0, len(counters)),
+	}
+	pids := make([]int, 0, len(counters))
+	for pid := range counters {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	timedPackets := int64(0)
+	for _, pid := range pids {
+		c := counters[pid]
+		// The whole stream is used for min and max if it is shorter than a window
+		if c.windows == 0 && clock.lastTicks > 0 {
+			c.addWindow(c.timed, clock.lastTicks)
+		}
+		pb := PidBitrate{PID: uint16(pid), Type: types[pid], Packets: c.total, MinBitrate: c.min, MaxBitrate: c.max}
+		if clock.lastTicks > 0 {
+			pb.AvgBitrate = bitrate(c.timed, clock.lastTicks)
+		}
+		timedPackets += c.timed
+		info.PIDs = append(info.PIDs, pb)
+	}
+	if clock.lastTicks > 0 {
+		info.MuxRate = bitrate(timedPackets, clock.lastTicks)
+	}
+	if c := counters[NullPID]; c != nil {
+		info.NullPackets = c.total
+	}
+	if nr > 0 {
+		info.NullShare = float64(info.NullPackets) / float64(nr)
+	}
+
+	return emit(h, info)
+}
@@ -0,0 +1,125 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBitrates(t *testing.T) {
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+
+	var info BitrateInfo
+	var streams []ElementaryStreamInfo
+	h := HandlerFunc(func(ev Event) error {
+		switch e := ev.(type) {
+		case BitrateInfo:
+			info = e
+		case ElementaryStreamInfo:
+			streams = append(streams, e)
+		}
+		return nil
+	})
+	err = ParseBitrates(context.TODO(), bytes.NewReader(data), h, Options{BitrateWindow: 200 * time.Millisecond})
+	require.NoError(t, err)
+	require.Len(t, streams, 2)
+
+	require.Equal(t, int64(len(data)/PacketSize), info.Packets)
+	require.Equal(t, int64(200), info.WindowMs)
+	require.Equal(t, int64(0), info.NullPackets)
+	total := int64(0)
+	sum := int64(0)
+	for _, p := range info.PIDs {
+		total += p.Packets
+		sum += p.AvgBitrate
+		require.LessOrEqual(t, p.MinBitrate, p.AvgBitrate)
+		require.GreaterOrEqual(t, p.MaxBitrate, p.AvgBitrate)
+	}
+	require.Equal(t, info.Packets, total)
+	require.InDelta(t, info.MuxRate, sum, float64(len(info.PIDs)))
+	require.Equal(t, "AVC", info.PIDs[2].Type)
+	require.Equal(t, uint16(256), info.PIDs[2].PID)
+}
+
+func TestBitratesMPTS(t *testing.T) {
+	pat := []byte{0x00, 0xb0, 17, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0x00, 0x01, 0xf0, 0x00, 0x00, 0x02, 0xf0, 0x01}
+	pat = append(pat, gots.ComputeCRC(pat)...)
+	sections := []struct {
+		pid     int
+		section []byte
+	}{
+		{0, pat},
+		{4096, newPMTSection(1, 256, []pmtStream{{streamType: 0x1b, pid: 256}})},
+		{4097, newPMTSection(2, 258, []pmtStream{{streamType: 0x0f, pid: 258}})},
+	}
+	var data []byte
+	for i := 0; i < 2; i++ {
+		for _, s := range sections {
+			cc := uint8(i)
+			for _, p := range sectionPackets(s.pid, s.section, &cc) {
+				data = append(data, p[:]...)
+			}
+		}
+	}
+	for _, pid := range []int{256, 258} {
+		var p packet.Packet
+		p[0], p[1], p[2], p[3] = SyncByte, byte(pid>>8), byte(pid), 0x10
+		data = append(data, p[:]...)
+	}
+	events := collectEvents(t, func(h Handler) error {
+		return ParseBitrates(context.TODO(), bytes.NewReader(data), h, Options{})
+	})
+	require.Equal(t, []ElementaryStreamInfo{
+		{PID: 256, Codec: "AVC", Type: "video", ProgramNumber: 1},
+		{PID: 258, Codec: "AAC", Type: "audio", ProgramNumber: 2},
+	}, eventsOf[ElementaryStreamInfo](events))
+	types := make(map[uint16]string)
+	for _, p := range lastEventOf[BitrateInfo](events).PIDs {
+		types[p.PID] = p.Type
+	}
+	require.Equal(t, map[uint16]string{0: "PAT", 256: "AVC", 258: "AAC", 4096: "PMT", 4097: "PMT"}, types)
+}
+
+func TestSlidingBitrateWindows(t *testing.T) {
+	// PCRs every 100ms for 3s, and a burst of 10 packets per 100ms on PID 300 from 0.5s to 1.5s
+	var data []byte
+	for i := 0; i <= 30; i++ {
+		var p packet.Packet
+		p[0], p[1], p[2], p[3], p[4], p[5] = SyncByte, 0x01, 0x00, 0x20, PacketSize-5, 0x10
+		gots.InsertPCR(p[6:12], uint64(i*PcrTimeScale/10))
+		data = append(data, p[:]...)
+		if i >= 5 && i < 15 {
+			for j := 0; j < 10; j++ {
+				var q packet.Packet
+				q[0], q[1], q[2], q[3] = SyncByte, 0x01, 0x2c, 0x10|byte(j)
+				data = append(data, q[:]...)
+			}
+		}
+	}
+	events := collectEvents(t, func(h Handler) error {
+		return ParseBitrates(context.TODO(), bytes.NewReader(data), h, Options{})
+	})
+	info := lastEventOf[BitrateInfo](events)
+	require.Len(t, info.PIDs, 2)
+	burst := info.PIDs[1]
+	require.Equal(t, uint16(300), burst.PID)
+	// The window from 0.5s to 1.5s has all 100 packets
+	require.Equal(t, int64(100*PacketSize*8), burst.MaxBitrate)
+	require.Equal(t, int64(0), burst.MinBitrate)
+	require.Equal(t, int64(100*PacketSize*8/3), burst.AvgBitrate)
+}
+
+func TestBitrateOverflow(t *testing.T) {
+	// 10 hours at 20 Mbit/s
+	ticks := int64(10 * 3600 * PcrTimeScale)
+	packets := int64(20_000_000) * 10 * 3600 / (PacketSize * 8)
+	require.InDelta(t, 20_000_000, bitrate(packets, ticks), 1000)
+}
@@ -0,0 +1,213 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+)
+
+// CBRInfo is reported by RestampCBR when the TS has been written.
+// PeakRate is the highest rate of non-null packets between two PCRs of the
+// input, and MaxDelayMs is the longest time a packet was sent after its
+// position in the input.
+type CBRInfo struct {
+	MuxRate       int64   `json:"muxRate"`
+	InputPackets  int64   `json:"inputPackets"`
+	InputNulls    int64   `json:"inputNulls"`
+	Packets       int64   `json:"packets"`
+	NullPackets   int64   `json:"nullPackets"`
+	PeakRate      int64   `json:"peakRate"`
+	MaxDelayMs    float64 `json:"maxDelayMs"`
+	RestampedPCRs int64   `json:"restampedPcrs"`
+}
+
+func (CBRInfo) isEvent() {}
+
+// cbrPacket is an input packet waiting for its time.
+type cbrPacket struct {
+	pkt packet.Packet
+	nr  int64
+}
+
+// cbrWriter places packets in the slots of a constant bitrate output.
+type cbrWriter struct {
+	w         io.Writer
+	slotTicks float64 // duration of a packet at the mux rate in 27MHz ticks
+	nextSlot  int64
+	started   bool
+	null      packet.Packet
+	info      CBRInfo
+	maxDelay  int64
+}
+
+// RestampCBR writes the TS in f at the constant bitrate Options.MuxRate
+// (bits per second) to tsWriter. The time of each packet is interpolated
+// between the PCRs of the first PCR PID, and the packet is sent in the first
+// free slot at or after that time, with null packets (PID 0x1FFF) in between.
+// Null packets of the input are dropped. The PCRs of all PIDs are restamped
+// by the delay of their packets, so that the PCRs of the first PCR PID follow
+// the packet position. It is an error if the non-null packets between two
+// PCRs exceed the mux rate. A CBRInfo is reported to h at the end.
+func RestampCBR(ctx context.Context, f io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	if o.MuxRate <= 0 {
+		return fmt.Errorf("no mux rate given")
+	}
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	_, err := packet.Sync(rd)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+	c := &cbrWriter{
+		w:         tsWriter,
+		slotTicks: float64(PacketSize*8*PcrTimeScale) / float64(o.MuxRate),
+		info:      CBRInfo{MuxRate: o.MuxRate},
+	}
+	c.null = nullPacket()
+
+	clock := newPCRClock()
+	var pending []cbrPacket // packets since the last PCR on the clock PID
+	var lastNr, lastTicks int64
+	rate := 0.0 // packets per tick between the last two PCRs
+	nr := int64(0)
+	var pkt packet.Packet
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if _, err := io.ReadFull(rd, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break dataLoop
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		c.info.InputPackets++
+		pid := packet.Pid(&pkt)
+		if pid == NullPID {
+			c.info.InputNulls++
+			nr++
+			continue
+		}
+		pending = append(pending, cbrPacket{pkt: pkt, nr: nr})
+		nr++
+		pcr, ok := packetPCR(&pkt)
+		if !ok || !clock.update(pid, pcr, nr-1) {
+			continue
+		}
+		ticks := clock.lastTicks
+		if len(pending) > 1 && !clock.hasRate() {
+			// Packets before the first PCR are sent in the slots before it
+			for i := range pending[:len(pending)-1] {
+				t := ticks - int64(float64(len(pending)-1-i)*c.slotTicks)
+				if err := c.write(&pending[i].pkt, t); err != nil {
+					return err
+				}
+			}
+			pending = pending[len(pending)-1:]
+		}
+		if clock.hasRate() {
+			dt := ticks - lastTicks
+			dn := nr - 1 - lastNr
+			if dt > 0 {
+				peak := int64(len(pending)) * PacketSize * 8 * PcrTimeScale / dt
+				if peak > o.MuxRate {
+					return fmt.Errorf("input rate %d bit/s between packets %d and %d exceeds the mux rate %d bit/s",
+						peak, lastNr, nr-1, o.MuxRate)
+				}
+				if peak > c.info.PeakRate {
+					c.info.PeakRate = peak
+				}
+				rate = float64(dn) / float64(dt)
+			}
+		}
+		for i := range pending {
+			t := ticks
+			if rate > 0 {
+				t -= int64(float64(nr-1-pending[i].nr) / rate)
+			}
+			if err := c.write(&pending[i].pkt, t); err != nil {
+				return err
+			}
+		}
+		pending = pending[:0]
+		lastNr, lastTicks = nr-1, ticks
+	}
+	if !clock.valid() {
+		return fmt.Errorf("no PCR found")
+	}
+	// Packets after the last PCR continue at the rate before it
+	for i := range pending {
+		t := lastTicks + int64(float64(pending[i].nr-lastNr)*c.slotTicks)
+		if rate > 0 {
+			t = lastTicks + int64(float64(pending[i].nr-lastNr)/rate)
+		}
+		if err := c.write(&pending[i].pkt, t); err != nil {
+			return err
+		}
+	}
+	c.info.MaxDelayMs = float64(c.maxDelay) * 1000 / PcrTimeScale
+	return emit(h, c.info)
+}
+
+// write sends pkt in the first free slot at or after t (27MHz ticks),
+// preceded by null packets for the empty slots, and restamps its PCR.
+func (c *cbrWriter) write(pkt *packet.Packet, t int64) error {
+	slot := int64(math.Ceil(float64(t)/c.slotTicks - 1e-9))
+	if !c.started {
+		c.nextSlot = slot
+		c.started = true
+	}
+	for ; c.nextSlot < slot; c.nextSlot++ {
+		if _, err := c.w.Write(c.null[:]); err != nil {
+			return err
+		}
+		c.info.Packets++
+		c.info.NullPackets++
+	}
+	delay := int64(math.Round(float64(c.nextSlot)*c.slotTicks)) - t
+	if delay > c.maxDelay {
+		c.maxDelay = delay
+	}
+	if pcr, ok := packetPCR(pkt); ok {
+		pcrBytes, _ := adaptationfield.PCR(pkt)
+		gots.InsertPCR(pcrBytes, uint64((pcr+delay)%PcrWrap))
+		c.info.RestampedPCRs++
+	}
+	c.nextSlot++
+	c.info.Packets++
+	_, err := c.w.Write(pkt[:])
+	return err
+}
+
+// packetPCR returns the PCR in pkt, if any.
+func packetPCR(pkt *packet.Packet) (int64, bool) {
+	if !packet.ContainsAdaptationField(pkt) || adaptationfield.Length(pkt) == 0 || !adaptationfield.HasPCR(pkt) {
+		return 0, false
+	}
+	pcrBytes, err := adaptationfield.PCR(pkt)
+	if err != nil {
+		return 0, false
+	}
+	return int64(gots.ExtractPCR(pcrBytes)), true
+}
+
+// nullPacket returns a null packet.
+func nullPacket() packet.Packet {
+	var p packet.Packet
+	p[0] = SyncByte
+	p[1] = byte(NullPID >> 8)
+	p[2] = byte(NullPID & 0xff)
+	p[3] = 0x10 // payload only
+	for i := 4; i < PacketSize; i++ {
+		p[i] = 0xff
+	}
+	return p
+}
@@ -0,0 +1,71 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestampCBR(t *testing.T) {
+	bbb, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+
+	t.Run("cbr", func(t *testing.T) {
+		var info CBRInfo
+		h := HandlerFunc(func(ev Event) error {
+			if ci, ok := ev.(CBRInfo); ok {
+				info = ci
+			}
+			return nil
+		})
+		muxRate := int64(3_000_000)
+		var out bytes.Buffer
+		err := RestampCBR(context.TODO(), bytes.NewReader(bbb), &out, h, Options{MuxRate: muxRate})
+		require.NoError(t, err)
+		data := out.Bytes()
+		require.Equal(t, int64(len(data)/PacketSize), info.Packets)
+		require.Equal(t, int64(len(bbb)/PacketSize), info.InputPackets)
+		require.Equal(t, info.InputPackets, info.Packets-info.NullPackets)
+		require.LessOrEqual(t, info.PeakRate, muxRate)
+		require.Equal(t, int64(13), info.RestampedPCRs)
+
+		// The non-null packets are those of the input, except for the PCRs
+		// which follow the packet position at the mux rate.
+		firstPos, firstPCR := -1, int64(0)
+		j := 0
+		for i := 0; i < len(data); i += PacketSize {
+			var pkt packet.Packet
+			copy(pkt[:], data[i:])
+			if pkt.PID() == NullPID {
+				continue
+			}
+			var in packet.Packet
+			copy(in[:], bbb[j:])
+			j += PacketSize
+			require.Equal(t, in.PID(), pkt.PID())
+			pcr, ok := packetPCR(&pkt)
+			if !ok {
+				require.Equal(t, in, pkt)
+				continue
+			}
+			pos := i / PacketSize
+			if firstPos < 0 {
+				firstPos, firstPCR = pos, pcr
+				continue
+			}
+			want := firstPCR + int64(pos-firstPos)*PacketSize*8*PcrTimeScale/muxRate
+			require.InDelta(t, want, pcr, 1, "pcr at packet %d", pos)
+		}
+		require.Equal(t, len(bbb), j)
+	})
+
+	t.Run("peak exceeds mux rate", func(t *testing.T) {
+		var out bytes.Buffer
+		err := RestampCBR(context.TODO(), bytes.NewReader(bbb), &out, nil, Options{MuxRate: 500_000})
+		require.ErrorContains(t, err, "exceeds the mux rate 500000")
+	})
+}
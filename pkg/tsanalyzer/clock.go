@@ -0,0 +1,70 @@
+package tsanalyzer
+
+import "time"
+
+// PCR steps larger than this are treated as discontinuities by the clock
+const maxClockStep = PcrTimeScale
+
+// pcrClock provides a time for every packet based on the first PCR PID found.
+// The time between PCRs is interpolated using the average packet rate, and
+// the clock is rebased at every PCR. The time can therefore step back at a PCR
+// if the interpolation overshot it. PCR steps backwards or larger than
+// maxClockStep are discontinuities, after which the clock continues from the
+// interpolated time.
+type pcrClock struct {
+	pid         int
+	firstPacket int64
+	lastPacket  int64
+	lastPCR     int64
+	lastTicks   int64
+}
+
+func newPCRClock() *pcrClock {
+	return &pcrClock{pid: -1}
+}
+
+func (c *pcrClock) valid() bool {
+	return c.pid >= 0
+}
+
+// hasRate is true when the packet rate is known, i.e. after two PCRs.
+func (c *pcrClock) hasRate() bool {
+	return c.lastPacket > c.firstPacket
+}
+
+// update adds a PCR from packet nr. It returns true if the PCR is on the clock PID.
+func (c *pcrClock) update(pid int, pcr int64, nr int64) bool {
+	if c.pid < 0 {
+		c.pid = pid
+		c.lastPCR = pcr
+		c.firstPacket = nr
+		c.lastPacket = nr
+		return true
+	}
+	if pid != c.pid {
+		return false
+	}
+	delta := (pcr - c.lastPCR + PcrWrap) % PcrWrap
+	if delta <= maxClockStep {
+		c.lastTicks += delta
+	} else {
+		// Discontinuity, continue from the interpolated time
+		c.lastTicks = c.ticks(nr)
+	}
+	c.lastPCR = pcr
+	c.lastPacket = nr
+	return true
+}
+
+// ticks returns the time of packet nr in 27MHz ticks since the first PCR.
+func (c *pcrClock) ticks(nr int64) int64 {
+	t := c.lastTicks
+	if c.lastPacket > c.firstPacket {
+		t += (nr - c.lastPacket) * c.lastTicks / (c.lastPacket - c.firstPacket)
+	}
+	return t
+}
+
+func durationToTicks(d time.Duration) int64 {
+	return int64(d) * PcrTimeScale / int64(time.Second)
+}
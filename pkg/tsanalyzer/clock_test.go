@@ -0,0 +1,32 @@
+package tsanalyzer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPCRClock(t *testing.T) {
+	c := newPCRClock()
+	step := int64(PcrTimeScale / 10)
+	require.True(t, c.update(256, PcrWrap-step, 0))
+	require.False(t, c.update(257, 0, 5))
+	// The PCR wraps after 10 packets
+	require.True(t, c.update(256, 0, 10))
+	require.Equal(t, step, c.ticks(10))
+	require.Equal(t, step+step/2, c.ticks(15))
+
+	// A burst of 100 packets before the next PCR makes the interpolation
+	// overshoot, and the clock is rebased at the PCR
+	require.Greater(t, c.ticks(110), 3*step)
+	c.update(256, step, 110)
+	require.Equal(t, 2*step, c.ticks(110))
+	require.Greater(t, c.ticks(111), 2*step)
+
+	// A PCR stepping backwards is a discontinuity
+	tk := c.ticks(120)
+	c.update(256, 0, 120)
+	require.Equal(t, tk, c.ticks(120))
+	c.update(256, step, 130)
+	require.Equal(t, tk+step, c.ticks(130))
+}
@@ -0,0 +1,496 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/Eyevinn/mp4ff/aac"
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/asticode/go-astits"
+)
+
+// DefaultSegmentDuration is the target segment duration in seconds if Options.SegmentDuration is 0.
+const DefaultSegmentDuration = 2.0
+
+// CMAFTrack is reported by RemuxMP4 for each track when the input has been read.
+// Times are in the track timescale (90kHz for video and the sample rate for audio).
+// BaseMediaDecodeTime is the decode time of the first sample, which is the first
+// DTS of the track.
+type CMAFTrack struct {
+	PID                 uint16 `json:"pid"`
+	Codec               string `json:"codec"`
+	TimeScale           uint32 `json:"timeScale"`
+	NrFragments         int    `json:"nrFragments"`
+	NrSamples           int    `json:"nrSamples"`
+	BaseMediaDecodeTime uint64 `json:"baseMediaDecodeTime"`
+	Duration            uint64 `json:"duration"`
+}
+
+func (CMAFTrack) isEvent() {}
+
+// TrackWriterFunc returns the writer for the CMAF track of a PID.
+// It is called when the init segment of the track is written.
+type TrackWriterFunc func(pid uint16, codec string) (io.Writer, error)
+
+// cmafTrack is a track that is being written.
+// Samples are kept until the next one arrives, since their duration is the
+// difference between the decode times.
+type cmafTrack struct {
+	info      CMAFTrack
+	w         io.Writer
+	target    uint64 // target fragment duration in timescale
+	frag      *mp4.Fragment
+	fragStart uint64
+	pending   *mp4.FullSample
+	lastDur   uint32
+	dts       *Timeline
+	nextTime  uint64 // expected decode time of the next audio frame
+	psKey     string // parameter sets in the init segment
+}
+
+// RemuxMP4 remuxes the AVC, HEVC and AAC streams of the selected programs to
+// fragmented MP4 tracks following CMAF. Each track is written to the writer
+// returned by newWriter as an init segment followed by fragments.
+// Video tracks start at the first IDR picture with parameter sets, and new
+// fragments start at the first IDR picture after Options.SegmentDuration
+// (DefaultSegmentDuration if 0). Audio fragments start at the first frame after
+// the target duration. The stream information and a CMAFTrack per track are
+// reported to h.
+func RemuxMP4(ctx context.Context, f io.Reader, newWriter TrackWriterFunc, h Handler, o Options) error {
+	segDur := o.SegmentDuration
+	if segDur == 0 {
+		segDur = DefaultSegmentDuration
+	}
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	var ds demuxState
+	dmx := newDemuxer(ctx, rd, &ds)
+	programs := newProgramTracker(o)
+	esKinds := make(map[uint16]string)
+	avcPSs := make(map[uint16]*AvcPS)
+	hevcPSs := make(map[uint16]*HevcPS)
+	tracks := make(map[uint16]*cmafTrack)
+
+dataLoop:
+	for {
+		// Check if context was cancelled
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		d, err := dmx.NextData()
+		if err != nil {
+			if err.Error() == "astits: no more packets" {
+				break dataLoop
+			}
+			return fmt.Errorf("reading next data %w", err)
+		}
+
+		// PID information of the selected programs
+		pmts, changes := programs.update(d, &ds)
+		for _, pmt := range pmts {
+			for _, streamInfo := range programStreams(pmt) {
+				esKinds[streamInfo.PID] = streamInfo.Codec
+				if err := emit(h, streamInfo); err != nil {
+					return err
+				}
+			}
+		}
+		for _, c := range changes {
+			if err := emit(h, c); err != nil {
+				return err
+			}
+			for _, pid := range c.changedPIDs() {
+				if tracks[pid] != nil {
+					return fmt.Errorf("PID %d: stream changed in program %d", pid, c.ProgramNumber)
+				}
+				delete(esKinds, pid)
+			}
+			for _, streamInfo := range c.New.Streams {
+				esKinds[streamInfo.PID] = streamInfo.Codec
+			}
+		}
+
+		pes := d.PES
+		if pes == nil || pes.Header.OptionalHeader == nil || pes.Header.OptionalHeader.PTS == nil {
+			continue
+		}
+		codec := esKinds[d.PID]
+		switch codec {
+		case "AVC":
+			avcPS := avcPSs[d.PID]
+			nrIDRs := int64(0)
+			if avcPS != nil {
+				nrIDRs = avcPS.Statistics.IDRCount()
+			}
+			if avcPS, err = ParseAVCPES(d, avcPS, nil, o); err != nil {
+				return err
+			}
+			avcPSs[d.PID] = avcPS
+			idr := avcPS.Statistics.IDRCount() > nrIDRs
+			t := tracks[d.PID]
+			if t == nil {
+				if !idr || !avcPS.hasPS() {
+					continue
+				}
+				init := mp4.CreateEmptyInit()
+				init.AddEmptyTrack(TimeScale, "video", "und")
+				spss := [][]byte{avcPS.spsnalu}
+				ppss := sortedNalus(avcPS.ppsnalus)
+				if err := init.Moov.Trak.SetAVCDescriptor("avc1", spss, ppss, true); err != nil {
+					return fmt.Errorf("PID %d: %w", d.PID, err)
+				}
+				if t, err = newCMAFTrack(d.PID, codec, TimeScale, segDur, init, newWriter); err != nil {
+					return err
+				}
+				t.psKey = psKey(spss, ppss)
+				tracks[d.PID] = t
+			}
+			if key := psKey([][]byte{avcPS.spsnalu}, sortedNalus(avcPS.ppsnalus)); key != t.psKey {
+				return fmt.Errorf("PID %d: parameter sets changed", d.PID)
+			}
+			if err := t.addVideo(d, idr, avcSample(pes.Data)); err != nil {
+				return err
+			}
+		case "HEVC":
+			hevcPS := hevcPSs[d.PID]
+			nrIDRs := int64(0)
+			if hevcPS != nil {
+				nrIDRs = hevcPS.Statistics.IDRCount()
+			}
+			if hevcPS, err = ParseHEVCPES(d, hevcPS, nil, o); err != nil {
+				return err
+			}
+			hevcPSs[d.PID] = hevcPS
+			idr := hevcPS.Statistics.IDRCount() > nrIDRs
+			vpss := [][]byte{hevcPS.vpsnalu}
+			spss := [][]byte{hevcPS.spsnalu}
+			ppss := sortedNalus(hevcPS.ppsnalus)
+			t := tracks[d.PID]
+			if t == nil {
+				if !idr || !hevcPS.hasPS() || hevcPS.vpsnalu == nil {
+					continue
+				}
+				init := mp4.CreateEmptyInit()
+				init.AddEmptyTrack(TimeScale, "video", "und")
+				if err := init.Moov.Trak.SetHEVCDescriptor("hvc1", vpss, spss, ppss, nil, true); err != nil {
+					return fmt.Errorf("PID %d: %w", d.PID, err)
+				}
+				if t, err = newCMAFTrack(d.PID, codec, TimeScale, segDur, init, newWriter); err != nil {
+					return err
+				}
+				t.psKey = psKey(vpss, spss, ppss)
+				tracks[d.PID] = t
+			}
+			if psKey(vpss, spss, ppss) != t.psKey {
+				return fmt.Errorf("PID %d: parameter sets changed", d.PID)
+			}
+			if err := t.addVideo(d, idr, hevcSample(pes.Data)); err != nil {
+				return err
+			}
+		case "AAC":
+			t, err := addAACFrames(d, tracks[d.PID], segDur, newWriter)
+			if err != nil {
+				return err
+			}
+			if t != nil {
+				tracks[d.PID] = t
+			}
+		}
+	}
+
+	if err := programs.err(); err != nil {
+		return err
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("no AVC, HEVC or AAC stream found")
+	}
+	pids := make([]uint16, 0, len(tracks))
+	for pid := range tracks {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	for _, pid := range pids {
+		t := tracks[pid]
+		if err := t.flush(); err != nil {
+			return err
+		}
+		if err := emit(h, t.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCMAFTrack writes the init segment of a track with track ID 1.
+func newCMAFTrack(pid uint16, codec string, timeScale uint32, segDur float64, init *mp4.InitSegment, newWriter TrackWriterFunc) (*cmafTrack, error) {
+	w, err := newWriter(pid, codec)
+	if err != nil {
+		return nil, err
+	}
+	if err := init.Encode(w); err != nil {
+		return nil, fmt.Errorf("PID %d: writing init segment: %w", pid, err)
+	}
+	return &cmafTrack{
+		info:   CMAFTrack{PID: pid, Codec: codec, TimeScale: timeScale},
+		w:      w,
+		target: uint64(math.Round(segDur * float64(timeScale))),
+		dts:    NewPTSTimeline(),
+	}, nil
+}
+
+// addVideo adds the picture of a video PES packet. The decode time is the
+// unwrapped DTS and the composition time offset is PTS - DTS.
+func (t *cmafTrack) addVideo(d *astits.DemuxerData, idr bool, data []byte) error {
+	oh := d.PES.Header.OptionalHeader
+	pts := oh.PTS.Base
+	dts := pts
+	if oh.DTS != nil {
+		dts = oh.DTS.Base
+	}
+	decodeTime := t.dts.Add(dts)
+	if decodeTime < 0 || (t.pending != nil && uint64(decodeTime) <= t.pending.DecodeTime) {
+		return fmt.Errorf("PID %d: DTS %d is not increasing", d.PID, dts)
+	}
+	flags := mp4.NonSyncSampleFlags
+	if idr {
+		flags = mp4.SyncSampleFlags
+	}
+	return t.add(mp4.FullSample{
+		Sample: mp4.Sample{
+			Flags:                 flags,
+			Size:                  uint32(len(data)),
+			CompositionTimeOffset: int32(SignedPTSDiff(pts, dts)),
+		},
+		DecodeTime: uint64(decodeTime),
+		Data:       data,
+	})
+}
+
+// addAACFrames adds the ADTS frames of an AAC PES packet. The track is created
+// from the first frame. The frames follow each other without gaps unless the
+// PTS differs by more than half a frame from the expected time.
+func addAACFrames(d *astits.DemuxerData, t *cmafTrack, segDur float64, newWriter TrackWriterFunc) (*cmafTrack, error) {
+	data := d.PES.Data
+	pts := t.unwrapPTS(d.PES.Header.OptionalHeader.PTS.Base)
+	pos := 0
+	nr := 0
+	for pos < len(data) {
+		hdr, offset, err := aac.DecodeADTSHeader(bytes.NewReader(data[pos:]))
+		if err != nil {
+			if nr == 0 {
+				return nil, fmt.Errorf("PID %d: no ADTS frame in PES: %w", d.PID, err)
+			}
+			break
+		}
+		start := pos + offset + int(hdr.HeaderLength)
+		end := start + int(hdr.PayloadLength)
+		if end > len(data) {
+			break
+		}
+		sampleRate := int(hdr.Frequency())
+		if t == nil {
+			if sampleRate == 0 {
+				return nil, fmt.Errorf("PID %d: unknown AAC sample rate", d.PID)
+			}
+			init := mp4.CreateEmptyInit()
+			init.AddEmptyTrack(uint32(sampleRate), "audio", "und")
+			if err := setAACDescriptor(init.Moov.Trak, hdr.ObjectType, sampleRate, hdr.ChannelConfig); err != nil {
+				return nil, fmt.Errorf("PID %d: %w", d.PID, err)
+			}
+			if t, err = newCMAFTrack(d.PID, "AAC", uint32(sampleRate), segDur, init, newWriter); err != nil {
+				return nil, err
+			}
+			pts = t.unwrapPTS(d.PES.Header.OptionalHeader.PTS.Base)
+		}
+		if sampleRate != int(t.info.TimeScale) {
+			return nil, fmt.Errorf("PID %d: AAC sample rate changed to %d", d.PID, sampleRate)
+		}
+		decodeTime := pts*int64(sampleRate)/TimeScale + int64(nr*aacSamplesPerFrame)
+		if t.pending != nil {
+			diff := decodeTime - int64(t.nextTime)
+			if diff > -aacSamplesPerFrame/2 && diff < aacSamplesPerFrame/2 {
+				decodeTime = int64(t.nextTime)
+			}
+		}
+		if decodeTime >= 0 && (t.pending == nil || uint64(decodeTime) > t.pending.DecodeTime) {
+			if err := t.add(mp4.FullSample{
+				Sample:     mp4.Sample{Flags: mp4.SyncSampleFlags, Size: uint32(end - start)},
+				DecodeTime: uint64(decodeTime),
+				Data:       data[start:end],
+			}); err != nil {
+				return nil, err
+			}
+			t.nextTime = uint64(decodeTime) + aacSamplesPerFrame
+			t.lastDur = aacSamplesPerFrame
+		}
+		nr++
+		pos = end
+	}
+	return t, nil
+}
+
+// unwrapPTS returns the unwrapped PTS, or 0 if the track is not created yet.
+func (t *cmafTrack) unwrapPTS(pts int64) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.dts.Add(pts)
+}
+
+// setAACDescriptor adds an mp4a sample entry with an esds box. Unlike
+// mp4.TrakBox.SetAACDescriptor, the channel configuration is kept.
+func setAACDescriptor(trak *mp4.TrakBox, objType byte, sampleRate int, channelConfig byte) error {
+	asc := &aac.AudioSpecificConfig{
+		ObjectType:           objType,
+		ChannelConfiguration: channelConfig,
+		SamplingFrequency:    sampleRate,
+	}
+	buf := bytes.Buffer{}
+	if err := asc.Encode(&buf); err != nil {
+		return err
+	}
+	nrChannels := uint16(channelConfig)
+	if channelConfig == 7 {
+		nrChannels = 8
+	}
+	esds := mp4.CreateEsdsBox(buf.Bytes())
+	trak.Mdia.Minf.Stbl.Stsd.AddChild(mp4.CreateAudioSampleEntryBox("mp4a", nrChannels, 16, uint16(sampleRate), esds))
+	return nil
+}
+
+// add sets the duration of the pending sample and writes it, starting a new
+// fragment if it is a sync sample at or after the target duration.
+func (t *cmafTrack) add(s mp4.FullSample) error {
+	if t.pending != nil {
+		t.lastDur = uint32(s.DecodeTime - t.pending.DecodeTime)
+		t.pending.Dur = t.lastDur
+		if err := t.write(*t.pending); err != nil {
+			return err
+		}
+	}
+	t.pending = &s
+	return nil
+}
+
+func (t *cmafTrack) write(s mp4.FullSample) error {
+	if t.frag == nil || (s.Flags == mp4.SyncSampleFlags && s.DecodeTime-t.fragStart >= t.target) {
+		if err := t.writeFragment(); err != nil {
+			return err
+		}
+		frag, err := mp4.CreateFragment(uint32(t.info.NrFragments+1), 1)
+		if err != nil {
+			return err
+		}
+		t.frag = frag
+		t.fragStart = s.DecodeTime
+		if t.info.NrFragments == 0 {
+			t.info.BaseMediaDecodeTime = s.DecodeTime
+		}
+		t.info.NrFragments++
+	}
+	t.frag.AddFullSample(s)
+	t.info.NrSamples++
+	t.info.Duration = s.DecodeTime + uint64(s.Dur) - t.info.BaseMediaDecodeTime
+	return nil
+}
+
+func (t *cmafTrack) writeFragment() error {
+	if t.frag == nil {
+		return nil
+	}
+	if err := t.frag.Encode(t.w); err != nil {
+		return fmt.Errorf("PID %d: writing fragment: %w", t.info.PID, err)
+	}
+	t.frag = nil
+	return nil
+}
+
+// flush writes the last sample, with the same duration as the one before, and the last fragment.
+func (t *cmafTrack) flush() error {
+	if t.pending != nil {
+		t.pending.Dur = t.lastDur
+		if err := t.write(*t.pending); err != nil {
+			return err
+		}
+		t.pending = nil
+	}
+	return t.writeFragment()
+}
+
+// avcSample converts an AVC access unit from Annex B to a sample with
+// 4-byte NAL unit lengths. Parameter sets are in the init segment and are
+// left out together with access unit delimiters.
+func avcSample(data []byte) []byte {
+	var nalus [][]byte
+	for _, nalu := range avc.ExtractNalusFromByteStream(data) {
+		switch avc.GetNaluType(nalu[0]) {
+		case avc.NALU_SPS, avc.NALU_PPS, avc.NALU_AUD:
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	return lengthPrefixed(nalus)
+}
+
+// hevcSample is avcSample for HEVC.
+func hevcSample(data []byte) []byte {
+	var nalus [][]byte
+	for _, nalu := range avc.ExtractNalusFromByteStream(data) {
+		switch hevc.GetNaluType(nalu[0]) {
+		case hevc.NALU_VPS, hevc.NALU_SPS, hevc.NALU_PPS, hevc.NALU_AUD:
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	return lengthPrefixed(nalus)
+}
+
+func lengthPrefixed(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	sample := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	return sample
+}
+
+// sortedNalus returns the parameter sets sorted by id.
+func sortedNalus(nalus map[uint32][]byte) [][]byte {
+	ids := make([]uint32, 0, len(nalus))
+	for id := range nalus {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	sorted := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		sorted = append(sorted, nalus[id])
+	}
+	return sorted
+}
+
+// psKey identifies a combination of parameter sets.
+func psKey(lists ...[][]byte) string {
+	var key []byte
+	for _, list := range lists {
+		for _, nalu := range list {
+			key = append(key, nalu...)
+			key = append(key, 0, 0, 0)
+		}
+		key = append(key, 0xff)
+	}
+	return string(key)
+}
@@ -0,0 +1,67 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/bits"
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemuxMP4(t *testing.T) {
+	f, err := os.Open("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	outputs := make(map[uint16]*bytes.Buffer)
+	newWriter := func(pid uint16, codec string) (io.Writer, error) {
+		outputs[pid] = &bytes.Buffer{}
+		return outputs[pid], nil
+	}
+	var tracks []CMAFTrack
+	h := HandlerFunc(func(ev Event) error {
+		if track, ok := ev.(CMAFTrack); ok {
+			tracks = append(tracks, track)
+		}
+		return nil
+	})
+	err = RemuxMP4(context.TODO(), f, newWriter, h, Options{SegmentDuration: 0.5})
+	require.NoError(t, err)
+	require.Equal(t, []CMAFTrack{
+		{PID: 256, Codec: "AVC", TimeScale: 90000, NrFragments: 2, NrSamples: 26, BaseMediaDecodeTime: 126000, Duration: 97500},
+		{PID: 257, Codec: "AAC", TimeScale: 44100, NrFragments: 3, NrSamples: 46, BaseMediaDecodeTime: 63366, Duration: 47104},
+	}, tracks)
+
+	for _, track := range tracks {
+		mf, err := mp4.DecodeFileSR(bits.NewFixedSliceReader(outputs[track.PID].Bytes()))
+		require.NoError(t, err)
+		require.NotNil(t, mf.Init)
+		if track.Codec == "AAC" {
+			require.Equal(t, uint16(2), mf.Init.Moov.Trak.Mdia.Minf.Stbl.Stsd.Mp4a.ChannelCount)
+		}
+		require.Len(t, mf.Segments, 1)
+		frags := mf.Segments[0].Fragments
+		require.Len(t, frags, track.NrFragments)
+		decodeTime := track.BaseMediaDecodeTime
+		for i, frag := range frags {
+			require.Equal(t, uint32(i+1), frag.Moof.Mfhd.SequenceNumber)
+			samples, err := frag.GetFullSamples(mf.Init.Moov.Mvex.Trex)
+			require.NoError(t, err)
+			require.Equal(t, decodeTime, samples[0].DecodeTime, fmt.Sprintf("PID %d fragment %d", track.PID, i+1))
+			require.True(t, samples[0].IsSync())
+			for _, s := range samples {
+				decodeTime += uint64(s.Dur)
+			}
+			if track.Codec == "AVC" {
+				require.True(t, avc.IsIDRSample(samples[0].Data))
+			}
+		}
+		require.Equal(t, track.BaseMediaDecodeTime+track.Duration, decodeTime)
+	}
+}
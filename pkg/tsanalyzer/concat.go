@@ -0,0 +1,398 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+	"github.com/Comcast/gots/v2/psi"
+	slices "golang.org/x/exp/slices"
+)
+
+// ConcatInput is reported by ConcatTS when an input has been written.
+// Offset is the PTS/DTS offset in 90kHz ticks (the PCR is shifted by the same time).
+// PIDs maps the input PIDs to the output PIDs, and DroppedPIDs are the
+// streams that have no match in the output program.
+type ConcatInput struct {
+	Nr            int         `json:"nr"`
+	Offset        int64       `json:"offset"`
+	Discontinuity bool        `json:"discontinuity,omitempty"`
+	Packets       int         `json:"packets"`
+	PIDs          map[int]int `json:"pids,omitempty"`
+	DroppedPIDs   []int       `json:"droppedPids,omitempty"`
+}
+
+func (ConcatInput) isEvent() {}
+
+// concatInput is the state of one input in ConcatTS.
+type concatInput struct {
+	info             ConcatInput
+	sections         map[int]*sectionAssembler
+	pmtPID           int
+	pmt              []byte
+	pcrPID           int
+	refPID           int // input PID of the timing stream
+	timed            bool
+	held             []packet.Packet // packets before the offset is known
+	lastDTS          int64
+	step             int64 // last DTS step of the timing stream
+	hasDTS           bool
+	firstPCR         int64 // PCR base of the first PCR, -1 if none yet
+	lastPCR          int64
+	discontinuitySet bool
+}
+
+// concatenator is the state of ConcatTS.
+type concatenator struct {
+	w             io.Writer
+	h             Handler
+	discontinuity bool
+	programNr     int
+	tsID          int
+	pmtPID        int
+	pmt           []byte
+	pcrPID        int
+	streams       []int    // output ES PIDs
+	keys          []string // stream kind of each output ES PID
+	timingPID     int      // output PID used for the timeline
+	cc            continuityCounters
+	end           int64 // end of the output timeline
+	lastPCR       int64 // last output PCR base, -1 if none
+	in            *concatInput
+}
+
+// ConcatTS writes the inputs one after the other to tsWriter as a single program.
+// The program is selected by Options.Program (or the lowest program number),
+// and the first input's PAT and PMT are used for the output. The streams of the
+// other inputs are mapped in PMT order to the output streams of the same codec
+// (or stream type), and unmatched streams are dropped. PTS, DTS and PCR of each
+// input after the first are shifted so that its first video DTS follows the
+// last video DTS of the previous input by one frame duration, or more if
+// needed for the PCR to increase. With
+// Options.Discontinuity, timestamps are kept and the discontinuity_indicator
+// is set on the first PCR of each input instead.
+// Continuity counters are renumbered. The stream information of the output and
+// a ConcatInput per input are reported to h.
+func ConcatTS(ctx context.Context, inputs []io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	c := &concatenator{
+		w:             tsWriter,
+		h:             h,
+		discontinuity: o.Discontinuity,
+		programNr:     o.Program,
+		pmtPID:        -1,
+		pcrPID:        -1,
+		timingPID:     -1,
+		lastPCR:       -1,
+		cc:            make(continuityCounters),
+	}
+	for i, f := range inputs {
+		c.in = &concatInput{
+			info:     ConcatInput{Nr: i + 1, Discontinuity: o.Discontinuity && i > 0, PIDs: make(map[int]int)},
+			sections: make(map[int]*sectionAssembler),
+			pmtPID:   -1,
+			pcrPID:   -1,
+			refPID:   -1,
+			firstPCR: -1,
+			timed:    i == 0 || o.Discontinuity,
+		}
+		if err := c.input(ctx, f); err != nil {
+			return fmt.Errorf("input %d: %w", i+1, err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// input writes one input.
+func (c *concatenator) input(ctx context.Context, f io.Reader) error {
+	reader := bufio.NewReader(f)
+	_, err := packet.Sync(reader)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+	var pkt packet.Packet
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		if err := c.inspect(&pkt); err != nil {
+			return err
+		}
+		if !c.in.timed {
+			c.in.held = append(c.in.held, pkt)
+			continue
+		}
+		if err := c.write(&pkt); err != nil {
+			return err
+		}
+	}
+	if c.pmt == nil {
+		return fmt.Errorf("no PMT found for program %d", c.programNr)
+	}
+	in := c.in
+	if !in.timed {
+		// No timestamps on the timing stream, keep the previous offset
+		in.timed = true
+		if err := c.flushHeld(); err != nil {
+			return err
+		}
+	}
+	if in.hasDTS && !c.discontinuity {
+		c.end = shiftPTS(in.lastDTS+in.step, in.info.Offset)
+	}
+	if in.firstPCR >= 0 {
+		c.lastPCR = shiftPTS(in.lastPCR, in.info.Offset)
+	}
+	sort.Ints(in.info.DroppedPIDs)
+	return emit(c.h, in.info)
+}
+
+// inspect parses PAT and PMT and finds the timestamps of the timing stream.
+func (c *concatenator) inspect(pkt *packet.Packet) error {
+	in := c.in
+	pid := packet.Pid(pkt)
+	if pid == in.pcrPID && packet.ContainsAdaptationField(pkt) && adaptationfield.Length(pkt) > 0 && adaptationfield.HasPCR(pkt) {
+		if pcrBytes, err := adaptationfield.PCR(pkt); err == nil {
+			in.lastPCR = int64(gots.ExtractPCR(pcrBytes)) / 300
+			if in.firstPCR < 0 {
+				in.firstPCR = in.lastPCR
+			}
+		}
+	}
+	switch {
+	case pid == 0 || pid == in.pmtPID:
+		return c.psi(pkt)
+	case pid != in.refPID || !packet.PayloadUnitStartIndicator(pkt):
+		return nil
+	}
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	_, dts, ok := pesTimes(payload)
+	if !ok {
+		return nil
+	}
+	if in.hasDTS {
+		if d := SignedPTSDiff(dts, in.lastDTS); d > 0 && d < TimeScale {
+			in.step = d
+		}
+	}
+	in.lastDTS = dts
+	in.hasDTS = true
+	if !in.timed {
+		in.info.Offset = SignedPTSDiff(c.end, dts)
+		// The PCR must not go backwards
+		if in.firstPCR >= 0 && c.lastPCR >= 0 {
+			if d := SignedPTSDiff(c.lastPCR, shiftPTS(in.firstPCR, in.info.Offset)); d >= 0 {
+				in.info.Offset += d + 1
+			}
+		}
+		in.timed = true
+		return c.flushHeld()
+	}
+	return nil
+}
+
+func (c *concatenator) flushHeld() error {
+	held := c.in.held
+	c.in.held = nil
+	for i := range held {
+		if err := c.write(&held[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// psi parses PAT and PMT of the input.
+func (c *concatenator) psi(pkt *packet.Packet) error {
+	in := c.in
+	pid := packet.Pid(pkt)
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	sa := in.sections[pid]
+	if sa == nil {
+		sa = &sectionAssembler{}
+		in.sections[pid] = sa
+	}
+	for _, section := range sa.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		switch {
+		case pid == 0 && section[0] == 0x00 && in.pmtPID < 0:
+			if c.programNr, in.pmtPID, err = selectProgram(patPrograms(section), c.programNr); err != nil {
+				return err
+			}
+			if c.pmtPID < 0 {
+				c.tsID = int(section[3])<<8 | int(section[4])
+				c.pmtPID = in.pmtPID
+			}
+		case pid == in.pmtPID && section[0] == 0x02:
+			p, ok := parsePMTSection(section)
+			if !ok || p.programNr != c.programNr || bytes.Equal(section, in.pmt) {
+				continue
+			}
+			if err := c.setPMT(section, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// streamKey is the kind of stream used to match streams between inputs.
+func streamKey(es psi.PmtElementaryStream) string {
+	if streamInfo := ParseElementaryStreamInfo(es); streamInfo != nil {
+		return streamInfo.Codec
+	}
+	return fmt.Sprintf("0x%02x", es.StreamType())
+}
+
+// setPMT maps the streams of the input to the output streams. The PMT of the
+// first input is the output PMT.
+func (c *concatenator) setPMT(section []byte, p pmtSection) error {
+	in := c.in
+	pmt, err := psi.NewPMT(append([]byte{0}, section...))
+	if err != nil {
+		return nil
+	}
+	in.pmt = section
+	in.pcrPID = p.pcrPID
+	in.info.PIDs = make(map[int]int)
+	in.info.DroppedPIDs = nil
+	if in.info.Nr == 1 {
+		if c.pmt == nil {
+			if err := emitPMTStreams(c.h, c.programNr, section); err != nil {
+				return err
+			}
+		}
+		c.pmt = section
+		c.pcrPID = p.pcrPID
+		c.streams, c.keys = nil, nil
+		c.timingPID = -1
+		for _, es := range pmt.ElementaryStreams() {
+			pid := es.ElementaryPid()
+			c.streams = append(c.streams, pid)
+			c.keys = append(c.keys, streamKey(es))
+			if streamInfo := ParseElementaryStreamInfo(es); streamInfo != nil && streamInfo.Type == "video" && c.timingPID < 0 {
+				c.timingPID = pid
+			}
+		}
+		if c.timingPID < 0 && len(c.streams) > 0 {
+			c.timingPID = c.streams[0]
+		}
+	}
+	used := make(map[int]bool)
+	for _, es := range pmt.ElementaryStreams() {
+		key := streamKey(es)
+		pid := es.ElementaryPid()
+		matched := false
+		for i, outPID := range c.streams {
+			if !used[outPID] && c.keys[i] == key {
+				used[outPID] = true
+				in.info.PIDs[pid] = outPID
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			in.info.DroppedPIDs = append(in.info.DroppedPIDs, pid)
+		}
+	}
+	if outPCR, ok := in.info.PIDs[in.pcrPID]; ok {
+		if outPCR != c.pcrPID {
+			return fmt.Errorf("PCR PID %d is mapped to %d, not to the PCR PID %d of the output", in.pcrPID, outPCR, c.pcrPID)
+		}
+	} else {
+		if slices.Contains(c.streams, c.pcrPID) {
+			return fmt.Errorf("PCR PID %d has no match in the output program", in.pcrPID)
+		}
+		in.info.PIDs[in.pcrPID] = c.pcrPID
+	}
+	in.refPID = -1
+	for pid, outPID := range in.info.PIDs {
+		if outPID == c.timingPID {
+			in.refPID = pid
+		}
+	}
+	if in.refPID < 0 && !in.timed {
+		return fmt.Errorf("no stream to align with PID %d of the previous input", c.timingPID)
+	}
+	return nil
+}
+
+// write writes an input packet to the output. PAT and PMT are replaced by
+// the output PAT and PMT.
+func (c *concatenator) write(pkt *packet.Packet) error {
+	in := c.in
+	pid := packet.Pid(pkt)
+	switch {
+	case pid == 0 || pid == in.pmtPID:
+		if !packet.PayloadUnitStartIndicator(pkt) {
+			return nil
+		}
+		if pid == 0 && c.pmtPID >= 0 {
+			return c.writeSection(0, patSection(c.tsID, c.programNr, c.pmtPID))
+		}
+		if pid == in.pmtPID && c.pmt != nil {
+			return c.writeSection(c.pmtPID, c.pmt)
+		}
+		return nil
+	}
+	outPID, ok := in.info.PIDs[pid]
+	if !ok {
+		return nil
+	}
+	if pid != outPID {
+		pkt[1] = pkt[1]&0xe0 | byte(outPID>>8)&0x1f
+		pkt[2] = byte(outPID)
+	}
+	if in.info.Offset != 0 {
+		ShiftPCR(pkt, in.info.Offset)
+		if packet.PayloadUnitStartIndicator(pkt) {
+			if pesHeader, err := packet.PESHeader(pkt); err == nil && pesHeader != nil {
+				_ = ShiftPESTimestamps(pesHeader, in.info.Offset)
+			}
+		}
+	}
+	if in.info.Discontinuity && !in.discontinuitySet && pid == in.pcrPID && packet.ContainsAdaptationField(pkt) && pkt[4] > 0 && pkt[5]&0x10 != 0 {
+		pkt[5] |= 0x80 // discontinuity_indicator
+		in.discontinuitySet = true
+	}
+	return c.writePacket(pkt)
+}
+
+func (c *concatenator) writeSection(pid int, section []byte) error {
+	var cc uint8 // set by writePacket
+	pkts := sectionPackets(pid, section, &cc)
+	for i := range pkts {
+		if err := c.writePacket(&pkts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *concatenator) writePacket(pkt *packet.Packet) error {
+	c.cc.set(pkt)
+	c.in.info.Packets++
+	return WritePacket(pkt, c.w)
+}
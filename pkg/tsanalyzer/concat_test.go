@@ -0,0 +1,109 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcatTS(t *testing.T) {
+	bbb, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	avc, err := os.ReadFile("../../internal/testdata/avc_with_time.ts")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		inputs        [][]byte
+		discontinuity bool
+		want          []ConcatInput
+		wantDTSSteps  []int64
+	}{
+		{
+			name:   "rebase",
+			inputs: [][]byte{bbb, bbb, bbb},
+			want: []ConcatInput{
+				{Nr: 1, Packets: 656, PIDs: map[int]int{256: 256, 257: 257}},
+				{Nr: 2, Offset: 97500, Packets: 656, PIDs: map[int]int{256: 256, 257: 257}},
+				{Nr: 3, Offset: 195000, Packets: 656, PIDs: map[int]int{256: 256, 257: 257}},
+			},
+			wantDTSSteps: []int64{3750},
+		},
+		{
+			name:   "remap",
+			inputs: [][]byte{bbb, avc},
+			want: []ConcatInput{
+				{Nr: 1, Packets: 656, PIDs: map[int]int{256: 256, 257: 257}},
+				{Nr: 2, Offset: -5268300, Packets: 377, PIDs: map[int]int{512: 256}},
+			},
+			wantDTSSteps: []int64{3750, 1800},
+		},
+		{
+			name:          "discontinuity",
+			inputs:        [][]byte{bbb, bbb},
+			discontinuity: true,
+			want: []ConcatInput{
+				{Nr: 1, Packets: 656, PIDs: map[int]int{256: 256, 257: 257}},
+				{Nr: 2, Discontinuity: true, Packets: 656, PIDs: map[int]int{256: 256, 257: 257}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var inputs []io.Reader
+			for _, data := range tc.inputs {
+				inputs = append(inputs, bytes.NewReader(data))
+			}
+			var got []ConcatInput
+			h := HandlerFunc(func(ev Event) error {
+				if ci, ok := ev.(ConcatInput); ok {
+					got = append(got, ci)
+				}
+				return nil
+			})
+			var out bytes.Buffer
+			err := ConcatTS(context.TODO(), inputs, &out, h, Options{Discontinuity: tc.discontinuity})
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+
+			cc := make(map[int]uint8)
+			lastDTS := int64(-1)
+			nrDiscontinuities := 0
+			data := out.Bytes()
+			for i := 0; i < len(data); i += PacketSize {
+				var pkt packet.Packet
+				copy(pkt[:], data[i:])
+				pid := packet.Pid(&pkt)
+				require.Contains(t, []int{0, 4096, 256, 257}, pid)
+				if packet.ContainsPayload(&pkt) {
+					if prev, ok := cc[pid]; ok {
+						require.Equal(t, (prev+1)&0x0f, packet.ContinuityCounter(&pkt), "PID %d packet %d", pid, i/PacketSize)
+					}
+					cc[pid] = packet.ContinuityCounter(&pkt)
+				}
+				if af := adaptationField(&pkt); len(af) > 0 && af[0]&0x80 != 0 {
+					nrDiscontinuities++
+				}
+				if pid != 256 || !packet.PayloadUnitStartIndicator(&pkt) {
+					continue
+				}
+				payload, err := packet.Payload(&pkt)
+				require.NoError(t, err)
+				_, dts, ok := pesTimes(payload)
+				require.True(t, ok)
+				if lastDTS >= 0 && tc.wantDTSSteps != nil {
+					require.Contains(t, tc.wantDTSSteps, SignedPTSDiff(dts, lastDTS), "packet %d", i/PacketSize)
+				}
+				lastDTS = dts
+			}
+			if tc.discontinuity {
+				require.Equal(t, len(tc.inputs)-1, nrDiscontinuities)
+			}
+		})
+	}
+}
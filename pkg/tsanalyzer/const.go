@@ -1,10 +1,13 @@
-package internal
+package tsanalyzer
 
 const (
-	PacketSize = 188
-	PtsWrap    = 1 << 33
-	PcrWrap    = PtsWrap * 300
-	TimeScale  = 90000
+	PacketSize   = 188
+	SyncByte     = 0x47
+	NullPID      = 0x1fff
+	PtsWrap      = 1 << 33
+	PcrWrap      = PtsWrap * 300
+	TimeScale    = 90000
+	PcrTimeScale = TimeScale * 300
 )
 
 func SignedPTSDiff(p2, p1 int64) int64 {
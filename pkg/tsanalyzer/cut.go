@@ -0,0 +1,619 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/psi"
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
+)
+
+// Units of a CutPoint
+const (
+	CutSeconds = "s"   // seconds after the first video PTS
+	CutPTS     = "pts" // PTS in 90kHz ticks
+	CutFrames  = "f"   // pictures in decode order, starting at 0
+)
+
+// audioLookback is how long audio PES packets are kept before the start of a
+// cut, for audio that is multiplexed ahead of the video.
+const audioLookback = 5 * TimeScale
+
+// CutPoint is a position in the video stream of a program.
+// The zero value means the start or end of the stream.
+type CutPoint struct {
+	Unit  string
+	Value float64
+}
+
+// ParseCutPoint parses a number followed by an optional unit: s (seconds,
+// the default), pts or f (frames), e.g. 10.5, 900000pts or 250f.
+func ParseCutPoint(s string) (CutPoint, error) {
+	cp := CutPoint{Unit: CutSeconds}
+	for _, unit := range []string{CutPTS, CutSeconds, CutFrames} {
+		if strings.HasSuffix(s, unit) {
+			cp.Unit = unit
+			s = strings.TrimSuffix(s, unit)
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return CutPoint{}, fmt.Errorf("bad cut point %q", s+cp.Unit)
+	}
+	cp.Value = v
+	return cp, nil
+}
+
+// reached tells if the picture with timestamp ts (PTS or DTS) and number nr
+// is at or after the cut point.
+func (cp CutPoint) reached(ts, firstPTS int64, nr int) bool {
+	switch cp.Unit {
+	case CutSeconds:
+		return SignedPTSDiff(ts, firstPTS) >= int64(cp.Value*TimeScale)
+	case CutPTS:
+		return SignedPTSDiff(ts, int64(cp.Value)) >= 0
+	case CutFrames:
+		return nr >= int(cp.Value)
+	}
+	return false
+}
+
+// CutInfo is reported by CutTS when the cut is done. StartPTS is the PTS of
+// the first picture and EndPTS is one frame after the highest PTS.
+type CutInfo struct {
+	ProgramNumber int     `json:"programNumber"`
+	StartPTS      int64   `json:"startPts"`
+	EndPTS        int64   `json:"endPts"`
+	Duration      float64 `json:"duration"`
+	Pictures      int     `json:"pictures"`
+	Packets       int     `json:"packets"`
+}
+
+func (CutInfo) isEvent() {}
+
+// heldPES is the packets of a PES packet that is not written yet.
+type heldPES struct {
+	pts  int64
+	pkts []packet.Packet
+}
+
+// Audio PID states in tsCutter
+const (
+	audioWaiting = iota // before the first PES at or after the start
+	audioWriting
+	audioDone // after the end
+)
+
+// tsCutter is the state of CutTS.
+type tsCutter struct {
+	w          io.Writer
+	h          Handler
+	start, end CutPoint
+	info       CutInfo
+	tsID       int
+	pmtPID     int
+	pmt        []byte
+	videoPID   int
+	videoCodec string
+	pids       map[int]bool
+	audio      map[int]int // audio PID -> state
+	accept     map[int]bool
+	sections   map[int]*sectionAssembler
+	cc         continuityCounters
+
+	firstPTS int64
+	pictures int // pictures seen in the input
+	// The current video PES and the packets after it
+	held     []packet.Packet
+	heldData []byte
+	lookback map[int][]heldPES // audio before the start
+
+	// Latest parameter sets
+	vps, sps []byte
+	ppss     [][]byte
+
+	started, videoDone bool
+	lastPTS, lastDTS   int64
+	frameDur           int64
+}
+
+// CutTS writes the part of the selected program (Options.Program, or the lowest
+// program number) between Options.CutStart and Options.CutEnd to tsWriter.
+// The output starts with a PAT with only the program and the PMT, followed by
+// the first IDR picture (or picture with random_access_indicator) at or after
+// the start. Parameter sets that are missing in that picture are inserted.
+// Video ends before the first picture with DTS (or number) at or after the end.
+// Audio starts with the first PES packet with PTS at or after the start picture
+// and ends before the end of the video. Continuity counters are renumbered.
+// The stream information and a CutInfo are reported to h.
+func CutTS(ctx context.Context, f io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	c := &tsCutter{
+		w:        tsWriter,
+		h:        h,
+		start:    o.CutStart,
+		end:      o.CutEnd,
+		pmtPID:   -1,
+		videoPID: -1,
+		pids:     make(map[int]bool),
+		audio:    make(map[int]int),
+		accept:   make(map[int]bool),
+		sections: make(map[int]*sectionAssembler),
+		cc:       make(continuityCounters),
+		firstPTS: -1,
+		lookback: make(map[int][]heldPES),
+	}
+	c.info.ProgramNumber = o.Program
+	reader := bufio.NewReader(f)
+	_, err := packet.Sync(reader)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+
+	var pkt packet.Packet
+	for !c.done() {
+		select {
+		case <-ctx.Done():
+			return c.finish()
+		default:
+		}
+
+		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		if err := c.packet(pkt); err != nil {
+			return err
+		}
+	}
+	if c.pmt == nil {
+		return fmt.Errorf("no PMT found for program %d", c.info.ProgramNumber)
+	}
+	if c.videoPID < 0 {
+		return fmt.Errorf("no video stream in program %d", c.info.ProgramNumber)
+	}
+	if err := c.flushVideo(); err != nil {
+		return err
+	}
+	if !c.started {
+		return fmt.Errorf("no IDR picture found at or after the start")
+	}
+	return c.finish()
+}
+
+// done is true when video has ended and all audio streams have passed the end.
+func (c *tsCutter) done() bool {
+	if !c.videoDone {
+		return false
+	}
+	for _, state := range c.audio {
+		if state != audioDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *tsCutter) finish() error {
+	if !c.started {
+		return nil
+	}
+	c.info.EndPTS = AddPTS(c.lastPTS, c.frameDur)
+	c.info.Duration = float64(SignedPTSDiff(c.info.EndPTS, c.info.StartPTS)) / TimeScale
+	return emit(c.h, c.info)
+}
+
+func (c *tsCutter) packet(pkt packet.Packet) error {
+	pid := packet.Pid(&pkt)
+	switch {
+	case pid == 0 || pid == c.pmtPID:
+		if c.held != nil {
+			c.held = append(c.held, pkt)
+			return nil
+		}
+		return c.psi(&pkt)
+	case !c.pids[pid]:
+		return nil
+	case pid == c.videoPID && packet.PayloadUnitStartIndicator(&pkt):
+		if err := c.flushVideo(); err != nil {
+			return err
+		}
+		payload, err := packet.Payload(&pkt)
+		if err != nil {
+			return nil
+		}
+		if _, _, ok := pesTimes(payload); !ok {
+			return nil
+		}
+		c.held = append(c.held[:0], pkt)
+		c.heldData = append(c.heldData[:0], payload...)
+		return nil
+	case c.held != nil:
+		c.held = append(c.held, pkt)
+		if pid == c.videoPID {
+			if payload, err := packet.Payload(&pkt); err == nil {
+				c.heldData = append(c.heldData, payload...)
+			}
+		}
+		return nil
+	}
+	return c.other(&pkt)
+}
+
+// psi handles PAT and PMT packets. The output gets its own PAT and PMT
+// packets, which are repeated where the input has them.
+func (c *tsCutter) psi(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	sa := c.sections[pid]
+	if sa == nil {
+		sa = &sectionAssembler{}
+		c.sections[pid] = sa
+	}
+	for _, section := range sa.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		switch {
+		case pid == 0 && section[0] == 0x00 && c.pmtPID < 0:
+			if c.info.ProgramNumber, c.pmtPID, err = selectProgram(patPrograms(section), c.info.ProgramNumber); err != nil {
+				return err
+			}
+			c.tsID = int(section[3])<<8 | int(section[4])
+		case pid == 0 && section[0] == 0x00:
+			if err := c.writePSI(0, patSection(c.tsID, c.info.ProgramNumber, c.pmtPID)); err != nil {
+				return err
+			}
+		case pid == c.pmtPID && section[0] == 0x02:
+			p, ok := parsePMTSection(section)
+			if !ok || p.programNr != c.info.ProgramNumber {
+				continue
+			}
+			if c.pmt == nil {
+				if err := emitPMTStreams(c.h, c.info.ProgramNumber, section); err != nil {
+					return err
+				}
+			}
+			if !bytes.Equal(section, c.pmt) {
+				if err := c.setPMT(section, p); err != nil {
+					return err
+				}
+			}
+			if err := c.writePSI(c.pmtPID, c.pmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setPMT sets the PIDs of the program. The video PID can not change.
+func (c *tsCutter) setPMT(section []byte, p pmtSection) error {
+	pmt, err := psi.NewPMT(append([]byte{0}, section...))
+	if err != nil {
+		return nil
+	}
+	c.pmt = section
+	c.pids = map[int]bool{p.pcrPID: true}
+	for _, es := range pmt.ElementaryStreams() {
+		pid := es.ElementaryPid()
+		c.pids[pid] = true
+		streamInfo := ParseElementaryStreamInfo(es)
+		if streamInfo == nil {
+			continue
+		}
+		switch {
+		case streamInfo.Type == "video" && c.videoPID < 0:
+			c.videoPID, c.videoCodec = pid, streamInfo.Codec
+		case streamInfo.Type == "audio":
+			if _, ok := c.audio[pid]; !ok {
+				c.audio[pid] = audioWaiting
+			}
+		}
+	}
+	if !c.pids[c.videoPID] {
+		return fmt.Errorf("video PID %d removed from program %d", c.videoPID, c.info.ProgramNumber)
+	}
+	return nil
+}
+
+// other handles packets on PIDs of the program other than the video PID.
+func (c *tsCutter) other(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	state, isAudio := c.audio[pid]
+	if !isAudio {
+		if c.started && !c.videoDone {
+			return c.write(pkt)
+		}
+		return nil
+	}
+	pusi := packet.PayloadUnitStartIndicator(pkt)
+	var pts int64
+	hasPTS := false
+	if pusi {
+		if payload, err := packet.Payload(pkt); err == nil {
+			pts, _, hasPTS = pesTimes(payload)
+		}
+	}
+	if !c.started {
+		// Keep recent audio for the start
+		lb := c.lookback[pid]
+		switch {
+		case pusi && hasPTS:
+			for len(lb) > 0 && SignedPTSDiff(pts, lb[0].pts) > audioLookback {
+				lb = lb[1:]
+			}
+			lb = append(lb, heldPES{pts: pts, pkts: []packet.Packet{*pkt}})
+		case pusi:
+			lb = nil
+		case len(lb) > 0:
+			lb[len(lb)-1].pkts = append(lb[len(lb)-1].pkts, *pkt)
+		}
+		c.lookback[pid] = lb
+		return nil
+	}
+	if pusi {
+		switch {
+		case state == audioDone:
+			c.accept[pid] = false
+		case !hasPTS:
+			c.accept[pid] = state == audioWriting
+		case c.videoDone && SignedPTSDiff(pts, AddPTS(c.lastPTS, c.frameDur)) >= 0:
+			c.audio[pid] = audioDone
+			c.accept[pid] = false
+		case SignedPTSDiff(pts, c.info.StartPTS) >= 0:
+			c.audio[pid] = audioWriting
+			c.accept[pid] = true
+		default:
+			c.accept[pid] = false
+		}
+	}
+	if c.accept[pid] {
+		return c.write(pkt)
+	}
+	return nil
+}
+
+// flushVideo decides what to do with the held video PES and writes it and the
+// packets after it.
+func (c *tsCutter) flushVideo() error {
+	if c.held == nil {
+		return nil
+	}
+	held := c.held
+	c.held = nil
+	pts, dts, _ := pesTimes(c.heldData)
+	nr := c.pictures
+	c.pictures++
+	if c.firstPTS < 0 {
+		c.firstPTS = pts
+	}
+	esStart := 9 + int(c.heldData[8])
+	if esStart > len(c.heldData) {
+		esStart = len(c.heldData)
+	}
+	nalus := avc.ExtractNalusFromByteStream(c.heldData[esStart:])
+	idr, hasPS := c.scanNalus(nalus)
+	if packet.ContainsAdaptationField(&held[0]) && held[0][4] > 0 && held[0][5]&0x40 != 0 {
+		idr = true // random_access_indicator
+	}
+
+	writeVideo := false
+	videoWritten := false
+	switch {
+	case c.videoDone:
+	case !c.started:
+		if idr && (c.start.Unit == "" || c.start.reached(pts, c.firstPTS, nr)) && (hasPS || c.sps != nil) {
+			if err := c.startCut(pts); err != nil {
+				return err
+			}
+			writeVideo = true
+			if !hasPS {
+				if err := c.writeWithPS(held[0], nalus, esStart); err != nil {
+					return err
+				}
+				videoWritten = true
+			}
+		}
+	case c.end.Unit != "" && c.end.reached(dts, c.firstPTS, nr):
+		c.videoDone = true
+	default:
+		writeVideo = true
+	}
+	if writeVideo {
+		c.info.Pictures++
+		if SignedPTSDiff(pts, c.lastPTS) > 0 {
+			c.lastPTS = pts
+		}
+		if d := SignedPTSDiff(dts, c.lastDTS); d > 0 && d < TimeScale {
+			c.frameDur = d
+		}
+		c.lastDTS = dts
+	}
+	for i := range held {
+		var err error
+		switch pid := packet.Pid(&held[i]); {
+		case pid == c.videoPID:
+			if writeVideo && !videoWritten {
+				err = c.write(&held[i])
+			}
+		case pid == 0 || pid == c.pmtPID:
+			err = c.psi(&held[i])
+		default:
+			err = c.other(&held[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanNalus saves the parameter sets of a picture and tells if it is an IDR
+// picture and has all parameter sets.
+func (c *tsCutter) scanNalus(nalus [][]byte) (idr, hasPS bool) {
+	var vps, sps []byte
+	var ppss [][]byte
+	for _, nalu := range nalus {
+		if c.videoCodec == "HEVC" {
+			switch hevc.GetNaluType(nalu[0]) {
+			case hevc.NALU_VPS:
+				vps = nalu
+			case hevc.NALU_SPS:
+				sps = nalu
+			case hevc.NALU_PPS:
+				ppss = append(ppss, nalu)
+			case hevc.NALU_IDR_W_RADL, hevc.NALU_IDR_N_LP:
+				idr = true
+			}
+			continue
+		}
+		switch avc.GetNaluType(nalu[0]) {
+		case avc.NALU_SPS:
+			sps = nalu
+		case avc.NALU_PPS:
+			ppss = append(ppss, nalu)
+		case avc.NALU_IDR:
+			idr = true
+		}
+	}
+	if vps != nil {
+		c.vps = vps
+	}
+	if sps != nil && !bytes.Equal(sps, c.sps) {
+		c.sps = sps
+		c.ppss = nil
+	}
+	for _, pps := range ppss {
+		if !containsNalu(c.ppss, pps) {
+			c.ppss = append(c.ppss, pps)
+		}
+	}
+	hasPS = sps != nil && len(ppss) > 0 && (c.videoCodec != "HEVC" || vps != nil)
+	return idr, hasPS
+}
+
+func containsNalu(nalus [][]byte, nalu []byte) bool {
+	for _, n := range nalus {
+		if bytes.Equal(n, nalu) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWithPS writes the video PES with the parameter sets inserted after the
+// access unit delimiter. The adaptation field of the first packet is kept.
+func (c *tsCutter) writeWithPS(first packet.Packet, nalus [][]byte, esStart int) error {
+	var ps [][]byte
+	if c.videoCodec == "HEVC" {
+		ps = append(ps, c.vps)
+	}
+	ps = append(ps, c.sps)
+	ps = append(ps, c.ppss...)
+	isAUD := func(nalu []byte) bool {
+		if c.videoCodec == "HEVC" {
+			return hevc.GetNaluType(nalu[0]) == hevc.NALU_AUD
+		}
+		return avc.GetNaluType(nalu[0]) == avc.NALU_AUD
+	}
+	data := append([]byte(nil), c.heldData[:esStart]...)
+	startCode := []byte{0, 0, 0, 1}
+	for i, nalu := range nalus {
+		if i == 0 && !isAUD(nalu) || i == 1 && isAUD(nalus[0]) {
+			for _, p := range ps {
+				data = append(data, startCode...)
+				data = append(data, p...)
+			}
+		}
+		data = append(data, startCode...)
+		data = append(data, nalu...)
+	}
+	if len(nalus) == 1 && isAUD(nalus[0]) {
+		for _, p := range ps {
+			data = append(data, startCode...)
+			data = append(data, p...)
+		}
+	}
+	if data[4] != 0 || data[5] != 0 {
+		// PES_packet_length, 0 if too long for video
+		length := len(data) - 6
+		if length > 0xffff {
+			length = 0
+		}
+		data[4], data[5] = byte(length>>8), byte(length)
+	}
+	var cc uint8 // set by write
+	pkts := pesPackets(c.videoPID, data, adaptationField(&first), &cc)
+	for i := range pkts {
+		if err := c.write(&pkts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startCut writes PAT, PMT and the audio PES packets in the lookback at or after pts.
+func (c *tsCutter) startCut(pts int64) error {
+	c.started = true
+	c.info.StartPTS = pts
+	c.lastPTS = pts
+	if err := c.writePSI(0, patSection(c.tsID, c.info.ProgramNumber, c.pmtPID)); err != nil {
+		return err
+	}
+	if err := c.writePSI(c.pmtPID, c.pmt); err != nil {
+		return err
+	}
+	pids := make([]int, 0, len(c.lookback))
+	for pid := range c.lookback {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		for _, p := range c.lookback[pid] {
+			accept := SignedPTSDiff(p.pts, pts) >= 0
+			if accept {
+				c.audio[pid] = audioWriting
+				for i := range p.pkts {
+					if err := c.write(&p.pkts[i]); err != nil {
+						return err
+					}
+				}
+			}
+			c.accept[pid] = accept
+		}
+	}
+	c.lookback = nil
+	return nil
+}
+
+func (c *tsCutter) writePSI(pid int, section []byte) error {
+	if !c.started || c.videoDone {
+		return nil
+	}
+	var cc uint8 // set by write
+	pkts := sectionPackets(pid, section, &cc)
+	for i := range pkts {
+		if err := c.write(&pkts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes a packet with the next continuity counter of its PID.
+func (c *tsCutter) write(pkt *packet.Packet) error {
+	c.cc.set(pkt)
+	c.info.Packets++
+	return WritePacket(pkt, c.w)
+}
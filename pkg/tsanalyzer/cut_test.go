@@ -0,0 +1,148 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCutPoint(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want CutPoint
+		err  bool
+	}{
+		{in: "10.5", want: CutPoint{Unit: CutSeconds, Value: 10.5}},
+		{in: "3s", want: CutPoint{Unit: CutSeconds, Value: 3}},
+		{in: "900000pts", want: CutPoint{Unit: CutPTS, Value: 900000}},
+		{in: "250f", want: CutPoint{Unit: CutFrames, Value: 250}},
+		{in: "ten", err: true},
+		{in: "pts", err: true},
+	}
+	for _, tc := range testCases {
+		cp, err := ParseCutPoint(tc.in)
+		if tc.err {
+			require.Error(t, err, tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		require.Equal(t, tc.want, cp, tc.in)
+	}
+}
+
+func cutInfo(t *testing.T, data []byte, o Options) (CutInfo, []byte) {
+	t.Helper()
+	var out bytes.Buffer
+	events := collectEvents(t, func(h Handler) error {
+		return CutTS(context.TODO(), bytes.NewReader(data), &out, h, o)
+	})
+	return lastEventOf[CutInfo](events), out.Bytes()
+}
+
+func TestCutTS(t *testing.T) {
+	testCases := []struct {
+		file       string
+		start, end CutPoint
+		want       CutInfo
+	}{
+		{
+			file:  "bbb_1s.ts",
+			start: CutPoint{Unit: CutPTS, Value: 133500},
+			end:   CutPoint{Unit: CutFrames, Value: 12},
+			want:  CutInfo{ProgramNumber: 1, StartPTS: 133500, EndPTS: 178500, Duration: 0.5, Pictures: 12, Packets: 73},
+		},
+		{
+			file:  "80s_with_ad.ts",
+			start: CutPoint{Unit: CutSeconds, Value: 10},
+			end:   CutPoint{Unit: CutSeconds, Value: 12},
+		},
+	}
+	for _, tc := range testCases {
+		data, err := os.ReadFile("../../internal/testdata/" + tc.file)
+		require.NoError(t, err)
+		info, out := cutInfo(t, data, Options{CutStart: tc.start, CutEnd: tc.end})
+		if tc.want.Pictures > 0 {
+			require.Equal(t, tc.want, info, tc.file)
+		}
+		require.Equal(t, info.Packets*PacketSize, len(out))
+
+		// PAT, PMT and a video picture with random_access_indicator first
+		var pkts []packet.Packet
+		for i := 0; i < len(out); i += PacketSize {
+			var pkt packet.Packet
+			copy(pkt[:], out[i:])
+			pkts = append(pkts, pkt)
+		}
+		require.Equal(t, 0, packet.Pid(&pkts[0]), tc.file)
+		require.Equal(t, 4096, packet.Pid(&pkts[1]), tc.file)
+		require.True(t, packet.PayloadUnitStartIndicator(&pkts[2]))
+		af := adaptationField(&pkts[2])
+		require.True(t, len(af) > 0 && af[0]&0x40 != 0, "random_access_indicator")
+
+		// Continuity counters without gaps
+		cc := make(map[int]int)
+		for i := range pkts {
+			pid := packet.Pid(&pkts[i])
+			if !packet.ContainsPayload(&pkts[i]) {
+				continue
+			}
+			c := int(packet.ContinuityCounter(&pkts[i]))
+			if prev, ok := cc[pid]; ok {
+				require.Equal(t, (prev+1)&0x0f, c, "PID %d packet %d", pid, i)
+			}
+			cc[pid] = c
+		}
+
+		// The output starts with an IDR picture with parameter sets, so
+		// cutting it again gives the same pictures.
+		again, _ := cutInfo(t, out, Options{})
+		require.Equal(t, info.StartPTS, again.StartPTS, tc.file)
+		require.Equal(t, info.Pictures, again.Pictures, tc.file)
+	}
+}
+
+func TestCutWriteWithPS(t *testing.T) {
+	var out bytes.Buffer
+	c := &tsCutter{
+		w:          &out,
+		videoPID:   256,
+		videoCodec: "AVC",
+		cc:         make(continuityCounters),
+		sps:        []byte{0x67, 0x64, 0x00, 0x1f},
+		ppss:       [][]byte{{0x68, 0xee}},
+	}
+	aud := []byte{0x09, 0xf0}
+	idr := bytes.Repeat([]byte{0x65, 0x88}, 200)
+	pesHeader := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 0x01, 0x00, 0x01}
+	es := append(append([]byte{0, 0, 0, 1}, aud...), append([]byte{0, 0, 0, 1}, idr...)...)
+	c.heldData = append(pesHeader, es...)
+	var first packet.Packet
+	first[3] = 0x30 // adaptation field and payload
+	first[4] = 1
+	first[5] = 0x40 // random_access_indicator
+	require.NoError(t, c.writeWithPS(first, [][]byte{aud, idr}, len(pesHeader)))
+
+	var data []byte
+	for i := 0; i < out.Len(); i += PacketSize {
+		var pkt packet.Packet
+		copy(pkt[:], out.Bytes()[i:])
+		require.Equal(t, 256, packet.Pid(&pkt))
+		require.Equal(t, uint8(i/PacketSize), packet.ContinuityCounter(&pkt))
+		if i == 0 {
+			require.Equal(t, []byte{0x40}, adaptationField(&pkt))
+		}
+		payload, err := packet.Payload(&pkt)
+		require.NoError(t, err)
+		data = append(data, payload...)
+	}
+	var want []byte
+	for _, nalu := range [][]byte{aud, c.sps, c.ppss[0], idr} {
+		want = append(want, 0, 0, 0, 1)
+		want = append(want, nalu...)
+	}
+	require.Equal(t, want, data[len(pesHeader):])
+}
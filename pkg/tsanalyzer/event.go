@@ -0,0 +1,100 @@
+// Package tsanalyzer provides analysis of MPEG-2 Transport Streams.
+//
+// The parsers read a TS from an io.Reader and report what they find as typed
+// events to a Handler. The events are the same values that the mp2ts-tools
+// command line programs print as JSON, e.g. ElementaryStreamInfo,
+// NaluFrameData, PsInfo, SCTE35Info and StreamStatistics.
+package tsanalyzer
+
+import "time"
+
+// Event is a piece of information produced by one of the parsers.
+//
+// The concrete types are, by group:
+//   - streams and programs: ElementaryStreamInfo, SdtInfo and ProgramChange
+//   - elementary stream data: PsInfo, NaluFrameData, AacFrameData, Ac3FrameData
+//     and SMPTE2038Data
+//   - SCTE-35: SCTE35Info and SCTE35Alignment
+//   - statistics and analysis: StreamStatistics, BitrateInfo, TimingError,
+//     TimingInfo, TR101290Error and TR101290Summary
+//   - tools writing a TS or MP4: PidFilterStatistics, CMAFTrack, HLSSegment,
+//     CutInfo, ConcatInput, MuxInfo, CBRInfo, FixChange, FixSummary,
+//     TimeJumpInfo and TimeshiftInfo
+type Event interface {
+	isEvent()
+}
+
+// Handler receives events from the parsers.
+// Returning an error stops the parsing and the error is returned by the parser.
+type Handler interface {
+	HandleEvent(ev Event) error
+}
+
+// HandlerFunc is an adapter to use an ordinary function as Handler.
+type HandlerFunc func(ev Event) error
+
+// HandleEvent calls f(ev).
+func (f HandlerFunc) HandleEvent(ev Event) error {
+	return f(ev)
+}
+
+// emit sends an event to h if h is not nil.
+func emit(h Handler, ev Event) error {
+	if h == nil {
+		return nil
+	}
+	return h.HandleEvent(ev)
+}
+
+func (ElementaryStreamInfo) isEvent() {}
+func (SdtInfo) isEvent()              {}
+func (PsInfo) isEvent()               {}
+func (NaluFrameData) isEvent()        {}
+func (AacFrameData) isEvent()         {}
+func (Ac3FrameData) isEvent()         {}
+func (SMPTE2038Data) isEvent()        {}
+func (SCTE35Info) isEvent()           {}
+func (StreamStatistics) isEvent()     {}
+func (PidFilterStatistics) isEvent()  {}
+
+// Options controls what the parsers analyze and how much detail the events contain.
+type Options struct {
+	MaxNrPictures   int              // Stop after this number of pictures (0 = no limit)
+	WaitForPS       bool             // Do not report NAL units before parameter sets (SPS/PPS) are found
+	SEIDetails      bool             // Include parsed SEI messages in NaluFrameData
+	PSDetails       bool             // Include parsed parameter sets in PsInfo
+	SMPTE2038       bool             // Parse SMPTE-2038 ancillary data
+	Audio           bool             // Parse AAC and AC-3/E-AC-3 frames and report frame data and statistics
+	Service         bool             // ParseInfo continues until service information (SDT) is found
+	Program         int              // Only analyze this program number (0 = all programs)
+	ServiceName     string           // Only analyze the program with this service name in the SDT
+	ExtractPID      int              // PID to extract in ExtractES (0 = first video PID)
+	PidsToDrop      []int            // PIDs to drop in FilterPids
+	DropStreams     []StreamSelector // Elementary streams to drop in FilterPids
+	KeepStreams     []StreamSelector // Elementary streams to keep in FilterPids (empty = all)
+	PIDMap          map[int]int      // PIDs to change in FilterPids, from input to output PID
+	ProgramNumbers  map[int]int      // Program numbers to change in FilterPids, from input to output number
+	PIDTimeout      time.Duration    // Max interval between packets on referenced PIDs in Validate (0 = DefaultPIDTimeout)
+	BitrateWindow   time.Duration    // Window for min/max bitrates in ParseBitrates (0 = DefaultBitrateWindow)
+	DelayWindow     time.Duration    // Window of the delay timeline in ParseTiming (0 = DefaultDelayWindow)
+	SCTE35Align     bool             // Report the video frame at the splice time of SCTE-35 cues in ParseAll
+	SCTE35PID       int              // PID for the cues in InjectSCTE35 (0 = DefaultSCTE35PID)
+	CutStart        CutPoint         // Start of the cut in CutTS (zero value = first IDR picture)
+	CutEnd          CutPoint         // End of the cut in CutTS (zero value = end of stream)
+	SegmentDuration float64          // Target segment duration in seconds in RemuxMP4 and SegmentHLS (0 = DefaultSegmentDuration)
+	Discontinuity   bool             // Set discontinuity_indicator instead of shifting timestamps in ConcatTS
+	VideoPID        int              // Video PID in MuxES (0 = DefaultVideoPID)
+	AudioPID        int              // Audio PID in MuxES (0 = DefaultAudioPID)
+	PMTPID          int              // PMT PID in MuxES (0 = DefaultPMTPID)
+	FrameRate       float64          // Video frame rate in MuxES (0 = from the VUI)
+	MuxRate         int64            // Output bitrate in bits per second in RestampCBR
+	StripNulls      bool             // Drop null packets in FixTS
+	PSIInterval     time.Duration    // Max interval between PAT/PMT in FixTS (0 = no insertion)
+	TimeOffset      int64            // Offset of all timestamps in 90kHz units in TimeshiftTS
+	PIDOffsets      map[int]int64    // Extra PTS/DTS offset per PID in 90kHz units in TimeshiftTS
+	Rebase          bool             // Shift so that the first PCR or PTS becomes RebaseTo in TimeshiftTS
+	RebaseTo        int64            // Target of the first timestamp with Rebase in 90kHz units
+	PCROnly         bool             // Only shift PCRs in TimeshiftTS
+	PESOnly         bool             // Only shift PTS/DTS in TimeshiftTS
+	TimeJumps       []TimeJump       // Changes of the offset during the stream in TimeshiftTS
+}
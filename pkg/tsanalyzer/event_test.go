@@ -0,0 +1,42 @@
+package tsanalyzer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// collectEvents runs a parser with a handler that collects all its events,
+// and requires that it succeeds.
+func collectEvents(t *testing.T, run func(h Handler) error) []Event {
+	t.Helper()
+	var events []Event
+	h := HandlerFunc(func(ev Event) error {
+		events = append(events, ev)
+		return nil
+	})
+	require.NoError(t, run(h))
+	return events
+}
+
+// eventsOf returns the events of type T in order.
+func eventsOf[T Event](events []Event) []T {
+	var evs []T
+	for _, ev := range events {
+		if e, ok := ev.(T); ok {
+			evs = append(evs, e)
+		}
+	}
+	return evs
+}
+
+// lastEventOf returns the last event of type T, or its zero value if there is none.
+func lastEventOf[T Event](events []Event) T {
+	var last T
+	for _, ev := range events {
+		if e, ok := ev.(T); ok {
+			last = e
+		}
+	}
+	return last
+}
@@ -1,4 +1,4 @@
-package internal
+package tsanalyzer
 
 import (
 	"bufio"
@@ -8,20 +8,22 @@ import (
 
 	"github.com/Eyevinn/mp4ff/avc"
 	"github.com/Eyevinn/mp4ff/hevc"
-	"github.com/asticode/go-astits"
+	slices "golang.org/x/exp/slices"
 )
 
-// ExtractES extracts elementary stream from a TS file
-func ExtractES(ctx context.Context, textWriter io.Writer, esWriter io.Writer, f io.Reader, o Options) error {
+// ExtractES extracts elementary stream from a TS file.
+// The first video PID of the selected programs is extracted unless o.ExtractPID is set.
+func ExtractES(ctx context.Context, f io.Reader, esWriter io.Writer, h Handler, o Options) error {
 	rd := bufio.NewReaderSize(f, 1000*PacketSize)
-	dmx := astits.NewDemuxer(ctx, rd)
-	pmtPID := -1
+	var ds demuxState
+	dmx := newDemuxer(ctx, rd, &ds)
+	programs := newProgramTracker(o)
 	esKinds := make(map[uint16]string)
 	targetPID := uint16(0)
 	extracting := false
+	extracted := false
 	hasAVCPS := false
 	hasHEVCPS := false
-	jp := &JsonPrinter{W: textWriter, Indent: o.Indent}
 
 dataLoop:
 	for {
@@ -40,38 +42,47 @@ dataLoop:
 			return fmt.Errorf("reading next data %w", err)
 		}
 
-		// Print PID information
-		if pmtPID < 0 && d.PMT != nil {
-			// Loop through elementary streams
-			for _, es := range d.PMT.ElementaryStreams {
-				streamInfo := ParseAstitsElementaryStreamInfo(es)
-				if streamInfo != nil {
-					esKinds[es.ElementaryPID] = streamInfo.Codec
-					jp.Print(streamInfo, o.ShowStreamInfo)
-
-					// Select target PID
-					if targetPID == 0 && (streamInfo.Codec == "AVC" || streamInfo.Codec == "HEVC") {
-						if o.ExtractPID == 0 {
-							// Auto-select first video PID
-							targetPID = es.ElementaryPID
-						} else if int(es.ElementaryPID) == o.ExtractPID {
-							// User-specified PID
-							targetPID = es.ElementaryPID
-						}
+		// PID information of the selected programs
+		pmts, changes := programs.update(d, &ds)
+		for _, pmt := range pmts {
+			for _, streamInfo := range programStreams(pmt) {
+				esKinds[streamInfo.PID] = streamInfo.Codec
+				if err := emit(h, streamInfo); err != nil {
+					return err
+				}
+
+				// Select target PID
+				if targetPID == 0 && (streamInfo.Codec == "AVC" || streamInfo.Codec == "HEVC") {
+					if o.ExtractPID == 0 {
+						// Auto-select first video PID
+						targetPID = streamInfo.PID
+					} else if int(streamInfo.PID) == o.ExtractPID {
+						// User-specified PID
+						targetPID = streamInfo.PID
 					}
 				}
 			}
-			pmtPID = int(d.PID)
+		}
 
-			if targetPID == 0 {
-				if o.ExtractPID == 0 {
-					return fmt.Errorf("no video PID found in stream")
-				}
-				return fmt.Errorf("specified PID %d not found or not a video stream", o.ExtractPID)
+		for _, c := range changes {
+			if err := emit(h, c); err != nil {
+				return err
+			}
+			for _, streamInfo := range c.New.Streams {
+				esKinds[streamInfo.PID] = streamInfo.Codec
+			}
+			// Wait for new parameter sets if the extracted stream has changed
+			if slices.Contains(c.changedPIDs(), targetPID) {
+				hasAVCPS = false
+				hasHEVCPS = false
+				extracting = false
 			}
 		}
 
-		if pmtPID == -1 {
+		if targetPID == 0 {
+			if programs.complete() {
+				break dataLoop
+			}
 			continue
 		}
 
@@ -142,12 +153,22 @@ dataLoop:
 			if err != nil {
 				return fmt.Errorf("writing elementary stream data: %w", err)
 			}
+			extracted = true
 		}
 	}
 
-	if !extracting {
+	if err := programs.err(); err != nil {
+		return err
+	}
+	if targetPID == 0 {
+		if o.ExtractPID == 0 {
+			return fmt.Errorf("no video PID found in stream")
+		}
+		return fmt.Errorf("specified PID %d not found or not a video stream", o.ExtractPID)
+	}
+	if !extracted {
 		return fmt.Errorf("no parameter sets found in stream, extraction did not start")
 	}
 
-	return jp.Error()
+	return nil
 }
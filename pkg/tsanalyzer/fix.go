@@ -0,0 +1,372 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+)
+
+// Names of the changes made by FixTS
+const (
+	FixResync        = "resync"
+	FixDamagedPacket = "damaged_packet"
+	FixDuplicate     = "duplicate"
+	FixContinuity    = "continuity"
+	FixPSIInserted   = "psi_inserted"
+	FixTruncated     = "truncated"
+)
+
+// FixChange is a change made by FixTS. Packet and Offset are the input packet
+// number and byte offset, and PID is -1 if the change is not for a PID.
+type FixChange struct {
+	Action      string `json:"action"`
+	PID         int    `json:"pid"`
+	Packet      int64  `json:"packet"`
+	Offset      int64  `json:"offset"`
+	Description string `json:"description"`
+}
+
+func (FixChange) isEvent() {}
+
+// FixSummary is reported by FixTS at the end. InputPackets counts the
+// complete input packets, including duplicates and null packets.
+type FixSummary struct {
+	InputPackets   int64 `json:"inputPackets"`
+	Packets        int64 `json:"packets"`
+	SkippedBytes   int64 `json:"skippedBytes"`
+	Resyncs        int   `json:"resyncs"`
+	DamagedPackets int   `json:"damagedPackets"`
+	Duplicates     int   `json:"duplicates"`
+	CCRepairs      int   `json:"ccRepairs"`
+	NullsStripped  int64 `json:"nullsStripped"`
+	PSIInserted    int   `json:"psiInserted"`
+}
+
+func (FixSummary) isEvent() {}
+
+// tsFixer is the state of FixTS.
+type tsFixer struct {
+	w          io.Writer
+	h          Handler
+	stripNulls bool
+	interval   int64 // PSI interval in 27MHz ticks, 0 = no insertion
+	nr         int64 // input packet number
+	offset     int64 // input byte offset
+	inCC       map[int]uint8
+	outCC      map[int]uint8
+	last       map[int][]byte // payload of the last packet with payload per PID
+	lastNr     map[int]int64  // input packet number of the last packet with payload per PID
+	repeated   map[int]bool   // the last packet with payload was a dropped duplicate
+	sections   map[int]*sectionAssembler
+	pat        []byte
+	pmts       map[int][]byte // PMT section per PMT PID
+	lastPSI    map[int]int64  // time of the last PAT or PMT per PID
+	clock      *pcrClock
+	summary    FixSummary
+}
+
+// FixTS writes a repaired copy of the TS in f to tsWriter. After lost sync,
+// bytes are skipped until sync is found again, and packets that are cut short
+// by the next sync byte are dropped. A packet that directly follows a packet
+// on the same PID with the same continuity counter and payload is dropped as a
+// duplicate, but only once in a row. The continuity counters are rewritten so
+// that they are continuous per PID. With
+// o.StripNulls, null packets are dropped. With o.PSIInterval, the last PAT and
+// PMT are repeated if they have not been sent for that interval, based on the
+// PCR. Each change is reported as a FixChange, and a FixSummary is reported
+// at the end.
+func FixTS(ctx context.Context, f io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	x := &tsFixer{
+		w:          tsWriter,
+		h:          h,
+		stripNulls: o.StripNulls,
+		interval:   durationToTicks(o.PSIInterval),
+		inCC:       make(map[int]uint8),
+		outCC:      make(map[int]uint8),
+		last:       make(map[int][]byte),
+		lastNr:     make(map[int]int64),
+		repeated:   make(map[int]bool),
+		sections:   make(map[int]*sectionAssembler),
+		pmts:       make(map[int][]byte),
+		lastPSI:    make(map[int]int64),
+		clock:      newPCRClock(),
+	}
+	hasSynced := false
+	var pkt packet.Packet
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		buf, err := rd.Peek(PacketSize + 1)
+		if len(buf) == 0 {
+			if err == nil || err == io.EOF {
+				break dataLoop
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		if buf[0] != SyncByte {
+			skipped, err := findSync(rd)
+			x.summary.SkippedBytes += skipped
+			x.summary.Resyncs++
+			if err := x.report(FixResync, -1, "skipped %d bytes to find sync", skipped); err != nil {
+				return err
+			}
+			x.offset += skipped
+			if err == io.EOF {
+				break dataLoop
+			}
+			if err != nil {
+				return fmt.Errorf("syncing with reader %w", err)
+			}
+			hasSynced = true
+			continue
+		}
+		hasSynced = true
+		if len(buf) < PacketSize {
+			if err := x.report(FixTruncated, -1, "dropped %d bytes at the end", len(buf)); err != nil {
+				return err
+			}
+			x.summary.SkippedBytes += int64(len(buf))
+			break dataLoop
+		}
+		copy(pkt[:], buf)
+		if len(buf) > PacketSize && buf[PacketSize] != SyncByte {
+			// The next packet does not start where expected
+			if _, err := rd.Discard(1); err != nil {
+				return err
+			}
+			skipped, err := findSync(rd)
+			n := skipped + 1
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("syncing with reader %w", err)
+			}
+			if n < PacketSize {
+				x.summary.DamagedPackets++
+				x.summary.SkippedBytes += n
+				if err := x.report(FixDamagedPacket, packet.Pid(&pkt), "dropped packet of %d bytes", n); err != nil {
+					return err
+				}
+				x.offset += n
+				continue
+			}
+			// Bytes have been inserted after the packet
+			x.summary.SkippedBytes += n - PacketSize
+			x.summary.Resyncs++
+			if err := x.packet(&pkt); err != nil {
+				return err
+			}
+			if err := x.report(FixResync, -1, "skipped %d bytes to find sync", n-PacketSize); err != nil {
+				return err
+			}
+			x.offset += n - PacketSize
+			continue
+		}
+		if _, err := rd.Discard(PacketSize); err != nil {
+			return err
+		}
+		if err := x.packet(&pkt); err != nil {
+			return err
+		}
+	}
+	if !hasSynced {
+		return fmt.Errorf("no TS sync found")
+	}
+	return emit(h, x.summary)
+}
+
+func (x *tsFixer) report(action string, pid int, format string, args ...any) error {
+	return emit(x.h, FixChange{
+		Action:      action,
+		PID:         pid,
+		Packet:      x.nr,
+		Offset:      x.offset,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// packet handles an input packet with correct length.
+func (x *tsFixer) packet(pkt *packet.Packet) error {
+	defer func() {
+		x.nr++
+		x.offset += PacketSize
+	}()
+	x.summary.InputPackets++
+	pid := packet.Pid(pkt)
+	if pid == NullPID {
+		if x.stripNulls {
+			x.summary.NullsStripped++
+			return nil
+		}
+		return x.write(pkt)
+	}
+	if pcr, ok := packetPCR(pkt); ok {
+		x.clock.update(pid, pcr, x.nr)
+	}
+	if err := x.insertPSI(pkt); err != nil {
+		return err
+	}
+
+	cc := packet.ContinuityCounter(pkt)
+	last, seen := x.inCC[pid]
+	if packet.ContainsPayload(pkt) {
+		payload, err := packet.Payload(pkt)
+		if err != nil {
+			payload = nil
+		}
+		// Other packets with the same counter, e.g. repeated PSI with a constant
+		// counter, are kept and get a new counter
+		if seen && cc == last && x.lastNr[pid] == x.nr-1 && !x.repeated[pid] && bytes.Equal(payload, x.last[pid]) {
+			x.summary.Duplicates++
+			x.repeated[pid] = true
+			x.lastNr[pid] = x.nr
+			return x.report(FixDuplicate, pid, "dropped duplicate packet with continuity counter %d", cc)
+		}
+		x.repeated[pid] = false
+		x.lastNr[pid] = x.nr
+		discontinuity := packet.ContainsAdaptationField(pkt) && adaptationfield.Length(pkt) > 0 &&
+			adaptationfield.IsDiscontinuous(pkt)
+		if seen && cc != (last+1)&0x0f && !discontinuity {
+			x.summary.CCRepairs++
+			if err := x.report(FixContinuity, pid, "continuity counter %d after %d", cc, last); err != nil {
+				return err
+			}
+		}
+		x.last[pid] = append(x.last[pid][:0], payload...)
+	}
+	x.inCC[pid] = cc
+
+	if pid == 0 || x.pmts[pid] != nil || x.isPMTPID(pid) {
+		x.psi(pkt)
+	}
+	return x.write(pkt)
+}
+
+// isPMTPID tells if pid is a PMT PID in the last PAT.
+func (x *tsFixer) isPMTPID(pid int) bool {
+	if x.pat == nil {
+		return false
+	}
+	for _, pmtPID := range patPrograms(x.pat) {
+		if pmtPID == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// psi saves the last PAT and PMT sections.
+func (x *tsFixer) psi(pkt *packet.Packet) {
+	pid := packet.Pid(pkt)
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return
+	}
+	a := x.sections[pid]
+	if a == nil {
+		a = &sectionAssembler{}
+		x.sections[pid] = a
+	}
+	for _, section := range a.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		switch {
+		case pid == 0 && section[0] == 0x00:
+			x.pat = section
+		case pid != 0 && section[0] == 0x02:
+			x.pmts[pid] = section
+		default:
+			continue
+		}
+		if x.clock.valid() {
+			x.lastPSI[pid] = x.clock.ticks(x.nr)
+		}
+	}
+}
+
+// insertPSI writes the last PAT and PMTs if they have not been sent for the
+// PSI interval. A PID with a partial section in the input waits until pkt
+// starts a new section on it, so that the section is not cut in half.
+func (x *tsFixer) insertPSI(pkt *packet.Packet) error {
+	if x.interval == 0 || x.pat == nil || !x.clock.valid() {
+		return nil
+	}
+	now := x.clock.ticks(x.nr)
+	pids := []int{0}
+	for _, pmtPID := range patPrograms(x.pat) {
+		if x.pmts[pmtPID] != nil {
+			pids = append(pids, pmtPID)
+		}
+	}
+	sort.Ints(pids[1:])
+	for _, pid := range pids {
+		last, ok := x.lastPSI[pid]
+		if !ok {
+			x.lastPSI[pid] = now
+			continue
+		}
+		if now-last <= x.interval || x.sectionPending(pid, pkt) {
+			continue
+		}
+		section := x.pmts[pid]
+		name := "PMT"
+		if pid == 0 {
+			section, name = x.pat, "PAT"
+		}
+		var cc uint8 // set by write
+		pkts := sectionPackets(pid, section, &cc)
+		for i := range pkts {
+			if err := x.write(&pkts[i]); err != nil {
+				return err
+			}
+		}
+		x.lastPSI[pid] = now
+		x.summary.PSIInserted++
+		if err := x.report(FixPSIInserted, pid, "inserted %s after %.0fms", name, float64(now-last)*1000/PcrTimeScale); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectionPending tells if a section on pid has started in the input but is not
+// complete before pkt.
+func (x *tsFixer) sectionPending(pid int, pkt *packet.Packet) bool {
+	a := x.sections[pid]
+	if a == nil || a.idle() {
+		return false
+	}
+	if packet.Pid(pkt) != pid || !packet.PayloadUnitStartIndicator(pkt) {
+		return true
+	}
+	// The rest of the section is before the pointer_field offset
+	payload, err := packet.Payload(pkt)
+	return err == nil && len(payload) > 0 && payload[0] != 0
+}
+
+// write writes pkt with a continuity counter that follows the previous
+// packet on the PID.
+func (x *tsFixer) write(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	if pid != NullPID {
+		cc, ok := x.outCC[pid]
+		switch {
+		case !ok:
+			cc = packet.ContinuityCounter(pkt)
+		case packet.ContainsPayload(pkt):
+			cc = (cc + 1) & 0x0f
+		}
+		x.outCC[pid] = cc
+		pkt[3] = pkt[3]&0xf0 | cc
+	}
+	x.summary.Packets++
+	return WritePacket(pkt, x.w)
+}
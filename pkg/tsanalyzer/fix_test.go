@@ -0,0 +1,227 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func fixData(t *testing.T, data []byte, o Options) ([]byte, []FixChange, FixSummary) {
+	t.Helper()
+	var out bytes.Buffer
+	events := collectEvents(t, func(h Handler) error {
+		return FixTS(context.TODO(), bytes.NewReader(data), &out, h, o)
+	})
+	summary := lastEventOf[FixSummary](events)
+	require.Equal(t, 0, out.Len()%PacketSize)
+	require.Equal(t, int64(out.Len()/PacketSize), summary.Packets)
+	return out.Bytes(), eventsOf[FixChange](events), summary
+}
+
+func TestFixTS(t *testing.T) {
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	nrPackets := len(data) / PacketSize
+	pkt := func(nr int) []byte {
+		return data[nr*PacketSize : (nr+1)*PacketSize]
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		out, changes, summary := fixData(t, data, Options{})
+		require.Equal(t, data, out)
+		require.Empty(t, changes)
+		require.Equal(t, FixSummary{InputPackets: int64(nrPackets), Packets: int64(nrPackets)}, summary)
+	})
+
+	t.Run("damaged", func(t *testing.T) {
+		null := nullPacket()
+		var damaged []byte
+		damaged = append(damaged, make([]byte, 7)...) // garbage before the first packet
+		for i := 0; i < nrPackets; i++ {
+			switch i {
+			case 20: // audio packet cut short
+				damaged = append(damaged, pkt(i)[:100]...)
+			case 30: // audio packet sent twice
+				damaged = append(damaged, pkt(i)...)
+				damaged = append(damaged, pkt(i)...)
+			case 40: // video packet lost
+			default:
+				damaged = append(damaged, pkt(i)...)
+			}
+			switch i {
+			case 10:
+				damaged = append(damaged, make([]byte, 50)...)
+			case 50:
+				for j := 0; j < 3; j++ {
+					damaged = append(damaged, null[:]...)
+				}
+			}
+		}
+		_, before := validateData(t, damaged)
+		require.Greater(t, before.Errors[ContinuityCountError], 0)
+
+		out, changes, summary := fixData(t, damaged, Options{StripNulls: true})
+		require.Equal(t, FixSummary{
+			InputPackets:   int64(nrPackets + 2),
+			Packets:        int64(nrPackets - 2),
+			SkippedBytes:   7 + 50 + 100,
+			Resyncs:        2,
+			DamagedPackets: 1,
+			Duplicates:     1,
+			CCRepairs:      2,
+			NullsStripped:  3,
+		}, summary)
+		var actions []string
+		for _, c := range changes {
+			actions = append(actions, c.Action)
+		}
+		require.Equal(t, []string{FixResync, FixResync, FixDamagedPacket, FixContinuity, FixDuplicate, FixContinuity}, actions)
+		require.Equal(t, int64(0), changes[0].Offset)
+		require.Equal(t, int64(7+11*PacketSize), changes[1].Offset)
+		require.Equal(t, 257, changes[2].PID)
+		require.Equal(t, 256, changes[5].PID)
+
+		// Apart from the lost packets, only the continuity counters differ
+		j := 0
+		for i := 0; i < nrPackets; i++ {
+			if i == 20 || i == 40 {
+				continue
+			}
+			got := out[j*PacketSize : (j+1)*PacketSize]
+			require.Equal(t, pkt(i)[:3], got[:3], "packet %d", i)
+			require.Equal(t, pkt(i)[4:], got[4:], "packet %d", i)
+			j++
+		}
+		_, after := validateData(t, out)
+		require.Equal(t, 0, after.Errors[ContinuityCountError])
+	})
+
+	t.Run("repeats", func(t *testing.T) {
+		// PAT and PMT are repeated with a constant continuity counter, and
+		// audio packet 30 is sent three times in a row
+		var repeated []byte
+		psiPackets := 0
+		for i := 0; i < nrPackets; i++ {
+			var p packet.Packet
+			copy(p[:], pkt(i))
+			if pid := p.PID(); pid == 0 || pid == 4096 {
+				p[3] &= 0xf0
+				psiPackets++
+			}
+			repeated = append(repeated, p[:]...)
+			if i == 30 {
+				repeated = append(repeated, p[:]...)
+				repeated = append(repeated, p[:]...)
+			}
+		}
+		_, before := validateData(t, repeated)
+		require.Greater(t, before.Errors[ContinuityCountError], 0)
+
+		out, _, summary := fixData(t, repeated, Options{})
+		require.Equal(t, 1, summary.Duplicates)
+		// All but the first PAT and PMT, and the third audio packet
+		require.Equal(t, psiPackets-2+1, summary.CCRepairs)
+		require.Equal(t, int64(nrPackets+1), summary.Packets)
+		_, after := validateData(t, out)
+		require.Equal(t, 0, after.Errors[ContinuityCountError])
+		require.Equal(t, 0, after.Errors[PATError])
+		require.Equal(t, 0, after.Errors[PMTError])
+	})
+
+	t.Run("missing PSI", func(t *testing.T) {
+		// Only the first PAT and PMT are kept
+		var stripped []byte
+		for i := 0; i < nrPackets; i++ {
+			var p packet.Packet
+			copy(p[:], pkt(i))
+			if pid := p.PID(); (pid == 0 || pid == 4096) && i > 2 {
+				continue
+			}
+			stripped = append(stripped, pkt(i)...)
+		}
+		_, before := validateData(t, stripped)
+		require.Greater(t, before.Errors[PATError], 0)
+
+		out, changes, summary := fixData(t, stripped, Options{PSIInterval: psiInterval / 2})
+		require.Greater(t, summary.PSIInserted, 0)
+		require.Len(t, changes, summary.PSIInserted)
+		require.Equal(t, FixPSIInserted, changes[0].Action)
+		require.Equal(t, 0, changes[0].PID)
+		require.Equal(t, 4096, changes[1].PID)
+		_, after := validateData(t, out)
+		require.Equal(t, 0, after.Errors[PATError])
+		require.Equal(t, 0, after.Errors[PMTError])
+		require.Equal(t, 0, after.Errors[ContinuityCountError])
+	})
+
+	t.Run("PMT in two packets", func(t *testing.T) {
+		var descriptors []byte
+		for len(descriptors) < 200 {
+			descriptors = append(descriptors, 0x05, 0x04, 'T', 'E', 'S', 'T') // registration_descriptor
+		}
+		pmt := newPMTSection(1, 256, []pmtStream{{streamType: 0x1b, pid: 256, descriptors: descriptors}})
+		var patCC, pmtCC uint8
+		var stream []byte
+		add := func(pkts ...packet.Packet) {
+			for _, p := range pkts {
+				stream = append(stream, p[:]...)
+			}
+		}
+		pcr := int64(0)
+		addPCRs := func(n int) {
+			for i := 0; i < n; i++ {
+				var p packet.Packet
+				p[0], p[1], p[2], p[3], p[4], p[5] = SyncByte, 0x01, 0x00, 0x20, PacketSize-5, 0x10
+				gots.InsertPCR(p[6:12], uint64(pcr))
+				for j := 12; j < PacketSize; j++ {
+					p[j] = 0xff
+				}
+				add(p)
+				pcr += PcrTimeScale / 100
+			}
+		}
+		nrPMTs := 0
+		for i := 0; i < 4; i++ {
+			// The PMT interval is exceeded between the two packets of the section
+			pmtPkts := sectionPackets(4096, pmt, &pmtCC)
+			require.Len(t, pmtPkts, 2)
+			add(sectionPackets(0, patSection(1, 1, 4096), &patCC)...)
+			add(pmtPkts[0])
+			addPCRs(60)
+			add(pmtPkts[1])
+			addPCRs(10)
+			nrPMTs++
+		}
+
+		out, changes, summary := fixData(t, stream, Options{PSIInterval: psiInterval})
+		require.Greater(t, summary.PSIInserted, 0)
+		insertedPMTs := 0
+		for _, c := range changes {
+			if c.Action == FixPSIInserted && c.PID == 4096 {
+				insertedPMTs++
+			}
+		}
+		var a sectionAssembler
+		var sections [][]byte
+		for i := 0; i < len(out); i += PacketSize {
+			var p packet.Packet
+			copy(p[:], out[i:])
+			if p.PID() != 4096 {
+				continue
+			}
+			payload, err := packet.Payload(&p)
+			require.NoError(t, err)
+			sections = append(sections, a.write(p.PayloadUnitStartIndicator(), payload)...)
+		}
+		// No input section is cut by an inserted one
+		require.Len(t, sections, nrPMTs+insertedPMTs)
+		for _, section := range sections {
+			require.Equal(t, pmt, section)
+		}
+	})
+}
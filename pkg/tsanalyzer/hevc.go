@@ -1,4 +1,4 @@
-package internal
+package tsanalyzer
 
 import (
 	"encoding/hex"
@@ -55,7 +55,9 @@ func (a *HevcPS) setPPS(nalu []byte) error {
 	return nil
 }
 
-func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options) (*HevcPS, error) {
+// ParseHEVCPES parses an HEVC PES packet and reports parameter sets and NAL units to h.
+// The returned HevcPS should be passed to the next call for the same PID.
+func ParseHEVCPES(d *astits.DemuxerData, ps *HevcPS, h Handler, o Options) (*HevcPS, error) {
 	pid := d.PID
 	pes := d.PES
 	fp := d.FirstPacket
@@ -77,7 +79,7 @@ func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options)
 	if fp != nil && fp.AdaptationField != nil {
 		nfd.RAI = fp.AdaptationField.RandomAccessIndicator
 		if nfd.RAI {
-			ps.Statistics.RAIPTS = append(ps.Statistics.IDRPTS, pts.Base)
+			ps.Statistics.AddRAI(pts.Base)
 		}
 	}
 
@@ -88,7 +90,7 @@ func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options)
 		// Use PTS as DTS in statistics if DTS is not present
 		nfd.DTS = pts.Base
 	}
-	ps.Statistics.TimeStamps = append(ps.Statistics.TimeStamps, nfd.DTS)
+	ps.Statistics.AddTimestamp(nfd.DTS)
 
 	data := pes.Data
 	firstPS := false
@@ -116,7 +118,7 @@ func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options)
 		case hevc.NALU_SEI_PREFIX, hevc.NALU_SEI_SUFFIX:
 
 			var seiData any
-			if o.ShowSEIDetails && len(ps.spss) > 0 {
+			if o.SEIDetails && len(ps.spss) > 0 {
 				sps := ps.spss[0]
 				seiMessages, err := hevc.ParseSEINalu(nalu, sps)
 				if err != nil {
@@ -142,7 +144,7 @@ func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options)
 			})
 			continue
 		case hevc.NALU_IDR_W_RADL, hevc.NALU_IDR_N_LP:
-			ps.Statistics.IDRPTS = append(ps.Statistics.IDRPTS, pts.Base)
+			ps.Statistics.AddIDR(pts.Base)
 		}
 		// Parse slice type for video NAL units
 		if hevc.IsVideoNaluType(naluType) {
@@ -157,7 +159,7 @@ func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options)
 			Data: nil,
 		})
 	}
-	if jp == nil {
+	if h == nil {
 		return ps, nil
 	}
 
@@ -165,29 +167,34 @@ func ParseHEVCPES(jp *JsonPrinter, d *astits.DemuxerData, ps *HevcPS, o Options)
 		vpsHex := hex.EncodeToString(ps.vpsnalu)
 		if vpsHex != ps.lastVPSHex {
 			ps.lastVPSHex = vpsHex
-			jp.PrintPS(pid, "VPS", 0, ps.vpsnalu, nil, o.VerbosePSInfo, o.ShowPS)
+			if err := emit(h, NewPsInfo(pid, "VPS", 0, ps.vpsnalu, nil, o.PSDetails)); err != nil {
+				return nil, err
+			}
 		}
 		spsHex := hex.EncodeToString(ps.spsnalu)
 		if spsHex != ps.lastSPSHex {
 			ps.lastSPSHex = spsHex
 			for nr := range ps.spss {
-				jp.PrintPS(pid, "SPS", nr, ps.spsnalu, ps.spss[nr], o.VerbosePSInfo, o.ShowPS)
+				if err := emit(h, NewPsInfo(pid, "SPS", nr, ps.spsnalu, ps.spss[nr], o.PSDetails)); err != nil {
+					return nil, err
+				}
 			}
 		}
 		for nr := range ps.ppss {
 			ppsHex := hex.EncodeToString(ps.ppsnalus[nr])
 			if ppsHex != ps.lastPPSHex[nr] {
 				ps.lastPPSHex[nr] = ppsHex
-				jp.PrintPS(pid, "PPS", nr, ps.ppsnalus[nr], ps.ppss[nr], o.VerbosePSInfo, o.ShowPS)
+				if err := emit(h, NewPsInfo(pid, "PPS", nr, ps.ppsnalus[nr], ps.ppss[nr], o.PSDetails)); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 
-	// Skip printing if WaitForPS is enabled and we don't have parameter sets yet
+	// Skip reporting if WaitForPS is enabled and we don't have parameter sets yet
 	if o.WaitForPS && !ps.hasPS() {
 		return ps, nil
 	}
 
-	jp.Print(nfd, o.ShowNALU)
-	return ps, jp.Error()
+	return ps, emit(h, nfd)
 }
@@ -0,0 +1,568 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+)
+
+// HLS cue tag styles for MediaPlaylist.CueTags
+const (
+	CueTagsNone      = ""
+	CueTagsCue       = "cue"       // EXT-X-CUE-OUT, EXT-X-CUE-OUT-CONT and EXT-X-CUE-IN
+	CueTagsDateRange = "daterange" // EXT-X-DATERANGE with SCTE35-OUT and SCTE35-IN
+)
+
+// HLSSegment is reported by SegmentHLS for each segment when it is complete.
+// PTS is the PTS of the first video picture and Duration is the time in seconds
+// to the first picture of the next segment. Cues are the SCTE-35 splice points
+// at the start of the segment.
+type HLSSegment struct {
+	Nr       int      `json:"nr"`
+	URI      string   `json:"uri"`
+	PTS      int64    `json:"pts"`
+	Duration float64  `json:"duration"`
+	Packets  int      `json:"packets"`
+	Cues     []HLSCue `json:"cues,omitempty"`
+}
+
+func (HLSSegment) isEvent() {}
+
+// HLSCue is a splice point. Out is true for the start of a break and false
+// for the return. Duration is the planned break duration in seconds.
+// Cue is missing for returns signaled by auto_return of a splice_insert.
+type HLSCue struct {
+	EventId    uint32      `json:"eventId"`
+	Out        bool        `json:"out"`
+	SpliceTime int64       `json:"spliceTime"`
+	Duration   float64     `json:"duration,omitempty"`
+	Cue        *SCTE35Info `json:"cue,omitempty"`
+}
+
+// SegmentWriterFunc returns the writer and the playlist URI for segment nr (starting at 1).
+// The writer of the previous segment is not used after the call.
+type SegmentWriterFunc func(nr int) (w io.Writer, uri string, err error)
+
+// hlsSegmenter is the state of SegmentHLS.
+type hlsSegmenter struct {
+	h          Handler
+	newSegment SegmentWriterFunc
+	target     int64 // target duration in 90kHz ticks
+	tsID       int
+	programNr  int
+	pmtPID     int
+	pmt        []byte
+	videoPID   int
+	videoCodec string
+	pids       map[int]bool // PIDs of the program
+	cuePIDs    map[int]bool
+	sections   map[int]*sectionAssembler
+	patCC      uint8
+	pmtCC      uint8
+
+	held    []packet.Packet // video PES packets until the picture type is known
+	heldPES []byte
+	heldPTS int64
+	heldDTS int64
+
+	w        io.Writer
+	seg      HLSSegment
+	lastPTS  int64 // highest PTS of the segment
+	lastDTS  int64
+	frameDur int64
+	cues     []HLSCue // cues that are not at a segment start yet
+}
+
+// SegmentHLS splits the selected program (Options.Program, or the lowest
+// program number) into TS segments. A segment starts at an IDR picture, or a
+// picture with random_access_indicator, when Options.SegmentDuration
+// (DefaultSegmentDuration if 0) has passed since the start of the segment, or
+// when an SCTE-35 splice point has passed. Each segment starts with a PAT with
+// only the selected program and the PMT, and they are repeated at the same
+// places as in the input. Packets of other programs are dropped.
+// The stream information of the program and an HLSSegment per segment are reported to h.
+func SegmentHLS(ctx context.Context, f io.Reader, newSegment SegmentWriterFunc, h Handler, o Options) error {
+	segDur := o.SegmentDuration
+	if segDur == 0 {
+		segDur = DefaultSegmentDuration
+	}
+	s := &hlsSegmenter{
+		h:          h,
+		newSegment: newSegment,
+		target:     int64(math.Round(segDur * TimeScale)),
+		programNr:  o.Program,
+		pmtPID:     -1,
+		videoPID:   -1,
+		pids:       make(map[int]bool),
+		cuePIDs:    make(map[int]bool),
+		sections:   make(map[int]*sectionAssembler),
+		patCC:      15,
+		pmtCC:      15,
+	}
+	reader := bufio.NewReader(f)
+	_, err := packet.Sync(reader)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+
+	var pkt packet.Packet
+	for {
+		select {
+		case <-ctx.Done():
+			return s.finish()
+		default:
+		}
+
+		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		if err := s.packet(&pkt); err != nil {
+			return err
+		}
+	}
+
+	if s.pmt == nil {
+		return fmt.Errorf("no PMT found for program %d", s.programNr)
+	}
+	if s.videoPID < 0 {
+		return fmt.Errorf("no video stream in program %d", s.programNr)
+	}
+	if err := s.finish(); err != nil {
+		return err
+	}
+	if s.seg.Nr == 0 {
+		return fmt.Errorf("no IDR picture found on PID %d", s.videoPID)
+	}
+	return nil
+}
+
+func (s *hlsSegmenter) packet(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	switch {
+	case pid == 0 || pid == s.pmtPID:
+		return s.psi(pkt)
+	case s.cuePIDs[pid]:
+		if err := s.cue(pkt); err != nil {
+			return err
+		}
+	case !s.pids[pid]:
+		return nil
+	}
+
+	if pid == s.videoPID && packet.PayloadUnitStartIndicator(pkt) {
+		if err := s.decide(false); err != nil {
+			return err
+		}
+		payload, err := packet.Payload(pkt)
+		if err != nil {
+			return s.write(pkt)
+		}
+		var ok bool
+		if s.heldPTS, s.heldDTS, ok = pesTimes(payload); !ok {
+			return s.write(pkt)
+		}
+		s.held = append(s.held[:0], *pkt)
+		if len(payload) > 9+int(payload[8]) {
+			s.heldPES = append(s.heldPES[:0], payload[9+int(payload[8]):]...)
+		}
+		if packet.ContainsAdaptationField(pkt) && adaptationfield.Length(pkt) > 0 && adaptationfield.IsRandomAccess(pkt) {
+			return s.decide(true)
+		}
+		return s.scan()
+	}
+	if s.held != nil {
+		s.held = append(s.held, *pkt)
+		if pid == s.videoPID {
+			if payload, err := packet.Payload(pkt); err == nil {
+				s.heldPES = append(s.heldPES, payload...)
+			}
+			return s.scan()
+		}
+		return nil
+	}
+	return s.write(pkt)
+}
+
+// psi handles PAT and PMT packets. The segments get their own PAT and PMT
+// packets, which are repeated where the input has them.
+func (s *hlsSegmenter) psi(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	sa := s.sections[pid]
+	if sa == nil {
+		sa = &sectionAssembler{}
+		s.sections[pid] = sa
+	}
+	for _, section := range sa.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		switch {
+		case pid == 0 && section[0] == 0x00 && s.pmtPID < 0:
+			if s.programNr, s.pmtPID, err = selectProgram(patPrograms(section), s.programNr); err != nil {
+				return err
+			}
+			s.tsID = int(section[3])<<8 | int(section[4])
+		case pid == 0 && section[0] == 0x00 && s.w != nil:
+			if err := s.writeSection(0, patSection(s.tsID, s.programNr, s.pmtPID), &s.patCC); err != nil {
+				return err
+			}
+		case pid == s.pmtPID && section[0] == 0x02:
+			p, ok := parsePMTSection(section)
+			if !ok || p.programNr != s.programNr {
+				continue
+			}
+			if bytes.Equal(section, s.pmt) {
+				if s.w != nil {
+					if err := s.writeSection(s.pmtPID, s.pmt, &s.pmtCC); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if s.pmt == nil {
+				if err := emitPMTStreams(s.h, s.programNr, section); err != nil {
+					return err
+				}
+			}
+			s.pmt = section
+			s.pids = map[int]bool{p.pcrPID: true}
+			for _, es := range p.streams {
+				s.pids[es.pid] = true
+				switch {
+				case es.streamType == scte35StreamType:
+					s.cuePIDs[es.pid] = true
+				case s.videoPID < 0 && es.streamType == 0x1b:
+					s.videoPID, s.videoCodec = es.pid, "AVC"
+				case s.videoPID < 0 && es.streamType == 0x24:
+					s.videoPID, s.videoCodec = es.pid, "HEVC"
+				}
+			}
+			if s.w != nil {
+				if err := s.writeSection(s.pmtPID, s.pmt, &s.pmtCC); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// cue decodes SCTE-35 sections and adds their splice points.
+func (s *hlsSegmenter) cue(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	sa := s.sections[pid]
+	if sa == nil {
+		sa = &sectionAssembler{}
+		s.sections[pid] = sa
+	}
+	for _, section := range sa.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		info, err := DecodeSCTE35(uint16(pid), section)
+		if err != nil {
+			return fmt.Errorf("cannot parse SCTE35 on PID %d: %w", pid, err)
+		}
+		s.cues = append(s.cues, hlsCues(info, s.lastPTS)...)
+	}
+	return nil
+}
+
+// hlsCues returns the splice points of a cue. Immediate splices are at now.
+func hlsCues(info SCTE35Info, now int64) []HLSCue {
+	cmd := info.SpliceCommand
+	adjust := func(pts uint64) int64 {
+		return AddPTS(int64(pts), int64(info.PTSAdjustment))
+	}
+	switch {
+	case cmd.Type == "SpliceInsert" && !cmd.Cancel:
+		c := HLSCue{EventId: cmd.EventId, Out: cmd.Out, Cue: &info}
+		switch {
+		case cmd.Immediate:
+			c.SpliceTime = now
+		case len(cmd.Components) > 0:
+			c.SpliceTime = adjust(cmd.Components[0].PTS)
+		default:
+			c.SpliceTime = adjust(cmd.PTS)
+		}
+		if !c.Out {
+			return []HLSCue{c}
+		}
+		c.Duration = float64(cmd.Duration) / TimeScale
+		cues := []HLSCue{c}
+		if cmd.AutoReturn && cmd.Duration > 0 {
+			cues = append(cues, HLSCue{EventId: cmd.EventId, SpliceTime: AddPTS(c.SpliceTime, int64(cmd.Duration))})
+		}
+		return cues
+	case cmd.Type == "TimeSignal":
+		var cues []HLSCue
+		for _, sd := range info.SegDesc {
+			if sd.Cancel {
+				continue
+			}
+			out, ok := segmentationOut(sd.TypeId)
+			if !ok {
+				continue
+			}
+			cues = append(cues, HLSCue{
+				EventId:    sd.EventId,
+				Out:        out,
+				SpliceTime: adjust(cmd.PTS),
+				Duration:   float64(sd.Duration) / TimeScale,
+				Cue:        &info,
+			})
+		}
+		return cues
+	}
+	return nil
+}
+
+// segmentationOut tells if a segmentation type starts (true) or ends (false)
+// a break or placement opportunity.
+func segmentationOut(typeId uint8) (out bool, ok bool) {
+	switch typeId {
+	case 0x22, 0x30, 0x32, 0x34, 0x36, 0x38, 0x3a, 0x3c, 0x3e, 0x44, 0x46:
+		return true, true
+	case 0x23, 0x31, 0x33, 0x35, 0x37, 0x39, 0x3b, 0x3d, 0x3f, 0x45, 0x47:
+		return false, true
+	}
+	return false, false
+}
+
+// scan looks for the first slice of the held picture.
+func (s *hlsSegmenter) scan() error {
+	for i := 0; i+3 < len(s.heldPES); i++ {
+		if s.heldPES[i] != 0 || s.heldPES[i+1] != 0 || s.heldPES[i+2] != 1 {
+			continue
+		}
+		header := s.heldPES[i+3]
+		if s.videoCodec == "AVC" {
+			if naluType := header & 0x1f; naluType >= 1 && naluType <= 5 {
+				return s.decide(naluType == 5)
+			}
+		} else if naluType := (header >> 1) & 0x3f; naluType < 32 {
+			return s.decide(naluType == 19 || naluType == 20)
+		}
+	}
+	return nil
+}
+
+// decide writes the held packets, starting a new segment first if the picture
+// is an IDR picture and the segment is long enough or a splice point has passed.
+func (s *hlsSegmenter) decide(idr bool) error {
+	if s.held == nil {
+		return nil
+	}
+	if idr && s.pmt != nil {
+		elapsed := SignedPTSDiff(s.heldPTS, s.seg.PTS)
+		if s.w == nil || elapsed >= s.target || (elapsed > 0 && s.splicePassed(s.heldPTS)) {
+			if err := s.startSegment(s.heldPTS); err != nil {
+				return err
+			}
+		}
+	}
+	if s.w != nil {
+		if SignedPTSDiff(s.heldPTS, s.lastPTS) > 0 {
+			s.lastPTS = s.heldPTS
+		}
+		if d := SignedPTSDiff(s.heldDTS, s.lastDTS); d > 0 && d < TimeScale {
+			s.frameDur = d
+		}
+		s.lastDTS = s.heldDTS
+	}
+	held := s.held
+	s.held = nil
+	for i := range held {
+		if err := s.write(&held[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *hlsSegmenter) splicePassed(pts int64) bool {
+	for _, c := range s.cues {
+		if SignedPTSDiff(pts, c.SpliceTime) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// startSegment ends the current segment and starts a new one with PAT and PMT.
+func (s *hlsSegmenter) startSegment(pts int64) error {
+	if s.w != nil {
+		s.seg.Duration = float64(SignedPTSDiff(pts, s.seg.PTS)) / TimeScale
+		if err := emit(s.h, s.seg); err != nil {
+			return err
+		}
+	}
+	w, uri, err := s.newSegment(s.seg.Nr + 1)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	s.seg = HLSSegment{Nr: s.seg.Nr + 1, URI: uri, PTS: pts}
+	s.lastPTS = pts
+	remaining := s.cues[:0]
+	for _, c := range s.cues {
+		if SignedPTSDiff(pts, c.SpliceTime) >= 0 {
+			s.seg.Cues = append(s.seg.Cues, c)
+		} else {
+			remaining = append(remaining, c)
+		}
+	}
+	s.cues = remaining
+	if err := s.writeSection(0, patSection(s.tsID, s.programNr, s.pmtPID), &s.patCC); err != nil {
+		return err
+	}
+	return s.writeSection(s.pmtPID, s.pmt, &s.pmtCC)
+}
+
+// finish writes the held packets and reports the last segment. Its duration
+// ends one frame after the highest PTS.
+func (s *hlsSegmenter) finish() error {
+	if err := s.decide(false); err != nil {
+		return err
+	}
+	if s.w == nil {
+		return nil
+	}
+	s.seg.Duration = float64(SignedPTSDiff(s.lastPTS, s.seg.PTS)+s.frameDur) / TimeScale
+	err := emit(s.h, s.seg)
+	s.w = nil
+	return err
+}
+
+func (s *hlsSegmenter) write(pkt *packet.Packet) error {
+	if s.w == nil {
+		return nil
+	}
+	s.seg.Packets++
+	return WritePacket(pkt, s.w)
+}
+
+func (s *hlsSegmenter) writeSection(pid int, section []byte, cc *uint8) error {
+	for _, p := range sectionPackets(pid, section, cc) {
+		if err := s.write(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patSection returns a PAT section with one program.
+func patSection(tsID, programNr, pmtPID int) []byte {
+	section := []byte{0x00, 0xb0, 13, byte(tsID >> 8), byte(tsID), 0xc1, 0x00, 0x00,
+		byte(programNr >> 8), byte(programNr), 0xe0 | byte(pmtPID>>8), byte(pmtPID)}
+	return append(section, gots.ComputeCRC(section)...)
+}
+
+// MediaPlaylist is an HLS media playlist for the segments reported by SegmentHLS.
+// CueTags is one of CueTagsNone, CueTagsCue and CueTagsDateRange.
+// ProgramDateTime is the wall-clock time of the first segment, and is
+// written if CueTags is CueTagsDateRange.
+type MediaPlaylist struct {
+	Segments        []HLSSegment
+	CueTags         string
+	ProgramDateTime time.Time
+}
+
+// Write writes the playlist as a VOD playlist.
+func (p MediaPlaylist) Write(w io.Writer) error {
+	if len(p.Segments) == 0 {
+		return fmt.Errorf("no segments")
+	}
+	targetDuration := 1
+	for _, seg := range p.Segments {
+		if d := int(math.Round(seg.Duration)); d > targetDuration {
+			targetDuration = d
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", targetDuration)
+	if p.CueTags == CueTagsDateRange {
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", formatDate(p.ProgramDateTime))
+	}
+	start := p.Segments[0].PTS
+	var breakStart, breakDuration float64 // elapsed time at the start of the current break
+	inBreak := false
+	outDates := make(map[uint32]time.Time)
+	elapsed := 0.0
+	for _, seg := range p.Segments {
+		for _, c := range seg.Cues {
+			switch p.CueTags {
+			case CueTagsCue:
+				switch {
+				case c.Out && c.Duration > 0:
+					fmt.Fprintf(&b, "#EXT-X-CUE-OUT:DURATION=%.3f\n", c.Duration)
+				case c.Out:
+					b.WriteString("#EXT-X-CUE-OUT\n")
+				default:
+					b.WriteString("#EXT-X-CUE-IN\n")
+				}
+			case CueTagsDateRange:
+				date := p.ProgramDateTime.Add(time.Duration(SignedPTSDiff(c.SpliceTime, start)) * time.Second / TimeScale)
+				switch {
+				case c.Out:
+					outDates[c.EventId] = date
+					fmt.Fprintf(&b, "#EXT-X-DATERANGE:ID=\"%d\",START-DATE=\"%s\"", c.EventId, formatDate(date))
+					if c.Duration > 0 {
+						fmt.Fprintf(&b, ",PLANNED-DURATION=%.3f", c.Duration)
+					}
+					fmt.Fprintf(&b, ",SCTE35-OUT=%s\n", cueHex(c.Cue))
+				case c.Cue != nil:
+					fmt.Fprintf(&b, "#EXT-X-DATERANGE:ID=\"%d\",START-DATE=\"%s\",SCTE35-IN=%s\n", c.EventId, formatDate(date), cueHex(c.Cue))
+				default:
+					// Return signaled by auto_return
+					outDate, ok := outDates[c.EventId]
+					if !ok {
+						continue
+					}
+					fmt.Fprintf(&b, "#EXT-X-DATERANGE:ID=\"%d\",START-DATE=\"%s\",END-DATE=\"%s\"\n", c.EventId, formatDate(outDate), formatDate(date))
+				}
+			}
+			if c.Out {
+				inBreak, breakStart, breakDuration = true, elapsed, c.Duration
+			} else {
+				inBreak = false
+			}
+		}
+		if p.CueTags == CueTagsCue && inBreak && elapsed > breakStart && breakDuration > 0 {
+			fmt.Fprintf(&b, "#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f,Duration=%.3f\n", elapsed-breakStart, breakDuration)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration, seg.URI)
+		elapsed += seg.Duration
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// cueHex returns the section of a cue as a hexadecimal-sequence.
+func cueHex(info *SCTE35Info) string {
+	section, err := base64.StdEncoding.DecodeString(info.Base64)
+	if err != nil {
+		return "0x"
+	}
+	return "0x" + hex.EncodeToString(section)
+}
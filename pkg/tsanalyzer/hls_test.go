@@ -0,0 +1,96 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentHLS(t *testing.T) {
+	f, err := os.Open("../../internal/testdata/80s_with_ad.ts")
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	var outputs []*bytes.Buffer
+	newSegment := func(nr int) (io.Writer, string, error) {
+		outputs = append(outputs, &bytes.Buffer{})
+		return outputs[nr-1], fmt.Sprintf("segment_%d.ts", nr), nil
+	}
+	var segments []HLSSegment
+	h := HandlerFunc(func(ev Event) error {
+		if seg, ok := ev.(HLSSegment); ok {
+			segments = append(segments, seg)
+		}
+		return nil
+	})
+	err = SegmentHLS(context.TODO(), f, newSegment, h, Options{SegmentDuration: 4})
+	require.NoError(t, err)
+	require.Len(t, segments, 21)
+	require.Len(t, outputs, 21)
+
+	// The segment before the splice point is cut short
+	require.Equal(t, 2.0, segments[2].Duration)
+	require.Len(t, segments[3].Cues, 1)
+	out := segments[3].Cues[0]
+	require.True(t, out.Out)
+	require.Equal(t, out.SpliceTime, segments[3].PTS)
+	require.Equal(t, 20.0, out.Duration)
+	// auto_return
+	require.Equal(t, []HLSCue{{EventId: out.EventId, SpliceTime: AddPTS(out.SpliceTime, 20*TimeScale)}}, segments[8].Cues)
+
+	for i, seg := range segments {
+		data := outputs[i].Bytes()
+		require.Equal(t, seg.Packets*PacketSize, len(data))
+		var pkt packet.Packet
+		copy(pkt[:], data)
+		require.Equal(t, 0, packet.Pid(&pkt), "PAT first in segment %d", seg.Nr)
+		copy(pkt[:], data[PacketSize:])
+		require.Equal(t, 4096, packet.Pid(&pkt), "PMT second in segment %d", seg.Nr)
+		copy(pkt[:], data[2*PacketSize:])
+		require.Equal(t, 256, packet.Pid(&pkt), "video third in segment %d", seg.Nr)
+		require.True(t, packet.PayloadUnitStartIndicator(&pkt))
+	}
+}
+
+func TestMediaPlaylist(t *testing.T) {
+	info := &SCTE35Info{Base64: "/DAAAAAAAAAAAAAAAAAAAAAA"}
+	p := MediaPlaylist{
+		Segments: []HLSSegment{
+			{URI: "1.ts", PTS: 90000, Duration: 4},
+			{URI: "2.ts", PTS: 450000, Duration: 4, Cues: []HLSCue{{EventId: 1, Out: true, SpliceTime: 450000, Duration: 8, Cue: info}}},
+			{URI: "3.ts", PTS: 810000, Duration: 4},
+			{URI: "4.ts", PTS: 1170000, Duration: 3.6, Cues: []HLSCue{{EventId: 1, SpliceTime: 1170000}}},
+		},
+		ProgramDateTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	header := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n"
+
+	p.CueTags = CueTagsCue
+	var b bytes.Buffer
+	require.NoError(t, p.Write(&b))
+	require.Equal(t, header+
+		"#EXTINF:4.000,\n1.ts\n"+
+		"#EXT-X-CUE-OUT:DURATION=8.000\n#EXTINF:4.000,\n2.ts\n"+
+		"#EXT-X-CUE-OUT-CONT:ElapsedTime=4.000,Duration=8.000\n#EXTINF:4.000,\n3.ts\n"+
+		"#EXT-X-CUE-IN\n#EXTINF:3.600,\n4.ts\n"+
+		"#EXT-X-ENDLIST\n", b.String())
+
+	p.CueTags = CueTagsDateRange
+	b.Reset()
+	require.NoError(t, p.Write(&b))
+	require.Equal(t, header+
+		"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00.000Z\n"+
+		"#EXTINF:4.000,\n1.ts\n"+
+		"#EXT-X-DATERANGE:ID=\"1\",START-DATE=\"2024-01-01T00:00:04.000Z\",PLANNED-DURATION=8.000,SCTE35-OUT=0xfc3000000000000000000000000000000000\n"+
+		"#EXTINF:4.000,\n2.ts\n#EXTINF:4.000,\n3.ts\n"+
+		"#EXT-X-DATERANGE:ID=\"1\",START-DATE=\"2024-01-01T00:00:04.000Z\",END-DATE=\"2024-01-01T00:00:12.000Z\"\n"+
+		"#EXTINF:3.600,\n4.ts\n"+
+		"#EXT-X-ENDLIST\n", b.String())
+}
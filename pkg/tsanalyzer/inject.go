@@ -0,0 +1,285 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+	"github.com/Comcast/gots/v2/pes"
+	"github.com/Comcast/gots/v2/psi"
+)
+
+const (
+	// DefaultSCTE35PID is the PID used by InjectSCTE35 if Options.SCTE35PID is 0.
+	DefaultSCTE35PID = 500
+	// DefaultPreroll is the time in seconds a cue is sent before its splice time.
+	DefaultPreroll = 4.0
+	// registrationDescriptorTag is the tag of the MPEG-2 registration_descriptor.
+	registrationDescriptorTag = 0x05
+)
+
+// SCTE35Event is a cue to insert with InjectSCTE35.
+// Time is the splice time in seconds after the first video PTS of the program.
+// If the splice command has a PTS, that is used as splice time instead.
+// pts_time is the splice time minus PTSAdjustment.
+// Preroll is how many seconds before the splice time the cue is sent
+// (DefaultPreroll if not set). Cues with splice_immediate_flag are sent at Time.
+type SCTE35Event struct {
+	Time    float64  `json:"time"`
+	Preroll *float64 `json:"preroll,omitempty"`
+	SCTE35Info
+}
+
+// scheduledCue is an encoded cue and the PTS when it is sent.
+type scheduledCue struct {
+	sendAt  int64
+	section []byte
+}
+
+// InjectSCTE35 writes the TS to tsWriter with events inserted as SCTE-35 cues on
+// Options.SCTE35PID (DefaultSCTE35PID if 0). The PID is added to the PMT of the
+// selected program (Options.Program, or the lowest program number) with
+// stream_type 0x86 and a CUEI registration descriptor. Cues are sent when the
+// PCR of the program reaches their send time. The stream information of the
+// program and each inserted cue are reported to h.
+func InjectSCTE35(ctx context.Context, f io.Reader, tsWriter io.Writer, events []SCTE35Event, h Handler, o Options) error {
+	cuePID := o.SCTE35PID
+	if cuePID == 0 {
+		cuePID = DefaultSCTE35PID
+	}
+	reader := bufio.NewReader(f)
+	_, err := packet.Sync(reader)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+
+	patAsm := &sectionAssembler{}
+	pmtAsm := &sectionAssembler{}
+	pmtPID := -1
+	var pmtCC, cueCC uint8
+	programNr := o.Program
+	pcrPID, videoPID := -1, -1
+	pmtWritten := false
+	var cues []scheduledCue
+	base, now := int64(-1), int64(-1)
+
+	var pkt packet.Packet
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		pid := packet.Pid(&pkt)
+
+		switch {
+		case pid == 0:
+			payload, err := packet.Payload(&pkt)
+			if err != nil {
+				break
+			}
+			for _, section := range patAsm.write(packet.PayloadUnitStartIndicator(&pkt), payload) {
+				if section[0] != 0x00 || pmtPID >= 0 {
+					continue
+				}
+				if programNr, pmtPID, err = selectProgram(patPrograms(section), programNr); err != nil {
+					return err
+				}
+			}
+		case pid == pmtPID:
+			// The PMT is written when a section is complete
+			payload, err := packet.Payload(&pkt)
+			if err != nil {
+				continue
+			}
+			if !pmtWritten && packet.PayloadUnitStartIndicator(&pkt) {
+				// Continue the continuity counter of the original PMT packets
+				pmtCC = uint8(packet.ContinuityCounter(&pkt)+15) & 0x0f
+			}
+			for _, section := range pmtAsm.write(packet.PayloadUnitStartIndicator(&pkt), payload) {
+				if p, ok := parsePMTSection(section); ok && p.programNr == programNr {
+					for _, s := range p.streams {
+						if s.pid == cuePID {
+							return fmt.Errorf("PID %d is already used in program %d", cuePID, programNr)
+						}
+						if videoPID < 0 && (s.streamType == 0x1b || s.streamType == 0x24) {
+							videoPID = s.pid
+						}
+					}
+					pcrPID = p.pcrPID
+					section = addSCTE35ToPMT(section, cuePID)
+					if !pmtWritten {
+						if err := emitPMTStreams(h, programNr, section); err != nil {
+							return err
+						}
+					}
+					pmtWritten = true
+				}
+				for _, p := range sectionPackets(pmtPID, section, &pmtCC) {
+					if err = WritePacket(&p, tsWriter); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		case pid == cuePID:
+			return fmt.Errorf("PID %d is already used", cuePID)
+		}
+
+		if pid == pcrPID && packet.ContainsAdaptationField(&pkt) && adaptationfield.Length(&pkt) > 0 && adaptationfield.HasPCR(&pkt) {
+			if pcrBytes, err := adaptationfield.PCR(&pkt); err == nil {
+				now = int64(gots.ExtractPCR(pcrBytes)) / 300
+			}
+		}
+		// The first video PTS of the program, or the first PTS if there is no video
+		if base < 0 && pmtWritten && packet.PayloadUnitStartIndicator(&pkt) && (pid == videoPID || (videoPID < 0 && pid != pcrPID)) {
+			if payload, err := packet.Payload(&pkt); err == nil && pesHasPTS(payload) {
+				base = int64(pes.ExtractTime(payload[9:14]))
+				if cues, err = scheduleCues(events, base); err != nil {
+					return err
+				}
+			}
+		}
+		for len(cues) > 0 && now >= 0 && SignedPTSDiff(now, cues[0].sendAt) >= 0 {
+			for _, p := range sectionPackets(cuePID, cues[0].section, &cueCC) {
+				if err = WritePacket(&p, tsWriter); err != nil {
+					return err
+				}
+			}
+			info, err := DecodeSCTE35(uint16(cuePID), cues[0].section)
+			if err != nil {
+				return err
+			}
+			if err := emit(h, info); err != nil {
+				return err
+			}
+			cues = cues[1:]
+		}
+
+		if err = WritePacket(&pkt, tsWriter); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !pmtWritten:
+		return fmt.Errorf("no PMT found for program %d", programNr)
+	case base < 0:
+		return fmt.Errorf("no PTS found in program %d", programNr)
+	case len(cues) > 0:
+		return fmt.Errorf("%d events are after the end of the stream", len(cues))
+	}
+	return nil
+}
+
+// scheduleCues encodes the events with splice times relative to base and
+// returns them sorted by send time.
+func scheduleCues(events []SCTE35Event, base int64) ([]scheduledCue, error) {
+	cues := make([]scheduledCue, 0, len(events))
+	for i, e := range events {
+		info := e.SCTE35Info
+		cmd := &info.SpliceCommand
+		spliceTime := AddPTS(base, int64(math.Round(e.Time*TimeScale)))
+		if cmd.PTS != 0 {
+			spliceTime = int64(cmd.PTS)
+		}
+		preroll := DefaultPreroll
+		if e.Preroll != nil {
+			preroll = *e.Preroll
+		}
+		if cmd.Immediate {
+			preroll = 0
+		} else {
+			cmd.PTS = uint64(AddPTS(spliceTime, PtsWrap-int64(info.PTSAdjustment)%PtsWrap))
+		}
+		section, err := EncodeSCTE35(info)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", i+1, err)
+		}
+		cues = append(cues, scheduledCue{
+			sendAt:  AddPTS(spliceTime, PtsWrap-int64(math.Round(preroll*TimeScale))),
+			section: section,
+		})
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return SignedPTSDiff(cues[i].sendAt, cues[j].sendAt) < 0 })
+	return cues, nil
+}
+
+// addSCTE35ToPMT returns a PMT section with an SCTE-35 stream on pid and a
+// CUEI registration descriptor in the program info.
+func addSCTE35ToPMT(section []byte, pid int) []byte {
+	cuei := []byte{registrationDescriptorTag, 4, 'C', 'U', 'E', 'I'}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	programInfo := section[12 : 12+programInfoLength]
+	var out []byte
+	out = append(out, section[:12]...)
+	out = append(out, programInfo...)
+	if !bytes.Contains(programInfo, cuei) {
+		out = append(out, cuei...)
+		programInfoLength += len(cuei)
+		out[10] = section[10]&0xf0 | byte(programInfoLength>>8)
+		out[11] = byte(programInfoLength)
+	}
+	out = append(out, section[12+len(programInfo):len(section)-4]...)
+	out = append(out, scte35StreamType, 0xe0|byte(pid>>8), byte(pid), 0xf0, 0x00)
+	sectionLength := len(out) + 4 - 3
+	out[1] = section[1]&0xf0 | byte(sectionLength>>8)
+	out[2] = byte(sectionLength)
+	return append(out, gots.ComputeCRC(out)...)
+}
+
+// sectionPackets packetizes a PSI section on pid, starting with a pointer field
+// and padded with stuffing bytes. cc is the continuity counter of the previous packet.
+func sectionPackets(pid int, section []byte, cc *uint8) []packet.Packet {
+	data := append([]byte{0x00}, section...)
+	var pkts []packet.Packet
+	for i := 0; len(data) > 0; i++ {
+		var p packet.Packet
+		*cc = (*cc + 1) & 0x0f
+		p[0] = SyncByte
+		p[1] = byte(pid>>8) & 0x1f
+		if i == 0 {
+			p[1] |= 0x40 // payload_unit_start_indicator
+		}
+		p[2] = byte(pid)
+		p[3] = 0x10 | *cc
+		n := copy(p[4:], data)
+		for j := 4 + n; j < PacketSize; j++ {
+			p[j] = 0xff
+		}
+		data = data[n:]
+		pkts = append(pkts, p)
+	}
+	return pkts
+}
+
+// emitPMTStreams reports the stream information of a PMT section.
+func emitPMTStreams(h Handler, programNr int, section []byte) error {
+	pmt, err := psi.NewPMT(append([]byte{0}, section...))
+	if err != nil {
+		return err
+	}
+	for _, es := range pmt.ElementaryStreams() {
+		if streamInfo := ParseElementaryStreamInfo(es); streamInfo != nil {
+			streamInfo.ProgramNumber = uint16(programNr)
+			if err := emit(h, *streamInfo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,598 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Eyevinn/mp4ff/aac"
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
+)
+
+const (
+	// DefaultVideoPID is the video PID used by MuxES if Options.VideoPID is 0.
+	DefaultVideoPID = 256
+	// DefaultAudioPID is the audio PID used by MuxES if Options.AudioPID is 0.
+	DefaultAudioPID = 257
+	// DefaultPMTPID is the PMT PID used by MuxES if Options.PMTPID is 0.
+	DefaultPMTPID = 4096
+
+	muxStartDTS       = TimeScale             // DTS of the first picture
+	muxDelay          = TimeScale / 2         // PCR of the first packet of a PES packet is DTS - muxDelay
+	muxPSIInterval    = TimeScale / 10        // max interval between PAT/PMT
+	muxPCRInterval    = TimeScale * 35 / 1000 // max interval between PCRs
+	muxMinPCRInterval = TimeScale / 100       // min interval for a PCR before an audio PES packet
+	aacFrameLen       = 1024                  // samples per AAC frame
+)
+
+// MuxInfo is reported by MuxES when the TS has been written.
+// ReorderDelay is the number of frames PTS is after DTS due to B-frame reordering.
+type MuxInfo struct {
+	VideoPID     int     `json:"videoPid"`
+	VideoCodec   string  `json:"videoCodec"`
+	FrameRate    float64 `json:"frameRate"`
+	Pictures     int     `json:"pictures"`
+	ReorderDelay int     `json:"reorderDelay"`
+	AudioPID     int     `json:"audioPid,omitempty"`
+	SampleRate   int     `json:"sampleRate,omitempty"`
+	AudioFrames  int     `json:"audioFrames,omitempty"`
+	StartPTS     int64   `json:"startPts"`
+	Duration     float64 `json:"duration"`
+	Packets      int     `json:"packets"`
+}
+
+func (MuxInfo) isEvent() {}
+
+// muxPicture is an access unit of the video.
+type muxPicture struct {
+	data      []byte // Annex B with access unit delimiter
+	rap       bool   // IDR or other IRAP picture
+	newCVS    bool   // POC is reset
+	poc       int
+	displayNr int
+	pts, dts  int64
+}
+
+// muxAudioFrame is an ADTS frame.
+type muxAudioFrame struct {
+	data []byte
+	pts  int64
+}
+
+// MuxES writes a TS with the Annex B AVC or HEVC stream in video and, if audio
+// is not nil, the ADTS AAC stream in audio, as program 1. The codec is detected
+// from the first NAL unit. The frame rate is Options.FrameRate, or taken from the
+// VUI timing information. PTS follows the picture order count, and DTS is
+// delayed by the number of frames needed for reordering. Audio starts at the
+// first video PTS. PCR is sent on the video PID in the first packet of each
+// picture, and in packets with only an adaptation field in between to keep the
+// PCR interval below 40ms. PAT and PMT are repeated before each IDR picture and
+// at least every 100ms, and random_access_indicator is set on IDR pictures.
+// The stream information and a MuxInfo are reported to h.
+func MuxES(ctx context.Context, video io.Reader, audio io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	videoData, err := io.ReadAll(video)
+	if err != nil {
+		return fmt.Errorf("reading video %w", err)
+	}
+	info := MuxInfo{VideoPID: o.VideoPID, FrameRate: o.FrameRate}
+	if info.VideoPID == 0 {
+		info.VideoPID = DefaultVideoPID
+	}
+	pmtPID := o.PMTPID
+	if pmtPID == 0 {
+		pmtPID = DefaultPMTPID
+	}
+	nalus := avc.ExtractNalusFromByteStream(videoData)
+	if len(nalus) == 0 {
+		return fmt.Errorf("no NAL units in video")
+	}
+	info.VideoCodec = detectVideoCodec(nalus[0])
+	var pics []*muxPicture
+	var rate float64
+	switch info.VideoCodec {
+	case "AVC":
+		pics, rate, err = avcPictures(nalus)
+	case "HEVC":
+		pics, rate, err = hevcPictures(nalus)
+	default:
+		return fmt.Errorf("video is neither AVC nor HEVC Annex B")
+	}
+	if err != nil {
+		return err
+	}
+	if info.FrameRate == 0 {
+		info.FrameRate = rate
+	}
+	if info.FrameRate <= 0 {
+		return fmt.Errorf("no frame rate given and no timing information in the VUI")
+	}
+	info.ReorderDelay = setPictureTimes(pics, info.FrameRate)
+	info.Pictures = len(pics)
+	info.StartPTS = pics[0].pts
+	for _, pic := range pics {
+		if SignedPTSDiff(pic.pts, info.StartPTS) < 0 {
+			info.StartPTS = pic.pts
+		}
+	}
+
+	var frames []muxAudioFrame
+	streams := []pmtStream{{streamType: 0x1b, pid: info.VideoPID}}
+	if info.VideoCodec == "HEVC" {
+		streams[0].streamType = 0x24
+	}
+	if audio != nil {
+		info.AudioPID = o.AudioPID
+		if info.AudioPID == 0 {
+			info.AudioPID = DefaultAudioPID
+		}
+		audioData, err := io.ReadAll(audio)
+		if err != nil {
+			return fmt.Errorf("reading audio %w", err)
+		}
+		frames, info.SampleRate, err = adtsFrames(audioData, info.StartPTS)
+		if err != nil {
+			return err
+		}
+		info.AudioFrames = len(frames)
+		streams = append(streams, pmtStream{streamType: 0x0f, pid: info.AudioPID})
+	}
+
+	m := &muxer{w: tsWriter, pmtPID: pmtPID, pcrPID: info.VideoPID, cc: make(continuityCounters), lastPSI: -1}
+	m.pat = patSection(1, 1, pmtPID)
+	m.pmt = newPMTSection(1, info.VideoPID, streams)
+	if err := emitPMTStreams(h, 1, m.pmt); err != nil {
+		return err
+	}
+
+	// Interleave video and audio PES packets in send time (DTS - muxDelay) order
+	frameDur := int64(math.Round(TimeScale / info.FrameRate))
+	vi, ai := 0, 0
+	videoNext := func() bool {
+		return ai >= len(frames) || vi < len(pics) && SignedPTSDiff(frames[ai].pts, pics[vi].dts) >= 0
+	}
+	for vi < len(pics) || ai < len(frames) {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if videoNext() {
+			pic := pics[vi]
+			vi++
+			if err := m.writePicture(info.VideoPID, pic, m.nextSend(pics, frames, vi, ai, pic.dts+frameDur)); err != nil {
+				return err
+			}
+			continue
+		}
+		frame := frames[ai]
+		ai++
+		if err := m.writeAudioFrame(info.AudioPID, frame, m.nextSend(pics, frames, vi, ai, frame.pts+frameDur)); err != nil {
+			return err
+		}
+	}
+	info.Packets = m.packets
+	info.Duration = float64(len(pics)) / info.FrameRate
+	return emit(h, info)
+}
+
+// muxer writes PES packets and PSI.
+type muxer struct {
+	w        io.Writer
+	pmtPID   int
+	pcrPID   int
+	pat, pmt []byte
+	cc       continuityCounters
+	lastPSI  int64 // send time of the last PAT/PMT, -1 if none
+	lastPCR  int64
+	packets  int
+}
+
+// nextSend returns the send time of the next PES packet, or of end if there is none.
+func (m *muxer) nextSend(pics []*muxPicture, frames []muxAudioFrame, vi, ai int, end int64) int64 {
+	switch {
+	case vi < len(pics) && (ai >= len(frames) || SignedPTSDiff(frames[ai].pts, pics[vi].dts) >= 0):
+		end = pics[vi].dts
+	case ai < len(frames):
+		end = frames[ai].pts
+	}
+	return end - muxDelay
+}
+
+func (m *muxer) writePicture(pid int, pic *muxPicture, next int64) error {
+	send := pic.dts - muxDelay
+	if pic.rap || m.lastPSI < 0 || send-m.lastPSI >= muxPSIInterval {
+		if err := m.writePSI(send); err != nil {
+			return err
+		}
+	}
+	af := make([]byte, 7)
+	af[0] = 0x10 // PCR_flag
+	if pic.rap {
+		af[0] |= 0x40 // random_access_indicator
+	}
+	gots.InsertPCR(af[1:], uint64(shiftPTS(send, 0))*300)
+	m.lastPCR = send
+	return m.writePES(pid, pesData(0xe0, pic.pts, pic.dts, pic.data), af, send, next)
+}
+
+func (m *muxer) writeAudioFrame(pid int, frame muxAudioFrame, next int64) error {
+	send := frame.pts - muxDelay
+	if send-m.lastPSI >= muxPSIInterval {
+		if err := m.writePSI(send); err != nil {
+			return err
+		}
+	}
+	if send-m.lastPCR >= muxMinPCRInterval {
+		if err := m.writePCR(send); err != nil {
+			return err
+		}
+	}
+	return m.writePES(pid, pesData(0xc0, frame.pts, frame.pts, frame.data), nil, send, next)
+}
+
+// writePCR writes a packet with only an adaptation field with PCR on the PCR PID.
+func (m *muxer) writePCR(send int64) error {
+	var p packet.Packet
+	p[0] = SyncByte
+	p[1] = byte(m.pcrPID>>8) & 0x1f
+	p[2] = byte(m.pcrPID)
+	p[3] = 0x20 // adaptation field only
+	p[4] = PacketSize - 5
+	p[5] = 0x10 // PCR_flag
+	gots.InsertPCR(p[6:12], uint64(shiftPTS(send, 0))*300)
+	for i := 12; i < PacketSize; i++ {
+		p[i] = 0xff
+	}
+	m.lastPCR = send
+	return m.write(&p)
+}
+
+func (m *muxer) writePSI(send int64) error {
+	m.lastPSI = send
+	for _, s := range []struct {
+		pid     int
+		section []byte
+	}{{0, m.pat}, {m.pmtPID, m.pmt}} {
+		var cc uint8 // set by write
+		pkts := sectionPackets(s.pid, s.section, &cc)
+		for i := range pkts {
+			if err := m.write(&pkts[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writePES writes a PES packet that is sent from send until next. PCR-only
+// packets are spread over the PES packet if needed to keep the PCR interval.
+func (m *muxer) writePES(pid int, data []byte, af []byte, send, next int64) error {
+	var cc uint8 // set by write
+	pkts := pesPackets(pid, data, af, &cc)
+	gap := next - send
+	nrPCRs := 0
+	if gap > muxPCRInterval {
+		nrPCRs = int((gap+muxPCRInterval-1)/muxPCRInterval) - 1
+	}
+	total := len(pkts) + nrPCRs
+	j := 1 // next PCR-only packet
+	i := 0 // next PES packet
+	for pos := 0; pos < total; pos++ {
+		var err error
+		if j <= nrPCRs && pos == j*total/(nrPCRs+1) {
+			err = m.writePCR(send + gap*int64(pos)/int64(total))
+			j++
+		} else {
+			err = m.write(&pkts[i])
+			i++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *muxer) write(pkt *packet.Packet) error {
+	m.cc.set(pkt)
+	m.packets++
+	return WritePacket(pkt, m.w)
+}
+
+// pesData returns a PES packet with PTS, and DTS if different from PTS.
+// PES_packet_length is 0 for video.
+func pesData(streamID byte, pts, dts int64, payload []byte) []byte {
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x84, 0x80, 5, 0, 0, 0, 0, 0}
+	gots.InsertPTS(header[9:14], uint64(shiftPTS(pts, 0)))
+	if dts != pts {
+		header[7] = 0xc0
+		header[8] = 10
+		header[9] = 0x30 | header[9]&0x0f
+		header = append(header, 0, 0, 0, 0, 0)
+		gots.InsertPTS(header[14:19], uint64(shiftPTS(dts, 0)))
+		header[14] = 0x10 | header[14]&0x0f
+	}
+	if length := len(header) - 6 + len(payload); streamID&0xf0 != 0xe0 && length <= 0xffff {
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	return append(header, payload...)
+}
+
+// newPMTSection returns a PMT section for a program.
+func newPMTSection(programNr, pcrPID int, streams []pmtStream) []byte {
+	section := []byte{0x02, 0xb0, 0, byte(programNr >> 8), byte(programNr), 0xc1, 0x00, 0x00,
+		0xe0 | byte(pcrPID>>8), byte(pcrPID), 0xf0, 0x00}
+	for _, s := range streams {
+		section = append(section, s.streamType, 0xe0|byte(s.pid>>8), byte(s.pid),
+			0xf0|byte(len(s.descriptors)>>8), byte(len(s.descriptors)))
+		section = append(section, s.descriptors...)
+	}
+	sectionLength := len(section) + 4 - 3
+	section[1] |= byte(sectionLength >> 8)
+	section[2] = byte(sectionLength)
+	return append(section, gots.ComputeCRC(section)...)
+}
+
+// detectVideoCodec tells if a NAL unit header is HEVC or AVC.
+func detectVideoCodec(nalu []byte) string {
+	if len(nalu) >= 2 && nalu[0]&0x81 == 0 && nalu[1] != 0 && nalu[1]&0xf8 == 0 {
+		// forbidden_zero_bit, nuh_layer_id 0 and nuh_temporal_id_plus1 > 0
+		switch hevc.GetNaluType(nalu[0]) {
+		case hevc.NALU_VPS, hevc.NALU_SPS, hevc.NALU_PPS, hevc.NALU_AUD, hevc.NALU_SEI_PREFIX:
+			return "HEVC"
+		}
+	}
+	if len(nalu) >= 1 && nalu[0]&0x80 == 0 {
+		switch avc.GetNaluType(nalu[0]) {
+		case avc.NALU_SPS, avc.NALU_PPS, avc.NALU_AUD, avc.NALU_SEI, avc.NALU_IDR:
+			return "AVC"
+		}
+	}
+	return ""
+}
+
+// annexB joins NAL units with start codes.
+func annexB(nalus [][]byte) []byte {
+	var data []byte
+	for _, nalu := range nalus {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+// avcPictures splits the NAL units in access units and finds their picture
+// order count and the frame rate from the VUI (0 if not present).
+func avcPictures(nalus [][]byte) ([]*muxPicture, float64, error) {
+	var pics []*muxPicture
+	var ps AvcPS
+	var au [][]byte
+	hasVCL, rap := false, false
+	var poc int
+	prevMsb, prevLsb := 0, 0
+	flush := func() {
+		if !hasVCL {
+			return
+		}
+		if avc.GetNaluType(au[0][0]) != avc.NALU_AUD {
+			au = append([][]byte{{0x09, 0xf0}}, au...)
+		}
+		pics = append(pics, &muxPicture{data: annexB(au), rap: rap, newCVS: rap, poc: poc})
+		au, hasVCL, rap = nil, false, false
+	}
+	for _, nalu := range nalus {
+		naluType := avc.GetNaluType(nalu[0])
+		switch {
+		case naluType == avc.NALU_AUD, naluType == avc.NALU_SPS, naluType == avc.NALU_PPS,
+			naluType == avc.NALU_SEI, naluType >= 14 && naluType <= 18:
+			flush()
+		case avc.IsVideoNaluType(naluType) && len(nalu) > 1 && nalu[1]&0x80 != 0:
+			flush() // first_mb_in_slice == 0
+		}
+		switch naluType {
+		case avc.NALU_SPS:
+			if err := ps.setSPS(nalu); err != nil {
+				return nil, 0, err
+			}
+		case avc.NALU_PPS:
+			if err := ps.setPPS(nalu); err != nil {
+				return nil, 0, err
+			}
+		}
+		au = append(au, nalu)
+		if !avc.IsVideoNaluType(naluType) || hasVCL {
+			continue
+		}
+		hasVCL = true
+		rap = naluType == avc.NALU_IDR
+		sps := ps.getSPS()
+		if sps == nil {
+			return nil, 0, fmt.Errorf("picture %d before SPS", len(pics)+1)
+		}
+		if rap {
+			prevMsb, prevLsb = 0, 0
+		}
+		switch sps.PicOrderCntType {
+		case 0:
+			sh, err := avc.ParseSliceHeader(nalu, ps.spss, ps.ppss)
+			if err != nil {
+				return nil, 0, fmt.Errorf("picture %d: %w", len(pics)+1, err)
+			}
+			maxLsb := 1 << (sps.Log2MaxPicOrderCntLsbMinus4 + 4)
+			poc = nextPOC(int(sh.PicOrderCntLsb), prevMsb, prevLsb, maxLsb)
+			if nalu[0]&0x60 != 0 { // nal_ref_idc
+				prevMsb, prevLsb = poc-int(sh.PicOrderCntLsb), int(sh.PicOrderCntLsb)
+			}
+		default:
+			// Output order is decode order
+			poc = len(pics)
+		}
+	}
+	flush()
+	if len(pics) == 0 {
+		return nil, 0, fmt.Errorf("no pictures in video")
+	}
+	var rate float64
+	if sps := ps.getSPS(); sps.VUI != nil && sps.VUI.TimingInfoPresentFlag && sps.VUI.NumUnitsInTick > 0 {
+		rate = float64(sps.VUI.TimeScale) / float64(2*sps.VUI.NumUnitsInTick)
+	}
+	return pics, rate, nil
+}
+
+// hevcPictures splits the NAL units in access units and finds their picture
+// order count and the frame rate from the VUI (0 if not present).
+func hevcPictures(nalus [][]byte) ([]*muxPicture, float64, error) {
+	var pics []*muxPicture
+	var ps HevcPS
+	var au [][]byte
+	hasVCL, rap, newCVS := false, false, false
+	var poc int
+	prevMsb, prevLsb := 0, 0
+	flush := func() {
+		if !hasVCL {
+			return
+		}
+		if hevc.GetNaluType(au[0][0]) != hevc.NALU_AUD {
+			au = append([][]byte{{0x46, 0x01, 0x50}}, au...)
+		}
+		pics = append(pics, &muxPicture{data: annexB(au), rap: rap, newCVS: newCVS, poc: poc})
+		au, hasVCL, rap, newCVS = nil, false, false, false
+	}
+	for _, nalu := range nalus {
+		naluType := hevc.GetNaluType(nalu[0])
+		switch {
+		case naluType >= hevc.NALU_VPS && naluType <= hevc.NALU_AUD, naluType == hevc.NALU_SEI_PREFIX,
+			naluType >= 41 && naluType <= 44, naluType >= 48 && naluType <= 55:
+			flush()
+		case hevc.IsVideoNaluType(naluType) && len(nalu) > 2 && nalu[2]&0x80 != 0:
+			flush() // first_slice_segment_in_pic_flag
+		}
+		switch naluType {
+		case hevc.NALU_SPS:
+			if err := ps.setSPS(nalu); err != nil {
+				return nil, 0, err
+			}
+		case hevc.NALU_PPS:
+			if err := ps.setPPS(nalu); err != nil {
+				return nil, 0, err
+			}
+		}
+		au = append(au, nalu)
+		if !hevc.IsVideoNaluType(naluType) || hasVCL {
+			continue
+		}
+		hasVCL = true
+		rap = naluType >= hevc.NALU_BLA_W_LP && naluType <= hevc.NALU_CRA
+		sh, err := hevc.ParseSliceHeader(nalu, ps.spss, ps.ppss)
+		if err != nil {
+			return nil, 0, fmt.Errorf("picture %d: %w", len(pics)+1, err)
+		}
+		sps := ps.spss[ps.ppss[sh.PicParameterSetId].SeqParameterSetID]
+		// NoRaslOutputFlag
+		newCVS = naluType >= hevc.NALU_BLA_W_LP && naluType <= hevc.NALU_IDR_N_LP || naluType == hevc.NALU_CRA && len(pics) == 0
+		lsb := int(sh.PicOrderCntLsb)
+		if newCVS {
+			poc = lsb
+		} else {
+			poc = nextPOC(lsb, prevMsb, prevLsb, 1<<(sps.Log2MaxPicOrderCntLsbMinus4+4))
+		}
+		subLayerNonRef := naluType <= 14 && naluType%2 == 0
+		isLeading := naluType >= hevc.NALU_RADL_N && naluType <= hevc.NALU_RASL_R
+		if nalu[1]&0x07 == 1 && !subLayerNonRef && !isLeading { // TemporalId 0
+			prevMsb, prevLsb = poc-lsb, lsb
+		}
+	}
+	flush()
+	if len(pics) == 0 {
+		return nil, 0, fmt.Errorf("no pictures in video")
+	}
+	var rate float64
+	for _, sps := range ps.spss {
+		if sps.VUI != nil && sps.VUI.TimingInfoPresentFlag && sps.VUI.NumUnitsInTick > 0 {
+			rate = float64(sps.VUI.TimeScale) / float64(sps.VUI.NumUnitsInTick)
+		}
+	}
+	return pics, rate, nil
+}
+
+// nextPOC returns the picture order count from its lsb and the previous msb and lsb.
+func nextPOC(lsb, prevMsb, prevLsb, maxLsb int) int {
+	msb := prevMsb
+	switch {
+	case lsb < prevLsb && prevLsb-lsb >= maxLsb/2:
+		msb += maxLsb
+	case lsb > prevLsb && lsb-prevLsb > maxLsb/2:
+		msb -= maxLsb
+	}
+	return msb + lsb
+}
+
+// setPictureTimes sets PTS from the output order within each coded video
+// sequence and DTS from the decode order, and returns the reorder delay in frames.
+func setPictureTimes(pics []*muxPicture, frameRate float64) int {
+	start := 0
+	for start < len(pics) {
+		end := start + 1
+		for end < len(pics) && !pics[end].newCVS {
+			end++
+		}
+		order := make([]*muxPicture, end-start)
+		copy(order, pics[start:end])
+		sort.SliceStable(order, func(i, j int) bool { return order[i].poc < order[j].poc })
+		for i, pic := range order {
+			pic.displayNr = start + i
+		}
+		start = end
+	}
+	delay := 0
+	for i, pic := range pics {
+		if d := i - pic.displayNr; d > delay {
+			delay = d
+		}
+	}
+	frameTime := func(nr int) int64 {
+		return shiftPTS(muxStartDTS, int64(math.Round(float64(nr)*TimeScale/frameRate)))
+	}
+	for i, pic := range pics {
+		pic.dts = frameTime(i)
+		pic.pts = frameTime(pic.displayNr + delay)
+	}
+	return delay
+}
+
+// adtsFrames splits ADTS data in frames with PTS from start.
+func adtsFrames(data []byte, start int64) ([]muxAudioFrame, int, error) {
+	var frames []muxAudioFrame
+	sampleRate := 0
+	for pos := 0; pos < len(data); {
+		header, offset, err := aac.DecodeADTSHeader(bytes.NewReader(data[pos:]))
+		if err != nil {
+			return nil, 0, fmt.Errorf("ADTS frame %d: %w", len(frames)+1, err)
+		}
+		pos += offset
+		end := pos + int(header.HeaderLength) + int(header.PayloadLength)
+		if end > len(data) {
+			break // truncated frame
+		}
+		if sampleRate == 0 {
+			sampleRate = int(header.Frequency())
+			if sampleRate == 0 {
+				return nil, 0, fmt.Errorf("bad ADTS sampling frequency index %d", header.SamplingFrequencyIndex)
+			}
+		}
+		nr := int64(len(frames))
+		pts := shiftPTS(start, nr*aacFrameLen*TimeScale/int64(sampleRate))
+		frames = append(frames, muxAudioFrame{data: data[pos:end], pts: pts})
+		pos = end
+	}
+	if len(frames) == 0 {
+		return nil, 0, fmt.Errorf("no ADTS frames in audio")
+	}
+	return frames, sampleRate, nil
+}
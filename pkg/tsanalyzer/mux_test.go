@@ -0,0 +1,169 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+	"github.com/stretchr/testify/require"
+)
+
+// pesStream is the payloads and times of the PES packets on a PID.
+type pesStream struct {
+	es        []byte
+	pts, dts  []int64
+	rai, pcrs []bool
+}
+
+func pesStreamOf(t *testing.T, data []byte, pid int) pesStream {
+	t.Helper()
+	var s pesStream
+	var pes []byte
+	flush := func() {
+		if len(pes) == 0 {
+			return
+		}
+		pts, dts, ok := pesTimes(pes)
+		require.True(t, ok)
+		s.pts = append(s.pts, pts)
+		s.dts = append(s.dts, dts)
+		s.es = append(s.es, pes[9+int(pes[8]):]...)
+	}
+	for i := 0; i < len(data); i += PacketSize {
+		var pkt packet.Packet
+		copy(pkt[:], data[i:])
+		if pkt.PID() != pid || !pkt.HasPayload() {
+			continue
+		}
+		payload, err := pkt.Payload()
+		require.NoError(t, err)
+		if pkt.PayloadUnitStartIndicator() {
+			flush()
+			pes = nil
+			af := adaptationField(&pkt)
+			s.rai = append(s.rai, len(af) > 0 && af[0]&0x40 != 0)
+			s.pcrs = append(s.pcrs, len(af) > 0 && af[0]&0x10 != 0)
+		}
+		pes = append(pes, payload...)
+	}
+	flush()
+	return s
+}
+
+func TestMuxES(t *testing.T) {
+	bbb, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	obs, err := os.ReadFile("../../internal/testdata/obs_hevc_aac.ts")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		data  []byte
+		audio bool
+		o     Options
+		want  MuxInfo
+		// pictures at the end whose reordered pictures are missing in the file
+		truncated int
+	}{
+		{
+			name: "avc",
+			data: bbb,
+			o:    Options{FrameRate: 24},
+			want: MuxInfo{VideoPID: 256, VideoCodec: "AVC", FrameRate: 24, Pictures: 26, ReorderDelay: 2,
+				StartPTS: 97500, Duration: 26.0 / 24},
+			truncated: 1,
+		},
+		{
+			name:  "avc with audio",
+			data:  bbb,
+			audio: true,
+			o:     Options{FrameRate: 24, VideoPID: 100, AudioPID: 101, PMTPID: 200},
+			want: MuxInfo{VideoPID: 100, VideoCodec: "AVC", FrameRate: 24, Pictures: 26, ReorderDelay: 2,
+				AudioPID: 101, SampleRate: 44100, AudioFrames: 46, StartPTS: 97500, Duration: 26.0 / 24},
+			truncated: 1,
+		},
+		{
+			name: "hevc",
+			data: obs,
+			o:    Options{FrameRate: 30},
+			want: MuxInfo{VideoPID: 256, VideoCodec: "HEVC", FrameRate: 30, Pictures: 60,
+				StartPTS: 90000, Duration: 2},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := pesStreamOf(t, tc.data, 256)
+			var audio io.Reader
+			var inAudio pesStream
+			if tc.audio {
+				inAudio = pesStreamOf(t, tc.data, 257)
+				audio = bytes.NewReader(inAudio.es)
+			}
+			var info MuxInfo
+			h := HandlerFunc(func(ev Event) error {
+				if mi, ok := ev.(MuxInfo); ok {
+					info = mi
+				}
+				return nil
+			})
+			var out bytes.Buffer
+			err := MuxES(context.TODO(), bytes.NewReader(in.es), audio, &out, h, tc.o)
+			require.NoError(t, err)
+			data := out.Bytes()
+			tc.want.Packets = len(data) / PacketSize
+			require.Equal(t, tc.want, info)
+
+			var first packet.Packet
+			copy(first[:], data)
+			require.Equal(t, 0, first.PID(), "PAT first")
+
+			// Timestamps relative to the first DTS are those of the original
+			got := pesStreamOf(t, data, info.VideoPID)
+			require.Equal(t, len(in.pts), len(got.pts))
+			for i := range in.pts {
+				if i < len(in.pts)-tc.truncated {
+					require.Equal(t, in.pts[i]-in.dts[0], got.pts[i]-got.dts[0], "pts %d", i)
+				}
+				require.Equal(t, in.dts[i]-in.dts[0], got.dts[i]-got.dts[0], "dts %d", i)
+				require.True(t, got.pcrs[i], "pcr %d", i)
+			}
+			require.True(t, got.rai[0])
+			require.False(t, got.rai[1])
+			if tc.audio {
+				gotAudio := pesStreamOf(t, data, info.AudioPID)
+				require.Equal(t, inAudio.es, gotAudio.es)
+				require.Equal(t, info.StartPTS, gotAudio.pts[0])
+			}
+
+			cc := make(map[int]uint8)
+			lastPCR := int64(-1)
+			for i := 0; i < len(data); i += PacketSize {
+				var pkt packet.Packet
+				copy(pkt[:], data[i:])
+				pid := pkt.PID()
+				if pkt.HasPayload() {
+					if last, ok := cc[pid]; ok {
+						require.Equal(t, (last+1)&0x0f, uint8(pkt.ContinuityCounter()), "cc on pid %d", pid)
+					}
+					cc[pid] = uint8(pkt.ContinuityCounter())
+				}
+				if af := adaptationField(&pkt); len(af) > 0 && af[0]&0x10 != 0 {
+					require.Equal(t, info.VideoPID, pid)
+					pcrBytes, err := adaptationfield.PCR(&pkt)
+					require.NoError(t, err)
+					pcr := int64(gots.ExtractPCR(pcrBytes))
+					if lastPCR >= 0 {
+						require.LessOrEqual(t, pcr-lastPCR, int64(muxPCRInterval*300))
+						require.Greater(t, pcr, lastPCR)
+					}
+					lastPCR = pcr
+				}
+			}
+		})
+	}
+}
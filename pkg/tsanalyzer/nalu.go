@@ -1,4 +1,4 @@
-package internal
+package tsanalyzer
 
 type NaluFrameData struct {
 	PID     uint16     `json:"pid"`
@@ -0,0 +1,121 @@
+package tsanalyzer
+
+import (
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/pes"
+)
+
+// pesTimes returns the PTS and DTS of a PES packet starting in payload.
+// DTS is PTS if there is no DTS.
+func pesTimes(payload []byte) (pts, dts int64, ok bool) {
+	if !pesHasPTS(payload) || len(payload) < 14 {
+		return 0, 0, false
+	}
+	pts = int64(pes.ExtractTime(payload[9:14]))
+	dts = pts
+	if payload[7]&0xc0 == 0xc0 && len(payload) >= 19 {
+		dts = int64(pes.ExtractTime(payload[14:19]))
+	}
+	return pts, dts, true
+}
+
+// pesPackets packetizes a PES packet on pid. af is the adaptation field of the
+// first packet after the length byte, e.g. with PCR and random_access_indicator,
+// or nil. The last packet is filled up with adaptation field stuffing.
+// cc is the continuity counter of the previous packet.
+func pesPackets(pid int, data []byte, af []byte, cc *uint8) []packet.Packet {
+	var pkts []packet.Packet
+	for first := true; first || len(data) > 0; first = false {
+		var p packet.Packet
+		*cc = (*cc + 1) & 0x0f
+		p[0] = SyncByte
+		p[1] = byte(pid>>8) & 0x1f
+		if first {
+			p[1] |= 0x40 // payload_unit_start_indicator
+		}
+		p[2] = byte(pid)
+		var field []byte
+		hasAF := false
+		if first && af != nil {
+			field = append(field, af...)
+			hasAF = true
+		}
+		space := PacketSize - 4
+		if hasAF {
+			space -= 1 + len(field)
+		}
+		if stuffing := space - len(data); stuffing > 0 {
+			if !hasAF {
+				hasAF = true
+				stuffing-- // length byte
+				if stuffing > 0 {
+					field = append(field, 0x00) // no flags
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				field = append(field, 0xff)
+			}
+		}
+		pos := 4
+		p[3] = 0x10 | *cc
+		if hasAF {
+			p[3] |= 0x20
+			p[4] = byte(len(field))
+			copy(p[5:], field)
+			pos = 5 + len(field)
+		}
+		n := copy(p[pos:], data)
+		data = data[n:]
+		pkts = append(pkts, p)
+	}
+	return pkts
+}
+
+// adaptationField returns the adaptation field of pkt after the length byte
+// without stuffing bytes, or nil if it has none.
+func adaptationField(pkt *packet.Packet) []byte {
+	if !packet.ContainsAdaptationField(pkt) || pkt[4] == 0 || int(pkt[4]) > PacketSize-5 {
+		return nil
+	}
+	af := pkt[5 : 5+int(pkt[4])]
+	flags := af[0]
+	n := 1
+	if flags&0x10 != 0 { // PCR
+		n += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 { // splice_countdown
+		n++
+	}
+	for _, mask := range []byte{0x02, 0x01} { // private data and extension
+		if flags&mask != 0 && n < len(af) {
+			n += 1 + int(af[n])
+		}
+	}
+	if n > len(af) {
+		n = len(af)
+	}
+	return append([]byte(nil), af[:n]...)
+}
+
+// continuityCounters renumbers the continuity counters of output packets.
+type continuityCounters map[int]uint8
+
+// set sets the continuity counter of pkt to follow the previous packet on its
+// PID. The first packet on a PID gets 0, and packets without payload keep
+// the previous value.
+func (c continuityCounters) set(pkt *packet.Packet) {
+	pid := packet.Pid(pkt)
+	cc, ok := c[pid]
+	switch {
+	case !ok:
+		cc = 0
+	case packet.ContainsPayload(pkt):
+		cc = (cc + 1) & 0x0f
+	}
+	c[pid] = cc
+	pkt[3] = pkt[3]&0xf0 | cc
+}
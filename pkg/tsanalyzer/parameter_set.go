@@ -1,11 +1,12 @@
-package internal
+package tsanalyzer
 
 import "encoding/hex"
 
 type ElementaryStreamInfo struct {
-	PID   uint16 `json:"pid"`
-	Codec string `json:"codec"`
-	Type  string `json:"type"`
+	PID           uint16 `json:"pid"`
+	Codec         string `json:"codec"`
+	Type          string `json:"type"`
+	ProgramNumber uint16 `json:"programNumber,omitempty"`
 }
 
 type PsInfo struct {
@@ -17,7 +18,9 @@ type PsInfo struct {
 	Details      any    `json:"details,omitempty"`
 }
 
-func (jp *JsonPrinter) PrintPS(pid uint16, psKind string, nr uint32, ps []byte, details any, verbose bool, show bool) {
+// NewPsInfo creates a PsInfo for a parameter set NAL unit.
+// The parsed parameter set is included as details if verbose is set.
+func NewPsInfo(pid uint16, psKind string, nr uint32, ps []byte, details any, verbose bool) PsInfo {
 	hexStr := hex.EncodeToString(ps)
 	length := len(hexStr) / 2
 	psInfo := PsInfo{
@@ -30,5 +33,5 @@ func (jp *JsonPrinter) PrintPS(pid uint16, psKind string, nr uint32, ps []byte,
 	if verbose {
 		psInfo.Details = details
 	}
-	jp.Print(psInfo, show)
+	return psInfo
 }
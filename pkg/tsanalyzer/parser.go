@@ -0,0 +1,346 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/psi"
+)
+
+// ParseAll parses stream information, service information, parameter sets,
+// NAL units, audio frames and SMPTE-2038 data. Statistics for each video and
+// audio stream are reported at the end. With o.SCTE35Align, the video frame
+// nearest to the splice time of each SCTE-35 cue is reported as SCTE35Alignment.
+func ParseAll(ctx context.Context, f io.Reader, h Handler, o Options) error {
+	var aligner *cueAligner
+	if o.SCTE35Align {
+		aligner = newCueAligner()
+		f = &packetTap{r: f, onPacket: aligner.packet}
+	}
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	var ds demuxState
+	dmx := newDemuxer(ctx, rd, &ds)
+	programs := newProgramTracker(o)
+	nrPics := 0
+	sdtFound := false
+	esKinds := make(map[uint16]string)
+	avcPSs := make(map[uint16]*AvcPS)
+	hevcPSs := make(map[uint16]*HevcPS)
+	aacStreams := make(map[uint16]*AacStream)
+	ac3Streams := make(map[uint16]*Ac3Stream)
+	statistics := make(map[uint16]*StreamStatistics)
+dataLoop:
+	for {
+		// Check if context was cancelled
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		d, err := dmx.NextData()
+		if err != nil {
+			if err.Error() == "astits: no more packets" {
+				break dataLoop
+			}
+			return fmt.Errorf("reading next data %w", err)
+		}
+
+		// Service information
+		if d.SDT != nil && !sdtFound {
+			if err := emit(h, ToSdtInfo(d.SDT)); err != nil {
+				return err
+			}
+			sdtFound = true
+		}
+
+		// PID information of the selected programs
+		pmts, changes := programs.update(d, &ds)
+		for _, pmt := range pmts {
+			for _, streamInfo := range programStreams(pmt) {
+				esKinds[streamInfo.PID] = streamInfo.Codec
+				if err := emit(h, streamInfo); err != nil {
+					return err
+				}
+			}
+		}
+		for _, c := range changes {
+			if err := emit(h, c); err != nil {
+				return err
+			}
+			// Start over for streams that are removed or have changed
+			for _, pid := range c.changedPIDs() {
+				if s := statistics[pid]; s != nil {
+					s.Calculate(TimeScale)
+					if err := emit(h, *s); err != nil {
+						return err
+					}
+				}
+				delete(esKinds, pid)
+				delete(avcPSs, pid)
+				delete(hevcPSs, pid)
+				delete(aacStreams, pid)
+				delete(ac3Streams, pid)
+				delete(statistics, pid)
+			}
+			for _, streamInfo := range c.New.Streams {
+				esKinds[streamInfo.PID] = streamInfo.Codec
+			}
+		}
+		if aligner != nil && aligner.err != nil {
+			return aligner.err
+		}
+		pes := d.PES
+		if pes == nil {
+			continue
+		}
+
+		switch esKinds[d.PID] {
+		case "AVC":
+			avcPS := avcPSs[d.PID]
+			nrIDRs := int64(0)
+			if avcPS != nil {
+				nrIDRs = avcPS.Statistics.IDRCount()
+			}
+			avcPS, err = ParseAVCPES(d, avcPS, h, o)
+			if err != nil {
+				return err
+			}
+			if avcPS == nil {
+				continue
+			}
+			if avcPSs[d.PID] == nil {
+				avcPSs[d.PID] = avcPS
+			}
+			nrPics++
+			statistics[d.PID] = &avcPS.Statistics
+			if aligner != nil {
+				if err := emitAlignments(h, programs, aligner.frame(alignedFrame(d, avcPS.Statistics.IDRCount() > nrIDRs))); err != nil {
+					return err
+				}
+			}
+		case "HEVC":
+			hevcPS := hevcPSs[d.PID]
+			nrIDRs := int64(0)
+			if hevcPS != nil {
+				nrIDRs = hevcPS.Statistics.IDRCount()
+			}
+			hevcPS, err = ParseHEVCPES(d, hevcPS, h, o)
+			if err != nil {
+				return err
+			}
+			if hevcPS == nil {
+				continue
+			}
+			if hevcPSs[d.PID] == nil {
+				hevcPSs[d.PID] = hevcPS
+			}
+			nrPics++
+			statistics[d.PID] = &hevcPS.Statistics
+			if aligner != nil {
+				if err := emitAlignments(h, programs, aligner.frame(alignedFrame(d, hevcPS.Statistics.IDRCount() > nrIDRs))); err != nil {
+					return err
+				}
+			}
+		case "AAC":
+			if !o.Audio {
+				continue
+			}
+			aacStream, err := ParseAACPES(d, aacStreams[d.PID], h, o)
+			if err != nil {
+				return err
+			}
+			aacStreams[d.PID] = aacStream
+			statistics[d.PID] = &aacStream.Statistics
+			// Audio frames are not pictures
+			continue
+		case "AC-3", "E-AC-3":
+			if !o.Audio {
+				continue
+			}
+			ac3Stream, err := ParseAC3PES(d, esKinds[d.PID], ac3Streams[d.PID], h, o)
+			if err != nil {
+				return err
+			}
+			ac3Streams[d.PID] = ac3Stream
+			statistics[d.PID] = &ac3Stream.Statistics
+			continue
+		case "SMPTE-2038":
+			if o.SMPTE2038 {
+				if err := emit(h, ParseSMPTE2038(d)); err != nil {
+					return err
+				}
+			}
+		default:
+			// Skip unknown elementary streams
+			continue
+		}
+
+		// Keep looping if MaxNrPictures equals 0
+		if o.MaxNrPictures > 0 && nrPics >= o.MaxNrPictures {
+			break dataLoop
+		}
+	}
+
+	if aligner != nil {
+		if aligner.err != nil {
+			return aligner.err
+		}
+		if err := emitAlignments(h, programs, aligner.flush()); err != nil {
+			return err
+		}
+	}
+
+	pids := make([]uint16, 0, len(statistics))
+	for pid := range statistics {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	for _, pid := range pids {
+		s := statistics[pid]
+		s.Calculate(TimeScale)
+		if err := emit(h, *s); err != nil {
+			return err
+		}
+	}
+
+	return programs.err()
+}
+
+// ParseInfo parses stream information from the PMTs of the selected programs and,
+// if o.Service is set, service information from the first SDT.
+func ParseInfo(ctx context.Context, f io.Reader, h Handler, o Options) error {
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	var ds demuxState
+	dmx := newDemuxer(ctx, rd, &ds)
+	programs := newProgramTracker(o)
+	sdtFound := false
+dataLoop:
+	for {
+		// Check if context was cancelled
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		d, err := dmx.NextData()
+		if err != nil {
+			if err.Error() == "astits: no more packets" {
+				break dataLoop
+			}
+			return fmt.Errorf("reading next data %w", err)
+		}
+
+		// PID information
+		pmts, _ := programs.update(d, &ds)
+		for _, pmt := range pmts {
+			for _, streamInfo := range programStreams(pmt) {
+				if err := emit(h, streamInfo); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Service information
+		if o.Service && d.SDT != nil && !sdtFound {
+			if err := emit(h, ToSdtInfo(d.SDT)); err != nil {
+				return err
+			}
+			sdtFound = true
+		}
+
+		// Loop until all programs (and service information if wanted) are found
+		if programs.complete() && (sdtFound || !o.Service) {
+			break dataLoop
+		}
+	}
+
+	return programs.err()
+}
+
+// ParseSCTE35 parses stream information and all SCTE-35 messages.
+func ParseSCTE35(ctx context.Context, f io.Reader, h Handler, o Options) error {
+	reader := bufio.NewReader(f)
+	_, err := packet.Sync(reader)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+	pat, err := psi.ReadPAT(reader)
+	if err != nil {
+		return fmt.Errorf("reading PAT %w", err)
+	}
+
+	pm := pat.ProgramMap()
+	programNrs := make([]int, 0, len(pm))
+	for nr := range pm {
+		programNrs = append(programNrs, nr)
+	}
+	sort.Ints(programNrs)
+	scte35PIDs := make(map[int]bool)
+	for _, nr := range programNrs {
+		pmt, err := psi.ReadPMT(reader, pm[nr])
+		if err != nil {
+			return fmt.Errorf("reading PMT %w", err)
+		}
+		for _, es := range pmt.ElementaryStreams() {
+			streamInfo := ParseElementaryStreamInfo(es)
+			if streamInfo != nil {
+				streamInfo.ProgramNumber = uint16(nr)
+				if streamInfo.Codec == "SCTE35" {
+					scte35PIDs[es.ElementaryPid()] = true
+				}
+
+				if err := emit(h, *streamInfo); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// SCTE35 sections can span several packets
+	sections := make(map[int]*sectionAssembler)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		var pkt packet.Packet
+		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+
+		currPID := packet.Pid(&pkt)
+		if scte35PIDs[currPID] {
+			pay, err := packet.Payload(&pkt)
+			if err != nil {
+				return fmt.Errorf("cannot get payload for packet on PID %d Error=%s", currPID, err)
+			}
+			a := sections[currPID]
+			if a == nil {
+				a = &sectionAssembler{}
+				sections[currPID] = a
+			}
+			for _, section := range a.write(packet.PayloadUnitStartIndicator(&pkt), pay) {
+				info, err := DecodeSCTE35(uint16(currPID), section)
+				if err != nil {
+					return fmt.Errorf("cannot parse SCTE35 Error=%v", err)
+				}
+				if err := emit(h, info); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
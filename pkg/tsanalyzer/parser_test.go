@@ -0,0 +1,43 @@
+package tsanalyzer
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAllEvents(t *testing.T) {
+	f, err := os.Open("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	var streams []ElementaryStreamInfo
+	var frames []NaluFrameData
+	var pss []PsInfo
+	var stats []StreamStatistics
+	h := HandlerFunc(func(ev Event) error {
+		switch e := ev.(type) {
+		case ElementaryStreamInfo:
+			streams = append(streams, e)
+		case NaluFrameData:
+			frames = append(frames, e)
+		case PsInfo:
+			pss = append(pss, e)
+		case StreamStatistics:
+			stats = append(stats, e)
+		}
+		return nil
+	})
+	err = ParseAll(context.TODO(), f, h, Options{MaxNrPictures: 10})
+	require.NoError(t, err)
+	require.Equal(t, []ElementaryStreamInfo{{PID: 256, Codec: "AVC", Type: "video", ProgramNumber: 1}, {PID: 257, Codec: "AAC", Type: "audio", ProgramNumber: 1}}, streams)
+	require.Len(t, frames, 10)
+	require.True(t, frames[0].RAI)
+	require.Equal(t, "SPS", pss[0].ParameterSet)
+	require.Nil(t, pss[0].Details)
+	require.Len(t, stats, 1)
+	require.Equal(t, uint16(256), stats[0].Pid)
+	require.Equal(t, 24.0, stats[0].FrameRate)
+}
@@ -0,0 +1,480 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	slices "golang.org/x/exp/slices"
+)
+
+// StreamSelector selects elementary streams in FilterPids by PID, by kind or
+// codec, and by language. The kinds are "video", "audio", "scte35",
+// "smpte2038", "subtitles", "teletext" and "data", and the codecs are those of
+// ElementaryStreamInfo, e.g. "AVC" or "AC-3". Kinds and codecs are matched
+// case-insensitively. The language is the ISO 639-2 code of the ISO 639
+// language or subtitling descriptor.
+type StreamSelector struct {
+	PID      int    // 0 = any PID
+	Name     string // Kind or codec ("" = any)
+	Language string // Language code ("" = any)
+}
+
+// streamNames are the kinds and codecs returned by streamKind.
+var streamNames = []string{"video", "audio", "scte35", "smpte2038", "subtitles", "teletext", "data",
+	"MPEG-2", "AVC", "HEVC", "MPEG-1", "AAC", "AC-3", "E-AC-3", "SCTE35", "SMPTE-2038"}
+
+// ParseStreamSelector parses a PID, or a kind or codec optionally followed by
+// a colon and a language, e.g. "256", "video", "audio:eng", "AAC" or "*:swe".
+func ParseStreamSelector(s string) (StreamSelector, error) {
+	if pid, err := strconv.Atoi(s); err == nil {
+		if pid <= 0 || pid >= NullPID {
+			return StreamSelector{}, fmt.Errorf("invalid PID %d", pid)
+		}
+		return StreamSelector{PID: pid}, nil
+	}
+	name, lang, _ := strings.Cut(s, ":")
+	if name == "" {
+		return StreamSelector{}, fmt.Errorf("no kind or codec in %q", s)
+	}
+	if name == "*" {
+		name = ""
+	} else if !slices.ContainsFunc(streamNames, func(n string) bool { return strings.EqualFold(n, name) }) {
+		return StreamSelector{}, fmt.Errorf("unknown stream kind or codec %q", name)
+	}
+	if lang != "" && len(lang) != 3 {
+		return StreamSelector{}, fmt.Errorf("language %q is not a three-letter code", lang)
+	}
+	return StreamSelector{Name: name, Language: lang}, nil
+}
+
+func (sel StreamSelector) matches(s pmtStream) bool {
+	if sel.PID != 0 && sel.PID != s.pid {
+		return false
+	}
+	kind, codec, lang := streamKind(s)
+	if sel.Name != "" && !strings.EqualFold(sel.Name, kind) && !strings.EqualFold(sel.Name, codec) {
+		return false
+	}
+	return sel.Language == "" || strings.EqualFold(sel.Language, lang)
+}
+
+// streamKind returns the kind, codec and language of a PMT stream.
+func streamKind(s pmtStream) (kind, codec, lang string) {
+	switch s.streamType {
+	case 0x01, 0x02:
+		kind, codec = "video", "MPEG-2"
+	case 0x1b:
+		kind, codec = "video", "AVC"
+	case 0x24:
+		kind, codec = "video", "HEVC"
+	case 0x03, 0x04:
+		kind, codec = "audio", "MPEG-1"
+	case 0x0f, 0x11:
+		kind, codec = "audio", "AAC"
+	case 0x81:
+		kind, codec = "audio", "AC-3"
+	case 0x87:
+		kind, codec = "audio", "E-AC-3"
+	case scte35StreamType:
+		kind, codec = "scte35", "SCTE35"
+	default:
+		kind = "data"
+	}
+	for d := s.descriptors; len(d) >= 2 && len(d) >= 2+int(d[1]); d = d[2+int(d[1]):] {
+		tag, body := d[0], d[2:2+int(d[1])]
+		switch {
+		case tag == 0x0a && len(body) >= 3, tag == 0x59 && len(body) >= 3: // ISO_639_language, subtitling
+			if lang == "" {
+				lang = string(body[:3])
+			}
+			if tag == 0x59 && s.streamType == 0x06 {
+				kind = "subtitles"
+			}
+		case tag == 0x56 && s.streamType == 0x06: // teletext
+			kind = "teletext"
+			if lang == "" && len(body) >= 3 {
+				lang = string(body[:3])
+			}
+		case tag == 0x6a && s.streamType == 0x06: // DVB AC-3
+			kind, codec = "audio", "AC-3"
+		case tag == 0x7a && s.streamType == 0x06: // DVB enhanced AC-3
+			kind, codec = "audio", "E-AC-3"
+		case tag == registrationDescriptorTag && len(body) >= 4 &&
+			uint32(body[0])<<24|uint32(body[1])<<16|uint32(body[2])<<8|uint32(body[3]) == ANC_REGISTERED_IDENTIFIER:
+			kind, codec = "smpte2038", "SMPTE-2038"
+		}
+	}
+	return kind, codec, lang
+}
+
+// pidFilter is the state of FilterPids.
+type pidFilter struct {
+	w              io.Writer
+	h              Handler
+	drop           []int
+	dropStreams    []StreamSelector
+	keepStreams    []StreamSelector
+	dropped        map[int]bool // elementary streams dropped by selectors
+	pidMap         map[int]int
+	outputs        map[int]int // input PID of every output PID
+	programNumbers map[int]int
+	sections       map[int]*sectionAssembler
+	pmtPIDs        map[int]bool
+	pcrPIDs        map[int]bool  // PCR PIDs of the programs that are dropped
+	pcrOnlyCC      map[int]uint8 // continuity counter of the PCR-only packets on a dropped PCR PID
+	reported       map[int]bool  // programs with reported stream information
+	psiCC          map[int]*uint8
+	stats          *PidFilterStatistics
+}
+
+// FilterPids writes the TS to tsWriter with the PIDs in o.PidsToDrop removed
+// from the PMT and their packets dropped. Elementary streams are also dropped
+// if they match o.DropStreams or, if o.KeepStreams is not empty, if they match
+// none of o.KeepStreams. PIDs are changed according to
+// o.PIDMap, also in the PAT and PMT, and program numbers according to
+// o.ProgramNumbers, also as service_id in the SDT. The PAT, PMT and SDT are
+// rewritten with a new CRC_32. It is an error if two PIDs are output on the
+// same PID, e.g. if a PID is mapped to a PMT PID or to a PID that is kept. If
+// the PCR PID of a program is dropped, its PCRs are kept in packets with only
+// an adaptation field. Packets before the first PAT are dropped. Stream
+// information of the output and PidFilterStatistics are reported to h.
+func FilterPids(ctx context.Context, f io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	if slices.Contains(o.PidsToDrop, 0) {
+		return fmt.Errorf("filtering out PAT is not allowed")
+	}
+	if err := checkPIDMap(o.PIDMap); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	_, err := packet.Sync(reader)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+
+	statistics := PidFilterStatistics{PidsToDrop: o.PidsToDrop, PIDMap: o.PIDMap, ProgramNumbers: o.ProgramNumbers}
+	pf := &pidFilter{
+		w:              tsWriter,
+		h:              h,
+		drop:           o.PidsToDrop,
+		dropStreams:    o.DropStreams,
+		keepStreams:    o.KeepStreams,
+		dropped:        make(map[int]bool),
+		pidMap:         o.PIDMap,
+		outputs:        make(map[int]int),
+		programNumbers: o.ProgramNumbers,
+		sections:       make(map[int]*sectionAssembler),
+		pmtPIDs:        make(map[int]bool),
+		pcrPIDs:        make(map[int]bool),
+		pcrOnlyCC:      make(map[int]uint8),
+		reported:       make(map[int]bool),
+		psiCC:          make(map[int]*uint8),
+		stats:          &statistics,
+	}
+
+	var pkt packet.Packet
+	foundPAT := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		// Read packet
+		if _, err := io.ReadFull(reader, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		statistics.TotalPackets++
+		if packet.IsPat(&pkt) {
+			foundPAT = true
+		}
+		if !foundPAT {
+			statistics.PacketsBeforePAT++
+			continue
+		}
+		if err := pf.packet(&pkt); err != nil {
+			return err
+		}
+	}
+
+	for pid := range pf.dropped {
+		statistics.DroppedPIDs = append(statistics.DroppedPIDs, pid)
+	}
+	sort.Ints(statistics.DroppedPIDs)
+	statistics.calculatePercentage()
+	return emit(h, statistics)
+}
+
+// checkPIDMap checks that the PIDs are valid and that no two PIDs are mapped
+// to the same output PID.
+func checkPIDMap(pidMap map[int]int) error {
+	targets := make(map[int]int)
+	for from, to := range pidMap {
+		switch {
+		case from == 0 || to == 0:
+			return fmt.Errorf("remapping PAT is not allowed")
+		case from < 0 || from >= NullPID || to < 0 || to >= NullPID:
+			return fmt.Errorf("invalid PID mapping %d:%d", from, to)
+		}
+		if other, ok := targets[to]; ok {
+			if other > from {
+				from, other = other, from
+			}
+			return fmt.Errorf("PIDs %d and %d are both mapped to %d", other, from, to)
+		}
+		targets[to] = from
+	}
+	return nil
+}
+
+// isDropped tells if the packets of pid are dropped.
+func (pf *pidFilter) isDropped(pid int) bool {
+	return pf.dropped[pid] || slices.Contains(pf.drop, pid)
+}
+
+// dropStream tells if a PMT stream is dropped.
+func (pf *pidFilter) dropStream(s pmtStream) bool {
+	if slices.Contains(pf.drop, s.pid) {
+		return true
+	}
+	for _, sel := range pf.dropStreams {
+		if sel.matches(s) {
+			return true
+		}
+	}
+	if len(pf.keepStreams) == 0 {
+		return false
+	}
+	for _, sel := range pf.keepStreams {
+		if sel.matches(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// outPID returns the output PID of pid.
+func (pf *pidFilter) outPID(pid int) int {
+	if out, ok := pf.pidMap[pid]; ok {
+		return out
+	}
+	return pid
+}
+
+// claimOutPID returns the output PID of pid, or an error if another PID is
+// already output on it.
+func (pf *pidFilter) claimOutPID(pid int) (int, error) {
+	out := pf.outPID(pid)
+	if other, ok := pf.outputs[out]; ok && other != pid {
+		if other > pid {
+			other, pid = pid, other
+		}
+		return 0, fmt.Errorf("PIDs %d and %d are both mapped to %d", other, pid, out)
+	}
+	pf.outputs[out] = pid
+	return out, nil
+}
+
+func (pf *pidFilter) packet(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	if pid == 0 || pf.pmtPIDs[pid] {
+		return pf.psi(pkt)
+	}
+	if pid == sdtPID && len(pf.programNumbers) > 0 && !pf.isDropped(pid) {
+		return pf.psi(pkt)
+	}
+	if pf.isDropped(pid) {
+		if _, ok := packetPCR(pkt); !ok || !pf.pcrPIDs[pid] {
+			pf.stats.FilteredPackets++
+			return nil
+		}
+		p := pcrOnlyPacket(pkt)
+		// The continuity counter does not change without payload
+		cc, ok := pf.pcrOnlyCC[pid]
+		if !ok {
+			cc = p[3] & 0x0f
+			pf.pcrOnlyCC[pid] = cc
+		}
+		p[3] = p[3]&0xf0 | cc
+		pkt = &p
+	}
+	out, err := pf.claimOutPID(pid)
+	if err != nil {
+		return err
+	}
+	if out != pid {
+		pkt[1] = pkt[1]&0xe0 | byte(out>>8)&0x1f
+		pkt[2] = byte(out)
+	}
+	return WritePacket(pkt, pf.w)
+}
+
+// psi rewrites PAT, PMT and SDT sections.
+func (pf *pidFilter) psi(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	outPID, err := pf.claimOutPID(pid)
+	if err != nil {
+		return err
+	}
+	cc := pf.psiCC[pid]
+	if cc == nil {
+		// Continue the continuity counter of the input
+		c := uint8(packet.ContinuityCounter(pkt)-1) & 0x0f
+		cc = &c
+		pf.psiCC[pid] = cc
+	}
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	a := pf.sections[pid]
+	if a == nil {
+		a = &sectionAssembler{}
+		pf.sections[pid] = a
+	}
+	for _, section := range a.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		var out []byte
+		switch {
+		case pid == 0 && section[0] == 0x00:
+			out, err = pf.rewritePAT(section)
+		case pid == sdtPID && section[0] == 0x42:
+			out = pf.rewriteSDT(section)
+		case pid != 0 && section[0] == 0x02:
+			out, err = pf.rewritePMT(section)
+		default:
+			out = section
+		}
+		if err != nil {
+			return err
+		}
+		pkts := sectionPackets(outPID, out, cc)
+		for i := range pkts {
+			if err := WritePacket(&pkts[i], pf.w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewritePAT returns the PAT section with new program numbers and PMT PIDs.
+func (pf *pidFilter) rewritePAT(section []byte) ([]byte, error) {
+	out := slices.Clone(section[:len(section)-4])
+	for i := 8; i+4 <= len(out); i += 4 {
+		programNr := int(out[i])<<8 | int(out[i+1])
+		pid := int(out[i+2]&0x1f)<<8 | int(out[i+3])
+		if slices.Contains(pf.drop, pid) {
+			return nil, fmt.Errorf("filtering out PMT is not allowed")
+		}
+		if programNr != 0 {
+			pf.pmtPIDs[pid] = true
+			if nr, ok := pf.programNumbers[programNr]; ok {
+				programNr = nr
+			}
+		}
+		pid, err := pf.claimOutPID(pid)
+		if err != nil {
+			return nil, err
+		}
+		out[i], out[i+1] = byte(programNr>>8), byte(programNr)
+		out[i+2], out[i+3] = out[i+2]&0xe0|byte(pid>>8)&0x1f, byte(pid)
+	}
+	return append(out, gots.ComputeCRC(out)...), nil
+}
+
+// rewritePMT returns the PMT section without the dropped streams, and with
+// new PIDs and program number.
+func (pf *pidFilter) rewritePMT(section []byte) ([]byte, error) {
+	p, ok := parsePMTSection(section)
+	if !ok {
+		return section, nil
+	}
+	programNr := p.programNr
+	if nr, ok := pf.programNumbers[programNr]; ok {
+		programNr = nr
+	}
+	for _, s := range p.streams {
+		if pf.dropStream(s) {
+			pf.dropped[s.pid] = true
+		} else {
+			delete(pf.dropped, s.pid)
+		}
+	}
+	if pf.isDropped(p.pcrPID) {
+		pf.pcrPIDs[p.pcrPID] = true
+	}
+	pcrPID := p.pcrPID
+	if pcrPID != NullPID {
+		var err error
+		if pcrPID, err = pf.claimOutPID(pcrPID); err != nil {
+			return nil, fmt.Errorf("%w in program %d", err, programNr)
+		}
+	}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	out := slices.Clone(section[:12+programInfoLength])
+	out[3], out[4] = byte(programNr>>8), byte(programNr)
+	out[8], out[9] = out[8]&0xe0|byte(pcrPID>>8)&0x1f, byte(pcrPID)
+	for _, s := range p.streams {
+		if pf.isDropped(s.pid) {
+			continue
+		}
+		pid, err := pf.claimOutPID(s.pid)
+		if err != nil {
+			return nil, fmt.Errorf("%w in program %d", err, programNr)
+		}
+		out = append(out, s.streamType, 0xe0|byte(pid>>8), byte(pid),
+			0xf0|byte(len(s.descriptors)>>8), byte(len(s.descriptors)))
+		out = append(out, s.descriptors...)
+	}
+	sectionLength := len(out) + 4 - 3
+	out[1] = section[1]&0xf0 | byte(sectionLength>>8)
+	out[2] = byte(sectionLength)
+	out = append(out, gots.ComputeCRC(out)...)
+	if !pf.reported[programNr] {
+		pf.reported[programNr] = true
+		if err := emitPMTStreams(pf.h, programNr, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// rewriteSDT returns the SDT section with new service_ids for the renumbered programs.
+func (pf *pidFilter) rewriteSDT(section []byte) []byte {
+	out := slices.Clone(section[:len(section)-4])
+	for i := 11; i+5 <= len(out); {
+		serviceID := int(out[i])<<8 | int(out[i+1])
+		if nr, ok := pf.programNumbers[serviceID]; ok {
+			out[i], out[i+1] = byte(nr>>8), byte(nr)
+		}
+		i += 5 + (int(out[i+3]&0x0f)<<8 | int(out[i+4]))
+	}
+	return append(out, gots.ComputeCRC(out)...)
+}
+
+// pcrOnlyPacket returns a packet with only the adaptation field of pkt,
+// up to and including the PCR, and stuffing.
+func pcrOnlyPacket(pkt *packet.Packet) packet.Packet {
+	var p packet.Packet
+	copy(p[:4], pkt[:4])
+	p[1] &= 0xbf            // no payload_unit_start_indicator
+	p[3] = p[3]&0xcf | 0x20 // adaptation field only
+	p[4] = PacketSize - 5
+	p[5] = pkt[5] & 0x90 // discontinuity_indicator and PCR_flag
+	copy(p[6:12], pkt[6:12])
+	for i := 12; i < PacketSize; i++ {
+		p[i] = 0xff
+	}
+	return p
+}
@@ -0,0 +1,242 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+// psiSections returns the PSI sections on pid in data with a valid CRC_32.
+func psiSections(t *testing.T, data []byte, pid int) [][]byte {
+	t.Helper()
+	a := &sectionAssembler{}
+	var sections [][]byte
+	for i := 0; i < len(data); i += PacketSize {
+		var pkt packet.Packet
+		copy(pkt[:], data[i:])
+		if pkt.PID() != pid {
+			continue
+		}
+		payload, err := pkt.Payload()
+		require.NoError(t, err)
+		for _, section := range a.write(pkt.PayloadUnitStartIndicator(), payload) {
+			n := len(section) - 4
+			require.Equal(t, gots.ComputeCRC(section[:n]), section[n:], "CRC_32 on pid %d", pid)
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+func TestFilterPids(t *testing.T) {
+	bbb, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name        string
+		o           Options
+		wantPMTPID  int
+		wantProgram int
+		wantPCRPID  int
+		wantStreams []int
+		wantPackets map[int]int
+		wantStats   PidFilterStatistics
+		wantErr     string
+	}{
+		{
+			name:        "drop",
+			o:           Options{PidsToDrop: []int{257}},
+			wantPMTPID:  4096,
+			wantProgram: 1,
+			wantPCRPID:  256,
+			wantStreams: []int{256},
+			wantPackets: map[int]int{0: 9, 17: 2, 256: 561, 4096: 9},
+			wantStats: PidFilterStatistics{PidsToDrop: []int{257}, DroppedPIDs: []int{257}, TotalPackets: 659,
+				FilteredPackets: 77, PacketsBeforePAT: 1},
+		},
+		{
+			name:        "remap",
+			o:           Options{PIDMap: map[int]int{256: 4096, 257: 4097, 4096: 100}, ProgramNumbers: map[int]int{1: 10}},
+			wantPMTPID:  100,
+			wantProgram: 10,
+			wantPCRPID:  4096,
+			wantStreams: []int{4096, 4097},
+			wantPackets: map[int]int{0: 9, 17: 2, 100: 9, 4096: 561, 4097: 77},
+			wantStats: PidFilterStatistics{PIDMap: map[int]int{256: 4096, 257: 4097, 4096: 100},
+				ProgramNumbers: map[int]int{1: 10}, TotalPackets: 659, PacketsBeforePAT: 1},
+		},
+		{
+			name:        "drop PCR PID",
+			o:           Options{PidsToDrop: []int{256}},
+			wantPMTPID:  4096,
+			wantProgram: 1,
+			wantPCRPID:  256,
+			wantStreams: []int{257},
+			wantPackets: map[int]int{0: 9, 17: 2, 256: 13, 257: 77, 4096: 9},
+			wantStats: PidFilterStatistics{PidsToDrop: []int{256}, DroppedPIDs: []int{256}, TotalPackets: 659,
+				FilteredPackets: 548, PacketsBeforePAT: 1},
+		},
+		{
+			name:        "keep",
+			o:           Options{KeepStreams: []StreamSelector{{Name: "VIDEO"}}},
+			wantPMTPID:  4096,
+			wantProgram: 1,
+			wantPCRPID:  256,
+			wantStreams: []int{256},
+			wantPackets: map[int]int{0: 9, 17: 2, 256: 561, 4096: 9},
+			wantStats:   PidFilterStatistics{DroppedPIDs: []int{257}, TotalPackets: 659, FilteredPackets: 77, PacketsBeforePAT: 1},
+		},
+		{
+			name:        "drop codec",
+			o:           Options{PidsToDrop: []int{17}, DropStreams: []StreamSelector{{Name: "avc"}}},
+			wantPMTPID:  4096,
+			wantProgram: 1,
+			wantPCRPID:  256,
+			wantStreams: []int{257},
+			wantPackets: map[int]int{0: 9, 256: 13, 257: 77, 4096: 9},
+			wantStats: PidFilterStatistics{PidsToDrop: []int{17}, DroppedPIDs: []int{256}, TotalPackets: 659,
+				FilteredPackets: 550, PacketsBeforePAT: 1},
+		},
+		{
+			name:    "same output PID",
+			o:       Options{PIDMap: map[int]int{256: 257}},
+			wantErr: "PIDs 256 and 257 are both mapped to 257 in program 1",
+		},
+		{
+			name:    "PAT",
+			o:       Options{PIDMap: map[int]int{0: 100}},
+			wantErr: "remapping PAT is not allowed",
+		},
+		{
+			name:    "null PID",
+			o:       Options{PIDMap: map[int]int{256: NullPID}},
+			wantErr: "invalid PID mapping 256:8191",
+		},
+		{
+			name:    "PMT PID",
+			o:       Options{PIDMap: map[int]int{256: 4096}},
+			wantErr: "PIDs 256 and 4096 are both mapped to 4096 in program 1",
+		},
+		{
+			name:    "kept PID",
+			o:       Options{PIDMap: map[int]int{256: 17}},
+			wantErr: "PIDs 17 and 256 are both mapped to 17",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stats PidFilterStatistics
+			h := HandlerFunc(func(ev Event) error {
+				if s, ok := ev.(PidFilterStatistics); ok {
+					stats = s
+				}
+				return nil
+			})
+			var out bytes.Buffer
+			err := FilterPids(context.TODO(), bytes.NewReader(bbb), &out, h, tc.o)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			stats.Percentage = 0
+			require.Equal(t, tc.wantStats, stats)
+			data := out.Bytes()
+
+			packets := make(map[int]int)
+			cc := make(map[int]uint8)
+			for i := 0; i < len(data); i += PacketSize {
+				var pkt packet.Packet
+				copy(pkt[:], data[i:])
+				pid := pkt.PID()
+				packets[pid]++
+				c := uint8(pkt.ContinuityCounter())
+				if last, ok := cc[pid]; ok {
+					if pkt.HasPayload() {
+						require.Equal(t, (last+1)&0x0f, c, "cc on pid %d", pid)
+					} else {
+						require.Equal(t, last, c, "cc on pid %d", pid)
+					}
+				}
+				cc[pid] = c
+			}
+			require.Equal(t, tc.wantPackets, packets)
+
+			pats := psiSections(t, data, 0)
+			require.NotEmpty(t, pats)
+			for _, pat := range pats {
+				require.Equal(t, map[int]int{tc.wantProgram: tc.wantPMTPID}, patPrograms(pat))
+			}
+			pmts := psiSections(t, data, tc.wantPMTPID)
+			require.Len(t, pmts, len(pats))
+			for _, section := range pmts {
+				pmt, ok := parsePMTSection(section)
+				require.True(t, ok)
+				require.Equal(t, tc.wantProgram, pmt.programNr)
+				require.Equal(t, tc.wantPCRPID, pmt.pcrPID)
+				var pids []int
+				for _, s := range pmt.streams {
+					pids = append(pids, s.pid)
+				}
+				require.Equal(t, tc.wantStreams, pids)
+			}
+			sdts := psiSections(t, data, sdtPID)
+			for _, sdt := range sdts {
+				// service_id of the first service
+				require.Equal(t, tc.wantProgram, int(sdt[11])<<8|int(sdt[12]))
+			}
+		})
+	}
+}
+
+func TestStreamSelector(t *testing.T) {
+	lang := func(code string) []byte { return append([]byte{0x0a, 4}, append([]byte(code), 0)...) }
+	video := pmtStream{streamType: 0x1b, pid: 256}
+	eng := pmtStream{streamType: 0x0f, pid: 257, descriptors: lang("eng")}
+	swe := pmtStream{streamType: 0x06, pid: 258, descriptors: append([]byte{0x7a, 1, 0}, lang("swe")...)}
+	cue := pmtStream{streamType: 0x86, pid: 500}
+	anc := pmtStream{streamType: 0x06, pid: 600, descriptors: []byte{0x05, 4, 'V', 'A', 'N', 'C'}}
+	sub := pmtStream{streamType: 0x06, pid: 700, descriptors: []byte{0x59, 8, 'f', 'i', 'n', 0x10, 0, 1, 0, 1}}
+	streams := []pmtStream{video, eng, swe, cue, anc, sub}
+
+	testCases := []struct {
+		selector string
+		want     []int
+		err      bool
+	}{
+		{selector: "256", want: []int{256}},
+		{selector: "video", want: []int{256}},
+		{selector: "hevc", want: nil},
+		{selector: "audio", want: []int{257, 258}},
+		{selector: "audio:eng", want: []int{257}},
+		{selector: "E-AC-3", want: []int{258}},
+		{selector: "*:swe", want: []int{258}},
+		{selector: "scte35", want: []int{500}},
+		{selector: "smpte2038", want: []int{600}},
+		{selector: "subtitles:fin", want: []int{700}},
+		{selector: "vidoe", err: true},
+		{selector: "audio:english", err: true},
+		{selector: ":eng", err: true},
+		{selector: "8191", err: true},
+	}
+	for _, tc := range testCases {
+		sel, err := ParseStreamSelector(tc.selector)
+		if tc.err {
+			require.Error(t, err, tc.selector)
+			continue
+		}
+		require.NoError(t, err, tc.selector)
+		var got []int
+		for _, s := range streams {
+			if sel.matches(s) {
+				got = append(got, s.pid)
+			}
+		}
+		require.Equal(t, tc.want, got, tc.selector)
+	}
+}
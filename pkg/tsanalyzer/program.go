@@ -0,0 +1,258 @@
+package tsanalyzer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/asticode/go-astits"
+)
+
+// ProgramLayout is the elementary streams of a program as described by one PMT version.
+type ProgramLayout struct {
+	Version int                    `json:"version"`
+	PCRPID  uint16                 `json:"pcrPid"`
+	Streams []ElementaryStreamInfo `json:"streams"`
+}
+
+// ProgramChange is reported when the PMT of a program changes after the
+// programs have been found, e.g. when the encoder restarts. Packet is the
+// number of the packet that completed the new PMT, or the PAT for programs
+// that are removed. Old is empty for added programs and New for removed programs.
+type ProgramChange struct {
+	ProgramNumber uint16        `json:"programNumber"`
+	PMTPID        uint16        `json:"pmtPid"`
+	Packet        int64         `json:"packet"`
+	Old           ProgramLayout `json:"old"`
+	New           ProgramLayout `json:"new"`
+}
+
+func (ProgramChange) isEvent() {}
+
+// changedPIDs returns the PIDs that are removed, added or have a new codec.
+func (c ProgramChange) changedPIDs() []uint16 {
+	codecs := make(map[uint16]string)
+	for _, s := range c.Old.Streams {
+		codecs[s.PID] = s.Codec
+	}
+	var pids []uint16
+	for _, s := range c.New.Streams {
+		codec, ok := codecs[s.PID]
+		if !ok || codec != s.Codec {
+			pids = append(pids, s.PID)
+		}
+		delete(codecs, s.PID)
+	}
+	for _, s := range c.Old.Streams {
+		if _, ok := codecs[s.PID]; ok {
+			pids = append(pids, s.PID)
+		}
+	}
+	return pids
+}
+
+// programTracker keeps track of the programs in a TS and which of them are
+// selected by Options.Program and Options.ServiceName.
+type programTracker struct {
+	number       int
+	name         string
+	patPrograms  map[uint16]uint16 // program number -> PMT PID from the latest PAT
+	pmts         map[uint16]*astits.PMTData
+	versions     map[uint16]int
+	selected     map[uint16]bool
+	serviceNames map[uint16]string // service id (= program number) -> name from the first SDT
+	sdtFound     bool
+	started      bool // all programs have been found once
+}
+
+func newProgramTracker(o Options) *programTracker {
+	return &programTracker{
+		number:       o.Program,
+		name:         o.ServiceName,
+		pmts:         make(map[uint16]*astits.PMTData),
+		versions:     make(map[uint16]int),
+		selected:     make(map[uint16]bool),
+		serviceNames: make(map[uint16]string),
+	}
+}
+
+// update handles PAT, PMT and SDT data. It returns the PMTs of the programs
+// that have become selected, sorted by program number, and the changes of
+// selected programs.
+func (t *programTracker) update(d *astits.DemuxerData, ds *demuxState) ([]*astits.PMTData, []ProgramChange) {
+	var changes []ProgramChange
+	nr := ds.packets - 1 // the packet that completed d
+	switch {
+	case d.PAT != nil:
+		programs := make(map[uint16]uint16)
+		for _, p := range d.PAT.Programs {
+			// Program number 0 is the network PID
+			if p.ProgramNumber != 0 {
+				programs[p.ProgramNumber] = p.ProgramMapID
+			}
+		}
+		for _, programNr := range sortedPrograms(t.patPrograms) {
+			if _, ok := programs[programNr]; ok {
+				continue
+			}
+			if t.selected[programNr] {
+				changes = append(changes, ProgramChange{
+					ProgramNumber: programNr,
+					PMTPID:        t.patPrograms[programNr],
+					Packet:        nr,
+					Old:           t.layout(programNr),
+				})
+			}
+			delete(t.pmts, programNr)
+			delete(t.versions, programNr)
+			delete(t.selected, programNr)
+		}
+		t.patPrograms = programs
+	case d.PMT != nil:
+		programNr := d.PMT.ProgramNumber
+		version := ds.versions[d.PID]
+		old, ok := t.pmts[programNr]
+		if ok && version == t.versions[programNr] && sameLayout(old, d.PMT) {
+			break
+		}
+		var oldLayout ProgramLayout
+		if ok {
+			oldLayout = t.layout(programNr)
+		}
+		t.pmts[programNr] = d.PMT
+		t.versions[programNr] = version
+		if t.selected[programNr] || (t.started && t.matches(programNr)) {
+			t.selected[programNr] = true
+			changes = append(changes, ProgramChange{
+				ProgramNumber: programNr,
+				PMTPID:        d.PID,
+				Packet:        nr,
+				Old:           oldLayout,
+				New:           t.layout(programNr),
+			})
+		}
+	case d.SDT != nil && !t.sdtFound:
+		for _, s := range d.SDT.Services {
+			for _, sd := range s.Descriptors {
+				if sd.Tag == astits.DescriptorTagService {
+					t.serviceNames[s.ServiceID] = string(sd.Service.Name)
+				}
+			}
+		}
+		t.sdtFound = true
+	default:
+		return nil, nil
+	}
+
+	var newPMTs []*astits.PMTData
+	for programNr, pmt := range t.pmts {
+		if !t.selected[programNr] && t.matches(programNr) {
+			t.selected[programNr] = true
+			newPMTs = append(newPMTs, pmt)
+		}
+	}
+	sort.Slice(newPMTs, func(i, j int) bool { return newPMTs[i].ProgramNumber < newPMTs[j].ProgramNumber })
+	if t.complete() {
+		t.started = true
+	}
+	return newPMTs, changes
+}
+
+// layout returns the current layout of a program.
+func (t *programTracker) layout(programNr uint16) ProgramLayout {
+	pmt := t.pmts[programNr]
+	return ProgramLayout{
+		Version: t.versions[programNr],
+		PCRPID:  pmt.PCRPID,
+		Streams: programStreams(pmt),
+	}
+}
+
+// matches returns true if the program is selected.
+func (t *programTracker) matches(programNr uint16) bool {
+	switch {
+	case t.number > 0:
+		return int(programNr) == t.number
+	case t.name != "":
+		return t.sdtFound && t.serviceNames[programNr] == t.name
+	default:
+		return true
+	}
+}
+
+// complete returns true when the PMTs of all programs in the PAT have been
+// found, and the SDT if a service name is to be matched.
+func (t *programTracker) complete() bool {
+	if t.patPrograms == nil || (t.name != "" && !t.sdtFound) {
+		return false
+	}
+	for nr := range t.patPrograms {
+		if t.pmts[nr] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// err returns an error if no program matches the selection.
+func (t *programTracker) err() error {
+	if len(t.selected) > 0 {
+		return nil
+	}
+	switch {
+	case t.number > 0:
+		return fmt.Errorf("program %d not found", t.number)
+	case t.name != "":
+		return fmt.Errorf("service %q not found", t.name)
+	default:
+		return nil
+	}
+}
+
+// programStreams returns the stream information for the supported
+// elementary streams of a program.
+func programStreams(pmt *astits.PMTData) []ElementaryStreamInfo {
+	var streams []ElementaryStreamInfo
+	for _, es := range pmt.ElementaryStreams {
+		streamInfo := ParseAstitsElementaryStreamInfo(es)
+		if streamInfo != nil {
+			streamInfo.ProgramNumber = pmt.ProgramNumber
+			streams = append(streams, *streamInfo)
+		}
+	}
+	return streams
+}
+
+// sameLayout returns true if the PMTs have the same PCR PID and elementary streams.
+func sameLayout(a, b *astits.PMTData) bool {
+	if a.PCRPID != b.PCRPID || len(a.ElementaryStreams) != len(b.ElementaryStreams) {
+		return false
+	}
+	for i, es := range a.ElementaryStreams {
+		other := b.ElementaryStreams[i]
+		if es.ElementaryPID != other.ElementaryPID || es.StreamType != other.StreamType {
+			return false
+		}
+	}
+	return true
+}
+
+// psiVersion returns the version_number of the PSI section starting in p, or -1.
+func psiVersion(p *astits.Packet) int {
+	if p == nil || len(p.Payload) == 0 {
+		return -1
+	}
+	start := 1 + int(p.Payload[0]) // pointer_field
+	if start+6 > len(p.Payload) {
+		return -1
+	}
+	return int(p.Payload[start+5]>>1) & 0x1f
+}
+
+func sortedPrograms(programs map[uint16]uint16) []uint16 {
+	nrs := make([]uint16, 0, len(programs))
+	for nr := range programs {
+		nrs = append(nrs, nr)
+	}
+	sort.Slice(nrs, func(i, j int) bool { return nrs[i] < nrs[j] })
+	return nrs
+}
@@ -0,0 +1,154 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// makeMPTS turns bbb_1s.ts into a TS with two programs. Program 2 has its
+// PMT on PID 4097 and the same elementary streams as program 1.
+func makeMPTS(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	var out []byte
+	for i := 0; i+PacketSize <= len(data); i += PacketSize {
+		pkt := append([]byte{}, data[i:i+PacketSize]...)
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		switch pid {
+		case 0:
+			section := []byte{0x00, 0xb0, 0x11, pkt[8], pkt[9], pkt[10], 0x00, 0x00,
+				0x00, 0x01, 0xf0, 0x00, 0x00, 0x02, 0xf0, 0x01}
+			section = append(section, gots.ComputeCRC(section)...)
+			copy(pkt[5:], section)
+			out = append(out, pkt...)
+		case 4096:
+			out = append(out, pkt...)
+			pmt2 := append([]byte{}, pkt...)
+			pmt2[2] = 0x01
+			pmt2[9] = 0x02
+			sectionEnd := 5 + 3 + (int(pmt2[6]&0x0f)<<8 | int(pmt2[7])) - 4
+			copy(pmt2[sectionEnd:], gots.ComputeCRC(pmt2[5:sectionEnd]))
+			out = append(out, pmt2...)
+		default:
+			out = append(out, pkt...)
+		}
+	}
+	return out
+}
+
+func TestMPTS(t *testing.T) {
+	data := makeMPTS(t)
+
+	parse := func(o Options) ([]ElementaryStreamInfo, int, error) {
+		var streams []ElementaryStreamInfo
+		nrFrames := 0
+		h := HandlerFunc(func(ev Event) error {
+			switch e := ev.(type) {
+			case ElementaryStreamInfo:
+				streams = append(streams, e)
+			case NaluFrameData:
+				nrFrames++
+			}
+			return nil
+		})
+		err := ParseAll(context.TODO(), bytes.NewReader(data), h, o)
+		return streams, nrFrames, err
+	}
+
+	t.Run("all programs", func(t *testing.T) {
+		streams, nrFrames, err := parse(Options{MaxNrPictures: 5})
+		require.NoError(t, err)
+		require.Len(t, streams, 4)
+		require.Equal(t, uint16(1), streams[0].ProgramNumber)
+		require.Equal(t, uint16(2), streams[3].ProgramNumber)
+		require.Equal(t, 5, nrFrames)
+	})
+
+	t.Run("program number", func(t *testing.T) {
+		streams, nrFrames, err := parse(Options{MaxNrPictures: 5, Program: 2})
+		require.NoError(t, err)
+		require.Len(t, streams, 2)
+		require.Equal(t, uint16(2), streams[0].ProgramNumber)
+		require.Equal(t, 5, nrFrames)
+	})
+
+	t.Run("service name", func(t *testing.T) {
+		streams, _, err := parse(Options{MaxNrPictures: 5, ServiceName: "ts-info"})
+		require.NoError(t, err)
+		require.Len(t, streams, 2)
+		require.Equal(t, uint16(1), streams[0].ProgramNumber)
+	})
+
+	t.Run("missing program", func(t *testing.T) {
+		_, _, err := parse(Options{Program: 3})
+		require.EqualError(t, err, "program 3 not found")
+		_, _, err = parse(Options{ServiceName: "other"})
+		require.EqualError(t, err, `service "other" not found`)
+	})
+
+	t.Run("extract", func(t *testing.T) {
+		var es bytes.Buffer
+		err := ExtractES(context.TODO(), bytes.NewReader(data), &es, nil, Options{Program: 2, WaitForPS: true})
+		require.NoError(t, err)
+		require.Greater(t, es.Len(), 0)
+		err = ExtractES(context.TODO(), bytes.NewReader(data), &es, nil, Options{Program: 3})
+		require.EqualError(t, err, "program 3 not found")
+	})
+}
+
+func TestProgramChange(t *testing.T) {
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	// From packet 300, the PMT has version 1 and PID 257 is private data instead of AAC
+	changeAt := -1
+	for i := 300 * PacketSize; i+PacketSize <= len(data); i += PacketSize {
+		pkt := data[i : i+PacketSize]
+		if int(pkt[1]&0x1f)<<8|int(pkt[2]) != 4096 {
+			continue
+		}
+		if changeAt < 0 {
+			changeAt = i / PacketSize
+		}
+		pkt[10] = 0xc3
+		pkt[22] = 0x06
+		sectionEnd := 5 + 3 + (int(pkt[6]&0x0f)<<8 | int(pkt[7])) - 4
+		copy(pkt[sectionEnd:], gots.ComputeCRC(pkt[5:sectionEnd]))
+	}
+	require.Greater(t, changeAt, 0)
+
+	var changes []ProgramChange
+	var stats []StreamStatistics
+	nrFrames := 0
+	h := HandlerFunc(func(ev Event) error {
+		switch e := ev.(type) {
+		case ProgramChange:
+			changes = append(changes, e)
+		case StreamStatistics:
+			stats = append(stats, e)
+		case NaluFrameData:
+			nrFrames++
+		}
+		return nil
+	})
+	err = ParseAll(context.TODO(), bytes.NewReader(data), h, Options{})
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	c := changes[0]
+	require.Equal(t, uint16(1), c.ProgramNumber)
+	require.Equal(t, uint16(4096), c.PMTPID)
+	require.Equal(t, int64(changeAt), c.Packet)
+	require.Equal(t, 0, c.Old.Version)
+	require.Equal(t, 1, c.New.Version)
+	require.Equal(t, "AAC", c.Old.Streams[1].Codec)
+	require.Equal(t, "PrivateData", c.New.Streams[1].Codec)
+	require.Equal(t, []uint16{257}, c.changedPIDs())
+	// The video stream is not affected
+	require.Len(t, stats, 1)
+	require.Equal(t, 26, nrFrames)
+}
@@ -0,0 +1,701 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/scte35"
+	"github.com/Eyevinn/mp4ff/bits"
+)
+
+// SCTE-35 splice_command_type values
+const (
+	spliceNull                 = 0x00
+	spliceSchedule             = 0x04
+	spliceInsert               = 0x05
+	timeSignal                 = 0x06
+	bandwidthReservation       = 0x07
+	privateCommand             = 0xff
+	scte35TableID              = 0xfc
+	availDescriptorTag         = 0x00
+	segmentationDescriptorTag  = 0x02
+	scte35DescriptorIdentifier = 0x43554549 // CUEI
+)
+
+// SCTE35Info is a decoded splice_info_section.
+// PTS values are pts_time values without PTSAdjustment added.
+// Base64 is the complete section from table_id to CRC_32.
+type SCTE35Info struct {
+	PID             uint16                   `json:"pid"`
+	PTSAdjustment   uint64                   `json:"ptsAdjustment,omitempty"`
+	Tier            uint16                   `json:"tier"`
+	EncryptedPacket bool                     `json:"encryptedPacket,omitempty"`
+	CWIndex         uint8                    `json:"cwIndex,omitempty"`
+	SpliceCommand   SpliceCommand            `json:"spliceCommand"`
+	SegDesc         []SegmentationDescriptor `json:"segmentationDes,omitempty"`
+	AvailDesc       []AvailDescriptor        `json:"availDes,omitempty"`
+	OtherDesc       []SpliceDescriptor       `json:"otherDes,omitempty"`
+	Base64          string                   `json:"base64"`
+}
+
+type SpliceCommand struct {
+	Type            string            `json:"type"`
+	EventId         uint32            `json:"eventId"`
+	PTS             uint64            `json:"pts"`
+	Duration        uint64            `json:"duration,omitempty"`
+	Out             bool              `json:"outOfNetwork,omitempty"`
+	Immediate       bool              `json:"immediate,omitempty"`
+	Cancel          bool              `json:"cancel,omitempty"`
+	AutoReturn      bool              `json:"autoReturn,omitempty"`
+	UniqueProgramId uint16            `json:"uniqueProgramId,omitempty"`
+	AvailNum        uint8             `json:"availNum,omitempty"`
+	AvailsExpected  uint8             `json:"availsExpected,omitempty"`
+	Components      []SpliceComponent `json:"components,omitempty"`
+	Events          []ScheduleEvent   `json:"events,omitempty"`
+	Identifier      uint32            `json:"identifier,omitempty"`
+	PrivateBytes    string            `json:"privateBytes,omitempty"`
+}
+
+// SpliceComponent is a component of a component splice.
+// UTCSpliceTime is only used in splice_schedule.
+type SpliceComponent struct {
+	Tag           uint8  `json:"tag"`
+	PTS           uint64 `json:"pts,omitempty"`
+	UTCSpliceTime uint32 `json:"utcSpliceTime,omitempty"`
+}
+
+// ScheduleEvent is an event in a splice_schedule command.
+type ScheduleEvent struct {
+	EventId         uint32            `json:"eventId"`
+	Cancel          bool              `json:"cancel,omitempty"`
+	Out             bool              `json:"outOfNetwork,omitempty"`
+	UTCSpliceTime   uint32            `json:"utcSpliceTime,omitempty"`
+	Duration        uint64            `json:"duration,omitempty"`
+	AutoReturn      bool              `json:"autoReturn,omitempty"`
+	UniqueProgramId uint16            `json:"uniqueProgramId"`
+	AvailNum        uint8             `json:"availNum"`
+	AvailsExpected  uint8             `json:"availsExpected"`
+	Components      []SpliceComponent `json:"components,omitempty"`
+}
+
+type SegmentationDescriptor struct {
+	SegmentNumber        uint8                   `json:"segmentNumber"`
+	EventId              uint32                  `json:"eventId"`
+	Type                 string                  `json:"type"`
+	Duration             uint64                  `json:"duration,omitempty"`
+	TypeId               uint8                   `json:"typeId"`
+	Cancel               bool                    `json:"cancel,omitempty"`
+	SegmentsExpected     uint8                   `json:"segmentsExpected"`
+	SubSegmentNumber     *uint8                  `json:"subSegmentNumber,omitempty"`
+	SubSegmentsExpected  *uint8                  `json:"subSegmentsExpected,omitempty"`
+	DeliveryRestrictions *DeliveryRestrictions   `json:"deliveryRestrictions,omitempty"`
+	Components           []SegmentationComponent `json:"components,omitempty"`
+	UPID                 *SegmentationUPID       `json:"upid,omitempty"`
+}
+
+// DeliveryRestrictions is present when delivery_not_restricted_flag is 0.
+type DeliveryRestrictions struct {
+	WebDeliveryAllowed bool   `json:"webDeliveryAllowed"`
+	NoRegionalBlackout bool   `json:"noRegionalBlackout"`
+	ArchiveAllowed     bool   `json:"archiveAllowed"`
+	DeviceRestrictions string `json:"deviceRestrictions"`
+}
+
+type SegmentationComponent struct {
+	Tag       uint8  `json:"tag"`
+	PTSOffset uint64 `json:"ptsOffset"`
+}
+
+// SegmentationUPID is a segmentation_upid. Value is decoded depending on the
+// type, e.g. as text for ADI and URI, and as hex if there is no better format.
+// A MID contains a list of UPIDs.
+type SegmentationUPID struct {
+	Type     uint8              `json:"type"`
+	TypeName string             `json:"typeName"`
+	Value    string             `json:"value,omitempty"`
+	MID      []SegmentationUPID `json:"mid,omitempty"`
+}
+
+type AvailDescriptor struct {
+	ProviderAvailId uint32 `json:"providerAvailId"`
+}
+
+// SpliceDescriptor is a splice descriptor that is not decoded. Data is hex.
+type SpliceDescriptor struct {
+	Tag        uint8  `json:"tag"`
+	Identifier string `json:"identifier"`
+	Data       string `json:"data,omitempty"`
+}
+
+var upidTypeNames = map[uint8]string{
+	0x00: "NotUsed",
+	0x01: "UserDefined",
+	0x02: "ISCI",
+	0x03: "AdID",
+	0x04: "UMID",
+	0x05: "ISAN",
+	0x06: "VISAN",
+	0x07: "TID",
+	0x08: "TI",
+	0x09: "ADI",
+	0x0a: "EIDR",
+	0x0b: "ATSC",
+	0x0c: "MPU",
+	0x0d: "MID",
+	0x0e: "ADS",
+	0x0f: "URI",
+	0x10: "UUID",
+	0x11: "SCR",
+}
+
+// DecodeSCTE35 decodes a splice_info_section starting with table_id and checks its CRC_32.
+func DecodeSCTE35(pid uint16, section []byte) (SCTE35Info, error) {
+	info := SCTE35Info{PID: pid}
+	if len(section) < 3 || section[0] != scte35TableID {
+		return info, fmt.Errorf("not a splice_info_section")
+	}
+	length := 3 + (int(section[1]&0x0f)<<8 | int(section[2]))
+	if length > len(section) || length < 20 {
+		return info, fmt.Errorf("bad section_length %d", length-3)
+	}
+	section = section[:length]
+	if !bytes.Equal(gots.ComputeCRC(section[:length-4]), section[length-4:]) {
+		return info, fmt.Errorf("CRC error")
+	}
+	info.Base64 = base64.StdEncoding.EncodeToString(section)
+
+	r := bits.NewReader(bytes.NewReader(section[3 : length-4]))
+	_ = r.Read(8) // protocol_version
+	info.EncryptedPacket = r.ReadFlag()
+	_ = r.Read(6) // encryption_algorithm
+	info.PTSAdjustment = uint64(r.Read(33))
+	info.CWIndex = uint8(r.Read(8))
+	info.Tier = uint16(r.Read(12))
+	commandLength := int(r.Read(12))
+	commandType := uint8(r.Read(8))
+	if info.EncryptedPacket {
+		// Commands and descriptors can not be decoded
+		return info, r.AccError()
+	}
+	info.SpliceCommand.Type = scte35.SpliceCommandTypeNames[scte35.SpliceCommandType(commandType)]
+	switch commandType {
+	case spliceNull, bandwidthReservation:
+	case spliceSchedule:
+		info.SpliceCommand.Events = decodeSpliceSchedule(r)
+	case spliceInsert:
+		info.SpliceCommand = decodeSpliceInsert(r, info.SpliceCommand)
+	case timeSignal:
+		info.SpliceCommand.PTS = decodeSpliceTime(r)
+	case privateCommand:
+		info.SpliceCommand.Identifier = uint32(r.Read(32))
+		if commandLength == 0xfff || commandLength < 4 {
+			return info, fmt.Errorf("private_command without splice_command_length")
+		}
+		info.SpliceCommand.PrivateBytes = hex.EncodeToString(readBytes(r, commandLength-4))
+	default:
+		return info, fmt.Errorf("unknown splice_command_type %d", commandType)
+	}
+	if err := r.AccError(); err != nil {
+		return info, fmt.Errorf("decoding splice command: %w", err)
+	}
+
+	loopLength := int(r.Read(16))
+	for loopLength >= 6 {
+		tag := uint8(r.Read(8))
+		descLength := int(r.Read(8))
+		data := readBytes(r, descLength)
+		if r.AccError() != nil || descLength < 4 {
+			return info, fmt.Errorf("bad splice descriptor")
+		}
+		loopLength -= 2 + descLength
+		identifier := binary.BigEndian.Uint32(data)
+		switch {
+		case identifier == scte35DescriptorIdentifier && tag == segmentationDescriptorTag:
+			segDesc, err := decodeSegmentationDescriptor(data[4:])
+			if err != nil {
+				return info, err
+			}
+			info.SegDesc = append(info.SegDesc, segDesc)
+		case identifier == scte35DescriptorIdentifier && tag == availDescriptorTag && descLength == 8:
+			info.AvailDesc = append(info.AvailDesc, AvailDescriptor{ProviderAvailId: binary.BigEndian.Uint32(data[4:])})
+		default:
+			info.OtherDesc = append(info.OtherDesc, SpliceDescriptor{
+				Tag:        tag,
+				Identifier: string(data[:4]),
+				Data:       hex.EncodeToString(data[4:]),
+			})
+		}
+	}
+	return info, r.AccError()
+}
+
+// decodeSpliceTime returns pts_time, or 0 if time_specified_flag is not set.
+func decodeSpliceTime(r *bits.Reader) uint64 {
+	if !r.ReadFlag() {
+		_ = r.Read(7) // reserved
+		return 0
+	}
+	_ = r.Read(6) // reserved
+	return uint64(r.Read(33))
+}
+
+// decodeBreakDuration returns the duration and auto_return flag of a break_duration.
+func decodeBreakDuration(r *bits.Reader) (uint64, bool) {
+	autoReturn := r.ReadFlag()
+	_ = r.Read(6) // reserved
+	return uint64(r.Read(33)), autoReturn
+}
+
+func decodeSpliceInsert(r *bits.Reader, cmd SpliceCommand) SpliceCommand {
+	cmd.EventId = uint32(r.Read(32))
+	cmd.Cancel = r.ReadFlag()
+	_ = r.Read(7) // reserved
+	if cmd.Cancel {
+		return cmd
+	}
+	cmd.Out = r.ReadFlag()
+	programSplice := r.ReadFlag()
+	hasDuration := r.ReadFlag()
+	cmd.Immediate = r.ReadFlag()
+	_ = r.Read(4) // reserved
+	if programSplice && !cmd.Immediate {
+		cmd.PTS = decodeSpliceTime(r)
+	}
+	if !programSplice {
+		count := int(r.Read(8))
+		for i := 0; i < count; i++ {
+			c := SpliceComponent{Tag: uint8(r.Read(8))}
+			if !cmd.Immediate {
+				c.PTS = decodeSpliceTime(r)
+			}
+			cmd.Components = append(cmd.Components, c)
+		}
+	}
+	if hasDuration {
+		cmd.Duration, cmd.AutoReturn = decodeBreakDuration(r)
+	}
+	cmd.UniqueProgramId = uint16(r.Read(16))
+	cmd.AvailNum = uint8(r.Read(8))
+	cmd.AvailsExpected = uint8(r.Read(8))
+	return cmd
+}
+
+func decodeSpliceSchedule(r *bits.Reader) []ScheduleEvent {
+	count := int(r.Read(8))
+	events := make([]ScheduleEvent, 0, count)
+	for i := 0; i < count; i++ {
+		e := ScheduleEvent{EventId: uint32(r.Read(32))}
+		e.Cancel = r.ReadFlag()
+		_ = r.Read(7) // reserved
+		if !e.Cancel {
+			e.Out = r.ReadFlag()
+			programSplice := r.ReadFlag()
+			hasDuration := r.ReadFlag()
+			_ = r.Read(5) // reserved
+			if programSplice {
+				e.UTCSpliceTime = uint32(r.Read(32))
+			} else {
+				componentCount := int(r.Read(8))
+				for j := 0; j < componentCount; j++ {
+					e.Components = append(e.Components, SpliceComponent{
+						Tag:           uint8(r.Read(8)),
+						UTCSpliceTime: uint32(r.Read(32)),
+					})
+				}
+			}
+			if hasDuration {
+				e.Duration, e.AutoReturn = decodeBreakDuration(r)
+			}
+			e.UniqueProgramId = uint16(r.Read(16))
+			e.AvailNum = uint8(r.Read(8))
+			e.AvailsExpected = uint8(r.Read(8))
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// decodeSegmentationDescriptor decodes a segmentation_descriptor after the identifier.
+func decodeSegmentationDescriptor(data []byte) (SegmentationDescriptor, error) {
+	var sd SegmentationDescriptor
+	r := bits.NewReader(bytes.NewReader(data))
+	sd.EventId = uint32(r.Read(32))
+	sd.Cancel = r.ReadFlag()
+	_ = r.Read(7) // reserved
+	if sd.Cancel {
+		return sd, r.AccError()
+	}
+	programSegmentation := r.ReadFlag()
+	hasDuration := r.ReadFlag()
+	deliveryNotRestricted := r.ReadFlag()
+	if deliveryNotRestricted {
+		_ = r.Read(5) // reserved
+	} else {
+		sd.DeliveryRestrictions = &DeliveryRestrictions{
+			WebDeliveryAllowed: r.ReadFlag(),
+			NoRegionalBlackout: r.ReadFlag(),
+			ArchiveAllowed:     r.ReadFlag(),
+			DeviceRestrictions: scte35.DeviceRestrictionsNames[scte35.DeviceRestrictions(r.Read(2))],
+		}
+	}
+	if !programSegmentation {
+		count := int(r.Read(8))
+		for i := 0; i < count; i++ {
+			c := SegmentationComponent{Tag: uint8(r.Read(8))}
+			_ = r.Read(7) // reserved
+			c.PTSOffset = uint64(r.Read(33))
+			sd.Components = append(sd.Components, c)
+		}
+	}
+	if hasDuration {
+		sd.Duration = uint64(r.Read(40))
+	}
+	upidType := uint8(r.Read(8))
+	upidLength := int(r.Read(8))
+	upid := readBytes(r, upidLength)
+	if upidType != 0 || upidLength > 0 {
+		u := decodeUPID(upidType, upid)
+		sd.UPID = &u
+	}
+	sd.TypeId = uint8(r.Read(8))
+	sd.Type = scte35.SegDescTypeNames[scte35.SegDescType(sd.TypeId)]
+	sd.SegmentNumber = uint8(r.Read(8))
+	sd.SegmentsExpected = uint8(r.Read(8))
+	if err := r.AccError(); err != nil {
+		return sd, fmt.Errorf("decoding segmentation descriptor: %w", err)
+	}
+	// sub_segment fields are only present for some types and may be omitted
+	switch sd.TypeId {
+	case 0x34, 0x36, 0x38, 0x3a, 0x44, 0x46:
+		if r.NrBytesRead() <= len(data)-2 {
+			subNum, subExpected := uint8(r.Read(8)), uint8(r.Read(8))
+			sd.SubSegmentNumber, sd.SubSegmentsExpected = &subNum, &subExpected
+		}
+	}
+	return sd, r.AccError()
+}
+
+// decodeUPID decodes a segmentation_upid of the given type.
+func decodeUPID(upidType uint8, data []byte) SegmentationUPID {
+	u := SegmentationUPID{Type: upidType, TypeName: upidTypeNames[upidType]}
+	if u.TypeName == "" {
+		u.TypeName = fmt.Sprintf("Unknown%d", upidType)
+	}
+	switch upidType {
+	case 0x02, 0x03, 0x07, 0x09, 0x0e, 0x0f, 0x11:
+		u.Value = string(data)
+	case 0x04:
+		// SMPTE 330 UMID
+		groups := make([]string, 0, 8)
+		for i := 0; i+4 <= len(data); i += 4 {
+			groups = append(groups, hex.EncodeToString(data[i:i+4]))
+		}
+		u.Value = strings.Join(groups, ".")
+	case 0x08:
+		if len(data) == 8 {
+			u.Value = fmt.Sprintf("%d", binary.BigEndian.Uint64(data))
+		}
+	case 0x0a:
+		// Compact binary EIDR: 16-bit DOI suffix prefix and 80-bit unique id
+		if len(data) == 12 {
+			id := strings.ToUpper(hex.EncodeToString(data[2:]))
+			u.Value = fmt.Sprintf("10.%d/%s-%s-%s-%s-%s", binary.BigEndian.Uint16(data),
+				id[0:4], id[4:8], id[8:12], id[12:16], id[16:20])
+		}
+	case 0x0b:
+		// ATSC content identifier
+		if len(data) >= 4 {
+			tsid := binary.BigEndian.Uint16(data)
+			endOfDay := (data[2] >> 1) & 0x1f
+			uniqueFor := int(data[2]&0x01)<<8 | int(data[3])
+			u.Value = fmt.Sprintf("tsid=%d endOfDay=%d uniqueFor=%d content=%s", tsid, endOfDay, uniqueFor, string(data[4:]))
+		}
+	case 0x0c:
+		if len(data) >= 4 {
+			u.Value = fmt.Sprintf("%s:%s", string(data[:4]), hex.EncodeToString(data[4:]))
+		}
+	case 0x0d:
+		for i := 0; i+2 <= len(data); {
+			t, l := data[i], int(data[i+1])
+			if i+2+l > len(data) {
+				break
+			}
+			u.MID = append(u.MID, decodeUPID(t, data[i+2:i+2+l]))
+			i += 2 + l
+		}
+	case 0x10:
+		if len(data) == 16 {
+			h := hex.EncodeToString(data)
+			u.Value = fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:])
+		}
+	}
+	if u.Value == "" && u.MID == nil && len(data) > 0 {
+		u.Value = hex.EncodeToString(data)
+	}
+	return u
+}
+
+func readBytes(r *bits.Reader, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.Read(8))
+	}
+	return b
+}
+
+// EncodeSCTE35 encodes info as a splice_info_section including the CRC_32.
+// splice_null, splice_insert and time_signal commands with segmentation and
+// avail descriptors can be encoded. The segmentation type is taken from TypeId,
+// or from Type if TypeId is 0.
+func EncodeSCTE35(info SCTE35Info) ([]byte, error) {
+	cmd := info.SpliceCommand
+	var cmdType uint8
+	var cmdBuf bytes.Buffer
+	w := bits.NewWriter(&cmdBuf)
+	switch cmd.Type {
+	case "SpliceNull":
+		cmdType = spliceNull
+	case "SpliceInsert":
+		cmdType = spliceInsert
+		encodeSpliceInsert(w, cmd)
+	case "TimeSignal":
+		cmdType = timeSignal
+		encodeSpliceTime(w, cmd.PTS)
+	default:
+		return nil, fmt.Errorf("encoding splice command %q is not supported", cmd.Type)
+	}
+	w.Flush()
+
+	var descBuf bytes.Buffer
+	for _, ad := range info.AvailDesc {
+		descBuf.Write([]byte{availDescriptorTag, 8, 'C', 'U', 'E', 'I'})
+		descBuf.Write(binary.BigEndian.AppendUint32(nil, ad.ProviderAvailId))
+	}
+	for _, sd := range info.SegDesc {
+		data, err := encodeSegmentationDescriptor(sd)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 255 {
+			return nil, fmt.Errorf("segmentation descriptor too long")
+		}
+		descBuf.Write([]byte{segmentationDescriptorTag, byte(len(data))})
+		descBuf.Write(data)
+	}
+
+	var buf bytes.Buffer
+	w = bits.NewWriter(&buf)
+	w.Write(scte35TableID, 8)
+	w.Write(0, 1) // section_syntax_indicator
+	w.Write(0, 1) // private_indicator
+	w.Write(3, 2) // sap_type: not specified
+	w.Write(uint(11+cmdBuf.Len()+2+descBuf.Len()+4), 12)
+	w.Write(0, 8) // protocol_version
+	w.Write(0, 1) // encrypted_packet
+	w.Write(0, 6) // encryption_algorithm
+	w.Write(uint(info.PTSAdjustment), 33)
+	w.Write(uint(info.CWIndex), 8)
+	w.Write(uint(info.Tier), 12)
+	w.Write(uint(cmdBuf.Len()), 12)
+	w.Write(uint(cmdType), 8)
+	buf.Write(cmdBuf.Bytes())
+	w.Write(uint(descBuf.Len()), 16)
+	buf.Write(descBuf.Bytes())
+	if err := w.AccError(); err != nil {
+		return nil, err
+	}
+	if buf.Len() > 4093 {
+		return nil, fmt.Errorf("splice_info_section too long")
+	}
+	section := buf.Bytes()
+	return append(section, gots.ComputeCRC(section)...), nil
+}
+
+func encodeSpliceTime(w *bits.Writer, pts uint64) {
+	w.Write(1, 1)    // time_specified_flag
+	w.Write(0x3f, 6) // reserved
+	w.Write(uint(pts), 33)
+}
+
+func encodeBreakDuration(w *bits.Writer, duration uint64, autoReturn bool) {
+	w.Write(flagBit(autoReturn), 1)
+	w.Write(0x3f, 6) // reserved
+	w.Write(uint(duration), 33)
+}
+
+func encodeSpliceInsert(w *bits.Writer, cmd SpliceCommand) {
+	w.Write(uint(cmd.EventId), 32)
+	w.Write(flagBit(cmd.Cancel), 1)
+	w.Write(0x7f, 7) // reserved
+	if cmd.Cancel {
+		return
+	}
+	programSplice := len(cmd.Components) == 0
+	w.Write(flagBit(cmd.Out), 1)
+	w.Write(flagBit(programSplice), 1)
+	w.Write(flagBit(cmd.Duration > 0), 1)
+	w.Write(flagBit(cmd.Immediate), 1)
+	w.Write(0x0f, 4) // reserved
+	if programSplice && !cmd.Immediate {
+		encodeSpliceTime(w, cmd.PTS)
+	}
+	if !programSplice {
+		w.Write(uint(len(cmd.Components)), 8)
+		for _, c := range cmd.Components {
+			w.Write(uint(c.Tag), 8)
+			if !cmd.Immediate {
+				encodeSpliceTime(w, c.PTS)
+			}
+		}
+	}
+	if cmd.Duration > 0 {
+		encodeBreakDuration(w, cmd.Duration, cmd.AutoReturn)
+	}
+	w.Write(uint(cmd.UniqueProgramId), 16)
+	w.Write(uint(cmd.AvailNum), 8)
+	w.Write(uint(cmd.AvailsExpected), 8)
+}
+
+// encodeSegmentationDescriptor encodes a segmentation_descriptor starting with the identifier.
+func encodeSegmentationDescriptor(sd SegmentationDescriptor) ([]byte, error) {
+	typeId := sd.TypeId
+	if typeId == 0 && sd.Type != "" {
+		found := false
+		for t, name := range scte35.SegDescTypeNames {
+			if name == sd.Type {
+				typeId, found = uint8(t), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown segmentation type %q", sd.Type)
+		}
+	}
+	var upid []byte
+	var upidType uint8
+	if sd.UPID != nil {
+		var err error
+		upidType = sd.UPID.Type
+		if upid, err = encodeUPID(*sd.UPID); err != nil {
+			return nil, err
+		}
+		if len(upid) > 255 {
+			return nil, fmt.Errorf("segmentation_upid too long")
+		}
+	}
+
+	var buf bytes.Buffer
+	w := bits.NewWriter(&buf)
+	w.Write(scte35DescriptorIdentifier, 32)
+	w.Write(uint(sd.EventId), 32)
+	w.Write(flagBit(sd.Cancel), 1)
+	w.Write(0x7f, 7) // reserved
+	if sd.Cancel {
+		return buf.Bytes(), w.AccError()
+	}
+	dr := sd.DeliveryRestrictions
+	w.Write(flagBit(len(sd.Components) == 0), 1)
+	w.Write(flagBit(sd.Duration > 0), 1)
+	w.Write(flagBit(dr == nil), 1)
+	if dr == nil {
+		w.Write(0x1f, 5) // reserved
+	} else {
+		w.Write(flagBit(dr.WebDeliveryAllowed), 1)
+		w.Write(flagBit(dr.NoRegionalBlackout), 1)
+		w.Write(flagBit(dr.ArchiveAllowed), 1)
+		device := uint(scte35.RestrictNone)
+		for d, name := range scte35.DeviceRestrictionsNames {
+			if name == dr.DeviceRestrictions {
+				device = uint(d)
+			}
+		}
+		w.Write(device, 2)
+	}
+	if len(sd.Components) > 0 {
+		w.Write(uint(len(sd.Components)), 8)
+		for _, c := range sd.Components {
+			w.Write(uint(c.Tag), 8)
+			w.Write(0x7f, 7) // reserved
+			w.Write(uint(c.PTSOffset), 33)
+		}
+	}
+	if sd.Duration > 0 {
+		w.Write(uint(sd.Duration), 40)
+	}
+	w.Write(uint(upidType), 8)
+	w.Write(uint(len(upid)), 8)
+	buf.Write(upid)
+	w.Write(uint(typeId), 8)
+	w.Write(uint(sd.SegmentNumber), 8)
+	w.Write(uint(sd.SegmentsExpected), 8)
+	if sd.SubSegmentNumber != nil && sd.SubSegmentsExpected != nil {
+		w.Write(uint(*sd.SubSegmentNumber), 8)
+		w.Write(uint(*sd.SubSegmentsExpected), 8)
+	}
+	return buf.Bytes(), w.AccError()
+}
+
+// encodeUPID encodes the value of a segmentation_upid in the format used by decodeUPID.
+func encodeUPID(u SegmentationUPID) ([]byte, error) {
+	switch u.Type {
+	case 0x02, 0x03, 0x07, 0x09, 0x0e, 0x0f, 0x11:
+		return []byte(u.Value), nil
+	case 0x08:
+		ti, err := strconv.ParseUint(u.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad TI UPID %q", u.Value)
+		}
+		return binary.BigEndian.AppendUint64(nil, ti), nil
+	case 0x0a:
+		var prefix uint16
+		var id string
+		if _, err := fmt.Sscanf(u.Value, "10.%d/%s", &prefix, &id); err != nil {
+			return nil, fmt.Errorf("bad EIDR UPID %q", u.Value)
+		}
+		data, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+		if err != nil || len(data) != 10 {
+			return nil, fmt.Errorf("bad EIDR UPID %q", u.Value)
+		}
+		return append(binary.BigEndian.AppendUint16(nil, prefix), data...), nil
+	case 0x0c:
+		format, data, ok := strings.Cut(u.Value, ":")
+		if !ok || len(format) != 4 {
+			return nil, fmt.Errorf("bad MPU UPID %q", u.Value)
+		}
+		info, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("bad MPU UPID %q", u.Value)
+		}
+		return append([]byte(format), info...), nil
+	case 0x0d:
+		var mid []byte
+		for _, sub := range u.MID {
+			data, err := encodeUPID(sub)
+			if err != nil {
+				return nil, err
+			}
+			mid = append(mid, sub.Type, byte(len(data)))
+			mid = append(mid, data...)
+		}
+		return mid, nil
+	}
+	// Hex, also for UMID and UUID with separators
+	value := strings.NewReplacer(".", "", "-", "").Replace(u.Value)
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad UPID of type %d: %q is not hex", u.Type, u.Value)
+	}
+	return data, nil
+}
+
+func flagBit(flag bool) uint {
+	if flag {
+		return 1
+	}
+	return 0
+}
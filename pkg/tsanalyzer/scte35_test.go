@@ -0,0 +1,117 @@
+package tsanalyzer
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// spliceInfoSection returns a splice_info_section with tier 0xfff and a correct CRC_32.
+func spliceInfoSection(ptsAdjustment []byte, cmdType byte, cmd, descriptors []byte) []byte {
+	length := 1 + 5 + 1 + 3 + 1 + len(cmd) + 2 + len(descriptors) + 4
+	s := []byte{0xfc, 0x30 | byte(length>>8), byte(length), 0x00}
+	s = append(s, ptsAdjustment...)
+	s = append(s, 0x00, 0xff, 0xf0|byte(len(cmd)>>8), byte(len(cmd)), cmdType)
+	s = append(s, cmd...)
+	s = append(s, byte(len(descriptors)>>8), byte(len(descriptors)))
+	s = append(s, descriptors...)
+	return append(s, gots.ComputeCRC(s)...)
+}
+
+func TestDecodeSCTE35(t *testing.T) {
+	t.Run("splice insert with avail descriptor", func(t *testing.T) {
+		cmd := []byte{0x00, 0x00, 0x00, 0x2a, 0x7f, 0xef,
+			0xfe, 0x00, 0x0d, 0xbb, 0xa0, // pts_time 900000
+			0xfe, 0x00, 0x29, 0x32, 0xe0, // auto_return, duration 2700000
+			0x00, 0x01, 0x01, 0x02}
+		desc := []byte{0x00, 0x08, 'C', 'U', 'E', 'I', 0x00, 0x00, 0x01, 0x23}
+		section := spliceInfoSection([]byte{0x00, 0x00, 0x00, 0x03, 0xe8}, 0x05, cmd, desc)
+		info, err := DecodeSCTE35(500, section)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1000), info.PTSAdjustment)
+		require.Equal(t, uint16(0xfff), info.Tier)
+		require.Equal(t, SpliceCommand{Type: "SpliceInsert", EventId: 42, PTS: 900000, Duration: 2700000,
+			Out: true, AutoReturn: true, UniqueProgramId: 1, AvailNum: 1, AvailsExpected: 2}, info.SpliceCommand)
+		require.Equal(t, []AvailDescriptor{{ProviderAvailId: 0x123}}, info.AvailDesc)
+		require.Equal(t, base64.StdEncoding.EncodeToString(section), info.Base64)
+	})
+
+	t.Run("time signal with MID and sub segments", func(t *testing.T) {
+		adi := []byte("SIGNAL:abc")
+		eidr := []byte{0x14, 0x1c, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+		mid := append([]byte{0x09, byte(len(adi))}, adi...)
+		mid = append(mid, 0x0a, byte(len(eidr)))
+		mid = append(mid, eidr...)
+		seg := []byte{'C', 'U', 'E', 'I', 0x00, 0x00, 0x00, 0x07, 0x7f, 0xd6,
+			0x00, 0x00, 0x52, 0x65, 0xc0, // duration 5400000
+			0x0d, byte(len(mid))}
+		seg = append(seg, mid...)
+		seg = append(seg, 0x36, 0x01, 0x01, 0x01, 0x03)
+		desc := append([]byte{0x02, byte(len(seg))}, seg...)
+		cmd := []byte{0xfe, 0x00, 0x0d, 0xbb, 0xa0}
+		info, err := DecodeSCTE35(500, spliceInfoSection(make([]byte, 5), 0x06, cmd, desc))
+		require.NoError(t, err)
+		require.Equal(t, "TimeSignal", info.SpliceCommand.Type)
+		require.Equal(t, uint64(900000), info.SpliceCommand.PTS)
+		require.Len(t, info.SegDesc, 1)
+		sd := info.SegDesc[0]
+		require.Equal(t, uint32(7), sd.EventId)
+		require.Equal(t, uint8(0x36), sd.TypeId)
+		require.Equal(t, uint64(5400000), sd.Duration)
+		require.Equal(t, uint8(1), sd.SegmentNumber)
+		require.Equal(t, uint8(1), sd.SegmentsExpected)
+		require.Equal(t, uint8(1), *sd.SubSegmentNumber)
+		require.Equal(t, uint8(3), *sd.SubSegmentsExpected)
+		require.True(t, sd.DeliveryRestrictions.WebDeliveryAllowed)
+		require.False(t, sd.DeliveryRestrictions.NoRegionalBlackout)
+		require.True(t, sd.DeliveryRestrictions.ArchiveAllowed)
+		require.Equal(t, "MID", sd.UPID.TypeName)
+		require.Equal(t, []SegmentationUPID{
+			{Type: 0x09, TypeName: "ADI", Value: "SIGNAL:abc"},
+			{Type: 0x0a, TypeName: "EIDR", Value: "10.5148/0000-0001-0203-0405-0607"},
+		}, sd.UPID.MID)
+	})
+
+	t.Run("spec sample", func(t *testing.T) {
+		// Time signal placement opportunity start from SCTE 35 section 14
+		section, err := base64.StdEncoding.DecodeString("/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg==")
+		require.NoError(t, err)
+		info, err := DecodeSCTE35(500, section)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1924989008), info.SpliceCommand.PTS)
+		sd := info.SegDesc[0]
+		require.Equal(t, uint8(0x34), sd.TypeId)
+		require.Equal(t, uint64(27630000), sd.Duration)
+		require.Equal(t, &SegmentationUPID{Type: 0x08, TypeName: "TI", Value: "748724618"}, sd.UPID)
+		require.Equal(t, uint8(2), sd.SegmentNumber)
+		require.Nil(t, sd.SubSegmentNumber)
+
+		section[len(section)-1] ^= 0xff
+		_, err = DecodeSCTE35(500, section)
+		require.EqualError(t, err, "CRC error")
+	})
+}
+
+func TestEncodeSCTE35(t *testing.T) {
+	cmd := []byte{0x00, 0x00, 0x00, 0x2a, 0x7f, 0xef,
+		0xfe, 0x00, 0x0d, 0xbb, 0xa0,
+		0xfe, 0x00, 0x29, 0x32, 0xe0,
+		0x00, 0x01, 0x01, 0x02}
+	desc := []byte{0x00, 0x08, 'C', 'U', 'E', 'I', 0x00, 0x00, 0x01, 0x23}
+	spliceInsert := spliceInfoSection([]byte{0x00, 0x00, 0x00, 0x03, 0xe8}, 0x05, cmd, desc)
+	timeSignal, err := base64.StdEncoding.DecodeString("/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg==")
+	require.NoError(t, err)
+
+	for _, section := range [][]byte{spliceInsert, timeSignal} {
+		info, err := DecodeSCTE35(500, section)
+		require.NoError(t, err)
+		encoded, err := EncodeSCTE35(info)
+		require.NoError(t, err)
+		require.Equal(t, section, encoded)
+	}
+
+	_, err = EncodeSCTE35(SCTE35Info{SpliceCommand: SpliceCommand{Type: "BandwidthReservation"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,316 @@
+package tsanalyzer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+	"github.com/Comcast/gots/v2/psi"
+	"github.com/asticode/go-astits"
+)
+
+const (
+	// alignmentMargin is how far the video DTS must pass the splice time before
+	// a cue is resolved, so that reordered frames are taken into account.
+	alignmentMargin = TimeScale
+	// frameHistory is how long video frames are kept for cues that arrive late.
+	frameHistory = 10 * TimeScale
+)
+
+// SCTE35Alignment is the video frame nearest to the splice time of an SCTE-35 cue.
+// SpliceTime is the splice PTS with pts_adjustment added. LeadTime is the time
+// from the arrival of the cue (interpolated PCR of the program) to the splice
+// time in 90kHz ticks, and is missing if the program has no PCR yet.
+// Frame is missing if there is no video frame in the program.
+// Aligned is true if the nearest frame is at the splice time (±1 tick) and is an IDR.
+type SCTE35Alignment struct {
+	PID           uint16        `json:"pid"`
+	ProgramNumber uint16        `json:"programNumber"`
+	Packet        int64         `json:"packet"`
+	SpliceTime    int64         `json:"spliceTime"`
+	LeadTime      *int64        `json:"leadTime,omitempty"`
+	Frame         *AlignedFrame `json:"frame,omitempty"`
+	Aligned       bool          `json:"aligned"`
+	Cue           SCTE35Info    `json:"cue"`
+}
+
+func (SCTE35Alignment) isEvent() {}
+
+// AlignedFrame is a video frame. Offset is PTS - SpliceTime in 90kHz ticks.
+type AlignedFrame struct {
+	PID    uint16 `json:"pid"`
+	PTS    int64  `json:"pts"`
+	Offset int64  `json:"offset"`
+	IDR    bool   `json:"idr"`
+	RAI    bool   `json:"rai"`
+	dts    int64
+}
+
+// alignProgram is the PIDs and PCR clock of a program.
+type alignProgram struct {
+	pcrPID   uint16
+	videoPID int // -1 if no video
+	clock    *pcrClock
+	firstPCR int64
+	frames   []AlignedFrame // recent frames of videoPID
+}
+
+// cueAligner correlates SCTE-35 cues with the video frames of their program.
+// PAT, PMT and cues are decoded from the packets as they are read, and the
+// cues are resolved against the frames reported by ParseAVCPES and ParseHEVCPES.
+type cueAligner struct {
+	programs map[uint16]*alignProgram // program number -> program
+	pmtPIDs  map[uint16]bool
+	cuePIDs  map[uint16]uint16 // SCTE-35 PID -> program number
+	sections map[uint16]*sectionAssembler
+	pending  []SCTE35Alignment
+	err      error
+}
+
+func newCueAligner() *cueAligner {
+	return &cueAligner{
+		programs: make(map[uint16]*alignProgram),
+		pmtPIDs:  make(map[uint16]bool),
+		cuePIDs:  make(map[uint16]uint16),
+		sections: make(map[uint16]*sectionAssembler),
+	}
+}
+
+// setProgram sets the PCR PID and streams of a program from a PMT section.
+// The first video stream is used for the alignment.
+func (a *cueAligner) setProgram(section []byte) {
+	ps, ok := parsePMTSection(section)
+	pmt, err := psi.NewPMT(append([]byte{0}, section...))
+	if !ok || err != nil {
+		return
+	}
+	programNr, pcrPID := uint16(ps.programNr), uint16(ps.pcrPID)
+	p := a.programs[programNr]
+	if p == nil || p.pcrPID != pcrPID {
+		p = &alignProgram{pcrPID: pcrPID, videoPID: -1, clock: newPCRClock()}
+		a.programs[programNr] = p
+	}
+	videoPID := -1
+	for _, es := range pmt.ElementaryStreams() {
+		streamInfo := ParseElementaryStreamInfo(es)
+		if streamInfo == nil {
+			continue
+		}
+		switch streamInfo.Codec {
+		case "AVC", "HEVC":
+			if videoPID < 0 {
+				videoPID = int(streamInfo.PID)
+			}
+		case "SCTE35":
+			a.cuePIDs[streamInfo.PID] = programNr
+		}
+	}
+	if videoPID != p.videoPID {
+		p.frames = nil
+	}
+	p.videoPID = videoPID
+}
+
+// packet handles packet nr as it is read, updating the PCR clocks and
+// decoding SCTE-35 sections.
+func (a *cueAligner) packet(pkt *packet.Packet, nr int64) {
+	pid := uint16(packet.Pid(pkt))
+	if packet.ContainsAdaptationField(pkt) && adaptationfield.Length(pkt) > 0 && adaptationfield.HasPCR(pkt) {
+		if pcrBytes, err := adaptationfield.PCR(pkt); err == nil {
+			pcr := int64(gots.ExtractPCR(pcrBytes))
+			for _, p := range a.programs {
+				if p.pcrPID == pid {
+					if !p.clock.valid() {
+						p.firstPCR = pcr
+					}
+					p.clock.update(int(pid), pcr, nr)
+				}
+			}
+		}
+	}
+	programNr, isCue := a.cuePIDs[pid]
+	if (pid != 0 && !a.pmtPIDs[pid] && !isCue) || a.err != nil {
+		return
+	}
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return
+	}
+	sa := a.sections[pid]
+	if sa == nil {
+		sa = &sectionAssembler{}
+		a.sections[pid] = sa
+	}
+	for _, section := range sa.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		switch {
+		case pid == 0 && section[0] == 0x00:
+			for _, pmtPID := range patPrograms(section) {
+				a.pmtPIDs[uint16(pmtPID)] = true
+			}
+		case a.pmtPIDs[pid] && section[0] == 0x02:
+			a.setProgram(section)
+		case isCue:
+			info, err := DecodeSCTE35(pid, section)
+			if err != nil {
+				a.err = fmt.Errorf("cannot parse SCTE35 on PID %d: %w", pid, err)
+				return
+			}
+			a.addCue(programNr, info, nr)
+		}
+	}
+}
+
+// addCue adds a cue with a splice time to the pending cues.
+// A pts_time of 0 is treated as not specified.
+func (a *cueAligner) addCue(programNr uint16, info SCTE35Info, nr int64) {
+	p := a.programs[programNr]
+	var arrival *int64
+	if p.clock.valid() {
+		t := ((p.firstPCR + p.clock.ticks(nr)) % PcrWrap) / 300
+		arrival = &t
+	}
+	cmd := info.SpliceCommand
+	var pts int64
+	switch {
+	case cmd.Type == "SpliceInsert" && !cmd.Cancel && cmd.Immediate:
+		if arrival == nil {
+			return
+		}
+		pts = *arrival
+	case cmd.Type == "SpliceInsert" && !cmd.Cancel && len(cmd.Components) > 0:
+		pts = AddPTS(int64(cmd.Components[0].PTS), int64(info.PTSAdjustment))
+	case ((cmd.Type == "SpliceInsert" && !cmd.Cancel) || cmd.Type == "TimeSignal") && cmd.PTS != 0:
+		pts = AddPTS(int64(cmd.PTS), int64(info.PTSAdjustment))
+	default:
+		return
+	}
+	al := SCTE35Alignment{
+		PID:           info.PID,
+		ProgramNumber: programNr,
+		Packet:        nr,
+		SpliceTime:    pts,
+		Cue:           info,
+	}
+	if arrival != nil {
+		lead := SignedPTSDiff(pts, *arrival)
+		al.LeadTime = &lead
+	}
+	// The nearest frame may already have been seen if the cue is late
+	for _, f := range p.frames {
+		al.update(f)
+	}
+	a.pending = append(a.pending, al)
+}
+
+// frame adds a video frame and returns the cues that are resolved by it.
+func (a *cueAligner) frame(f AlignedFrame) []SCTE35Alignment {
+	var resolved []SCTE35Alignment
+	for programNr, p := range a.programs {
+		if p.videoPID != int(f.PID) {
+			continue
+		}
+		p.frames = append(p.frames, f)
+		for len(p.frames) > 0 && SignedPTSDiff(f.dts, p.frames[0].dts) > frameHistory {
+			p.frames = p.frames[1:]
+		}
+		remaining := a.pending[:0]
+		for _, al := range a.pending {
+			if al.ProgramNumber != programNr {
+				remaining = append(remaining, al)
+				continue
+			}
+			al.update(f)
+			if SignedPTSDiff(f.dts, al.SpliceTime) > alignmentMargin {
+				resolved = append(resolved, al.done())
+			} else {
+				remaining = append(remaining, al)
+			}
+		}
+		a.pending = remaining
+	}
+	return resolved
+}
+
+// flush returns all pending cues in the order they arrived.
+func (a *cueAligner) flush() []SCTE35Alignment {
+	resolved := make([]SCTE35Alignment, 0, len(a.pending))
+	for _, al := range a.pending {
+		resolved = append(resolved, al.done())
+	}
+	a.pending = nil
+	return resolved
+}
+
+// update replaces the frame if f is nearer to the splice time.
+func (al *SCTE35Alignment) update(f AlignedFrame) {
+	f.Offset = SignedPTSDiff(f.PTS, al.SpliceTime)
+	if al.Frame == nil || abs(f.Offset) < abs(al.Frame.Offset) {
+		al.Frame = &f
+	}
+}
+
+func (al SCTE35Alignment) done() SCTE35Alignment {
+	al.Aligned = al.Frame != nil && al.Frame.IDR && abs(al.Frame.Offset) <= 1
+	return al
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// packetTap is a reader that calls onPacket with every packet read through it.
+// Since the demuxer reads ahead, cues are known before the frames around them.
+type packetTap struct {
+	r        io.Reader
+	buf      []byte
+	nr       int64
+	onPacket func(pkt *packet.Packet, nr int64)
+}
+
+func (t *packetTap) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	for len(t.buf) >= PacketSize {
+		if t.buf[0] != SyncByte {
+			t.buf = t.buf[1:]
+			continue
+		}
+		var pkt packet.Packet
+		copy(pkt[:], t.buf)
+		t.onPacket(&pkt, t.nr)
+		t.nr++
+		t.buf = t.buf[PacketSize:]
+	}
+	return n, err
+}
+
+// alignedFrame returns the frame of a video PES packet.
+func alignedFrame(d *astits.DemuxerData, idr bool) AlignedFrame {
+	oh := d.PES.Header.OptionalHeader
+	f := AlignedFrame{PID: d.PID, PTS: oh.PTS.Base, IDR: idr, dts: oh.PTS.Base}
+	if oh.DTS != nil {
+		f.dts = oh.DTS.Base
+	}
+	if fp := d.FirstPacket; fp != nil && fp.AdaptationField != nil {
+		f.RAI = fp.AdaptationField.RandomAccessIndicator
+	}
+	return f
+}
+
+// emitAlignments reports the alignments of the selected programs to h.
+func emitAlignments(h Handler, programs *programTracker, alignments []SCTE35Alignment) error {
+	for _, al := range alignments {
+		if !programs.selected[al.ProgramNumber] {
+			continue
+		}
+		if err := emit(h, al); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package tsanalyzer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCueAligner(t *testing.T) {
+	a := newCueAligner()
+	p := &alignProgram{pcrPID: 256, videoPID: 256, clock: newPCRClock()}
+	a.programs[1] = p
+	// PCR 1s at packet 0 and 2s at packet 1000
+	p.firstPCR = PcrTimeScale
+	p.clock.update(256, PcrTimeScale, 0)
+	p.clock.update(256, 2*PcrTimeScale, 1000)
+
+	// frames every 40ms from 1s with an IDR every 2s
+	var resolved []SCTE35Alignment
+	addFrames := func(from, to int64) {
+		for pts := from; pts < to; pts += 3600 {
+			f := AlignedFrame{PID: 256, PTS: pts, dts: pts, IDR: (pts-TimeScale)%(2*TimeScale) == 0}
+			resolved = append(resolved, a.frame(f)...)
+		}
+	}
+	addFrames(TimeScale, 3*TimeScale)
+
+	// Cue at 2.5s arriving at 2s, splicing at 5s (4.9s + pts_adjustment 0.1s)
+	a.addCue(1, SCTE35Info{PID: 500, PTSAdjustment: 9000,
+		SpliceCommand: SpliceCommand{Type: "TimeSignal", PTS: 441000}}, 1500)
+	// Late cue splicing at 2.01s, between two frames
+	a.addCue(1, SCTE35Info{PID: 500, SpliceCommand: SpliceCommand{Type: "SpliceInsert", PTS: 180900}}, 1500)
+	// Cancel without splice time
+	a.addCue(1, SCTE35Info{PID: 500, SpliceCommand: SpliceCommand{Type: "SpliceInsert", Cancel: true}}, 1500)
+	require.Len(t, a.pending, 2)
+
+	addFrames(3*TimeScale, 6*TimeScale)
+	require.Len(t, resolved, 1)
+	late := resolved[0]
+	require.Equal(t, int64(180900), late.SpliceTime)
+	require.Equal(t, int64(180900-225000), *late.LeadTime)
+	require.Equal(t, int64(180000), late.Frame.PTS)
+	require.Equal(t, int64(-900), late.Frame.Offset)
+	require.False(t, late.Aligned)
+
+	remaining := a.flush()
+	require.Len(t, remaining, 1)
+	al := remaining[0]
+	require.Equal(t, int64(5*TimeScale), al.SpliceTime)
+	require.Equal(t, int64(5*TimeScale-225000), *al.LeadTime)
+	require.Equal(t, int64(5*TimeScale), al.Frame.PTS)
+	require.True(t, al.Frame.IDR)
+	require.True(t, al.Aligned)
+}
@@ -1,29 +1,25 @@
-package internal
+package tsanalyzer
 
 import "github.com/asticode/go-astits"
 
-type sdtServiceDescriptor struct {
+type SdtServiceDescriptor struct {
 	ServiceName  string `json:"serviceName"`
 	ProviderName string `json:"providerName"`
 }
 
-type sdtService struct {
+type SdtService struct {
 	ServiceID   uint16                 `json:"serviceId"`
-	Descriptors []sdtServiceDescriptor `json:"descriptors"`
+	Descriptors []SdtServiceDescriptor `json:"descriptors"`
 }
 
-type sdtInfo struct {
-	SdtServices []sdtService `json:"SDT"`
+type SdtInfo struct {
+	SdtServices []SdtService `json:"SDT"`
 }
 
-func (p *JsonPrinter) PrintSdtInfo(sdt *astits.SDTData, show bool) {
-	sdtInfo := ToSdtInfo(sdt)
-	p.Print(sdtInfo, show)
-}
-
-func ToSdtInfo(sdt *astits.SDTData) sdtInfo {
-	sdtInfo := sdtInfo{
-		SdtServices: make([]sdtService, 0, len(sdt.Services)),
+// ToSdtInfo converts an SDT parsed by astits to SdtInfo.
+func ToSdtInfo(sdt *astits.SDTData) SdtInfo {
+	sdtInfo := SdtInfo{
+		SdtServices: make([]SdtService, 0, len(sdt.Services)),
 	}
 
 	for _, s := range sdt.Services {
@@ -34,10 +30,10 @@ func ToSdtInfo(sdt *astits.SDTData) sdtInfo {
 	return sdtInfo
 }
 
-func toSdtService(s *astits.SDTDataService) sdtService {
-	sdtService := sdtService{
+func toSdtService(s *astits.SDTDataService) SdtService {
+	sdtService := SdtService{
 		ServiceID:   s.ServiceID,
-		Descriptors: make([]sdtServiceDescriptor, 0, len(s.Descriptors)),
+		Descriptors: make([]SdtServiceDescriptor, 0, len(s.Descriptors)),
 	}
 
 	for _, d := range s.Descriptors {
@@ -50,8 +46,8 @@ func toSdtService(s *astits.SDTDataService) sdtService {
 	return sdtService
 }
 
-func toSdtServiceDescriptor(sd *astits.DescriptorService) sdtServiceDescriptor {
-	return sdtServiceDescriptor{
+func toSdtServiceDescriptor(sd *astits.DescriptorService) SdtServiceDescriptor {
+	return SdtServiceDescriptor{
 		ProviderName: string(sd.Provider),
 		ServiceName:  string(sd.Name),
 	}
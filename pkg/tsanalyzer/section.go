@@ -0,0 +1,139 @@
+package tsanalyzer
+
+import "fmt"
+
+// sectionAssembler collects PSI sections from the payloads of the packets on one PID.
+type sectionAssembler struct {
+	buf     []byte
+	started bool
+}
+
+// write adds the payload of a packet and returns the sections completed by it.
+func (a *sectionAssembler) write(pusi bool, payload []byte) [][]byte {
+	var sections [][]byte
+	if pusi {
+		if len(payload) == 0 {
+			a.reset()
+			return nil
+		}
+		pointer := int(payload[0])
+		if 1+pointer > len(payload) {
+			a.reset()
+			return nil
+		}
+		if a.started {
+			a.buf = append(a.buf, payload[1:1+pointer]...)
+			sections = a.complete(sections)
+		}
+		a.buf = append(a.buf[:0], payload[1+pointer:]...)
+		a.started = true
+	} else {
+		if !a.started {
+			return nil
+		}
+		a.buf = append(a.buf, payload...)
+	}
+	return a.complete(sections)
+}
+
+// complete moves all complete sections in the buffer to sections.
+func (a *sectionAssembler) complete(sections [][]byte) [][]byte {
+	for len(a.buf) >= 3 && a.buf[0] != 0xff {
+		length := 3 + (int(a.buf[1]&0x0f)<<8 | int(a.buf[2]))
+		if len(a.buf) < length {
+			return sections
+		}
+		section := make([]byte, length)
+		copy(section, a.buf[:length])
+		sections = append(sections, section)
+		a.buf = a.buf[length:]
+	}
+	if len(a.buf) > 0 && a.buf[0] == 0xff {
+		// Stuffing until next payload unit start
+		a.reset()
+	}
+	return sections
+}
+
+// idle tells if there is no partial section, so that a new section can start.
+func (a *sectionAssembler) idle() bool {
+	return len(a.buf) == 0
+}
+
+func (a *sectionAssembler) reset() {
+	a.buf = a.buf[:0]
+	a.started = false
+}
+
+// patPrograms returns the PMT PID for each program number in a PAT section.
+func patPrograms(section []byte) map[int]int {
+	programs := make(map[int]int)
+	end := len(section) - 4 // CRC_32
+	for i := 8; i+4 <= end; i += 4 {
+		programNr := int(section[i])<<8 | int(section[i+1])
+		pid := int(section[i+2]&0x1f)<<8 | int(section[i+3])
+		// Program number 0 is the network PID
+		if programNr != 0 {
+			programs[programNr] = pid
+		}
+	}
+	return programs
+}
+
+// selectProgram returns the program number and PMT PID of program nr in the
+// programs of a PAT, or of the lowest program number if nr is 0.
+func selectProgram(programs map[int]int, nr int) (int, int, error) {
+	if nr == 0 {
+		for programNr := range programs {
+			if nr == 0 || programNr < nr {
+				nr = programNr
+			}
+		}
+	}
+	pmtPID, ok := programs[nr]
+	if !ok {
+		return 0, 0, fmt.Errorf("program %d not found", nr)
+	}
+	return nr, pmtPID, nil
+}
+
+// pmtStream is an elementary stream entry in a PMT section.
+type pmtStream struct {
+	streamType  byte
+	pid         int
+	descriptors []byte
+}
+
+// pmtSection contains the fields of a PMT section needed by the analyzers.
+type pmtSection struct {
+	programNr int
+	version   int
+	pcrPID    int
+	streams   []pmtStream
+}
+
+// parsePMTSection parses a PMT section (table_id 0x02) including the CRC_32.
+func parsePMTSection(section []byte) (pmtSection, bool) {
+	var p pmtSection
+	if len(section) < 16 || section[0] != 0x02 {
+		return p, false
+	}
+	p.programNr = int(section[3])<<8 | int(section[4])
+	p.version = int(section[5]>>1) & 0x1f
+	p.pcrPID = int(section[8]&0x1f)<<8 | int(section[9])
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	end := len(section) - 4 // CRC_32
+	for i := 12 + programInfoLength; i+5 <= end; {
+		infoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		if i+5+infoLength > end {
+			return p, false
+		}
+		p.streams = append(p.streams, pmtStream{
+			streamType:  section[i],
+			pid:         int(section[i+1]&0x1f)<<8 | int(section[i+2]),
+			descriptors: section[i+5 : i+5+infoLength],
+		})
+		i += 5 + infoLength
+	}
+	return p, true
+}
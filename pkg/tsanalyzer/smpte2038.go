@@ -1,8 +1,7 @@
-package internal
+package tsanalyzer
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"log"
 
@@ -44,13 +43,13 @@ var SMPTE291Map = map[SMPTE291Identifier]string{
 	{0x62, 0x03}: "VBI Data",
 }
 
-type smpte2038Data struct {
+type SMPTE2038Data struct {
 	PID     uint16 `json:"pid"`
 	PTS     int64  `json:"pts"`
-	Entries []smpte2038Entry
+	Entries []SMPTE2038Entry
 }
 
-type smpte2038Entry struct {
+type SMPTE2038Entry struct {
 	LineNr    byte   `json:"lineNr"`
 	HorOffset byte   `json:"horOffset"`
 	DID       byte   `json:"did"`
@@ -59,16 +58,17 @@ type smpte2038Entry struct {
 	Type      string `json:"type"`
 }
 
-func ParseSMPTE2038(jp *JsonPrinter, d *astits.DemuxerData, o Options) {
+// ParseSMPTE2038 parses the ancillary data entries of an SMPTE-2038 PES packet.
+func ParseSMPTE2038(d *astits.DemuxerData) SMPTE2038Data {
 	pl := d.PES.Data
 	pdtDtsIndicator := d.PES.Header.OptionalHeader.PTSDTSIndicator
 	if pdtDtsIndicator != 2 {
-		fmt.Printf("SMPTE-2038: invalid PDT_DTS_Indicator=%d\n", pdtDtsIndicator)
+		log.Printf("SMPTE-2038: invalid PDT_DTS_Indicator=%d\n", pdtDtsIndicator)
 	}
 	pts := d.PES.Header.OptionalHeader.PTS
 	rd := bytes.NewBuffer(pl)
 	r := bits.NewReader(rd)
-	smpteData := smpte2038Data{PID: d.PID, PTS: pts.Base}
+	smpteData := SMPTE2038Data{PID: d.PID, PTS: pts.Base}
 	for {
 		z := r.Read(6)
 		if r.AccError() == io.EOF {
@@ -78,13 +78,13 @@ func ParseSMPTE2038(jp *JsonPrinter, d *astits.DemuxerData, o Options) {
 			z2 := r.Read(2)
 			if z2 != 0x3 {
 				log.Printf("SMPTE-2038: invalid stuffing\n")
-				return
+				return smpteData
 			}
 			_ = r.ReadRemainingBytes()
 		}
 		if z != 0 {
 			log.Printf("SMPTE-2038: reserved bits not zero %x\n", z)
-			return
+			return smpteData
 		}
 		_ = r.Read(1) // cNotYChFlag
 		lineNr := r.Read(11)
@@ -106,10 +106,10 @@ func ParseSMPTE2038(jp *JsonPrinter, d *astits.DemuxerData, o Options) {
 			_ = r.Read(8 - r.NrBitsReadInCurrentByte())
 		}
 		if r.AccError() != nil {
-			fmt.Printf("SMPTE-2038: read error\n")
-			return
+			log.Printf("SMPTE-2038: read error\n")
+			return smpteData
 		}
-		smpteData.Entries = append(smpteData.Entries, smpte2038Entry{
+		smpteData.Entries = append(smpteData.Entries, SMPTE2038Entry{
 			LineNr:    byte(lineNr),
 			HorOffset: byte(horOffset),
 			DID:       byte(did),
@@ -118,7 +118,5 @@ func ParseSMPTE2038(jp *JsonPrinter, d *astits.DemuxerData, o Options) {
 			Type:      didStr,
 		})
 	}
-	if jp != nil {
-		jp.Print(smpteData, true)
-	}
+	return smpteData
 }
@@ -0,0 +1,173 @@
+package tsanalyzer
+
+import "fmt"
+
+type PidFilterStatistics struct {
+	PidsToDrop       []int       `json:"pidsToDrop"`
+	PIDMap           map[int]int `json:"pidMap,omitempty"`
+	ProgramNumbers   map[int]int `json:"programNumbers,omitempty"`
+	DroppedPIDs      []int       `json:"droppedPids,omitempty"`
+	TotalPackets     uint32      `json:"total"`
+	FilteredPackets  uint32      `json:"filtered"`
+	PacketsBeforePAT uint32      `json:"packetBeforePAT"`
+	Percentage       float32     `json:"percentage"`
+}
+
+// StreamStatistics are the statistics of the timestamps of a stream. The
+// timestamps (DTS, or PTS without DTS) and the PTS of RAI and IDR pictures are
+// added to Timelines, so the memory use does not grow with the stream length.
+type StreamStatistics struct {
+	Type      string  `json:"streamType"`
+	Pid       uint16  `json:"pid"`
+	FrameRate float64 `json:"frameRate"`
+	MaxStep   int64   `json:"maxStep,omitempty"`
+	MinStep   int64   `json:"minStep,omitempty"`
+	AvgStep   int64   `json:"avgStep,omitempty"`
+	// Wrap-arounds and discontinuities of the timestamps
+	Wraps           int64 `json:"wraps,omitempty"`
+	Discontinuities int64 `json:"discontinuities,omitempty"`
+	// RAI-markers
+	RAIGOPDuration int64 `json:"RAIGoPDuration,omitempty"`
+	IDRGOPDuration int64 `json:"IDRGoPDuration,omitempty"`
+	// Audio frames missing between timestamps
+	Gaps int `json:"gaps,omitempty"`
+	// Errors
+	Errors []string `json:"errors,omitempty"`
+
+	timestamps *Timeline
+	raiPTS     *Timeline
+	idrPTS     *Timeline
+}
+
+func (s *PidFilterStatistics) calculatePercentage() {
+	if s.TotalPackets == 0 {
+		s.Percentage = 0
+	} else {
+		s.Percentage = (float32(s.PacketsBeforePAT) + float32(s.FilteredPackets)) / float32(s.TotalPackets)
+	}
+}
+
+// AddTimestamp adds the DTS, or the PTS if there is no DTS, of a frame.
+func (s *StreamStatistics) AddTimestamp(ts int64) {
+	if s.timestamps == nil {
+		s.timestamps = NewPTSTimeline()
+	}
+	s.timestamps.Add(ts)
+}
+
+// AddRAI adds the PTS of a picture with random_access_indicator.
+func (s *StreamStatistics) AddRAI(pts int64) {
+	if s.raiPTS == nil {
+		// Only steps backwards are discontinuities
+		s.raiPTS = NewTimeline(PtsWrap, PtsWrap/2)
+	}
+	s.raiPTS.Add(pts)
+}
+
+// AddIDR adds the PTS of an IDR picture.
+func (s *StreamStatistics) AddIDR(pts int64) {
+	if s.idrPTS == nil {
+		s.idrPTS = NewTimeline(PtsWrap, PtsWrap/2)
+	}
+	s.idrPTS.Add(pts)
+}
+
+// IDRCount returns the number of IDR pictures added.
+func (s *StreamStatistics) IDRCount() int64 {
+	if s.idrPTS == nil {
+		return 0
+	}
+	return s.idrPTS.Count()
+}
+
+// Timestamps returns the timeline of the timestamps, or nil if none are added.
+func (s *StreamStatistics) Timestamps() *Timeline {
+	return s.timestamps
+}
+
+// Calculate derives frame rate and GoP duration (video) or gaps (audio)
+// from the collected timestamps.
+func (s *StreamStatistics) Calculate(timescale int64) {
+	s.calculateFrameRate(timescale)
+	if s.isAudio() {
+		s.calculateGaps()
+		return
+	}
+	s.calculateGoPDuration(timescale)
+}
+
+func (s *StreamStatistics) isAudio() bool {
+	switch s.Type {
+	case "AAC", "AC-3", "E-AC-3":
+		return true
+	}
+	return false
+}
+
+func CalculateSteps(timestamps []int64) []int64 {
+	if len(timestamps) < 2 {
+		return nil
+	}
+
+	// PTS/DTS are 33-bit values, so it wraps around after 26.5 hours
+	steps := make([]int64, len(timestamps)-1)
+	for i := 0; i < len(timestamps)-1; i++ {
+		steps[i] = SignedPTSDiff(timestamps[i+1], timestamps[i])
+	}
+	return steps
+}
+
+// Calculate frame rate from DTS or PTS steps
+func (s *StreamStatistics) calculateFrameRate(timescale int64) {
+	var ts TimelineStats
+	if s.timestamps != nil {
+		ts = s.timestamps.Stats()
+	}
+	s.Wraps, s.Discontinuities = ts.Wraps, ts.Discontinuities
+	if ts.Discontinuities > 0 {
+		s.Errors = append(s.Errors, fmt.Sprintf("%d discontinuities in timestamps", ts.Discontinuities))
+	}
+	if ts.Steps < 1 {
+		s.Errors = append(s.Errors, "too few timestamps to calculate frame rate")
+		return
+	}
+
+	tolerance := int64(0)
+	if s.isAudio() {
+		// Audio frame timestamps and PES PTS are rounded to the timescale
+		tolerance = 2
+	}
+	if ts.MaxStep-ts.MinStep > tolerance {
+		s.Errors = append(s.Errors, "irregular PTS/DTS steps")
+		s.MinStep, s.MaxStep, s.AvgStep = ts.MinStep, ts.MaxStep, ts.AvgStep
+	}
+
+	if s.isAudio() {
+		// The average step is rounded too much for audio frame durations
+		s.FrameRate = float64(timescale) * float64(ts.Steps) / float64(ts.Span)
+		return
+	}
+	s.FrameRate = float64(timescale) / float64(ts.AvgStep)
+}
+
+func (s *StreamStatistics) calculateGoPDuration(timescale int64) {
+	if s.raiPTS == nil || s.idrPTS == nil || s.raiPTS.Stats().Steps < 1 || s.idrPTS.Stats().Steps < 1 {
+		s.Errors = append(s.Errors, "no GoP duration since less than 2 I-frames")
+		return
+	}
+
+	// Calculate GOP duration
+	s.RAIGOPDuration = s.raiPTS.Stats().AvgStep / timescale
+	s.IDRGOPDuration = s.idrPTS.Stats().AvgStep / timescale
+}
+
+// calculateGaps counts the steps that are more than 1.5 times the smallest step.
+func (s *StreamStatistics) calculateGaps() {
+	if s.timestamps == nil {
+		return
+	}
+	s.Gaps = int(s.timestamps.StepsAbove(s.timestamps.Stats().MinStep * 3 / 2))
+	if s.Gaps > 0 {
+		s.Errors = append(s.Errors, fmt.Sprintf("%d gaps in timestamps", s.Gaps))
+	}
+}
@@ -1,4 +1,4 @@
-package internal
+package tsanalyzer
 
 import (
 	"math"
@@ -0,0 +1,182 @@
+package tsanalyzer
+
+import "sort"
+
+// Types of TimelineEvent
+const (
+	TimelineWrap          = "wrap"
+	TimelineDiscontinuity = "discontinuity"
+)
+
+// DefaultMaxTimestampStep is the largest PTS/DTS step between consecutive
+// values of a stream that is not a discontinuity, in 90kHz units.
+const DefaultMaxTimestampStep = 10 * TimeScale
+
+const (
+	// Max number of events kept by a Timeline. Later events are only counted.
+	maxTimelineEvents = 100
+	// Max number of distinct step values counted by a Timeline. Steps with
+	// other values are counted with the closest value.
+	maxTimelineStepValues = 64
+)
+
+// TimelineEvent is a wrap-around or a discontinuity in a Timeline. Index is
+// the number of the value starting at 0, Raw the value as read, Value the
+// unwrapped value and Step the difference to the previous value.
+type TimelineEvent struct {
+	Type  string `json:"type"`
+	Index int64  `json:"index"`
+	Raw   int64  `json:"raw"`
+	Value int64  `json:"value"`
+	Step  int64  `json:"step"`
+}
+
+// TimelineStats are the statistics of a Timeline. The steps exclude
+// discontinuities, and Span is the sum of the steps.
+type TimelineStats struct {
+	Values          int64 `json:"values"`
+	First           int64 `json:"first"`
+	Last            int64 `json:"last"`
+	Steps           int64 `json:"steps"`
+	MinStep         int64 `json:"minStep"`
+	MaxStep         int64 `json:"maxStep"`
+	AvgStep         int64 `json:"avgStep"`
+	Span            int64 `json:"span"`
+	Wraps           int64 `json:"wraps"`
+	Discontinuities int64 `json:"discontinuities"`
+}
+
+// Timeline unwraps PTS/DTS or PCR values to a 64-bit timeline that continues
+// across wrap-arounds, starting at the first value. Steps backwards or larger
+// than the max step are discontinuities. The statistics of the steps are
+// updated with each value and use a bounded amount of memory, so a Timeline
+// can follow a stream of any length.
+type Timeline struct {
+	wrap       int64
+	maxStep    int64
+	raw        int64 // last value as read
+	stats      TimelineStats
+	stepCounts []stepCount // sorted by value
+	events     []TimelineEvent
+}
+
+type stepCount struct {
+	value int64
+	count int64
+}
+
+// NewTimeline returns a Timeline for values that wrap at wrap, e.g. PtsWrap
+// or PcrWrap, with steps up to maxStep.
+func NewTimeline(wrap, maxStep int64) *Timeline {
+	return &Timeline{wrap: wrap, maxStep: maxStep}
+}
+
+// NewPTSTimeline returns a Timeline for PTS/DTS values with steps up to
+// DefaultMaxTimestampStep.
+func NewPTSTimeline() *Timeline {
+	return NewTimeline(PtsWrap, DefaultMaxTimestampStep)
+}
+
+// NewPCRTimeline returns a Timeline for 27MHz PCR values with steps up to
+// maxClockStep.
+func NewPCRTimeline() *Timeline {
+	return NewTimeline(PcrWrap, maxClockStep)
+}
+
+// Add adds a value and returns it unwrapped.
+func (t *Timeline) Add(raw int64) int64 {
+	s := &t.stats
+	if s.Values == 0 {
+		t.raw = raw
+		s.Values = 1
+		s.First, s.Last = raw, raw
+		return raw
+	}
+	step := (raw-t.raw+3*t.wrap/2)%t.wrap - t.wrap/2
+	s.Last += step
+	index := s.Values
+	s.Values++
+	if raw < t.raw && step > 0 {
+		s.Wraps++
+		t.addEvent(TimelineEvent{Type: TimelineWrap, Index: index, Raw: raw, Value: s.Last, Step: step})
+	}
+	t.raw = raw
+	if step < 0 || step > t.maxStep {
+		s.Discontinuities++
+		t.addEvent(TimelineEvent{Type: TimelineDiscontinuity, Index: index, Raw: raw, Value: s.Last, Step: step})
+		return s.Last
+	}
+	if s.Steps == 0 || step < s.MinStep {
+		s.MinStep = step
+	}
+	if s.Steps == 0 || step > s.MaxStep {
+		s.MaxStep = step
+	}
+	s.Steps++
+	s.Span += step
+	s.AvgStep = s.Span / s.Steps
+	t.countStep(step)
+	return s.Last
+}
+
+func (t *Timeline) addEvent(ev TimelineEvent) {
+	if len(t.events) < maxTimelineEvents {
+		t.events = append(t.events, ev)
+	}
+}
+
+// countStep counts a step value. If there are more than
+// maxTimelineStepValues distinct values, the two closest values are merged
+// into the one with the larger count.
+func (t *Timeline) countStep(step int64) {
+	i := sort.Search(len(t.stepCounts), func(i int) bool { return t.stepCounts[i].value >= step })
+	if i < len(t.stepCounts) && t.stepCounts[i].value == step {
+		t.stepCounts[i].count++
+		return
+	}
+	t.stepCounts = append(t.stepCounts, stepCount{})
+	copy(t.stepCounts[i+1:], t.stepCounts[i:])
+	t.stepCounts[i] = stepCount{value: step, count: 1}
+	if len(t.stepCounts) <= maxTimelineStepValues {
+		return
+	}
+	m := 0
+	for j := 1; j < len(t.stepCounts)-1; j++ {
+		if t.stepCounts[j+1].value-t.stepCounts[j].value < t.stepCounts[m+1].value-t.stepCounts[m].value {
+			m = j
+		}
+	}
+	a, b := t.stepCounts[m], t.stepCounts[m+1]
+	if b.count > a.count {
+		a.value = b.value
+	}
+	a.count += b.count
+	t.stepCounts[m] = a
+	t.stepCounts = append(t.stepCounts[:m+1], t.stepCounts[m+2:]...)
+}
+
+// Stats returns the current statistics.
+func (t *Timeline) Stats() TimelineStats {
+	return t.stats
+}
+
+// Count returns the number of values.
+func (t *Timeline) Count() int64 {
+	return t.stats.Values
+}
+
+// Events returns the first wrap and discontinuity events.
+func (t *Timeline) Events() []TimelineEvent {
+	return t.events
+}
+
+// StepsAbove returns the number of steps larger than limit.
+func (t *Timeline) StepsAbove(limit int64) int64 {
+	n := int64(0)
+	for _, c := range t.stepCounts {
+		if c.value > limit {
+			n += c.count
+		}
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package tsanalyzer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeline(t *testing.T) {
+	t.Run("unwrap", func(t *testing.T) {
+		tl := NewPTSTimeline()
+		require.Equal(t, int64(PtsWrap-3000), tl.Add(PtsWrap-3000))
+		require.Equal(t, int64(PtsWrap), tl.Add(0))
+		require.Equal(t, int64(PtsWrap+3000), tl.Add(3000))
+		require.Equal(t, int64(PtsWrap-1500), tl.Add(PtsWrap-1500))
+		require.Equal(t, []TimelineEvent{
+			{Type: TimelineWrap, Index: 1, Raw: 0, Value: PtsWrap, Step: 3000},
+			{Type: TimelineDiscontinuity, Index: 3, Raw: PtsWrap - 1500, Value: PtsWrap - 1500, Step: -4500},
+		}, tl.Events())
+		require.Equal(t, TimelineStats{Values: 4, First: PtsWrap - 3000, Last: PtsWrap - 1500, Steps: 2,
+			MinStep: 3000, MaxStep: 3000, AvgStep: 3000, Span: 6000, Wraps: 1, Discontinuities: 1}, tl.Stats())
+	})
+
+	t.Run("several wraps", func(t *testing.T) {
+		// The PTS wraps every 26.5 hours
+		tl := NewPTSTimeline()
+		nrFrames := int64(60 * 3600 * 25)
+		for i := int64(0); i < nrFrames; i++ {
+			tl.Add((i * 3600) % PtsWrap)
+		}
+		s := tl.Stats()
+		require.Equal(t, int64(2), s.Wraps)
+		require.Equal(t, int64(0), s.Discontinuities)
+		require.Equal(t, (nrFrames-1)*3600, s.Last)
+		require.Equal(t, int64(3600), s.AvgStep)
+		require.Len(t, tl.stepCounts, 1)
+		require.Equal(t, int64(0), tl.StepsAbove(3600))
+	})
+
+	t.Run("jump", func(t *testing.T) {
+		tl := NewPTSTimeline()
+		for _, ts := range []int64{0, 3600, 7200, 7200 + 20*TimeScale, 7200 + 20*TimeScale + 3600} {
+			tl.Add(ts)
+		}
+		s := tl.Stats()
+		require.Equal(t, int64(1), s.Discontinuities)
+		require.Equal(t, int64(3), s.Steps)
+		require.Equal(t, int64(3600), s.MaxStep)
+		require.Equal(t, int64(7200+20*TimeScale+3600), s.Last)
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		tl := NewPTSTimeline()
+		ts := int64(0)
+		for i := 0; i < 10000; i++ {
+			tl.Add(ts)
+			ts += int64(3000 + i%1000)
+		}
+		require.Len(t, tl.stepCounts, maxTimelineStepValues)
+		require.Equal(t, int64(9999), tl.Stats().Steps)
+		// Steps with merged values are counted approximately
+		require.InDelta(t, 3998, tl.StepsAbove(3600), 40)
+
+		for i := 0; i < maxTimelineEvents; i++ {
+			tl.Add(0)
+			tl.Add(2 * DefaultMaxTimestampStep)
+		}
+		require.Len(t, tl.Events(), maxTimelineEvents)
+		require.Equal(t, int64(2*maxTimelineEvents), tl.Stats().Discontinuities)
+	})
+
+	t.Run("pcr", func(t *testing.T) {
+		tl := NewPCRTimeline()
+		require.Equal(t, int64(PcrWrap-27000), tl.Add(PcrWrap-27000))
+		require.Equal(t, int64(PcrWrap+27000), tl.Add(27000))
+		require.Equal(t, int64(1), tl.Stats().Wraps)
+		require.Equal(t, int64(54000), tl.Stats().MaxStep)
+	})
+}
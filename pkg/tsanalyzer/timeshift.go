@@ -0,0 +1,465 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Comcast/gots/v2/packet"
+)
+
+// Max number of packets read to find the reference timestamp with Options.Rebase,
+// and to complete a SCTE-35 section
+const rebaseLookahead = 10000
+
+// TimeJump is a change of the offset in TimeshiftTS. It applies from input
+// packet Packet, or if PTS is set, from the first PES packet with an input PTS
+// at or after PTS on PID (any PID if 0). Jump (90kHz) is added to the offset
+// and is negative for a step back. With Discontinuity, the
+// discontinuity_indicator is set in the next packet with PCR on each PID.
+type TimeJump struct {
+	Packet        int64  `json:"packet,omitempty"`
+	PTS           *int64 `json:"pts,omitempty"`
+	PID           int    `json:"pid,omitempty"`
+	Jump          int64  `json:"jump"`
+	Discontinuity bool   `json:"discontinuity,omitempty"`
+}
+
+// TimeJumpInfo is reported by TimeshiftTS when a TimeJump is applied at input
+// packet Packet on PID. PTS is the input PTS for jumps at a PTS, and Offset is
+// the new common offset.
+type TimeJumpInfo struct {
+	Packet        int64 `json:"packet"`
+	PID           int   `json:"pid"`
+	PTS           int64 `json:"pts,omitempty"`
+	Jump          int64 `json:"jump"`
+	Offset        int64 `json:"offset"`
+	Discontinuity bool  `json:"discontinuity"`
+}
+
+func (TimeJumpInfo) isEvent() {}
+
+// TimeshiftPID is the result of TimeshiftTS for a PID with timestamps.
+// PCRs are in 27MHz units and PTS/DTS in 90kHz units, after the shift.
+// The offsets are those of the last values. ESCRs counts the shifted ESCR
+// and pack header SCR fields, and SCTE35Cues the cues with shifted
+// pts_adjustment. BadPESHeaders counts the PES headers with PTS that are too
+// short to be shifted and are passed on unchanged.
+type TimeshiftPID struct {
+	PID           int   `json:"pid"`
+	PCROffset     int64 `json:"pcrOffset"`
+	PTSOffset     int64 `json:"ptsOffset"`
+	PCRs          int64 `json:"pcrs"`
+	FirstPCR      int64 `json:"firstPcr"`
+	LastPCR       int64 `json:"lastPcr"`
+	PESPackets    int64 `json:"pesPackets"`
+	FirstPTS      int64 `json:"firstPts"`
+	LastPTS       int64 `json:"lastPts"`
+	FirstDTS      int64 `json:"firstDts"`
+	LastDTS       int64 `json:"lastDts"`
+	ESCRs         int64 `json:"escrs,omitempty"`
+	SCTE35Cues    int64 `json:"scte35Cues,omitempty"`
+	BadPESHeaders int64 `json:"badPesHeaders,omitempty"`
+}
+
+// TimeshiftInfo is reported by TimeshiftTS at the end. Offset is the common
+// offset in 90kHz units at the end, and PIDs are the PIDs with PCR or PTS in PID order.
+type TimeshiftInfo struct {
+	Offset  int64          `json:"offset"`
+	Packets int64          `json:"packets"`
+	PIDs    []TimeshiftPID `json:"pids"`
+}
+
+func (TimeshiftInfo) isEvent() {}
+
+// timeshifter is the state of TimeshiftTS.
+type timeshifter struct {
+	h        Handler
+	o        Options
+	offset   int64
+	pids     map[int]*TimeshiftPID
+	nr       int64       // input packet number
+	nextJump int         // index of the next TimeJump
+	discs    int         // number of jumps with discontinuity
+	discPIDs map[int]int // number of discontinuities signaled per PID
+	w        io.Writer
+	queue    []packet.Packet // shifted packets held back until SCTE-35 sections are complete
+	sections map[int]*sectionAssembler
+	pmtPIDs  map[int]bool
+	cues     map[int]*cueRewriter // per SCTE-35 PID
+}
+
+// cueRewriter collects a SCTE-35 section from the packets on a PID with the
+// positions of its bytes in the queue, so that it can be changed in place.
+type cueRewriter struct {
+	started bool
+	data    []byte
+	pos     []cueBytePos
+}
+
+// cueBytePos is the position of a section byte in the queue.
+type cueBytePos struct {
+	pkt, offset int
+}
+
+// TimeshiftTS shifts the PCRs and PES timestamps of the TS in f and writes
+// the result to tsWriter. All timestamps are shifted by o.TimeOffset (90kHz)
+// and wrap around. With o.Rebase, the offset is instead chosen so that the
+// first PCR_base becomes o.RebaseTo. Without PCR, or with o.PESOnly, the
+// earliest PTS/DTS of the first rebaseLookahead packets becomes o.RebaseTo.
+// o.PIDOffsets are added to the PTS/DTS of the PIDs, but not to the PCRs,
+// so they change the A/V sync. With o.PCROnly or o.PESOnly, only the PCRs or
+// only the PTS/DTS are shifted. o.TimeJumps change the offset during the
+// stream, in the order given, and each is reported as a TimeJumpInfo when
+// applied. ESCR and pack header SCR fields in the PES headers are shifted
+// with the PCRs, and the pts_adjustment of SCTE-35 cues with the PTS, with
+// the CRC_32 recomputed. A TimeshiftInfo with the first and last values per
+// PID is reported at the end.
+func TimeshiftTS(ctx context.Context, f io.Reader, tsWriter io.Writer, h Handler, o Options) error {
+	if o.PCROnly && o.PESOnly {
+		return fmt.Errorf("PCR only and PES only cannot be combined")
+	}
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	if _, err := packet.Sync(rd); err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+	s := &timeshifter{
+		h:        h,
+		o:        o,
+		offset:   o.TimeOffset,
+		pids:     make(map[int]*TimeshiftPID),
+		discPIDs: make(map[int]int),
+		w:        tsWriter,
+		sections: make(map[int]*sectionAssembler),
+		pmtPIDs:  make(map[int]bool),
+		cues:     make(map[int]*cueRewriter),
+	}
+	var pending []packet.Packet // packets read before the rebase offset is known
+	waiting := o.Rebase
+	nrPackets := int64(0)
+	var pkt packet.Packet
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if _, err := io.ReadFull(rd, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break dataLoop
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		nrPackets++
+		if waiting {
+			pending = append(pending, pkt)
+			if _, ok := packetPCR(&pkt); (ok && !o.PESOnly) || len(pending) >= rebaseLookahead {
+				if err := s.flush(pending); err != nil {
+					return err
+				}
+				pending, waiting = nil, false
+			}
+			continue
+		}
+		if err := s.write(&pkt); err != nil {
+			return err
+		}
+	}
+	if waiting {
+		if err := s.flush(pending); err != nil {
+			return err
+		}
+	}
+	// Incomplete SCTE-35 sections are written as they are
+	for _, p := range s.queue {
+		if err := WritePacket(&p, tsWriter); err != nil {
+			return err
+		}
+	}
+
+	info := TimeshiftInfo{Offset: s.offset, Packets: nrPackets}
+	for _, st := range s.pids {
+		info.PIDs = append(info.PIDs, *st)
+	}
+	sort.Slice(info.PIDs, func(i, j int) bool { return info.PIDs[i].PID < info.PIDs[j].PID })
+	return emit(h, info)
+}
+
+// flush sets the rebase offset from pkts and writes them shifted.
+func (s *timeshifter) flush(pkts []packet.Packet) error {
+	ref, ok := rebaseReference(pkts, s.o.PESOnly)
+	if !ok {
+		return fmt.Errorf("no timestamps found to rebase in the first %d packets", len(pkts))
+	}
+	s.offset = s.o.RebaseTo - ref
+	for i := range pkts {
+		if err := s.write(&pkts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write shifts pkt and writes it, unless a SCTE-35 section that is not
+// complete yet is pending.
+func (s *timeshifter) write(pkt *packet.Packet) error {
+	if err := s.shift(pkt); err != nil {
+		return err
+	}
+	pid := packet.Pid(pkt)
+	if pid == 0 || s.pmtPIDs[pid] {
+		s.psi(pkt)
+	}
+	s.queue = append(s.queue, *pkt)
+	if c := s.cues[pid]; c != nil && !s.o.PCROnly {
+		s.cue(pid, c, len(s.queue)-1)
+	}
+	if len(s.queue) < rebaseLookahead {
+		for _, c := range s.cues {
+			if len(c.pos) > 0 {
+				return nil
+			}
+		}
+	} else {
+		// Give up sections that are not completed
+		for _, c := range s.cues {
+			c.reset()
+		}
+	}
+	for i := range s.queue {
+		if err := WritePacket(&s.queue[i], s.w); err != nil {
+			return err
+		}
+	}
+	s.queue = s.queue[:0]
+	return nil
+}
+
+// psi finds the PMT PIDs and the SCTE-35 PIDs.
+func (s *timeshifter) psi(pkt *packet.Packet) {
+	pid := packet.Pid(pkt)
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return
+	}
+	a := s.sections[pid]
+	if a == nil {
+		a = &sectionAssembler{}
+		s.sections[pid] = a
+	}
+	for _, section := range a.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		switch {
+		case pid == 0 && section[0] == 0x00:
+			for _, pmtPID := range patPrograms(section) {
+				s.pmtPIDs[pmtPID] = true
+			}
+		case section[0] == 0x02:
+			p, ok := parsePMTSection(section)
+			if !ok {
+				continue
+			}
+			for _, es := range p.streams {
+				if es.streamType == scte35StreamType && s.cues[es.pid] == nil {
+					s.cues[es.pid] = &cueRewriter{}
+				}
+			}
+		}
+	}
+}
+
+// cue adds the payload of the packet at index qi in the queue to the SCTE-35
+// section on pid, and shifts the pts_adjustment of the completed sections.
+func (s *timeshifter) cue(pid int, c *cueRewriter, qi int) {
+	pkt := &s.queue[qi]
+	payload, err := packet.Payload(pkt)
+	if err != nil || len(payload) == 0 {
+		return
+	}
+	start := PacketSize - len(payload)
+	if packet.PayloadUnitStartIndicator(pkt) {
+		pointer := int(payload[0])
+		start++
+		if start+pointer > PacketSize {
+			c.reset()
+			return
+		}
+		if c.started {
+			s.addCueBytes(pid, c, qi, start, start+pointer)
+		}
+		c.reset()
+		c.started = true
+		start += pointer
+	} else if !c.started {
+		return
+	}
+	s.addCueBytes(pid, c, qi, start, PacketSize)
+}
+
+// addCueBytes adds bytes start to end of the packet at index qi in the queue
+// to the section and rewrites the completed sections in place.
+func (s *timeshifter) addCueBytes(pid int, c *cueRewriter, qi, start, end int) {
+	for i := start; i < end; i++ {
+		c.data = append(c.data, s.queue[qi][i])
+		c.pos = append(c.pos, cueBytePos{qi, i})
+	}
+	for len(c.data) >= 3 && c.data[0] != 0xff {
+		length := 3 + (int(c.data[1]&0x0f)<<8 | int(c.data[2]))
+		if len(c.data) < length {
+			return
+		}
+		if ShiftSCTE35PTSAdjustment(c.data[:length], s.offset) {
+			for i, p := range c.pos[:length] {
+				s.queue[p.pkt][p.offset] = c.data[i]
+			}
+			s.pid(pid).SCTE35Cues++
+		}
+		c.data, c.pos = c.data[length:], c.pos[length:]
+	}
+	if len(c.data) > 0 && c.data[0] == 0xff {
+		// Stuffing until next payload unit start
+		c.reset()
+	}
+}
+
+func (c *cueRewriter) reset() {
+	c.data, c.pos = nil, nil
+	c.started = false
+}
+
+// rebaseReference returns the first PCR_base in pkts, or the earliest PTS/DTS
+// if there is no PCR or pesOnly is set.
+func rebaseReference(pkts []packet.Packet, pesOnly bool) (int64, bool) {
+	if !pesOnly {
+		for i := range pkts {
+			if pcr, ok := packetPCR(&pkts[i]); ok {
+				return pcr / 300, true
+			}
+		}
+	}
+	ref, found := int64(0), false
+	for i := range pkts {
+		hdr, err := packet.PESHeader(&pkts[i])
+		if err != nil {
+			continue
+		}
+		_, dts, ok := pesTimes(hdr)
+		if !ok {
+			continue
+		}
+		// dts is earlier than ref if ref is less than half a wrap after it
+		if !found || (ref-dts+PtsWrap)%PtsWrap < PtsWrap/2 {
+			ref, found = dts, true
+		}
+	}
+	return ref, found
+}
+
+// shift shifts the PCR and PES timestamps in pkt and records the resulting
+// values, also for timestamps that are not shifted.
+func (s *timeshifter) shift(pkt *packet.Packet) error {
+	defer func() { s.nr++ }()
+	pid := packet.Pid(pkt)
+	var hdr []byte
+	if packet.PayloadUnitStartIndicator(pkt) {
+		if h, err := packet.PESHeader(pkt); err == nil {
+			hdr = h
+		}
+	}
+	if err := s.applyJumps(pid, hdr); err != nil {
+		return err
+	}
+	if _, ok := packetPCR(pkt); ok {
+		if !s.o.PESOnly {
+			ShiftPCR(pkt, s.offset)
+		}
+		if s.discPIDs[pid] < s.discs {
+			pkt[5] |= 0x80 // discontinuity_indicator
+			s.discPIDs[pid] = s.discs
+		}
+		pcr, _ := packetPCR(pkt)
+		st := s.pid(pid)
+		if st.PCRs == 0 {
+			st.FirstPCR = pcr
+		}
+		st.PCRs++
+		st.LastPCR = pcr
+	}
+	if hdr == nil {
+		return nil
+	}
+	if !s.o.PESOnly {
+		if n := ShiftPESClockReferences(hdr, s.offset); n > 0 {
+			s.pid(pid).ESCRs += int64(n)
+		}
+	}
+	if !pesHasPTS(hdr) {
+		return nil
+	}
+	if !s.o.PCROnly {
+		if err := ShiftPESTimestamps(hdr, s.offset+s.o.PIDOffsets[pid]); err != nil {
+			s.pid(pid).BadPESHeaders++
+			return nil
+		}
+	}
+	pts, dts, ok := pesTimes(hdr)
+	if !ok {
+		return nil
+	}
+	st := s.pid(pid)
+	if st.PESPackets == 0 {
+		st.FirstPTS, st.FirstDTS = pts, dts
+	}
+	st.PESPackets++
+	st.LastPTS, st.LastDTS = pts, dts
+	return nil
+}
+
+// applyJumps applies the time jumps that start at the current packet on pid.
+// hdr is the PES header of the packet with the input timestamps, or nil.
+func (s *timeshifter) applyJumps(pid int, hdr []byte) error {
+	for s.nextJump < len(s.o.TimeJumps) {
+		j := s.o.TimeJumps[s.nextJump]
+		info := TimeJumpInfo{Packet: s.nr, PID: pid, Jump: j.Jump, Discontinuity: j.Discontinuity}
+		if j.PTS != nil {
+			if hdr == nil || (j.PID != 0 && j.PID != pid) {
+				return nil
+			}
+			pts, _, ok := pesTimes(hdr)
+			if !ok || (pts-*j.PTS+PtsWrap)%PtsWrap >= PtsWrap/2 {
+				return nil // before the PTS of the jump
+			}
+			info.PTS = pts
+		} else if s.nr < j.Packet {
+			return nil
+		}
+		s.nextJump++
+		s.offset += j.Jump
+		if j.Discontinuity {
+			s.discs++
+		}
+		info.Offset = s.offset
+		if err := emit(s.h, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pid returns the result for pid, with the current offsets.
+func (s *timeshifter) pid(pid int) *TimeshiftPID {
+	st := s.pids[pid]
+	if st == nil {
+		st = &TimeshiftPID{PID: pid}
+		s.pids[pid] = st
+	}
+	if !s.o.PESOnly {
+		st.PCROffset = s.offset
+	}
+	if !s.o.PCROnly {
+		st.PTSOffset = s.offset + s.o.PIDOffsets[pid]
+	}
+	return st
+}
@@ -0,0 +1,260 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func timeshiftData(t *testing.T, data []byte, o Options) ([]byte, TimeshiftInfo) {
+	t.Helper()
+	out, _, info := timeshiftJumps(t, data, o)
+	return out, info
+}
+
+func timeshiftJumps(t *testing.T, data []byte, o Options) ([]byte, []TimeJumpInfo, TimeshiftInfo) {
+	t.Helper()
+	var out bytes.Buffer
+	events := collectEvents(t, func(h Handler) error {
+		return TimeshiftTS(context.TODO(), bytes.NewReader(data), &out, h, o)
+	})
+	info := lastEventOf[TimeshiftInfo](events)
+	require.Equal(t, len(data), out.Len())
+	require.Equal(t, int64(len(data)/PacketSize), info.Packets)
+	return out.Bytes(), eventsOf[TimeJumpInfo](events), info
+}
+
+func TestTimeshiftTS(t *testing.T) {
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	out, orig := timeshiftData(t, data, Options{})
+	require.Equal(t, data, out)
+	require.Len(t, orig.PIDs, 2)
+	video, audio := orig.PIDs[0], orig.PIDs[1]
+	require.Equal(t, 256, video.PID)
+	require.Equal(t, 257, audio.PID)
+	require.Greater(t, video.PCRs, int64(0))
+	require.Equal(t, int64(0), audio.PCRs)
+
+	t.Run("offset with wrap", func(t *testing.T) {
+		offset := int64(PtsWrap - 90000)
+		_, info := timeshiftData(t, data, Options{TimeOffset: offset})
+		require.Equal(t, offset, info.Offset)
+		v := info.PIDs[0]
+		require.Equal(t, offset, v.PCROffset)
+		require.Equal(t, offset, v.PTSOffset)
+		require.Equal(t, shiftPTS(video.FirstPTS, offset), v.FirstPTS)
+		require.Equal(t, shiftPTS(video.LastDTS, offset), v.LastDTS)
+		require.Equal(t, (video.FirstPCR+offset*300)%PcrWrap, v.FirstPCR)
+		require.Equal(t, (video.LastPCR+offset*300)%PcrWrap, v.LastPCR)
+	})
+
+	t.Run("rebase with audio offset", func(t *testing.T) {
+		_, info := timeshiftData(t, data, Options{Rebase: true, RebaseTo: 0, PIDOffsets: map[int]int64{257: 9000}})
+		require.Equal(t, -video.FirstPCR/300, info.Offset)
+		v, a := info.PIDs[0], info.PIDs[1]
+		require.Equal(t, video.FirstPCR%300, v.FirstPCR)
+		require.Equal(t, video.FirstPTS-video.FirstPCR/300, v.FirstPTS)
+		require.Equal(t, info.Offset+9000, a.PTSOffset)
+		require.Equal(t, audio.FirstPTS+info.Offset+9000, a.FirstPTS)
+	})
+
+	t.Run("rebase pes only", func(t *testing.T) {
+		_, info := timeshiftData(t, data, Options{Rebase: true, RebaseTo: 900000, PESOnly: true})
+		v, a := info.PIDs[0], info.PIDs[1]
+		require.Equal(t, video.FirstPCR, v.FirstPCR)
+		require.Equal(t, int64(0), v.PCROffset)
+		first := v.FirstDTS
+		if a.FirstDTS < first {
+			first = a.FirstDTS
+		}
+		require.Equal(t, int64(900000), first)
+	})
+
+	t.Run("pcr only", func(t *testing.T) {
+		_, info := timeshiftData(t, data, Options{TimeOffset: 90000, PCROnly: true})
+		v, a := info.PIDs[0], info.PIDs[1]
+		require.Equal(t, video.FirstPCR+90000*300, v.FirstPCR)
+		require.Equal(t, video.FirstPTS, v.FirstPTS)
+		require.Equal(t, audio.LastPTS, a.LastPTS)
+		require.Equal(t, int64(0), v.PTSOffset)
+	})
+
+	t.Run("schedule", func(t *testing.T) {
+		for _, discontinuity := range []bool{true, false} {
+			at := video.FirstPTS + 45000
+			o := Options{TimeJumps: []TimeJump{
+				{Packet: 300, Jump: 900000, Discontinuity: discontinuity},
+				{PTS: &at, PID: 256, Jump: -45000, Discontinuity: discontinuity},
+			}}
+			out, jumps, info := timeshiftJumps(t, data, o)
+			require.Len(t, jumps, 2)
+			require.Equal(t, TimeJumpInfo{Packet: 300, PID: jumps[0].PID, Jump: 900000, Offset: 900000,
+				Discontinuity: discontinuity}, jumps[0])
+			require.Greater(t, jumps[1].Packet, int64(300))
+			require.Equal(t, 256, jumps[1].PID)
+			require.GreaterOrEqual(t, jumps[1].PTS, at)
+			require.Equal(t, int64(855000), jumps[1].Offset)
+			require.Equal(t, int64(855000), info.Offset)
+			require.Equal(t, video.LastPTS+855000, info.PIDs[0].LastPTS)
+			require.Equal(t, video.FirstPCR, info.PIDs[0].FirstPCR)
+
+			_, summary := validateData(t, out)
+			if discontinuity {
+				require.Equal(t, 0, summary.Errors[PCRDiscontinuityIndicatorError])
+			} else {
+				require.Greater(t, summary.Errors[PCRDiscontinuityIndicatorError], 0)
+			}
+		}
+	})
+
+	t.Run("pcr and pes only", func(t *testing.T) {
+		err := TimeshiftTS(context.TODO(), bytes.NewReader(data), &bytes.Buffer{}, nil, Options{PCROnly: true, PESOnly: true})
+		require.Error(t, err)
+	})
+}
+
+func TestTimeshiftTruncatedPESHeader(t *testing.T) {
+	// The PES header has a PTS flag and PES_header_data_length 5, but the
+	// adaptation field leaves room for only 3 bytes of the PTS
+	var p packet.Packet
+	p[0], p[1], p[2], p[3] = SyncByte, 0x41, 0x00, 0x30
+	p[4] = PacketSize - 5 - 12
+	for i := 6; i < PacketSize-12; i++ {
+		p[i] = 0xff
+	}
+	copy(p[PacketSize-12:], []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01})
+	out, info := timeshiftData(t, p[:], Options{TimeOffset: 9000})
+	require.Equal(t, p[:], out)
+	require.Equal(t, []TimeshiftPID{{PID: 256, PCROffset: 9000, PTSOffset: 9000, BadPESHeaders: 1}}, info.PIDs)
+}
+
+func TestShiftPESClockReferences(t *testing.T) {
+	scr := func(base, ext int64) []byte {
+		b := []byte{0x04, 0x00, 0x04, 0x00, 0x04, 0x01} // marker bits
+		insertSCR(b, base, ext)
+		return b
+	}
+	escrBase, scrBase := int64(PtsWrap-1000), int64(123456789)
+	// PES header with PTS, ESCR, DSM trick mode and a PES extension with
+	// private data and a pack header
+	hdr := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0xa9, 0x00}
+	hdr = append(hdr, 0x21, 0x00, 0x01, 0x00, 0x01) // PTS 0
+	hdr = append(hdr, scr(escrBase, 299)...)
+	hdr = append(hdr, 0x1f)      // DSM trick mode
+	hdr = append(hdr, 0x80|0x40) // PES_private_data and pack_header_field
+	hdr = append(hdr, make([]byte, 16)...)
+	pack := append([]byte{0x00, 0x00, 0x01, 0xba}, scr(scrBase, 5)...)
+	pack[4] |= 0x40                             // MPEG-2 pack header
+	pack = append(pack, 0x01, 0x89, 0xc3, 0xf8) // program_mux_rate and no stuffing
+	hdr = append(hdr, byte(len(pack)))
+	hdr = append(hdr, pack...)
+	hdr[8] = byte(len(hdr) - 9)
+	orig := append([]byte{}, hdr...)
+
+	require.Equal(t, 2, ShiftPESClockReferences(hdr, 2000))
+	escr, scrPos := pesClockReferences(hdr)
+	require.Equal(t, 14, escr)
+	base, ext := extractSCR(hdr[escr : escr+6])
+	require.Equal(t, int64(1000), base)
+	require.Equal(t, int64(299), ext)
+	base, ext = extractSCR(hdr[scrPos : scrPos+6])
+	require.Equal(t, scrBase+2000, base)
+	require.Equal(t, int64(5), ext)
+
+	require.Equal(t, 2, ShiftPESClockReferences(hdr, -2000))
+	require.Equal(t, orig, hdr)
+}
+
+func TestTimeshiftSCTE35(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		data, err := os.ReadFile("../../internal/testdata/80s_with_ad.ts")
+		require.NoError(t, err)
+		cuesOf := func(data []byte) []SCTE35Info {
+			var cues []SCTE35Info
+			h := HandlerFunc(func(ev Event) error {
+				if c, ok := ev.(SCTE35Info); ok {
+					cues = append(cues, c)
+				}
+				return nil
+			})
+			require.NoError(t, ParseSCTE35(context.TODO(), bytes.NewReader(data), h, Options{}))
+			return cues
+		}
+		offset := int64(PtsWrap - 90000)
+		out, info := timeshiftData(t, data, Options{TimeOffset: offset})
+		want := cuesOf(data)
+		got := cuesOf(out)
+		require.NotEmpty(t, want)
+		require.Len(t, got, len(want))
+		nrCues := int64(0)
+		for _, p := range info.PIDs {
+			nrCues += p.SCTE35Cues
+		}
+		require.Equal(t, int64(len(want)), nrCues)
+		for i := range want {
+			require.Equal(t, uint64(shiftPTS(int64(want[i].PTSAdjustment), offset)), got[i].PTSAdjustment)
+			want[i].PTSAdjustment, want[i].Base64 = 0, ""
+			got[i].PTSAdjustment, got[i].Base64 = 0, ""
+			require.Equal(t, want[i], got[i])
+		}
+
+		_, info = timeshiftData(t, data, Options{TimeOffset: offset, PCROnly: true})
+		for _, p := range info.PIDs {
+			require.Equal(t, int64(0), p.SCTE35Cues)
+		}
+	})
+
+	t.Run("section in two packets", func(t *testing.T) {
+		var cc uint8
+		var data []byte
+		for _, section := range [][]byte{
+			patSection(1, 1, 4096),
+			newPMTSection(1, 256, []pmtStream{{streamType: scte35StreamType, pid: 500}}),
+		} {
+			pid := 0
+			if section[0] == 0x02 {
+				pid = 4096
+			}
+			for _, p := range sectionPackets(pid, section, &cc) {
+				data = append(data, p[:]...)
+			}
+		}
+		desc := make([]byte, 0, 250)
+		for len(desc) < 240 {
+			desc = append(desc, 0x00, 0x08, 'C', 'U', 'E', 'I', 0x00, 0x00, 0x01, 0x23)
+		}
+		cue := spliceInfoSection([]byte{0x00, 0x00, 0x00, 0x03, 0xe8}, 0x06, []byte{0xfe, 0x00, 0x0d, 0xbb, 0xa0}, desc)
+		pkts := sectionPackets(500, cue, &cc)
+		require.Len(t, pkts, 2)
+		null := nullPacket()
+		data = append(data, pkts[0][:]...)
+		data = append(data, null[:]...)
+		data = append(data, pkts[1][:]...)
+
+		out, info := timeshiftData(t, data, Options{TimeOffset: 9000})
+		require.Equal(t, []TimeshiftPID{{PID: 500, PCROffset: 9000, PTSOffset: 9000, SCTE35Cues: 1}}, info.PIDs)
+		var pids []int
+		var a sectionAssembler
+		var sections [][]byte
+		for i := 0; i < len(out); i += PacketSize {
+			var p packet.Packet
+			copy(p[:], out[i:])
+			pids = append(pids, p.PID())
+			if p.PID() == 500 {
+				payload, err := p.Payload()
+				require.NoError(t, err)
+				sections = append(sections, a.write(p.PayloadUnitStartIndicator(), payload)...)
+			}
+		}
+		require.Equal(t, []int{0, 4096, 500, NullPID, 500}, pids)
+		require.Len(t, sections, 1)
+		decoded, err := DecodeSCTE35(500, sections[0])
+		require.NoError(t, err)
+		require.Equal(t, uint64(10000), decoded.PTSAdjustment)
+	})
+}
@@ -0,0 +1,186 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+	"github.com/Comcast/gots/v2/pes"
+)
+
+// ShiftPCR shifts the PCR in pkt, if any, by offset in 90kHz units.
+func ShiftPCR(pkt *packet.Packet, offset int64) {
+	if !packet.ContainsAdaptationField(pkt) || adaptationfield.Length(pkt) == 0 || !adaptationfield.HasPCR(pkt) {
+		return
+	}
+	pcrBytes, err := adaptationfield.PCR(pkt)
+	if err != nil {
+		return
+	}
+	pcr := int64(gots.ExtractPCR(pcrBytes))
+
+	// Convert offset from 90kHz to 27MHz (multiply by 300)
+	pcrOffset := offset * 300
+
+	// Apply offset with wrap-around
+	newPcr := (pcr + pcrOffset) % PcrWrap
+	if newPcr < 0 {
+		newPcr += PcrWrap
+	}
+
+	gots.InsertPCR(pcrBytes, uint64(newPcr))
+}
+
+// ShiftPESTimestamps shifts PTS and DTS in a PES header by offset in 90kHz units.
+// It returns an error if the header is too short for its PTS and DTS.
+func ShiftPESTimestamps(pesHeaderBytes []byte, offset int64) error {
+	pesHeader, err := pes.NewPESHeader(pesHeaderBytes)
+	if err != nil {
+		return err
+	}
+
+	if !pesHeader.HasPTS() {
+		return nil
+	}
+	if len(pesHeaderBytes) < 14 || pesHeader.HasDTS() && len(pesHeaderBytes) < 19 {
+		return fmt.Errorf("PES header of %d bytes too short for PTS/DTS", len(pesHeaderBytes))
+	}
+
+	// Rewrite PTS
+	pts := int64(pesHeader.PTS())
+	gots.InsertPTS(pesHeaderBytes[9:14], uint64(shiftPTS(pts, offset)))
+
+	// Rewrite DTS if present
+	if pesHeader.HasDTS() {
+		pesHeaderBytes[9] = 0x30 | pesHeaderBytes[9]&0x0f // set first 4 bits to 0011
+		dts := int64(pesHeader.DTS())
+		gots.InsertPTS(pesHeaderBytes[14:19], uint64(shiftPTS(dts, offset)))
+		pesHeaderBytes[14] = 0x10 | pesHeaderBytes[14]&0x0f // set first 4 bits to 0001
+	}
+
+	return nil
+}
+
+// shiftPTS adds a possibly negative offset to a 33-bit timestamp.
+func shiftPTS(ts, offset int64) int64 {
+	ts = (ts + offset) % PtsWrap
+	if ts < 0 {
+		ts += PtsWrap
+	}
+	return ts
+}
+
+// ShiftPESClockReferences shifts the ESCR and the SCR of a pack header in the
+// PES extension of a PES header by offset in 90kHz units. The fields before
+// them, e.g. the DSM trick mode, are skipped and left unchanged. It returns
+// the number of shifted clock references.
+func ShiftPESClockReferences(pesHeaderBytes []byte, offset int64) int {
+	escr, scr := pesClockReferences(pesHeaderBytes)
+	n := 0
+	for _, i := range []int{escr, scr} {
+		if i < 0 {
+			continue
+		}
+		base, ext := extractSCR(pesHeaderBytes[i : i+6])
+		insertSCR(pesHeaderBytes[i:i+6], shiftPTS(base, offset), ext)
+		n++
+	}
+	return n
+}
+
+// pesClockReferences returns the positions of the ESCR and of the SCR in the
+// pack header of the PES extension in a PES header, or -1 if not present.
+func pesClockReferences(hdr []byte) (escr, scr int) {
+	escr, scr = -1, -1
+	if len(hdr) < 9 || hdr[0] != 0 || hdr[1] != 0 || hdr[2] != 1 || hdr[6]&0xc0 != 0x80 {
+		return escr, scr
+	}
+	flags := hdr[7]
+	end := 9 + int(hdr[8]) // end of PES header data
+	if end > len(hdr) {
+		end = len(hdr)
+	}
+	i := 9
+	switch flags >> 6 {
+	case 2: // PTS
+		i += 5
+	case 3: // PTS and DTS
+		i += 10
+	}
+	if flags&0x20 != 0 { // ESCR
+		if i+6 <= end {
+			escr = i
+		}
+		i += 6
+	}
+	if flags&0x10 != 0 { // ES_rate
+		i += 3
+	}
+	if flags&0x08 != 0 { // DSM trick mode
+		i++
+	}
+	if flags&0x04 != 0 { // additional_copy_info
+		i++
+	}
+	if flags&0x02 != 0 { // previous_PES_CRC
+		i += 2
+	}
+	if flags&0x01 == 0 || i >= end { // PES_extension
+		return escr, scr
+	}
+	extFlags := hdr[i]
+	i++
+	if extFlags&0x80 != 0 { // PES_private_data
+		i += 16
+	}
+	if extFlags&0x40 != 0 && i+1+10 <= end { // pack_header_field
+		pack := hdr[i+1:]
+		// MPEG-2 pack header with its SCR after the pack_start_code
+		if pack[0] == 0 && pack[1] == 0 && pack[2] == 1 && pack[3] == 0xba && pack[4]&0xc0 == 0x40 {
+			scr = i + 1 + 4
+		}
+	}
+	return escr, scr
+}
+
+// extractSCR returns the 33-bit base and 9-bit extension of an ESCR or SCR field.
+func extractSCR(b []byte) (base, ext int64) {
+	base = int64(b[0]&0x38)<<27 | int64(b[0]&0x03)<<28 | int64(b[1])<<20 |
+		int64(b[2]&0xf8)<<12 | int64(b[2]&0x03)<<13 | int64(b[3])<<5 | int64(b[4]>>3)
+	ext = int64(b[4]&0x03)<<7 | int64(b[5]>>1)
+	return base, ext
+}
+
+// insertSCR writes base and ext into an ESCR or SCR field. The leading bits
+// and the marker bits are kept.
+func insertSCR(b []byte, base, ext int64) {
+	b[0] = b[0]&0xc4 | byte(base>>27)&0x38 | byte(base>>28)&0x03
+	b[1] = byte(base >> 20)
+	b[2] = b[2]&0x04 | byte(base>>12)&0xf8 | byte(base>>13)&0x03
+	b[3] = byte(base >> 5)
+	b[4] = b[4]&0x04 | byte(base<<3)&0xf8 | byte(ext>>7)&0x03
+	b[5] = b[5]&0x01 | byte(ext<<1)
+}
+
+// ShiftSCTE35PTSAdjustment adds offset in 90kHz units to the pts_adjustment of
+// a SCTE-35 splice_info_section including the CRC_32, and recomputes the CRC_32.
+// Sections with a wrong CRC_32 are not changed. It returns true if the
+// section was changed.
+func ShiftSCTE35PTSAdjustment(section []byte, offset int64) bool {
+	if len(section) < 15 || section[0] != 0xfc {
+		return false
+	}
+	end := len(section) - 4
+	if !bytes.Equal(gots.ComputeCRC(section[:end]), section[end:]) {
+		return false
+	}
+	adj := int64(section[4]&0x01)<<32 | int64(binary.BigEndian.Uint32(section[5:9]))
+	adj = shiftPTS(adj, offset)
+	section[4] = section[4]&0xfe | byte(adj>>32)
+	binary.BigEndian.PutUint32(section[5:9], uint32(adj))
+	copy(section[end:], gots.ComputeCRC(section[:end]))
+	return true
+}
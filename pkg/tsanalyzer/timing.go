@@ -0,0 +1,399 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+)
+
+// TSTDMaxDelay is the max delay of data through the T-STD buffers in 90kHz
+// units, i.e. from the arrival of the first byte of an access unit to its DTS.
+// Still picture video is exempt.
+const TSTDMaxDelay = TimeScale
+
+// DefaultDelayWindow is the default duration of the windows of the delay timeline
+const DefaultDelayWindow = time.Second
+
+// Types of TimingError
+const (
+	DTSAfterPTSError      = "DTS_after_PTS"
+	DTSNotIncreasingError = "DTS_not_increasing"
+	TSTDUnderflowError    = "T-STD_underflow"
+	TSTDDelayError        = "T-STD_delay"
+)
+
+// TimingError is a PTS/DTS error or a T-STD violation of an access unit.
+// Packet is the packet with the PES header.
+type TimingError struct {
+	Type        string `json:"type"`
+	PID         int    `json:"pid"`
+	Packet      int64  `json:"packet"`
+	PTS         int64  `json:"pts"`
+	DTS         int64  `json:"dts"`
+	Description string `json:"description"`
+}
+
+// DelaySample is the min and max PTS - PCR delay in a window starting at Time
+// seconds after the first PCR of the program. Windows without PES headers are
+// left out.
+type DelaySample struct {
+	Time       float64 `json:"time"`
+	MinDelayMs float64 `json:"minDelayMs"`
+	MaxDelayMs float64 `json:"maxDelayMs"`
+}
+
+// PidTiming is the timing of the PES packets of one PID relative to the PCR of
+// its program. The delay is the PTS minus the PCR at the arrival of the PES
+// header. Delays are only measured after two PCRs. Underflows are access units
+// that arrive completely only after their DTS, and LongDelays those with more
+// than TSTDMaxDelay between the arrival of the PES header and the DTS.
+type PidTiming struct {
+	PID              int           `json:"pid"`
+	Type             string        `json:"type,omitempty"`
+	Program          int           `json:"program"`
+	PCRPID           int           `json:"pcrPid"`
+	PESPackets       int64         `json:"pesPackets"`
+	Delays           int64         `json:"delays"`
+	MinDelayMs       float64       `json:"minDelayMs"`
+	AvgDelayMs       float64       `json:"avgDelayMs"`
+	MaxDelayMs       float64       `json:"maxDelayMs"`
+	DTSAfterPTS      int64         `json:"dtsAfterPts"`
+	DTSNotIncreasing int64         `json:"dtsNotIncreasing"`
+	Underflows       int64         `json:"underflows"`
+	LongDelays       int64         `json:"longDelays"`
+	WithinTSTD       bool          `json:"withinTstd"`
+	Wraps            int64         `json:"wraps,omitempty"`
+	Timeline         []DelaySample `json:"timeline,omitempty"`
+}
+
+// TimingInfo is the PTS/DTS timing of all PES PIDs in PID order.
+type TimingInfo struct {
+	Packets        int64       `json:"packets"`
+	WindowMs       int64       `json:"windowMs"`
+	TSTDMaxDelayMs float64     `json:"tstdMaxDelayMs"`
+	PIDs           []PidTiming `json:"pids"`
+}
+
+func (TimingError) isEvent() {}
+func (TimingInfo) isEvent()  {}
+
+// pcrInterpolator gives the PCR at any packet from the PCRs of a PCR PID,
+// using the packet rate between the two latest PCRs without discontinuity.
+type pcrInterpolator struct {
+	pcrs           *Timeline
+	lastPacket     int64
+	ticks, packets int64 // latest regular PCR step
+	discs          int64 // number of discontinuity_indicators
+}
+
+func (p *pcrInterpolator) add(pcr, nr int64, discontinuity bool) {
+	if discontinuity {
+		p.discs++
+	}
+	prev := p.pcrs.Stats()
+	v := p.pcrs.Add(pcr)
+	if step := v - prev.Last; prev.Values > 0 && !discontinuity && step > 0 && step <= maxClockStep {
+		p.ticks, p.packets = step, nr-p.lastPacket
+	}
+	p.lastPacket = nr
+}
+
+// at returns the unwrapped PCR of packet nr, or false if the rate is unknown.
+func (p *pcrInterpolator) at(nr int64) (int64, bool) {
+	if p.packets == 0 {
+		return 0, false
+	}
+	return p.pcrs.Stats().Last + (nr-p.lastPacket)*p.ticks/p.packets, true
+}
+
+// pcrBase returns the 33-bit PCR base of an unwrapped PCR.
+func pcrBase(pcr int64) int64 {
+	return ((pcr/300)%PtsWrap + PtsWrap) % PtsWrap
+}
+
+// pidTimer collects the timing of one PES PID.
+type pidTimer struct {
+	info     PidTiming
+	dts      *Timeline
+	discs    int64 // discontinuity_indicators of the PCR PID seen at the latest DTS
+	sum      int64 // sum of the delays in 90kHz units
+	min, max int64
+	// The access unit being received
+	pending    bool
+	pendingPkt int64
+	pendingPTS int64
+	pendingDTS int64
+	arrival    int64 // unwrapped PCR of its latest packet
+	arrived    bool
+	// The window of the delay timeline
+	inWindow    bool
+	windowStart int64
+	sample      DelaySample
+}
+
+// delayMs converts a PTS/DTS difference to milliseconds with 3 decimals.
+func delayMs(d float64) float64 {
+	return math.Round(d*1000*1000/TimeScale) / 1000
+}
+
+// ParseTiming reports the delay between the PTS and the PCR of every PES PID,
+// PES packets with DTS after PTS or DTS not increasing, and access units that
+// break the T-STD delay limits. The PCR of the program is interpolated for
+// every packet. TimingErrors are reported when found, and a TimingInfo at the end.
+func ParseTiming(ctx context.Context, f io.Reader, h Handler, o Options) error {
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	_, err := packet.Sync(rd)
+	if err != nil {
+		return fmt.Errorf("syncing with reader %w", err)
+	}
+
+	window := o.DelayWindow
+	if window == 0 {
+		window = DefaultDelayWindow
+	}
+	windowTicks := durationToTicks(window)
+	sections := make(map[int]*sectionAssembler)
+	pmtPIDs := make(map[int]bool)
+	clocks := make(map[int]*pcrInterpolator) // per PCR PID
+	streams := make(map[int]pmtSection)      // program of each elementary PID
+	types := make(map[int]string)
+	timers := make(map[int]*pidTimer)
+	nr := int64(0)
+	var pkt packet.Packet
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		if _, err := io.ReadFull(rd, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break dataLoop
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+		pid := packet.Pid(&pkt)
+
+		if c := clocks[pid]; c != nil {
+			if pcr, ok := packetPCR(&pkt); ok {
+				c.add(pcr, nr, adaptationfield.IsDiscontinuous(&pkt))
+			}
+		}
+
+		if pid == 0 || pmtPIDs[pid] {
+			payload, err := packet.Payload(&pkt)
+			if err != nil {
+				nr++
+				continue
+			}
+			a := sections[pid]
+			if a == nil {
+				a = &sectionAssembler{}
+				sections[pid] = a
+			}
+			for _, section := range a.write(packet.PayloadUnitStartIndicator(&pkt), payload) {
+				switch {
+				case pid == 0 && section[0] == 0x00:
+					for _, pmtPID := range patPrograms(section) {
+						pmtPIDs[pmtPID] = true
+					}
+				case pid != 0 && section[0] == 0x02:
+					pmt, ok := parsePMTSection(section)
+					if !ok {
+						continue
+					}
+					if pmt.pcrPID != NullPID && clocks[pmt.pcrPID] == nil {
+						clocks[pmt.pcrPID] = &pcrInterpolator{pcrs: NewPCRTimeline()}
+					}
+					for _, s := range pmt.streams {
+						streams[s.pid] = pmt
+						_, types[s.pid], _ = streamKind(s)
+					}
+				}
+			}
+			nr++
+			continue
+		}
+
+		pmt, ok := streams[pid]
+		if !ok {
+			nr++
+			continue
+		}
+		t := timers[pid]
+		pusi := packet.PayloadUnitStartIndicator(&pkt)
+		if t != nil && t.pending && pusi {
+			if err := t.finish(h); err != nil {
+				return err
+			}
+		}
+		var arrival int64
+		arrived := false
+		if c := clocks[pmt.pcrPID]; c != nil {
+			arrival, arrived = c.at(nr)
+		}
+		if t != nil && t.pending {
+			t.arrival, t.arrived = arrival, arrived
+		}
+		if !pusi {
+			nr++
+			continue
+		}
+		payload, err := packet.Payload(&pkt)
+		if err != nil {
+			nr++
+			continue
+		}
+		pts, dts, ok := pesTimes(payload)
+		if !ok {
+			nr++
+			continue
+		}
+		if t == nil {
+			t = &pidTimer{info: PidTiming{PID: pid, Type: types[pid]}, dts: NewPTSTimeline()}
+			timers[pid] = t
+		}
+		t.info.Program, t.info.PCRPID = pmt.programNr, pmt.pcrPID
+		t.info.PESPackets++
+		if err := t.checkDTS(h, nr, pts, dts, clocks[pmt.pcrPID]); err != nil {
+			return err
+		}
+		t.pending, t.pendingPkt, t.pendingPTS, t.pendingDTS = true, nr, pts, dts
+		t.arrival, t.arrived = arrival, arrived
+		if arrived {
+			if err := t.addDelay(h, pts, dts, arrival, clocks[pmt.pcrPID], windowTicks); err != nil {
+				return err
+			}
+		}
+		nr++
+	}
+
+	info := TimingInfo{
+		Packets:        nr,
+		WindowMs:       window.Milliseconds(),
+		TSTDMaxDelayMs: delayMs(TSTDMaxDelay),
+		PIDs:           make([]PidTiming, 0, len(timers)),
+	}
+	pids := make([]int, 0, len(timers))
+	for pid := range timers {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		t := timers[pid]
+		if t.pending {
+			if err := t.finish(h); err != nil {
+				return err
+			}
+		}
+		if t.inWindow {
+			t.closeWindow()
+		}
+		if t.info.Delays > 0 {
+			t.info.MinDelayMs = delayMs(float64(t.min))
+			t.info.MaxDelayMs = delayMs(float64(t.max))
+			t.info.AvgDelayMs = delayMs(float64(t.sum) / float64(t.info.Delays))
+			t.info.WithinTSTD = t.info.Underflows == 0 && t.info.LongDelays == 0
+		}
+		t.info.Wraps = t.dts.Stats().Wraps
+		info.PIDs = append(info.PIDs, t.info)
+	}
+
+	return emit(h, info)
+}
+
+// checkDTS checks that the DTS is not after the PTS and that it increases,
+// unless there is a discontinuity_indicator on the PCR PID in between.
+func (t *pidTimer) checkDTS(h Handler, nr, pts, dts int64, c *pcrInterpolator) error {
+	if diff := SignedPTSDiff(dts, pts); diff > 0 {
+		t.info.DTSAfterPTS++
+		err := TimingError{Type: DTSAfterPTSError, PID: t.info.PID, Packet: nr, PTS: pts, DTS: dts,
+			Description: fmt.Sprintf("DTS is %.3f ms after PTS", delayMs(float64(diff)))}
+		if err := emit(h, err); err != nil {
+			return err
+		}
+	}
+	discs := int64(0)
+	if c != nil {
+		discs = c.discs
+	}
+	prev := t.dts.Stats()
+	v := t.dts.Add(dts)
+	if prev.Values > 0 && v <= prev.Last && discs == t.discs {
+		t.info.DTSNotIncreasing++
+		err := TimingError{Type: DTSNotIncreasingError, PID: t.info.PID, Packet: nr, PTS: pts, DTS: dts,
+			Description: fmt.Sprintf("DTS is %.3f ms after the previous DTS", delayMs(float64(v-prev.Last)))}
+		if err := emit(h, err); err != nil {
+			return err
+		}
+	}
+	t.discs = discs
+	return nil
+}
+
+// addDelay adds the PTS - PCR delay of a PES header that arrived at PCR
+// arrival, and checks the T-STD max delay with the DTS.
+func (t *pidTimer) addDelay(h Handler, pts, dts, arrival int64, c *pcrInterpolator, windowTicks int64) error {
+	delay := SignedPTSDiff(pts, pcrBase(arrival))
+	if t.info.Delays == 0 || delay < t.min {
+		t.min = delay
+	}
+	if t.info.Delays == 0 || delay > t.max {
+		t.max = delay
+	}
+	t.info.Delays++
+	t.sum += delay
+
+	// Windows start at multiples of the window duration after the first PCR.
+	// The interpolated PCR may step back a little at the next PCR, so only
+	// steps back by more than a window start a new one.
+	now := arrival - c.pcrs.Stats().First
+	if t.inWindow && (now-t.windowStart >= windowTicks || now < t.windowStart-windowTicks) {
+		t.closeWindow()
+	}
+	ms := delayMs(float64(delay))
+	if !t.inWindow {
+		t.inWindow, t.windowStart = true, now-(now%windowTicks+windowTicks)%windowTicks
+		t.sample = DelaySample{Time: math.Round(float64(t.windowStart)*1000/PcrTimeScale) / 1000, MinDelayMs: ms, MaxDelayMs: ms}
+	} else {
+		t.sample.MinDelayMs = math.Min(t.sample.MinDelayMs, ms)
+		t.sample.MaxDelayMs = math.Max(t.sample.MaxDelayMs, ms)
+	}
+
+	if d := SignedPTSDiff(dts, pcrBase(arrival)); d > TSTDMaxDelay {
+		t.info.LongDelays++
+		err := TimingError{Type: TSTDDelayError, PID: t.info.PID, Packet: t.pendingPkt, PTS: pts, DTS: dts,
+			Description: fmt.Sprintf("DTS is %.3f ms after arrival, more than %.0f ms", delayMs(float64(d)), delayMs(TSTDMaxDelay))}
+		return emit(h, err)
+	}
+	return nil
+}
+
+func (t *pidTimer) closeWindow() {
+	t.info.Timeline = append(t.info.Timeline, t.sample)
+	t.inWindow = false
+}
+
+// finish checks that the pending access unit arrived completely before its DTS.
+func (t *pidTimer) finish(h Handler) error {
+	t.pending = false
+	if !t.arrived {
+		return nil
+	}
+	if d := SignedPTSDiff(t.pendingDTS, pcrBase(t.arrival)); d < 0 {
+		t.info.Underflows++
+		err := TimingError{Type: TSTDUnderflowError, PID: t.info.PID, Packet: t.pendingPkt, PTS: t.pendingPTS, DTS: t.pendingDTS,
+			Description: fmt.Sprintf("access unit arrives %.3f ms after DTS", delayMs(float64(-d)))}
+		return emit(h, err)
+	}
+	return nil
+}
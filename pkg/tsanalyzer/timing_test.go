@@ -0,0 +1,104 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func timingData(t *testing.T, data []byte) ([]TimingError, TimingInfo) {
+	t.Helper()
+	events := collectEvents(t, func(h Handler) error {
+		return ParseTiming(context.TODO(), bytes.NewReader(data), h, Options{})
+	})
+	info := lastEventOf[TimingInfo](events)
+	require.Equal(t, int64(len(data)/PacketSize), info.Packets)
+	return eventsOf[TimingError](events), info
+}
+
+func TestParseTiming(t *testing.T) {
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+	errs, orig := timingData(t, data)
+	require.Empty(t, errs)
+	require.Len(t, orig.PIDs, 2)
+	video, audio := orig.PIDs[0], orig.PIDs[1]
+	require.Equal(t, 256, video.PID)
+	require.Equal(t, "AVC", video.Type)
+	require.Equal(t, 256, audio.PCRPID)
+	for _, p := range orig.PIDs {
+		require.True(t, p.WithinTSTD)
+		require.Greater(t, p.Delays, int64(0))
+		require.LessOrEqual(t, p.MinDelayMs, p.AvgDelayMs)
+		require.LessOrEqual(t, p.AvgDelayMs, p.MaxDelayMs)
+		require.Greater(t, p.MinDelayMs, 0.0)
+		require.NotEmpty(t, p.Timeline)
+		require.Equal(t, p.MaxDelayMs, p.Timeline[0].MaxDelayMs)
+	}
+
+	t.Run("DTS errors", func(t *testing.T) {
+		bad := append([]byte{}, data...)
+		var prevDTS int64
+		nrDTS := 0
+		for i := 0; i < len(bad); i += PacketSize {
+			var p packet.Packet
+			copy(p[:], bad[i:])
+			if p.PID() != 256 || !p.PayloadUnitStartIndicator() {
+				continue
+			}
+			payload, err := packet.Payload(&p)
+			require.NoError(t, err)
+			pts, dts, ok := pesTimes(payload)
+			if !ok || payload[7]&0xc0 != 0xc0 {
+				continue
+			}
+			nrDTS++
+			switch nrDTS {
+			case 5:
+				dts = pts + 3000
+			case 10:
+				dts = prevDTS
+			}
+			gots.InsertPTS(payload[14:19], uint64(dts))
+			payload[14] = 0x10 | payload[14]&0x0f
+			copy(bad[i:], p[:])
+			prevDTS = dts
+		}
+		errs, info := timingData(t, bad)
+		var types []string
+		for _, e := range errs {
+			types = append(types, e.Type)
+		}
+		// The DTS after PTS also steps back from the next DTS
+		require.Equal(t, []string{DTSAfterPTSError, DTSNotIncreasingError, DTSNotIncreasingError}, types)
+		require.Equal(t, int64(1), info.PIDs[0].DTSAfterPTS)
+		require.Equal(t, int64(2), info.PIDs[0].DTSNotIncreasing)
+		require.Equal(t, errs[0].PTS+3000, errs[0].DTS)
+	})
+
+	t.Run("T-STD limits", func(t *testing.T) {
+		early, _ := timeshiftData(t, data, Options{PIDOffsets: map[int]int64{257: -TimeScale}})
+		errs, info := timingData(t, early)
+		a := info.PIDs[1]
+		require.Equal(t, a.Delays, a.Underflows)
+		require.False(t, a.WithinTSTD)
+		require.True(t, info.PIDs[0].WithinTSTD)
+		require.InDelta(t, audio.MinDelayMs-1000, a.MinDelayMs, 0.01)
+		require.Len(t, errs, int(a.Underflows))
+		require.Equal(t, TSTDUnderflowError, errs[0].Type)
+
+		late, _ := timeshiftData(t, data, Options{PIDOffsets: map[int]int64{257: TimeScale}})
+		errs, info = timingData(t, late)
+		a = info.PIDs[1]
+		require.Equal(t, int64(0), a.Underflows)
+		require.Greater(t, a.LongDelays, int64(0))
+		require.False(t, a.WithinTSTD)
+		require.Len(t, errs, int(a.LongDelays))
+		require.Equal(t, TSTDDelayError, errs[0].Type)
+	})
+}
@@ -0,0 +1,192 @@
+package tsanalyzer
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/psi"
+	"github.com/asticode/go-astits"
+)
+
+const (
+	ANC_REGISTERED_IDENTIFIER = 0x56414E43
+	ANC_DESCRIPTOR_TAG        = 0xC4
+)
+
+// ReadPMTPackets reads packets until a complete PMT on pid has been found.
+// It returns the packets of the PMT and the parsed PMT.
+func ReadPMTPackets(r io.Reader, pid int) ([]packet.Packet, psi.PMT, error) {
+	packets := []packet.Packet{}
+	var pkt = &packet.Packet{}
+	var err error
+	var pmt psi.PMT
+
+	pmtAcc := packet.NewAccumulator(psi.PmtAccumulatorDoneFunc)
+	done := false
+
+	for !done {
+		if _, err := io.ReadFull(r, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil, gots.ErrPMTNotFound
+			}
+			return nil, nil, err
+		}
+		currPid := pkt.PID()
+		if currPid != pid {
+			continue
+		}
+		packets = append(packets, *pkt)
+
+		_, err = pmtAcc.WritePacket(pkt)
+		if err == gots.ErrAccumulatorDone {
+			pmt, err = psi.NewPMT(pmtAcc.Bytes())
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(pmt.Pids()) == 0 {
+				done = false
+				pmtAcc = packet.NewAccumulator(psi.PmtAccumulatorDoneFunc)
+				continue
+			}
+			done = true
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return packets, pmt, nil
+}
+
+// WritePacket writes a TS packet to w.
+func WritePacket(pkt *packet.Packet, w io.Writer) error {
+	_, err := w.Write(pkt[:])
+	return err
+}
+
+// ParseAstitsElementaryStreamInfo returns information about a PMT elementary stream
+// parsed by astits, or nil if the stream type is not supported.
+func ParseAstitsElementaryStreamInfo(es *astits.PMTElementaryStream) *ElementaryStreamInfo {
+	var streamInfo *ElementaryStreamInfo
+	switch es.StreamType {
+	case astits.StreamTypeH264Video:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "AVC", Type: "video"}
+	case astits.StreamTypeAACAudio:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "AAC", Type: "audio"}
+	case astits.StreamTypeH265Video:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "HEVC", Type: "video"}
+	case astits.StreamTypeAC3Audio:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "AC-3", Type: "audio"}
+	case astits.StreamTypeEAC3Audio:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "E-AC-3", Type: "audio"}
+	case astits.StreamTypeSCTE35:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "SCTE35", Type: "cue"}
+	case astits.StreamTypePrivateData:
+		streamInfo = &ElementaryStreamInfo{PID: es.ElementaryPID, Codec: "PrivateData", Type: "data"}
+	default:
+		return nil
+	}
+	for _, d := range es.ElementaryStreamDescriptors {
+		switch d.Tag {
+		case astits.DescriptorTagAC3:
+			// DVB signalling of AC-3 in private data
+			if es.StreamType == astits.StreamTypePrivateData {
+				streamInfo.Codec = "AC-3"
+				streamInfo.Type = "audio"
+			}
+		case astits.DescriptorTagEnhancedAC3:
+			if es.StreamType == astits.StreamTypePrivateData {
+				streamInfo.Codec = "E-AC-3"
+				streamInfo.Type = "audio"
+			}
+		case astits.DescriptorTagRegistration:
+			r := d.Registration
+			switch r.FormatIdentifier {
+			case ANC_REGISTERED_IDENTIFIER:
+				streamInfo.Codec = "SMPTE-2038"
+				streamInfo.Type = "ANC"
+			}
+		default:
+			// Nothing
+		}
+	}
+
+	return streamInfo
+}
+
+// ParseElementaryStreamInfo returns information about a PMT elementary stream
+// parsed by gots, or nil if the stream type is not supported.
+func ParseElementaryStreamInfo(es psi.PmtElementaryStream) *ElementaryStreamInfo {
+	pid := uint16(es.ElementaryPid())
+	var streamInfo *ElementaryStreamInfo
+	switch es.StreamType() {
+	case psi.PmtStreamTypeMpeg4VideoH264:
+		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "AVC", Type: "video"}
+	case psi.PmtStreamTypeAac:
+		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "AAC", Type: "audio"}
+	case psi.PmtStreamTypeMpeg4VideoH265:
+		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "HEVC", Type: "video"}
+	case psi.PmtStreamTypeScte35:
+		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "SCTE35", Type: "cue"}
+	case psi.PmtStreamTypeAc3:
+		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "AC-3", Type: "audio"}
+	case psi.PmtStreamTypeEc3:
+		streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "E-AC-3", Type: "audio"}
+	case psi.PmtStreamTypePrivateContent:
+		// DVB signalling of AC-3 and E-AC-3 in private data
+		for _, d := range es.Descriptors() {
+			switch d.Tag() {
+			case astits.DescriptorTagAC3:
+				streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "AC-3", Type: "audio"}
+			case astits.DescriptorTagEnhancedAC3:
+				streamInfo = &ElementaryStreamInfo{PID: pid, Codec: "E-AC-3", Type: "audio"}
+			}
+		}
+	}
+
+	return streamInfo
+}
+
+// ParsePacketToPAT parses a PAT from a single TS packet.
+func ParsePacketToPAT(pkt *packet.Packet) (pat psi.PAT, e error) {
+	if packet.IsPat(pkt) {
+		pay, err := packet.Payload(pkt)
+		if err != nil {
+			return nil, err
+		}
+
+		pat, err = psi.NewPAT(pay)
+		if err != nil {
+			return nil, err
+		}
+
+		return pat, nil
+	}
+
+	return nil, fmt.Errorf("unable to parse packet to PAT")
+}
+
+// demuxState is the packet count and PSI versions seen by a demuxer created by newDemuxer.
+type demuxState struct {
+	packets  int64          // number of packets read
+	versions map[uint16]int // version_number of the latest PSI section per PID
+}
+
+// newDemuxer creates an astits demuxer that updates ds with the packets read.
+func newDemuxer(ctx context.Context, r io.Reader, ds *demuxState) *astits.Demuxer {
+	ds.versions = make(map[uint16]int)
+	return astits.NewDemuxer(ctx, r,
+		astits.DemuxerOptPacketSkipper(func(p *astits.Packet) bool {
+			ds.packets++
+			return false
+		}),
+		astits.DemuxerOptPacketsParser(func(ps []*astits.Packet) ([]*astits.DemuxerData, bool, error) {
+			// Only the version is picked up, the parsing is left to astits
+			if len(ps) > 0 && ps[0].Header.PayloadUnitStartIndicator {
+				ds.versions[ps[0].Header.PID] = psiVersion(ps[0])
+			}
+			return nil, false, nil
+		}))
+}
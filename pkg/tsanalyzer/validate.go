@@ -0,0 +1,569 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/packet/adaptationfield"
+)
+
+// Names of the ETSI TR 101 290 indicators
+const (
+	TSSyncLoss           = "TS_sync_loss"
+	SyncByteError        = "Sync_byte_error"
+	PATError             = "PAT_error"
+	ContinuityCountError = "Continuity_count_error"
+	PMTError             = "PMT_error"
+	PIDError             = "PID_error"
+
+	TransportError                 = "Transport_error"
+	CRCError                       = "CRC_error"
+	PCRRepetitionError             = "PCR_repetition_error"
+	PCRDiscontinuityIndicatorError = "PCR_discontinuity_indicator_error"
+	PCRAccuracyError               = "PCR_accuracy_error"
+	PTSError                       = "PTS_error"
+)
+
+const (
+	// Number of consecutive sync bytes needed to acquire sync
+	syncAcquirePackets = 5
+	// Number of consecutive corrupted sync bytes before sync is lost
+	syncLossPackets = 2
+	// Max interval between PAT and PMT sections
+	psiInterval = 500 * time.Millisecond
+	// Default max interval between packets on a referenced PID
+	DefaultPIDTimeout = 5 * time.Second
+	// Max interval between PCRs on a PID
+	pcrRepetitionInterval = 40 * time.Millisecond
+	// Max difference between consecutive PCR values without discontinuity_indicator
+	pcrDiscontinuityLimit = 100 * time.Millisecond
+	// Max PCR inaccuracy in nanoseconds
+	pcrAccuracyLimit = 500
+	// Min time of constant bitrate before the PCR accuracy is checked
+	pcrCBRWindow = time.Second
+	// Max relative difference between the rate between two PCRs and the transport rate of a CBR stream
+	pcrCBRTolerance = 0.01
+	// Max interval between PTS values on audio and video PIDs
+	ptsInterval = 700 * time.Millisecond
+	// PID of SDT and BAT
+	sdtPID = 0x11
+	// SCTE-35 stream type, which is not checked for PID_error
+	scte35StreamType = 0x86
+)
+
+// TR101290Error is an error found by the ETSI TR 101 290 checks.
+type TR101290Error struct {
+	Priority    int     `json:"priority"`
+	Indicator   string  `json:"indicator"`
+	PID         int     `json:"pid"`
+	Packet      int64   `json:"packet"`
+	Offset      int64   `json:"offset"`
+	Time        float64 `json:"time"`
+	Description string  `json:"description"`
+}
+
+// TR101290Summary is reported when validation is done.
+type TR101290Summary struct {
+	Packets  int64          `json:"packets"`
+	Duration float64        `json:"duration"`
+	Errors   map[string]int `json:"errors"`
+}
+
+func (TR101290Error) isEvent()   {}
+func (TR101290Summary) isEvent() {}
+
+// ccState is the continuity counter state of a PID.
+type ccState struct {
+	cc        int
+	duplicate bool
+}
+
+// pcrState is the PCR history of a PID.
+type pcrState struct {
+	values  [2]int64 // the two latest PCRs without discontinuity between them
+	offsets [2]int64 // byte offsets of the packets with the two latest PCRs
+	nr      int      // number of valid entries in values
+	time    int64    // clock time of the latest PCR
+	// The transport rate since the latest discontinuity
+	firstOffset int64 // byte offset of the first PCR
+	span        int64 // PCR ticks from the first PCR
+	vbr         bool  // the rate between two PCRs differed from the transport rate
+}
+
+// validator runs the TR 101 290 checks packet by packet.
+type validator struct {
+	h          Handler
+	clock      *pcrClock
+	pidTimeout time.Duration
+	nr         int64
+	offset     int64
+	ccs        map[int]*ccState
+	sections   map[int]*sectionAssembler
+	lastPAT    int64
+	pmtPIDs    map[int]int   // PMT PID to program number
+	lastPMT    map[int]int64 // PMT PID to time of last PMT section
+	esPIDs     map[int]int   // elementary stream PID to program number
+	lastPID    map[int]int64 // elementary stream PID to time of last packet
+	lastPTS    map[int]int64 // audio and video PID to time of last PTS
+	pcrs       map[int]*pcrState
+	timing     bool // interval checks have started
+	summary    TR101290Summary
+}
+
+func newValidator(h Handler, o Options) *validator {
+	pidTimeout := o.PIDTimeout
+	if pidTimeout == 0 {
+		pidTimeout = DefaultPIDTimeout
+	}
+	return &validator{
+		h:          h,
+		clock:      newPCRClock(),
+		pidTimeout: pidTimeout,
+		ccs:        make(map[int]*ccState),
+		sections:   make(map[int]*sectionAssembler),
+		pmtPIDs:    make(map[int]int),
+		lastPMT:    make(map[int]int64),
+		esPIDs:     make(map[int]int),
+		lastPID:    make(map[int]int64),
+		lastPTS:    make(map[int]int64),
+		pcrs:       make(map[int]*pcrState),
+		summary:    TR101290Summary{Errors: make(map[string]int)},
+	}
+}
+
+func (v *validator) now() int64 {
+	if !v.clock.valid() {
+		return 0
+	}
+	return v.clock.ticks(v.nr)
+}
+
+func (v *validator) report(priority int, indicator string, pid int, format string, args ...any) error {
+	v.summary.Errors[indicator]++
+	return emit(v.h, TR101290Error{
+		Priority:    priority,
+		Indicator:   indicator,
+		PID:         pid,
+		Packet:      v.nr,
+		Offset:      v.offset,
+		Time:        float64(v.now()) / PcrTimeScale,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkPacket runs the checks on a packet with a correct sync byte.
+func (v *validator) checkPacket(pkt *packet.Packet) error {
+	pid := packet.Pid(pkt)
+	hasAF := packet.ContainsAdaptationField(pkt) && adaptationfield.Length(pkt) > 0
+	discontinuity := hasAF && adaptationfield.IsDiscontinuous(pkt)
+
+	pcr := int64(-1)
+	if hasAF && adaptationfield.HasPCR(pkt) {
+		if pcrBytes, err := adaptationfield.PCR(pkt); err == nil {
+			pcr = int64(gots.ExtractPCR(pcrBytes))
+			v.clock.update(pid, pcr, v.nr)
+		}
+	}
+	now := v.now()
+
+	if pkt[1]&0x80 != 0 {
+		if err := v.report(2, TransportError, pid, "transport_error_indicator is set"); err != nil {
+			return err
+		}
+	}
+
+	if pcr >= 0 {
+		if err := v.checkPCR(pid, pcr, discontinuity, now); err != nil {
+			return err
+		}
+	}
+
+	if pid != NullPID {
+		if err := v.checkCC(pkt, pid, discontinuity); err != nil {
+			return err
+		}
+	}
+
+	scrambled := pkt[3]&0xc0 != 0
+	if pid == 0 && scrambled {
+		if err := v.report(1, PATError, pid, "scrambling_control_field is not 00 on PID 0"); err != nil {
+			return err
+		}
+	}
+	if _, ok := v.pmtPIDs[pid]; ok && scrambled {
+		if err := v.report(1, PMTError, pid, "scrambling_control_field is not 00 on PMT PID"); err != nil {
+			return err
+		}
+	}
+	if _, ok := v.esPIDs[pid]; ok {
+		v.lastPID[pid] = now
+	}
+	if _, ok := v.lastPTS[pid]; ok && packet.PayloadUnitStartIndicator(pkt) {
+		if payload, err := packet.Payload(pkt); err == nil && pesHasPTS(payload) {
+			v.lastPTS[pid] = now
+		}
+	}
+
+	if pid == 0 || pid == sdtPID || v.pmtPIDs[pid] != 0 {
+		if err := v.checkSections(pkt, pid, now); err != nil {
+			return err
+		}
+	}
+
+	return v.checkIntervals(now)
+}
+
+// checkCC checks the continuity counter of a packet.
+// One duplicate packet is allowed, and the counter does not increment without payload.
+func (v *validator) checkCC(pkt *packet.Packet, pid int, discontinuity bool) error {
+	cc := int(packet.ContinuityCounter(pkt))
+	s, ok := v.ccs[pid]
+	if !ok || discontinuity {
+		v.ccs[pid] = &ccState{cc: cc}
+		return nil
+	}
+	var err error
+	switch {
+	case !packet.ContainsPayload(pkt):
+		if cc != s.cc {
+			err = v.report(1, ContinuityCountError, pid, "counter changed from %d to %d in packet without payload", s.cc, cc)
+		}
+	case cc == s.cc:
+		if s.duplicate {
+			err = v.report(1, ContinuityCountError, pid, "packet with counter %d occurs more than twice", cc)
+		}
+		s.duplicate = true
+	case cc != (s.cc+1)&0x0f:
+		err = v.report(1, ContinuityCountError, pid, "counter jumped from %d to %d", s.cc, cc)
+		s.duplicate = false
+	default:
+		s.duplicate = false
+	}
+	s.cc = cc
+	return err
+}
+
+// checkSections checks the PSI sections on PID 0 and the PMT PIDs.
+func (v *validator) checkSections(pkt *packet.Packet, pid int, now int64) error {
+	payload, err := packet.Payload(pkt)
+	if err != nil {
+		return nil
+	}
+	a := v.sections[pid]
+	if a == nil {
+		a = &sectionAssembler{}
+		v.sections[pid] = a
+	}
+	for _, section := range a.write(packet.PayloadUnitStartIndicator(pkt), payload) {
+		tableID := section[0]
+		if !sectionCRCValid(section) {
+			if err := v.report(2, CRCError, pid, "CRC_32 error in section with table_id 0x%02x", tableID); err != nil {
+				return err
+			}
+			continue
+		}
+		if pid == sdtPID {
+			continue
+		}
+		if pid == 0 {
+			if tableID != 0x00 {
+				if err := v.report(1, PATError, pid, "section with table_id 0x%02x on PID 0", tableID); err != nil {
+					return err
+				}
+				continue
+			}
+			v.lastPAT = now
+			for programNr, pmtPID := range patPrograms(section) {
+				if v.pmtPIDs[pmtPID] == 0 {
+					v.lastPMT[pmtPID] = now
+				}
+				v.pmtPIDs[pmtPID] = programNr
+			}
+			continue
+		}
+		if tableID != 0x02 {
+			continue
+		}
+		v.lastPMT[pid] = now
+		pmt, ok := parsePMTSection(section)
+		if !ok {
+			continue
+		}
+		for _, es := range pmt.streams {
+			if es.streamType == scte35StreamType {
+				// Cues are sent only when needed
+				continue
+			}
+			if _, ok := v.esPIDs[es.pid]; !ok {
+				v.lastPID[es.pid] = now
+				if isAudioVideoStreamType(es.streamType) {
+					v.lastPTS[es.pid] = now
+				}
+			}
+			v.esPIDs[es.pid] = pmt.programNr
+		}
+	}
+	return nil
+}
+
+// checkIntervals checks that PAT, PMTs and referenced PIDs occur often enough.
+func (v *validator) checkIntervals(now int64) error {
+	if !v.clock.valid() || !v.clock.hasRate() {
+		return nil
+	}
+	if !v.timing {
+		// Start measuring intervals when the clock is reliable
+		v.lastPAT = now
+		for pid := range v.lastPMT {
+			v.lastPMT[pid] = now
+		}
+		for pid := range v.lastPID {
+			v.lastPID[pid] = now
+		}
+		for pid := range v.lastPTS {
+			v.lastPTS[pid] = now
+		}
+		v.timing = true
+		return nil
+	}
+	limit := durationToTicks(psiInterval)
+	if now-v.lastPAT > limit {
+		v.lastPAT = now
+		if err := v.report(1, PATError, 0, "no PAT for more than %v", psiInterval); err != nil {
+			return err
+		}
+	}
+	for _, pid := range sortedKeys(v.lastPMT) {
+		if now-v.lastPMT[pid] > limit {
+			v.lastPMT[pid] = now
+			if err := v.report(1, PMTError, pid, "no PMT for program %d for more than %v", v.pmtPIDs[pid], psiInterval); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pid := range sortedKeys(v.lastPID) {
+		if now-v.lastPID[pid] > durationToTicks(v.pidTimeout) {
+			v.lastPID[pid] = now
+			if err := v.report(1, PIDError, pid, "no packets for more than %v", v.pidTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pid := range sortedKeys(v.lastPTS) {
+		if now-v.lastPTS[pid] > durationToTicks(ptsInterval) {
+			v.lastPTS[pid] = now
+			if err := v.report(2, PTSError, pid, "no PTS for more than %v", ptsInterval); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkPCR checks the interval, discontinuities and accuracy of the PCRs on a PID.
+// The accuracy of a PCR is checked against the position interpolated between
+// its neighbouring PCRs, which assumes a constant bitrate. It is therefore only
+// checked after pcrCBRWindow of PCRs where the rate between every two PCRs is
+// within pcrCBRTolerance of the transport rate since the latest discontinuity.
+// A PID where the rate varies more is taken as VBR and not checked until the
+// next discontinuity.
+func (v *validator) checkPCR(pid int, pcr int64, discontinuity bool, now int64) error {
+	s := v.pcrs[pid]
+	if s == nil {
+		s = &pcrState{}
+		s.reset(pcr, v.offset)
+		s.time = now
+		v.pcrs[pid] = s
+		return nil
+	}
+	if v.timing && now-s.time > durationToTicks(pcrRepetitionInterval) {
+		if err := v.report(2, PCRRepetitionError, pid, "PCR interval %.1fms", float64(now-s.time)*1000/PcrTimeScale); err != nil {
+			return err
+		}
+	}
+	s.time = now
+	if discontinuity {
+		s.reset(pcr, v.offset)
+		return nil
+	}
+
+	last := s.values[s.nr-1]
+	delta := (pcr - last + PcrWrap) % PcrWrap
+	if delta > PcrWrap/2 {
+		delta -= PcrWrap
+	}
+	if delta < 0 || delta > durationToTicks(pcrDiscontinuityLimit) {
+		s.reset(pcr, v.offset)
+		return v.report(2, PCRDiscontinuityIndicatorError, pid, "PCR step %.1fms without discontinuity_indicator", float64(delta)*1000/PcrTimeScale)
+	}
+
+	s.span += delta
+	transportRate := float64(v.offset-s.firstOffset) / float64(s.span)
+	if delta == 0 || math.Abs(float64(v.offset-s.offsets[s.nr-1])/float64(delta)/transportRate-1) > pcrCBRTolerance {
+		s.vbr = true
+	}
+	if s.nr == 2 && !s.vbr && s.span >= durationToTicks(pcrCBRWindow) {
+		d01 := (s.values[1] - s.values[0] + PcrWrap) % PcrWrap
+		d02 := (pcr - s.values[0] + PcrWrap) % PcrWrap
+		expected := float64(d02) * float64(s.offsets[1]-s.offsets[0]) / float64(v.offset-s.offsets[0])
+		inaccuracy := (float64(d01) - expected) * 1e9 / PcrTimeScale
+		if inaccuracy > pcrAccuracyLimit || inaccuracy < -pcrAccuracyLimit {
+			if err := v.report(2, PCRAccuracyError, pid, "PCR at offset %d is off by %.0fns", s.offsets[1], inaccuracy); err != nil {
+				return err
+			}
+		}
+	}
+	if s.nr == 2 {
+		s.values[0], s.offsets[0] = s.values[1], s.offsets[1]
+	}
+	s.values[1], s.offsets[1], s.nr = pcr, v.offset, 2
+	return nil
+}
+
+// reset restarts the PCR history at a discontinuity.
+func (s *pcrState) reset(pcr, offset int64) {
+	s.values[0], s.offsets[0], s.nr = pcr, offset, 1
+	s.firstOffset, s.span, s.vbr = offset, 0, false
+}
+
+// sectionCRCValid checks the CRC_32 of a section with section_syntax_indicator set.
+func sectionCRCValid(section []byte) bool {
+	if section[1]&0x80 == 0 {
+		return true
+	}
+	if len(section) < 7 {
+		return false
+	}
+	crc := gots.ComputeCRC(section[:len(section)-4])
+	return bytes.Equal(crc, section[len(section)-4:])
+}
+
+// pesHasPTS returns true if a payload starts with a PES header with PTS.
+func pesHasPTS(payload []byte) bool {
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return false
+	}
+	return payload[7]&0x80 != 0
+}
+
+// isAudioVideoStreamType returns true for the PMT stream types of the common audio and video codecs.
+func isAudioVideoStreamType(streamType byte) bool {
+	switch streamType {
+	case 0x01, 0x02, 0x03, 0x04, 0x0f, 0x10, 0x11, 0x1b, 0x24, 0x81, 0x87:
+		return true
+	}
+	return false
+}
+
+func sortedKeys(m map[int]int64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// findSync skips bytes until syncAcquirePackets consecutive sync bytes are found.
+// It returns the number of skipped bytes.
+func findSync(rd *bufio.Reader) (int64, error) {
+	skipped := int64(0)
+	for {
+		buf, err := rd.Peek(syncAcquirePackets * PacketSize)
+		if len(buf) < PacketSize {
+			if err == nil || err == io.EOF || err == bufio.ErrBufferFull {
+				return skipped, io.EOF
+			}
+			return skipped, err
+		}
+		synced := true
+		for i := 0; i < len(buf); i += PacketSize {
+			if buf[i] != SyncByte {
+				synced = false
+				break
+			}
+		}
+		if synced {
+			return skipped, nil
+		}
+		if _, err := rd.Discard(1); err != nil {
+			return skipped, err
+		}
+		skipped++
+	}
+}
+
+// Validate runs the ETSI TR 101 290 priority 1 and 2 checks on a TS.
+// Each error is reported as a TR101290Error and a TR101290Summary is reported at the end.
+func Validate(ctx context.Context, f io.Reader, h Handler, o Options) error {
+	rd := bufio.NewReaderSize(f, 1000*PacketSize)
+	v := newValidator(h, o)
+	synced := false
+	hasSynced := false
+	badSyncs := 0
+	var pkt packet.Packet
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break dataLoop
+		default:
+		}
+
+		if !synced {
+			skipped, err := findSync(rd)
+			v.offset += skipped
+			if err == io.EOF {
+				break dataLoop
+			}
+			if err != nil {
+				return fmt.Errorf("syncing with reader %w", err)
+			}
+			synced = true
+			hasSynced = true
+			badSyncs = 0
+		}
+
+		if _, err := io.ReadFull(rd, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break dataLoop
+			}
+			return fmt.Errorf("reading Packet %w", err)
+		}
+
+		if pkt[0] != SyncByte {
+			badSyncs++
+			if err := v.report(1, SyncByteError, -1, "sync byte 0x%02x", pkt[0]); err != nil {
+				return err
+			}
+			if badSyncs >= syncLossPackets {
+				if err := v.report(1, TSSyncLoss, -1, "%d consecutive corrupted sync bytes", badSyncs); err != nil {
+					return err
+				}
+				synced = false
+			}
+		} else {
+			badSyncs = 0
+			if err := v.checkPacket(&pkt); err != nil {
+				return err
+			}
+		}
+		v.nr++
+		v.offset += PacketSize
+	}
+
+	if !hasSynced {
+		return fmt.Errorf("no TS sync found")
+	}
+	v.summary.Packets = v.nr
+	v.summary.Duration = float64(v.now()) / PcrTimeScale
+	return emit(h, v.summary)
+}
@@ -0,0 +1,126 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/stretchr/testify/require"
+)
+
+func validateData(t *testing.T, data []byte) ([]TR101290Error, TR101290Summary) {
+	t.Helper()
+	events := collectEvents(t, func(h Handler) error {
+		return Validate(context.TODO(), bytes.NewReader(data), h, Options{})
+	})
+	return eventsOf[TR101290Error](events), lastEventOf[TR101290Summary](events)
+}
+
+func TestValidate(t *testing.T) {
+	data, err := os.ReadFile("../../internal/testdata/bbb_1s.ts")
+	require.NoError(t, err)
+
+	t.Run("clean", func(t *testing.T) {
+		errs, summary := validateData(t, data)
+		for _, e := range errs {
+			require.Equal(t, 2, e.Priority, "no priority 1 errors")
+		}
+		require.Equal(t, int64(len(data)/PacketSize), summary.Packets)
+		// All 11 PCR intervals of the file are 83ms
+		require.Equal(t, 11, summary.Errors[PCRRepetitionError])
+	})
+
+	t.Run("dropped packet", func(t *testing.T) {
+		// Packet 5 is a video packet
+		corrupt := append(append([]byte{}, data[:5*PacketSize]...), data[6*PacketSize:]...)
+		_, summary := validateData(t, corrupt)
+		require.Equal(t, 1, summary.Errors[ContinuityCountError])
+	})
+
+	t.Run("transport and CRC error", func(t *testing.T) {
+		// Packet 1 is the PAT
+		corrupt := append([]byte{}, data...)
+		corrupt[1*PacketSize+1] |= 0x80
+		corrupt[1*PacketSize+10] ^= 0xff
+		errs, summary := validateData(t, corrupt)
+		require.Equal(t, 1, summary.Errors[TransportError])
+		require.Equal(t, 1, summary.Errors[CRCError])
+		require.Equal(t, TransportError, errs[0].Indicator)
+		require.Equal(t, CRCError, errs[1].Indicator)
+		require.Equal(t, 0, errs[1].PID)
+		require.Equal(t, int64(1), errs[1].Packet)
+	})
+
+	t.Run("sync loss", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		corrupt[100*PacketSize] = 0x00
+		corrupt[101*PacketSize] = 0x00
+		errs, summary := validateData(t, corrupt)
+		require.Equal(t, 2, summary.Errors[SyncByteError])
+		require.Equal(t, 1, summary.Errors[TSSyncLoss])
+		found := false
+		for _, e := range errs {
+			if e.Indicator == TSSyncLoss {
+				require.Equal(t, int64(101*PacketSize), e.Offset)
+				found = true
+			}
+		}
+		require.True(t, found)
+	})
+
+	t.Run("leading garbage", func(t *testing.T) {
+		corrupt := append([]byte{0x47, 0x12, 0x34}, data...)
+		_, summary := validateData(t, corrupt)
+		require.Equal(t, 0, summary.Errors[TSSyncLoss])
+		require.Equal(t, int64(len(data)/PacketSize), summary.Packets)
+	})
+}
+
+// pcrStream returns PCRs every 20ms on PID 256 for 2s, with nullPackets(i) null
+// packets after PCR i. PCR 60 is late by jitter 27MHz ticks.
+func pcrStream(nullPackets func(i int) int, jitter int64) []byte {
+	var data []byte
+	for i := 0; i < 100; i++ {
+		pcr := int64(i) * PcrTimeScale / 50
+		if i == 60 {
+			pcr += jitter
+		}
+		var p packet.Packet
+		p[0], p[1], p[2], p[3], p[4], p[5] = SyncByte, 0x01, 0x00, 0x20, PacketSize-5, 0x10
+		gots.InsertPCR(p[6:12], uint64(pcr))
+		data = append(data, p[:]...)
+		for j := 0; j < nullPackets(i); j++ {
+			var q packet.Packet
+			q[0], q[1], q[2], q[3] = SyncByte, 0x1f, 0xff, 0x10
+			data = append(data, q[:]...)
+		}
+	}
+	return data
+}
+
+func TestPCRAccuracy(t *testing.T) {
+	t.Run("CBR", func(t *testing.T) {
+		cbr := func(i int) int { return 9 }
+		_, summary := validateData(t, pcrStream(cbr, 0))
+		require.Equal(t, 0, summary.Errors[PCRAccuracyError])
+		// 100 ticks is 3.7us, which is also seen in the PCRs before and after
+		// when they are interpolated from the late PCR
+		_, summary = validateData(t, pcrStream(cbr, 100))
+		require.Equal(t, 3, summary.Errors[PCRAccuracyError])
+	})
+
+	t.Run("VBR", func(t *testing.T) {
+		vbr := func(i int) int { return 5 + i%7 }
+		_, summary := validateData(t, pcrStream(vbr, 0))
+		require.Equal(t, 0, summary.Errors[PCRAccuracyError])
+		for _, name := range []string{"bbb_1s.ts", "obs_hevc_aac.ts"} {
+			data, err := os.ReadFile("../../internal/testdata/" + name)
+			require.NoError(t, err)
+			_, summary := validateData(t, data)
+			require.Equal(t, 0, summary.Errors[PCRAccuracyError], name)
+		}
+	})
+}